@@ -0,0 +1,302 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/xperimental/uswd/db"
+)
+
+// Operations of commands. Membership changes are not applied to the database, they become configuration
+// entries of the log.
+const (
+	opPut          = "put"
+	opDelete       = "delete"
+	opBatch        = "batch"
+	opAddMember    = "addMember"
+	opRemoveMember = "removeMember"
+)
+
+// command is a change of the database replicated using the log.
+type command struct {
+	Op  string `json:"op"`
+	Key string `json:"key,omitempty"`
+	// Value is encoded using base64 in JSON, so that binary values are preserved.
+	Value           []byte      `json:"value,omitempty"`
+	ExpectedVersion int64       `json:"version"`
+	Options         putOptions  `json:"options,omitzero"`
+	Ops             []operation `json:"ops,omitempty"`
+	Member          *Member     `json:"member,omitempty"`
+}
+
+// operation is a single operation of a batch.
+type operation struct {
+	Key             string     `json:"key"`
+	Value           []byte     `json:"value,omitempty"`
+	Delete          bool       `json:"delete,omitempty"`
+	ExpectedVersion int64      `json:"version"`
+	Options         putOptions `json:"options,omitzero"`
+}
+
+// putOptions contains the settings of a stored value. Changes sent to the leader contain the options given by
+// the client, which the leader resolves to the metadata of the new value before adding the change to the log.
+type putOptions struct {
+	TTL         time.Duration     `json:"ttl,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	// Metadata is set for values copied including their metadata and for all values of resolved changes.
+	Metadata *db.Metadata `json:"metadata,omitempty"`
+}
+
+func encodeOptions(opts []db.PutOption) putOptions {
+	options := db.ApplyPutOptions(opts...)
+	return putOptions{
+		TTL:         options.TTL,
+		ContentType: options.ContentType,
+		Headers:     options.Headers,
+		Metadata:    options.Metadata,
+	}
+}
+
+func (o putOptions) options() []db.PutOption {
+	opts := []db.PutOption{
+		db.WithTTL(o.TTL),
+		db.WithContentType(o.ContentType),
+		db.WithHeaders(o.Headers),
+	}
+	if o.Metadata != nil {
+		opts = append(opts, db.WithMetadata(*o.Metadata))
+	}
+
+	return opts
+}
+
+func putCommand(key, value string, expectedVersion int64, opts []db.PutOption) command {
+	return command{
+		Op:              opPut,
+		Key:             key,
+		Value:           []byte(value),
+		ExpectedVersion: expectedVersion,
+		Options:         encodeOptions(opts),
+	}
+}
+
+func batchCommand(ops []db.Op) command {
+	operations := make([]operation, 0, len(ops))
+	for _, op := range ops {
+		operations = append(operations, operation{
+			Key:             op.Key,
+			Value:           []byte(op.Value),
+			Delete:          op.Delete,
+			ExpectedVersion: op.ExpectedVersion,
+			Options:         encodeOptions(op.Options),
+		})
+	}
+
+	return command{
+		Op:  opBatch,
+		Ops: operations,
+	}
+}
+
+func (c command) ops() []db.Op {
+	ops := make([]db.Op, 0, len(c.Ops))
+	for _, op := range c.Ops {
+		ops = append(ops, db.Op{
+			Key:             op.Key,
+			Value:           string(op.Value),
+			Delete:          op.Delete,
+			ExpectedVersion: op.ExpectedVersion,
+			Options:         op.Options.options(),
+		})
+	}
+
+	return ops
+}
+
+// resolve checks the change against the current state of the database at now and returns the change added to
+// the log, which sets the version, times and expiry of every value explicitly. Applying it gives the same result
+// on every node regardless of its clock. It returns false if a deleted key does not exist, so that there is
+// nothing to change.
+func (c command) resolve(database db.Database, now time.Time) (command, bool, error) {
+	switch c.Op {
+	case opPut:
+		ops, err := db.ResolveBatch(database, []db.Op{
+			db.CompareAndPutOp(c.Key, string(c.Value), c.ExpectedVersion, c.Options.options()...),
+		}, now)
+		if err != nil {
+			if batchErr, ok := err.(*db.BatchError); ok {
+				return command{}, false, batchErr.Err
+			}
+
+			return command{}, false, err
+		}
+
+		return putCommand(c.Key, string(c.Value), db.AnyVersion, ops[0].Options), true, nil
+	case opDelete:
+		_, found, err := db.Stat(database, c.Key)
+		if err != nil || !found {
+			return command{}, false, err
+		}
+
+		return command{Op: opDelete, Key: c.Key, ExpectedVersion: db.AnyVersion}, true, nil
+	case opBatch:
+		ops, err := db.ResolveBatch(database, c.ops(), now)
+		if err != nil {
+			return command{}, false, err
+		}
+
+		return batchCommand(ops), true, nil
+	default:
+		return command{}, false, fmt.Errorf("unknown operation: %s", c.Op)
+	}
+}
+
+// apply changes the database. It returns false if a deleted key did not exist. Applying a resolved change
+// again after a crash does not change the database any further.
+func (c command) apply(database db.Database) (bool, error) {
+	switch c.Op {
+	case opPut:
+		if c.Options.Metadata == nil {
+			return false, errUnresolved
+		}
+
+		done, err := contains(database, operation{Key: c.Key, Options: c.Options})
+		if err != nil || done {
+			return true, err
+		}
+
+		return true, database.Put(c.Key, string(c.Value), c.Options.options()...)
+	case opDelete:
+		return database.Delete(c.Key)
+	case opBatch:
+		done := true
+		for _, op := range c.Ops {
+			if !op.Delete && op.Options.Metadata == nil {
+				return false, errUnresolved
+			}
+
+			contained, err := contains(database, op)
+			if err != nil {
+				return false, err
+			}
+			done = done && contained
+		}
+
+		if done {
+			return true, nil
+		}
+
+		return true, database.Batch(c.ops())
+	default:
+		return false, fmt.Errorf("unknown operation: %s", c.Op)
+	}
+}
+
+// contains returns true if the database already contains the result of a resolved operation, because it has
+// been applied before. A key still created at the same time has reached at least the version of the value,
+// a deleted key is missing.
+func contains(database db.Database, op operation) (bool, error) {
+	meta, found, err := db.Stat(database, op.Key)
+	if err != nil {
+		return false, err
+	}
+
+	if op.Delete {
+		return !found, nil
+	}
+
+	want := op.Options.Metadata
+	return found && meta.Created.Equal(want.Created) && meta.Version >= want.Version, nil
+}
+
+// knownErrors contains the errors, which keep their identity when a change is forwarded to the leader.
+var knownErrors = map[string]error{
+	"versionMismatch":  db.ErrVersionMismatch,
+	"readOnly":         db.ErrReadOnly,
+	"noLeader":         ErrNoLeader,
+	"timeout":          ErrTimeout,
+	"membershipChange": ErrMembershipChange,
+	"unknownMember":    ErrUnknownMember,
+	"notLeader":        errNotLeader,
+}
+
+// commandError is an error returned by the leader for a forwarded change.
+type commandError struct {
+	Kind    string `json:"kind,omitempty"`
+	Message string `json:"message"`
+	Key     string `json:"key,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	// Index and Cause are set for errors of batch operations.
+	Index int           `json:"index,omitempty"`
+	Cause *commandError `json:"cause,omitempty"`
+}
+
+func encodeError(err error) *commandError {
+	if err == nil {
+		return nil
+	}
+
+	switch err := err.(type) {
+	case *db.BatchError:
+		return &commandError{
+			Kind:    "batch",
+			Message: err.Error(),
+			Key:     err.Key,
+			Index:   err.Index,
+			Cause:   encodeError(err.Err),
+		}
+	case *db.InvalidKeyError:
+		return &commandError{
+			Kind:    "invalidKey",
+			Message: err.Error(),
+			Key:     err.Key,
+			Reason:  err.Reason,
+		}
+	}
+
+	for kind, known := range knownErrors {
+		if err == known {
+			return &commandError{
+				Kind:    kind,
+				Message: err.Error(),
+			}
+		}
+	}
+
+	return &commandError{
+		Message: err.Error(),
+	}
+}
+
+func (e *commandError) decode() error {
+	if e == nil {
+		return nil
+	}
+
+	switch e.Kind {
+	case "batch":
+		cause := e.Cause.decode()
+		if cause == nil {
+			cause = errors.New(e.Message)
+		}
+
+		return &db.BatchError{
+			Index: e.Index,
+			Key:   e.Key,
+			Err:   cause,
+		}
+	case "invalidKey":
+		return &db.InvalidKeyError{
+			Key:    e.Key,
+			Reason: e.Reason,
+		}
+	}
+
+	if known, ok := knownErrors[e.Kind]; ok {
+		return known
+	}
+
+	return errors.New(e.Message)
+}
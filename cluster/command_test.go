@@ -0,0 +1,136 @@
+package cluster
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xperimental/uswd/db"
+)
+
+func TestCommandError(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc string
+		err  error
+		want error
+	}{
+		{
+			desc: "none",
+		},
+		{
+			desc: "known",
+			err:  db.ErrVersionMismatch,
+			want: db.ErrVersionMismatch,
+		},
+		{
+			desc: "invalid key",
+			err:  &db.InvalidKeyError{Key: "_key", Reason: "reserved"},
+			want: &db.InvalidKeyError{Key: "_key", Reason: "reserved"},
+		},
+		{
+			desc: "batch",
+			err:  &db.BatchError{Index: 1, Key: "key", Err: db.ErrVersionMismatch},
+			want: &db.BatchError{Index: 1, Key: "key", Err: db.ErrVersionMismatch},
+		},
+		{
+			desc: "other",
+			err:  errors.New("disk full"),
+			want: errors.New("disk full"),
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			data, err := json.Marshal(encodeError(test.err))
+			if err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+
+			var decoded *commandError
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+
+			if got := decoded.decode(); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCommandApply(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	leader := db.NewMemoryDatabase()
+	follower := db.NewMemoryDatabase()
+	commands := []command{
+		putCommand("key", "first", db.AnyVersion, []db.PutOption{db.WithContentType("text/plain"), db.WithTTL(time.Hour)}),
+		putCommand("key", "second", 1, []db.PutOption{db.WithContentType("text/plain")}),
+		batchCommand([]db.Op{{Key: "other", Value: "value"}}),
+	}
+
+	for i, c := range commands {
+		resolved, ok, err := c.resolve(leader, now.Add(time.Duration(i)*time.Minute))
+		if err != nil || !ok {
+			t.Fatalf("got %v and error %v, want change", ok, err)
+		}
+
+		// Commands are stored in the log as JSON.
+		data, err := json.Marshal(resolved)
+		if err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+
+		decoded := command{}
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+
+		// Applying a command again after a crash does not change the database.
+		for _, database := range []db.Database{leader, follower, follower} {
+			if _, err := decoded.apply(database); err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+		}
+	}
+
+	for _, database := range []db.Database{leader, follower} {
+		entry, found, err := database.Get("key")
+		if err != nil || !found {
+			t.Fatalf("got %v and error %v, want value", found, err)
+		}
+
+		if entry.Value != "second" || entry.Version != 2 || entry.ContentType != "text/plain" {
+			t.Errorf("got %q, version %d and content type %q, want %q, 2 and %q", entry.Value, entry.Version, entry.ContentType, "second", "text/plain")
+		}
+
+		if !entry.Modified.Equal(now.Add(time.Minute)) || !entry.Created.Equal(now) {
+			t.Errorf("got modified %s and created %s, want %s and %s", entry.Modified, entry.Created, now.Add(time.Minute), now)
+		}
+	}
+
+	if _, _, err := putCommand("key", "third", 1, nil).resolve(leader, now); err != db.ErrVersionMismatch {
+		t.Errorf("got error %v, want %v", err, db.ErrVersionMismatch)
+	}
+
+	if _, err := putCommand("key", "third", db.AnyVersion, nil).apply(leader); err != errUnresolved {
+		t.Errorf("got error %v, want %v", err, errUnresolved)
+	}
+
+	if _, ok, err := (command{Op: opDelete, Key: "missing"}).resolve(leader, now); err != nil || ok {
+		t.Errorf("got %v and error %v, want false", ok, err)
+	}
+
+	found, err := command{Op: opDelete, Key: "other"}.apply(follower)
+	if err != nil || !found {
+		t.Errorf("got %v and error %v, want true", found, err)
+	}
+}
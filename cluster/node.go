@@ -0,0 +1,656 @@
+// Package cluster replicates the changes of a database to several nodes using the Raft consensus algorithm.
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xperimental/uswd/db"
+)
+
+const (
+	defaultElectionTimeout   = time.Second
+	defaultHeartbeatInterval = 100 * time.Millisecond
+	defaultCommitTimeout     = 10 * time.Second
+	defaultSnapshotThreshold = 10000
+)
+
+// unavailableError is an error of a change, which might succeed when it is made again later.
+type unavailableError string
+
+func (e unavailableError) Error() string {
+	return string(e)
+}
+
+// Unavailable returns true, so that servers can report the error as a temporary one.
+func (e unavailableError) Unavailable() bool {
+	return true
+}
+
+var (
+	// ErrNoLeader is returned when a change can not be made, because no leader could be reached.
+	ErrNoLeader error = unavailableError("cluster has no leader")
+	// ErrTimeout is returned when a change has not been committed in time. It might still be applied later.
+	ErrTimeout error = unavailableError("change has not been committed in time")
+	// ErrMembershipChange is returned when changing the members while an earlier change is not committed yet
+	// or before the leader has committed an entry of its own term.
+	ErrMembershipChange = errors.New("another membership change is in progress")
+	// ErrUnknownMember is returned when removing a node, which is not a member of the cluster.
+	ErrUnknownMember = errors.New("node is not a member of the cluster")
+
+	errClosed = errors.New("node is closed")
+	// errNotEmpty is returned when a node, which has not received a copy of the cluster yet, has a database
+	// containing keys. Installing the copy would remove them.
+	errNotEmpty = errors.New("database of a node joining the cluster needs to be empty")
+	// errNotLeader is returned for a forwarded change, which reached a node that is not the leader. The change
+	// has not been made, so it can be sent again.
+	errNotLeader = errors.New("node is not the leader")
+	// errUnresolved is returned for a change in the log, which does not contain the metadata of its values.
+	errUnresolved = errors.New("change has not been resolved by the leader")
+)
+
+// Member is a node of the cluster.
+type Member struct {
+	ID string `json:"id"`
+	// Address is the URL of the HTTP server of the node.
+	Address string `json:"address"`
+}
+
+// ParseMembers parses a comma-separated list of members in the form "id=address".
+func ParseMembers(value string) ([]Member, error) {
+	members := []Member{}
+	if strings.TrimSpace(value) == "" {
+		return members, nil
+	}
+
+	ids := make(map[string]bool)
+	for _, part := range strings.Split(value, ",") {
+		tokens := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+			return nil, fmt.Errorf("member needs to be given as id=address: %s", part)
+		}
+
+		if ids[tokens[0]] {
+			return nil, fmt.Errorf("duplicate member: %s", tokens[0])
+		}
+		ids[tokens[0]] = true
+
+		members = append(members, Member{
+			ID:      tokens[0],
+			Address: tokens[1],
+		})
+	}
+
+	return members, nil
+}
+
+// role is the part a node plays in the cluster.
+type role int
+
+const (
+	roleFollower role = iota
+	roleCandidate
+	roleLeader
+)
+
+var roleNames = map[role]string{
+	roleFollower:  "follower",
+	roleCandidate: "candidate",
+	roleLeader:    "leader",
+}
+
+func (r role) String() string {
+	return roleNames[r]
+}
+
+// Status describes the state of a node.
+type Status struct {
+	ID            string   `json:"id"`
+	Role          string   `json:"role"`
+	Term          uint64   `json:"term"`
+	Leader        string   `json:"leader,omitempty"`
+	LeaderAddress string   `json:"leaderAddress,omitempty"`
+	LastIndex     uint64   `json:"lastIndex"`
+	CommitIndex   uint64   `json:"commitIndex"`
+	AppliedIndex  uint64   `json:"appliedIndex"`
+	Members       []Member `json:"members"`
+}
+
+// Node is a member of a cluster, which replicates every change through a log before applying it to the
+// wrapped database. Changes made on a follower are forwarded to the leader. Reads are served from the wrapped
+// database of the node, so followers might not have applied the latest changes yet. A follower, which forwarded
+// a change, waits until it has applied the change itself, so that its clients read their own changes.
+//
+// The leader resolves every change against its database before adding it to the log, so that the log contains
+// the versions, times and expiry of the new values. Changes are resolved one at a time, after all earlier entries
+// have been applied. The wrapped database needs to keep its contents when the node is restarted. A crash between
+// applying an entry and recording its index applies the entry again after the restart, which does not change
+// values that already have the resolved metadata.
+type Node struct {
+	db.Database
+	id                string
+	address           string
+	client            *http.Client
+	durability        db.Durability
+	electionTimeout   time.Duration
+	heartbeatInterval time.Duration
+	commitTimeout     time.Duration
+	snapshotThreshold int
+	members           []Member
+	bootstrap         bool
+	secret            string
+
+	storage *storage
+	done    chan struct{}
+	wg      sync.WaitGroup
+	// applyLock serializes the changes of the database made by applying entries and installing snapshots.
+	applyLock sync.Mutex
+	applied   chan struct{}
+	// proposeLock serializes the changes proposed by the leader.
+	proposeLock sync.Mutex
+
+	lock             sync.Mutex
+	state            persistentState
+	log              []entry
+	role             role
+	leader           Member
+	leaderContact    time.Time
+	electionDeadline time.Time
+	commitIndex      uint64
+	appliedIndex     uint64
+	replicators      map[string]*replicator
+	proposals        map[uint64]*proposal
+	appliedWaiters   []chan struct{}
+	closed           bool
+}
+
+// NodeOption changes the configuration of a node.
+type NodeOption func(n *Node)
+
+// WithMembers sets the members a new cluster starts with. It is only used when the directory of the node does
+// not contain a state yet. A node without members waits until it is added to an existing cluster.
+func WithMembers(members []Member) NodeOption {
+	return func(n *Node) {
+		n.members = members
+	}
+}
+
+// WithBootstrap starts a new cluster with the contents of the database of this node. It is only used together
+// with the members of a new cluster, when the directory of the node does not contain a state yet. Exactly one
+// member of a new cluster needs to be bootstrapped. The databases of all other members need to be empty, they
+// receive a copy from the leader.
+func WithBootstrap() NodeOption {
+	return func(n *Node) {
+		n.bootstrap = true
+	}
+}
+
+// WithSecret sets the secret shared by all members of the cluster. The nodes only accept requests of other
+// nodes, which know the secret. It is required.
+func WithSecret(secret string) NodeOption {
+	return func(n *Node) {
+		n.secret = secret
+	}
+}
+
+// WithNodeDurability sets how writes to the log are synchronized to disk. The default is DurabilityDirectory.
+func WithNodeDurability(durability db.Durability) NodeOption {
+	return func(n *Node) {
+		n.durability = durability
+	}
+}
+
+// WithElectionTimeout sets the time after which a follower, which has not heard from a leader, starts an
+// election. The actual timeout is chosen randomly between one and two times this value. The default is one second.
+func WithElectionTimeout(timeout time.Duration) NodeOption {
+	return func(n *Node) {
+		n.electionTimeout = timeout
+	}
+}
+
+// WithHeartbeatInterval sets the interval in which the leader contacts idle followers. It needs to be a lot
+// shorter than the election timeout. The default is 100 milliseconds.
+func WithHeartbeatInterval(interval time.Duration) NodeOption {
+	return func(n *Node) {
+		n.heartbeatInterval = interval
+	}
+}
+
+// WithCommitTimeout sets the time a change waits for being committed. The default is ten seconds.
+func WithCommitTimeout(timeout time.Duration) NodeOption {
+	return func(n *Node) {
+		n.commitTimeout = timeout
+	}
+}
+
+// WithSnapshotThreshold sets the number of applied entries kept in the log. Followers missing entries, which
+// have been removed, receive a copy of the database. The default is 10000.
+func WithSnapshotThreshold(entries int) NodeOption {
+	return func(n *Node) {
+		n.snapshotThreshold = entries
+	}
+}
+
+// WithNodeClient sets the HTTP client used for contacting the other nodes.
+func WithNodeClient(client *http.Client) NodeOption {
+	return func(n *Node) {
+		n.client = client
+	}
+}
+
+// NewNode starts the node id of a cluster. The node is reachable by the other nodes at address and keeps its
+// state in dir. Committed changes are applied to database.
+func NewNode(id, address string, database db.Database, dir string, opts ...NodeOption) (*Node, error) {
+	if id == "" {
+		return nil, errors.New("node needs an ID")
+	}
+
+	n := &Node{
+		Database:          database,
+		id:                id,
+		address:           address,
+		client:            http.DefaultClient,
+		durability:        db.DurabilityDirectory,
+		electionTimeout:   defaultElectionTimeout,
+		heartbeatInterval: defaultHeartbeatInterval,
+		commitTimeout:     defaultCommitTimeout,
+		snapshotThreshold: defaultSnapshotThreshold,
+		done:              make(chan struct{}),
+		applied:           make(chan struct{}, 1),
+		replicators:       make(map[string]*replicator),
+		proposals:         make(map[uint64]*proposal),
+	}
+	for _, o := range opts {
+		o(n)
+	}
+
+	if n.secret == "" {
+		return nil, errors.New("node needs the secret of the cluster")
+	}
+
+	var err error
+	n.storage, n.state, n.log, n.appliedIndex, err = openStorage(dir, n.durability, n.members)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.appliedIndex < n.state.SnapshotIndex {
+		n.appliedIndex = n.state.SnapshotIndex
+	}
+	n.commitIndex = n.appliedIndex
+	n.members = n.membersAt(n.lastIndex())
+	if err := n.initialize(); err != nil {
+		n.storage.close()
+		return nil, err
+	}
+	n.resetElectionDeadline()
+
+	n.wg.Add(2)
+	go n.runTimer()
+	go n.runApply()
+	n.notifyApply()
+
+	return n, nil
+}
+
+// initialize makes the database the initial state of a new cluster when bootstrapping. Otherwise the database
+// of a node, which has not received a copy of the cluster yet, needs to be empty.
+func (n *Node) initialize() error {
+	if n.state.Initialized || n.state.Installing {
+		return nil
+	}
+
+	if n.bootstrap && n.state.Term == 0 && n.lastIndex() == 0 && len(n.members) > 0 {
+		log.Printf("Starting new cluster with the contents of the database.")
+		n.state.Initialized = true
+		return n.persist()
+	}
+
+	return n.checkEmpty()
+}
+
+// checkEmpty returns errNotEmpty if the database contains keys.
+func (n *Node) checkEmpty() error {
+	keys, err := n.Database.List()
+	if err != nil {
+		return err
+	}
+
+	if len(keys) > 0 {
+		return errNotEmpty
+	}
+
+	return nil
+}
+
+// ID returns the ID of the node.
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Unwrap returns the database, which the committed changes are applied to.
+func (n *Node) Unwrap() db.Database {
+	return n.Database
+}
+
+// Status returns the current state of the node.
+func (n *Node) Status() Status {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return Status{
+		ID:            n.id,
+		Role:          n.role.String(),
+		Term:          n.state.Term,
+		Leader:        n.leader.ID,
+		LeaderAddress: n.leader.Address,
+		LastIndex:     n.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		AppliedIndex:  n.appliedIndex,
+		Members:       append([]Member{}, n.members...),
+	}
+}
+
+func (n *Node) Put(key, value string, opts ...db.PutOption) error {
+	_, err := n.propose(putCommand(key, value, db.AnyVersion, opts))
+	return err
+}
+
+func (n *Node) CompareAndPut(key, value string, expectedVersion int64, opts ...db.PutOption) error {
+	_, err := n.propose(putCommand(key, value, expectedVersion, opts))
+	return err
+}
+
+func (n *Node) Delete(key string) (bool, error) {
+	return n.propose(command{
+		Op:  opDelete,
+		Key: key,
+	})
+}
+
+func (n *Node) Batch(ops []db.Op) error {
+	_, err := n.propose(batchCommand(ops))
+	return err
+}
+
+// GetReader streams the value of key if the wrapped database supports it. Values written using PutReader
+// are read into memory, because they need to be replicated in the log.
+func (n *Node) GetReader(key string) (db.ValueReader, db.Metadata, bool, error) {
+	return db.GetReader(n.Database, key)
+}
+
+// AddMember adds a node to the cluster. The node receives a copy of the database before it gets the changes.
+func (n *Node) AddMember(member Member) error {
+	if member.ID == "" || member.Address == "" {
+		return errors.New("member needs an ID and an address")
+	}
+
+	_, err := n.propose(command{
+		Op:     opAddMember,
+		Member: &member,
+	})
+	return err
+}
+
+// RemoveMember removes a node from the cluster. A leader removing itself steps down once the change is committed.
+func (n *Node) RemoveMember(id string) error {
+	_, err := n.propose(command{
+		Op: opRemoveMember,
+		Member: &Member{
+			ID: id,
+		},
+	})
+	return err
+}
+
+// proposal is a change waiting for being applied.
+type proposal struct {
+	term   uint64
+	result chan proposalResult
+}
+
+type proposalResult struct {
+	index uint64
+	found bool
+	err   error
+}
+
+// propose makes a change on the leader and waits until it has been applied on this node.
+func (n *Node) propose(c command) (bool, error) {
+	deadline := time.Now().Add(n.commitTimeout)
+	for {
+		result, forward, err := n.proposeLocal(c)
+		if err != nil {
+			return false, err
+		}
+
+		if forward.ID == "" {
+			return result.found, result.err
+		}
+
+		if forward.ID != n.id {
+			result, err := n.forward(forward, c)
+			if err != nil {
+				return false, err
+			}
+
+			if result.err == nil {
+				n.waitApplied(result.index, deadline)
+			}
+
+			if result.err != errNotLeader {
+				return result.found, result.err
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return false, ErrNoLeader
+		}
+
+		// The leader is not known yet, wait for the election.
+		select {
+		case <-n.done:
+			return false, errClosed
+		case <-time.After(n.heartbeatInterval):
+		}
+	}
+}
+
+// proposeLocal appends the change to the log if the node is the leader and waits for the result. Otherwise
+// it returns the leader to forward the change to, which is the node itself if the leader is not known.
+func (n *Node) proposeLocal(c command) (proposalResult, Member, error) {
+	var term uint64
+	if c.Op != opAddMember && c.Op != opRemoveMember {
+		n.proposeLock.Lock()
+		defer n.proposeLock.Unlock()
+
+		var ok bool
+		var err error
+		c, term, ok, err = n.resolve(c)
+		if err != nil || (term != 0 && !ok) {
+			return proposalResult{err: err}, Member{}, nil
+		}
+	}
+
+	n.lock.Lock()
+	if n.closed {
+		n.lock.Unlock()
+		return proposalResult{}, Member{}, errClosed
+	}
+
+	if n.role != roleLeader || (term != 0 && term != n.state.Term) {
+		leader := n.leader
+		n.lock.Unlock()
+		if leader.ID == "" {
+			leader = Member{ID: n.id}
+		}
+
+		return proposalResult{}, leader, nil
+	}
+
+	var index uint64
+	var err error
+	switch c.Op {
+	case opAddMember, opRemoveMember:
+		index, err = n.changeMembers(c)
+	default:
+		index, err = n.appendEntries(entry{
+			Type:    entryCommand,
+			Command: &c,
+		})
+	}
+	if err != nil {
+		n.lock.Unlock()
+		return proposalResult{}, Member{}, err
+	}
+
+	p := &proposal{
+		term:   n.state.Term,
+		result: make(chan proposalResult, 1),
+	}
+	n.proposals[index] = p
+	n.lock.Unlock()
+
+	timer := time.NewTimer(n.commitTimeout)
+	defer timer.Stop()
+
+	select {
+	case result := <-p.result:
+		return result, Member{}, nil
+	case <-timer.C:
+		n.lock.Lock()
+		delete(n.proposals, index)
+		n.lock.Unlock()
+		return proposalResult{}, Member{}, ErrTimeout
+	case <-n.done:
+		return proposalResult{}, Member{}, errClosed
+	}
+}
+
+// resolve waits until the leader has applied all entries of its log and resolves the change against the
+// resulting state of the database. It returns the term of the leader, which is zero if the node is not the
+// leader, and false if there is nothing to change. The caller needs to hold the propose lock.
+func (n *Node) resolve(c command) (command, uint64, bool, error) {
+	n.lock.Lock()
+	if n.role != roleLeader {
+		n.lock.Unlock()
+		return c, 0, false, nil
+	}
+	term := n.state.Term
+	index := n.lastIndex()
+	n.lock.Unlock()
+
+	n.waitApplied(index, time.Now().Add(n.commitTimeout))
+
+	n.lock.Lock()
+	applied, closed := n.appliedIndex, n.closed
+	n.lock.Unlock()
+	switch {
+	case closed:
+		return c, 0, false, errClosed
+	case applied < index:
+		return c, 0, false, ErrTimeout
+	}
+
+	resolved, ok, err := c.resolve(n.Database, time.Now())
+	return resolved, term, ok, err
+}
+
+// changeMembers appends a configuration entry adding or removing a single member. Only one change can be
+// in progress at a time, and only after the leader has committed an entry of its term, so that it knows the
+// latest committed configuration. The caller needs to hold the lock.
+func (n *Node) changeMembers(c command) (uint64, error) {
+	if n.configIndex() > n.commitIndex || n.termAt(n.commitIndex) != n.state.Term {
+		return 0, ErrMembershipChange
+	}
+
+	members := []Member{}
+	found := false
+	for _, m := range n.members {
+		if m.ID != c.Member.ID {
+			members = append(members, m)
+			continue
+		}
+
+		found = true
+		if c.Op == opAddMember && m.Address != c.Member.Address {
+			return 0, fmt.Errorf("member %s already exists with address %s", m.ID, m.Address)
+		}
+	}
+
+	switch {
+	case c.Op == opRemoveMember && !found:
+		return 0, ErrUnknownMember
+	case c.Op == opAddMember:
+		members = append(members, *c.Member)
+	}
+
+	log.Printf("Changing members of the cluster to %v.", members)
+	return n.appendEntries(entry{
+		Type:    entryConfig,
+		Members: members,
+	})
+}
+
+// waitApplied waits until the entry has been applied on this node or the deadline has passed.
+func (n *Node) waitApplied(index uint64, deadline time.Time) {
+	for {
+		n.lock.Lock()
+		if n.appliedIndex >= index || n.closed {
+			n.lock.Unlock()
+			return
+		}
+
+		wait := make(chan struct{})
+		n.appliedWaiters = append(n.appliedWaiters, wait)
+		n.lock.Unlock()
+
+		select {
+		case <-wait:
+		case <-time.After(time.Until(deadline)):
+			return
+		}
+	}
+}
+
+// resetElectionDeadline chooses a random time for starting the next election. The caller needs to hold the lock.
+func (n *Node) resetElectionDeadline() {
+	timeout := n.electionTimeout + time.Duration(rand.Int63n(int64(n.electionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// Close stops the node and closes the wrapped database.
+func (n *Node) Close() error {
+	n.lock.Lock()
+	if n.closed {
+		n.lock.Unlock()
+		return nil
+	}
+
+	n.closed = true
+	close(n.done)
+	n.stopReplicators()
+	for _, wait := range n.appliedWaiters {
+		close(wait)
+	}
+	n.appliedWaiters = nil
+	n.lock.Unlock()
+
+	n.wg.Wait()
+
+	n.lock.Lock()
+	err := n.storage.close()
+	n.lock.Unlock()
+
+	if dbErr := n.Database.Close(); err == nil {
+		err = dbErr
+	}
+
+	return err
+}
@@ -0,0 +1,537 @@
+package cluster_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xperimental/uswd/cluster"
+	"github.com/xperimental/uswd/db"
+)
+
+// testNode is a node of a test cluster, which can be disconnected from the other nodes.
+type testNode struct {
+	*cluster.Node
+	server       *httptest.Server
+	disconnected int32
+}
+
+func (n *testNode) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&n.disconnected) == 1 {
+		http.Error(w, "Disconnected.", http.StatusServiceUnavailable)
+		return
+	}
+
+	n.Handler(http.NotFoundHandler()).ServeHTTP(w, r)
+}
+
+// RoundTrip sends the requests of the node to the other nodes unless it is disconnected.
+func (n *testNode) RoundTrip(r *http.Request) (*http.Response, error) {
+	if atomic.LoadInt32(&n.disconnected) == 1 {
+		return nil, errors.New("disconnected")
+	}
+
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func (n *testNode) setDisconnected(disconnected bool) {
+	value := int32(0)
+	if disconnected {
+		value = 1
+	}
+
+	atomic.StoreInt32(&n.disconnected, value)
+}
+
+func (n *testNode) stop(t *testing.T) {
+	if err := n.Close(); err != nil {
+		t.Errorf("got error %q, want none", err)
+	}
+
+	n.server.Close()
+}
+
+// testSecret is the secret shared by the nodes of test clusters.
+const testSecret = "secret"
+
+// newServer returns a server, which has not been started yet, together with its address.
+func newServer() (*httptest.Server, string) {
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	return server, "http://" + server.Listener.Addr().String()
+}
+
+// startNode starts a node using a server created by newServer.
+func startNode(t *testing.T, server *httptest.Server, id string, database db.Database, dir string, opts ...cluster.NodeOption) *testNode {
+	n := &testNode{
+		server: server,
+	}
+
+	opts = append([]cluster.NodeOption{
+		cluster.WithNodeClient(&http.Client{Transport: n}),
+		cluster.WithElectionTimeout(100 * time.Millisecond),
+		cluster.WithHeartbeatInterval(10 * time.Millisecond),
+		cluster.WithCommitTimeout(2 * time.Second),
+		cluster.WithNodeDurability(db.DurabilityNone),
+		cluster.WithSecret(testSecret),
+	}, opts...)
+
+	node, err := cluster.NewNode(id, "http://"+server.Listener.Addr().String(), database, dir, opts...)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	n.Node = node
+	server.Config.Handler = n
+	server.Start()
+	return n
+}
+
+// startCluster starts a cluster of count nodes using memory databases. The returned function stops the
+// nodes and removes their directories.
+func startCluster(t *testing.T, count int, opts ...cluster.NodeOption) ([]*testNode, func()) {
+	servers := []*httptest.Server{}
+	members := []cluster.Member{}
+	for i := 0; i < count; i++ {
+		server, address := newServer()
+		servers = append(servers, server)
+		members = append(members, cluster.Member{
+			ID:      fmt.Sprintf("node%d", i+1),
+			Address: address,
+		})
+	}
+
+	nodes := []*testNode{}
+	dirs := []string{}
+	for i, server := range servers {
+		dir, err := ioutil.TempDir("", "uswd")
+		if err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+		dirs = append(dirs, dir)
+
+		nodeOpts := append([]cluster.NodeOption{cluster.WithMembers(members)}, opts...)
+		if i == 0 {
+			nodeOpts = append(nodeOpts, cluster.WithBootstrap())
+		}
+		nodes = append(nodes, startNode(t, server, members[i].ID, db.NewMemoryDatabase(), dir, nodeOpts...))
+	}
+
+	return nodes, func() {
+		for _, n := range nodes {
+			n.stop(t)
+		}
+
+		for _, dir := range dirs {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+// waitFor waits until condition returns true.
+func waitFor(t *testing.T, message string, condition func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", message)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForLeader waits until all nodes know the same leader and returns it.
+func waitForLeader(t *testing.T, nodes []*testNode) *testNode {
+	var leader *testNode
+	waitFor(t, "leader", func() bool {
+		leader = nil
+		id := nodes[0].Status().Leader
+		for _, n := range nodes {
+			status := n.Status()
+			if status.Leader == "" || status.Leader != id {
+				return false
+			}
+
+			if status.Role == "leader" {
+				leader = n
+			}
+		}
+
+		return leader != nil
+	})
+
+	return leader
+}
+
+// waitForValue waits until all nodes have stored the value of key.
+func waitForValue(t *testing.T, nodes []*testNode, key, value string) {
+	waitFor(t, fmt.Sprintf("value of %q", key), func() bool {
+		for _, n := range nodes {
+			entry, found, err := n.Get(key)
+			if err != nil || !found || entry.Value != value {
+				return false
+			}
+		}
+
+		return true
+	})
+}
+
+func follower(nodes []*testNode, leader *testNode) *testNode {
+	for _, n := range nodes {
+		if n != leader {
+			return n
+		}
+	}
+
+	return nil
+}
+
+func TestClusterReplication(t *testing.T) {
+	t.Parallel()
+
+	nodes, stop := startCluster(t, 3)
+	defer stop()
+
+	leader := waitForLeader(t, nodes)
+	node := follower(nodes, leader)
+
+	if err := node.Put("key", "first"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	// A follower forwarding a change has applied it before returning.
+	entry, found, err := node.Get("key")
+	if err != nil || !found || entry.Value != "first" {
+		t.Fatalf("got %v, %v and error %v, want value", entry, found, err)
+	}
+
+	if err := node.CompareAndPut("key", "second", 5); err != db.ErrVersionMismatch {
+		t.Errorf("got error %v, want %v", err, db.ErrVersionMismatch)
+	}
+
+	if err := leader.CompareAndPut("key", "second", 1); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	err = node.Batch([]db.Op{
+		{Key: "other", Value: "value"},
+		{Key: "key", Value: "conflict", ExpectedVersion: 1},
+	})
+	if _, ok := err.(*db.BatchError); !ok {
+		t.Errorf("got error %v, want batch error", err)
+	}
+
+	found, err = node.Delete("missing")
+	if err != nil || found {
+		t.Errorf("got %v and error %v, want false", found, err)
+	}
+
+	waitForValue(t, nodes, "key", "second")
+	for _, n := range nodes {
+		entry, _, _ := n.Get("key")
+		if entry.Version != 2 {
+			t.Errorf("got version %d on %s, want 2", entry.Version, n.ID())
+		}
+
+		if _, found, _ := n.Get("other"); found {
+			t.Errorf("got value of failed batch on %s, want none", n.ID())
+		}
+	}
+}
+
+func TestClusterLeaderFailure(t *testing.T) {
+	t.Parallel()
+
+	nodes, stop := startCluster(t, 3)
+	defer stop()
+
+	leader := waitForLeader(t, nodes)
+	if err := leader.Put("key", "before"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	leader.setDisconnected(true)
+	remaining := []*testNode{}
+	for _, n := range nodes {
+		if n != leader {
+			remaining = append(remaining, n)
+		}
+	}
+
+	next := waitForLeader(t, remaining)
+	if err := remaining[0].Put("key", "after"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if next.Status().Term <= leader.Status().Term {
+		t.Errorf("got term %d, want later than %d", next.Status().Term, leader.Status().Term)
+	}
+
+	leader.setDisconnected(false)
+	waitForValue(t, nodes, "key", "after")
+}
+
+func TestClusterMembership(t *testing.T) {
+	t.Parallel()
+
+	nodes, stop := startCluster(t, 3, cluster.WithSnapshotThreshold(5))
+	defer stop()
+
+	leader := waitForLeader(t, nodes)
+	for i := 0; i < 20; i++ {
+		if err := leader.Put(fmt.Sprintf("key%d", i), "value"); err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	defer os.RemoveAll(dir)
+
+	server, address := newServer()
+	added := startNode(t, server, "node4", db.NewMemoryDatabase(), dir)
+	defer added.stop(t)
+
+	// The new member receives a copy of the database, because the log has been compacted.
+	if err := follower(nodes, leader).AddMember(cluster.Member{ID: "node4", Address: address}); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	nodes = append(nodes, added)
+	waitForValue(t, nodes, "key19", "value")
+
+	if err := leader.RemoveMember("unknown"); err != cluster.ErrUnknownMember {
+		t.Errorf("got error %v, want %v", err, cluster.ErrUnknownMember)
+	}
+
+	// The leader removing itself steps down, the remaining members elect a new leader.
+	if err := leader.RemoveMember(leader.ID()); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	remaining := []*testNode{}
+	for _, n := range nodes {
+		if n != leader {
+			remaining = append(remaining, n)
+		}
+	}
+
+	next := waitForLeader(t, remaining)
+	if err := added.Put("key", "after"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	waitForValue(t, remaining, "key", "after")
+
+	members := []string{}
+	for _, m := range next.Status().Members {
+		members = append(members, m.ID)
+	}
+
+	want := []string{}
+	for _, n := range remaining {
+		want = append(want, n.ID())
+	}
+
+	if !reflect.DeepEqual(members, want) {
+		t.Errorf("got members %v, want %v", members, want)
+	}
+}
+
+func TestClusterRestart(t *testing.T) {
+	t.Parallel()
+
+	dataDir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	defer os.RemoveAll(dataDir)
+
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := func() *testNode {
+		database, err := db.NewFileDatabase(dataDir)
+		if err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+
+		server, address := newServer()
+		return startNode(t, server, "node1", database, dir, cluster.WithBootstrap(), cluster.WithMembers([]cluster.Member{
+			{ID: "node1", Address: address},
+		}))
+	}
+
+	node := start()
+	waitForLeader(t, []*testNode{node})
+	if err := node.Put("key", "value"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	before := node.Status()
+	node.stop(t)
+
+	node = start()
+	defer node.stop(t)
+
+	status := node.Status()
+	if status.AppliedIndex != before.AppliedIndex || status.Term != before.Term {
+		t.Errorf("got applied index %d and term %d, want %d and %d", status.AppliedIndex, status.Term, before.AppliedIndex, before.Term)
+	}
+
+	waitForLeader(t, []*testNode{node})
+	if err := node.CompareAndPut("key", "changed", 1); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+}
+
+func TestNodeNotEmpty(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	defer os.RemoveAll(dir)
+
+	database := db.NewMemoryDatabase()
+	if err := database.Put("key", "value"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	// Only a bootstrapped node keeps the keys of its database, all other nodes would lose them.
+	members := cluster.WithMembers([]cluster.Member{{ID: "node1", Address: "http://localhost"}})
+	if _, err := cluster.NewNode("node1", "http://localhost", database, dir, members, cluster.WithSecret(testSecret)); err == nil {
+		t.Fatal("got no error, want error")
+	}
+
+	node, err := cluster.NewNode("node1", "http://localhost", database, dir, members, cluster.WithSecret(testSecret), cluster.WithBootstrap(), cluster.WithNodeDurability(db.DurabilityNone))
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	defer node.Close()
+
+	if _, found, err := node.Get("key"); err != nil || !found {
+		t.Errorf("got %v and error %v, want value", found, err)
+	}
+}
+
+func TestNodeSecret(t *testing.T) {
+	t.Parallel()
+
+	nodes, stop := startCluster(t, 1)
+	defer stop()
+
+	tests := []struct {
+		desc   string
+		method string
+		path   string
+		secret string
+		status int
+	}{
+		{
+			desc:   "missing secret",
+			method: http.MethodPost,
+			path:   "/_raft/vote",
+			status: http.StatusUnauthorized,
+		},
+		{
+			desc:   "wrong secret",
+			method: http.MethodPost,
+			path:   "/_raft/append",
+			secret: "wrong",
+			status: http.StatusUnauthorized,
+		},
+		{
+			desc:   "members",
+			method: http.MethodDelete,
+			path:   "/_cluster/members/node1",
+			status: http.StatusUnauthorized,
+		},
+		{
+			desc:   "status",
+			method: http.MethodGet,
+			path:   "/_cluster",
+			status: http.StatusOK,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, nodes[0].server.URL+test.path, nil)
+			if err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+			if test.secret != "" {
+				req.Header.Set("X-Cluster-Secret", test.secret)
+			}
+
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+			res.Body.Close()
+
+			if res.StatusCode != test.status {
+				t.Errorf("got status %d, want %d", res.StatusCode, test.status)
+			}
+		})
+	}
+}
+
+func TestParseMembers(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		value   string
+		members []cluster.Member
+		err     bool
+	}{
+		{
+			value:   "",
+			members: []cluster.Member{},
+		},
+		{
+			value: "a=http://host-a:8080, b=http://host-b:8080",
+			members: []cluster.Member{
+				{ID: "a", Address: "http://host-a:8080"},
+				{ID: "b", Address: "http://host-b:8080"},
+			},
+		},
+		{
+			value: "http://host-a:8080",
+			err:   true,
+		},
+		{
+			value: "a=http://host-a:8080,a=http://host-b:8080",
+			err:   true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.value, func(t *testing.T) {
+			t.Parallel()
+
+			members, err := cluster.ParseMembers(test.value)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+
+			if !reflect.DeepEqual(members, test.members) {
+				t.Errorf("got %v, want %v", members, test.members)
+			}
+		})
+	}
+}
@@ -0,0 +1,942 @@
+package cluster
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/xperimental/uswd/db"
+)
+
+// maxAppendEntries limits the number of entries sent to a follower in a single request.
+const maxAppendEntries = 500
+
+// entryType is the kind of an entry of the log.
+type entryType string
+
+const (
+	// entryCommand changes the database.
+	entryCommand entryType = "command"
+	// entryConfig changes the members of the cluster. It takes effect as soon as it is added to the log.
+	entryConfig entryType = "config"
+	// entryNoop is added by a new leader, so that it can commit the entries of earlier terms.
+	entryNoop entryType = "noop"
+)
+
+// entry is an entry of the log.
+type entry struct {
+	Index   uint64    `json:"index"`
+	Term    uint64    `json:"term"`
+	Type    entryType `json:"type"`
+	Command *command  `json:"command,omitempty"`
+	Members []Member  `json:"members,omitempty"`
+}
+
+// The following methods need to be called holding the lock.
+
+func (n *Node) lastIndex() uint64 {
+	return n.state.SnapshotIndex + uint64(len(n.log))
+}
+
+// entry returns the entry at index, which needs to be kept in the log.
+func (n *Node) entry(index uint64) entry {
+	return n.log[index-n.state.SnapshotIndex-1]
+}
+
+// termAt returns the term of the entry at index. It is zero for entries, which are not known.
+func (n *Node) termAt(index uint64) uint64 {
+	switch {
+	case index == n.state.SnapshotIndex:
+		return n.state.SnapshotTerm
+	case index < n.state.SnapshotIndex || index > n.lastIndex():
+		return 0
+	default:
+		return n.entry(index).Term
+	}
+}
+
+// membersAt returns the members of the cluster after the entry at index.
+func (n *Node) membersAt(index uint64) []Member {
+	for i := index; i > n.state.SnapshotIndex; i-- {
+		if e := n.entry(i); e.Type == entryConfig {
+			return e.Members
+		}
+	}
+
+	return n.state.Members
+}
+
+// configIndex returns the index of the latest configuration entry.
+func (n *Node) configIndex() uint64 {
+	for i := n.lastIndex(); i > n.state.SnapshotIndex; i-- {
+		if n.entry(i).Type == entryConfig {
+			return i
+		}
+	}
+
+	return n.state.SnapshotIndex
+}
+
+func (n *Node) isMember(id string) bool {
+	for _, m := range n.members {
+		if m.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (n *Node) persist() error {
+	if err := n.storage.saveState(n.state); err != nil {
+		log.Printf("Error saving state of node: %s", err)
+		return err
+	}
+
+	return nil
+}
+
+// appendEntries adds entries to the log of the leader and starts replicating them. It returns the index
+// of the last entry.
+func (n *Node) appendEntries(entries ...entry) (uint64, error) {
+	for i := range entries {
+		entries[i].Index = n.lastIndex() + uint64(i) + 1
+		entries[i].Term = n.state.Term
+	}
+
+	if err := n.storage.append(entries...); err != nil {
+		return 0, err
+	}
+
+	n.log = append(n.log, entries...)
+	n.setMembers(n.membersAt(n.lastIndex()))
+	for _, r := range n.replicators {
+		r.notify()
+	}
+
+	n.advanceCommit()
+	return n.lastIndex(), nil
+}
+
+// setMembers changes the members of the cluster. A leader starts and stops replicating to the changed members.
+func (n *Node) setMembers(members []Member) {
+	n.members = members
+	if n.role != roleLeader {
+		return
+	}
+
+	current := make(map[string]bool)
+	for _, m := range members {
+		current[m.ID] = true
+		if m.ID == n.id {
+			continue
+		}
+
+		if r, ok := n.replicators[m.ID]; ok {
+			r.member = m
+			continue
+		}
+
+		n.startReplicator(m)
+	}
+
+	for id, r := range n.replicators {
+		if !current[id] {
+			r.close()
+			delete(n.replicators, id)
+		}
+	}
+}
+
+// runTimer starts an election when the leader has not been heard from during the election timeout.
+func (n *Node) runTimer() {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.electionTimeout / 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+		}
+
+		n.lock.Lock()
+		if !n.closed && n.state.Initialized && !n.state.Installing && n.role != roleLeader && n.isMember(n.id) && time.Now().After(n.electionDeadline) {
+			n.startElection()
+		}
+		n.lock.Unlock()
+	}
+}
+
+type voteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	LastIndex uint64 `json:"lastIndex"`
+	LastTerm  uint64 `json:"lastTerm"`
+}
+
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// startElection asks the other members to vote for this node in a new term. The caller needs to hold the lock.
+func (n *Node) startElection() {
+	n.state.Term++
+	n.state.Vote = n.id
+	if err := n.persist(); err != nil {
+		n.resetElectionDeadline()
+		return
+	}
+
+	log.Printf("Starting election for term %d.", n.state.Term)
+	n.role = roleCandidate
+	n.leader = Member{}
+	n.resetElectionDeadline()
+
+	request := voteRequest{
+		Term:      n.state.Term,
+		Candidate: n.id,
+		LastIndex: n.lastIndex(),
+		LastTerm:  n.termAt(n.lastIndex()),
+	}
+
+	votes := 1
+	if votes > len(n.members)/2 {
+		n.becomeLeader()
+		return
+	}
+
+	for _, m := range n.members {
+		if m.ID == n.id {
+			continue
+		}
+
+		go func(m Member) {
+			response := voteResponse{}
+			if err := n.call(m, votePath, request, &response, n.electionTimeout); err != nil {
+				return
+			}
+
+			n.lock.Lock()
+			defer n.lock.Unlock()
+
+			switch {
+			case n.closed:
+			case response.Term > n.state.Term:
+				n.stepDown(response.Term)
+			case n.role != roleCandidate || n.state.Term != request.Term || !response.Granted:
+			default:
+				votes++
+				if votes > len(n.members)/2 {
+					n.becomeLeader()
+				}
+			}
+		}(m)
+	}
+}
+
+// becomeLeader starts replicating to the other members. The caller needs to hold the lock.
+func (n *Node) becomeLeader() {
+	log.Printf("Elected as leader for term %d.", n.state.Term)
+	n.role = roleLeader
+	n.leader = Member{
+		ID:      n.id,
+		Address: n.address,
+	}
+
+	n.setMembers(n.members)
+	if _, err := n.appendEntries(entry{Type: entryNoop}); err != nil {
+		log.Printf("Error starting term: %s", err)
+		n.stepDown(n.state.Term)
+	}
+}
+
+// stepDown makes the node a follower and continues with a later term. The caller needs to hold the lock.
+func (n *Node) stepDown(term uint64) {
+	if term > n.state.Term {
+		n.state.Term = term
+		n.state.Vote = ""
+		n.persist()
+		n.leader = Member{}
+	}
+
+	if n.role == roleLeader {
+		log.Printf("Stepping down as leader in term %d.", n.state.Term)
+		n.leader = Member{}
+	}
+
+	n.role = roleFollower
+	n.stopReplicators()
+	n.resetElectionDeadline()
+}
+
+func (n *Node) stopReplicators() {
+	for id, r := range n.replicators {
+		r.close()
+		delete(n.replicators, id)
+	}
+}
+
+// handleVote answers the request of a candidate for a vote.
+func (n *Node) handleVote(request voteRequest) voteResponse {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	// Nodes which have been removed from the cluster do not learn about new terms. They should not disturb
+	// the cluster while the leader is still active.
+	if n.role == roleLeader || (n.leader.ID != "" && time.Since(n.leaderContact) < n.electionTimeout) {
+		return voteResponse{Term: n.state.Term}
+	}
+
+	if request.Term > n.state.Term {
+		n.stepDown(request.Term)
+	}
+
+	response := voteResponse{Term: n.state.Term}
+	if request.Term < n.state.Term || (n.state.Vote != "" && n.state.Vote != request.Candidate) {
+		return response
+	}
+
+	lastTerm := n.termAt(n.lastIndex())
+	if request.LastTerm < lastTerm || (request.LastTerm == lastTerm && request.LastIndex < n.lastIndex()) {
+		return response
+	}
+
+	n.state.Vote = request.Candidate
+	if err := n.persist(); err != nil {
+		return response
+	}
+
+	n.resetElectionDeadline()
+	response.Granted = true
+	return response
+}
+
+type appendRequest struct {
+	Term      uint64  `json:"term"`
+	Leader    Member  `json:"leader"`
+	PrevIndex uint64  `json:"prevIndex"`
+	PrevTerm  uint64  `json:"prevTerm"`
+	Entries   []entry `json:"entries"`
+	Commit    uint64  `json:"commit"`
+}
+
+type appendResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+	// LastIndex is the last index, which might match the log of the leader. It is used if the entries do not match.
+	LastIndex uint64 `json:"lastIndex"`
+	// NeedSnapshot is set by nodes, which need a copy of the database.
+	NeedSnapshot bool `json:"needSnapshot,omitempty"`
+}
+
+// contactLeader records a request of the leader of the current term. The caller needs to hold the lock.
+func (n *Node) contactLeader(term uint64, leader Member) bool {
+	if term < n.state.Term {
+		return false
+	}
+
+	if term > n.state.Term || n.role != roleFollower {
+		n.stepDown(term)
+	}
+
+	n.leader = leader
+	n.leaderContact = time.Now()
+	n.resetElectionDeadline()
+	return true
+}
+
+// handleAppend adds the entries sent by the leader to the log.
+func (n *Node) handleAppend(request appendRequest) appendResponse {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if !n.contactLeader(request.Term, request.Leader) {
+		return appendResponse{Term: n.state.Term}
+	}
+
+	response := appendResponse{Term: n.state.Term}
+	if !n.state.Initialized || n.state.Installing {
+		response.NeedSnapshot = true
+		return response
+	}
+
+	if request.PrevIndex > n.lastIndex() {
+		response.LastIndex = n.lastIndex()
+		return response
+	}
+
+	if request.PrevIndex >= n.state.SnapshotIndex && n.termAt(request.PrevIndex) != request.PrevTerm {
+		response.LastIndex = request.PrevIndex - 1
+		return response
+	}
+
+	entries := request.Entries
+	for len(entries) > 0 {
+		e := entries[0]
+		if e.Index > n.lastIndex() {
+			break
+		}
+
+		if e.Index > n.state.SnapshotIndex && n.termAt(e.Index) != e.Term {
+			if err := n.truncate(e.Index); err != nil {
+				log.Printf("Error removing conflicting entries: %s", err)
+				response.LastIndex = n.lastIndex()
+				return response
+			}
+			break
+		}
+
+		entries = entries[1:]
+	}
+
+	if len(entries) > 0 {
+		if err := n.storage.append(entries...); err != nil {
+			log.Printf("Error appending entries: %s", err)
+			response.LastIndex = n.lastIndex()
+			return response
+		}
+
+		n.log = append(n.log, entries...)
+		n.setMembers(n.membersAt(n.lastIndex()))
+	}
+
+	last := request.PrevIndex + uint64(len(request.Entries))
+	if request.Commit > n.commitIndex && n.commitIndex < last {
+		n.commitIndex = request.Commit
+		if n.commitIndex > last {
+			n.commitIndex = last
+		}
+
+		n.notifyApply()
+	}
+
+	response.Success = true
+	return response
+}
+
+// truncate removes the entries starting with index, which have not been committed.
+func (n *Node) truncate(index uint64) error {
+	if err := n.storage.truncate(int(index - n.state.SnapshotIndex - 1)); err != nil {
+		return err
+	}
+
+	n.log = n.log[:index-n.state.SnapshotIndex-1]
+	n.setMembers(n.membersAt(n.lastIndex()))
+	for i, p := range n.proposals {
+		if i >= index {
+			p.result <- proposalResult{err: ErrNoLeader}
+			delete(n.proposals, i)
+		}
+	}
+
+	return nil
+}
+
+// replicator sends the entries of the leader to a single follower.
+type replicator struct {
+	member       Member
+	next         uint64
+	match        uint64
+	needSnapshot bool
+	trigger      chan struct{}
+	stop         chan struct{}
+}
+
+// startReplicator starts replicating to a member. The caller needs to hold the lock.
+func (n *Node) startReplicator(member Member) {
+	if n.closed {
+		return
+	}
+
+	r := &replicator{
+		member:  member,
+		next:    n.lastIndex() + 1,
+		trigger: make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+	}
+	n.replicators[member.ID] = r
+
+	n.wg.Add(1)
+	go n.runReplicator(r, n.state.Term)
+}
+
+func (r *replicator) notify() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (r *replicator) close() {
+	close(r.stop)
+}
+
+// runReplicator sends new entries or heartbeats to a follower until the replicator is stopped.
+func (n *Node) runReplicator(r *replicator, term uint64) {
+	defer n.wg.Done()
+
+	ticker := time.NewTicker(n.heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		n.sendAppend(r, term)
+
+		select {
+		case <-n.done:
+			return
+		case <-r.stop:
+			return
+		case <-r.trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendAppend sends the entries the follower is missing, or a copy of the database if the entries are no
+// longer kept in the log.
+func (n *Node) sendAppend(r *replicator, term uint64) {
+	n.lock.Lock()
+	if n.role != roleLeader || n.state.Term != term {
+		n.lock.Unlock()
+		return
+	}
+
+	prev := r.next - 1
+	if r.needSnapshot || prev < n.state.SnapshotIndex {
+		n.lock.Unlock()
+		n.sendSnapshot(r, term)
+		return
+	}
+
+	count := n.lastIndex() - prev
+	if count > maxAppendEntries {
+		count = maxAppendEntries
+	}
+
+	request := appendRequest{
+		Term: term,
+		Leader: Member{
+			ID:      n.id,
+			Address: n.address,
+		},
+		PrevIndex: prev,
+		PrevTerm:  n.termAt(prev),
+		Entries:   make([]entry, 0, count),
+		Commit:    n.commitIndex,
+	}
+	for i := prev + 1; i <= prev+count; i++ {
+		request.Entries = append(request.Entries, n.entry(i))
+	}
+	member := r.member
+	n.lock.Unlock()
+
+	response := appendResponse{}
+	if err := n.call(member, appendPath, request, &response, n.electionTimeout); err != nil {
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	switch {
+	case response.Term > n.state.Term:
+		n.stepDown(response.Term)
+	case n.role != roleLeader || n.state.Term != term:
+	case response.NeedSnapshot:
+		r.needSnapshot = true
+		r.notify()
+	case response.Success:
+		if match := prev + count; match > r.match {
+			r.match = match
+		}
+		r.next = r.match + 1
+		n.advanceCommit()
+		if r.next <= n.lastIndex() {
+			r.notify()
+		}
+	default:
+		r.next = response.LastIndex + 1
+		if r.next > prev {
+			r.next = prev
+		}
+		if r.next < 1 {
+			r.next = 1
+		}
+		r.notify()
+	}
+}
+
+// advanceCommit commits the entries of the current term, which have been stored by a majority of the members.
+// The caller needs to hold the lock.
+func (n *Node) advanceCommit() {
+	if n.role != roleLeader {
+		return
+	}
+
+	for index := n.lastIndex(); index > n.commitIndex && n.termAt(index) == n.state.Term; index-- {
+		count := 0
+		for _, m := range n.members {
+			if m.ID == n.id {
+				count++
+			} else if r, ok := n.replicators[m.ID]; ok && r.match >= index {
+				count++
+			}
+		}
+
+		if count > len(n.members)/2 {
+			n.commitIndex = index
+			n.notifyApply()
+			break
+		}
+	}
+
+	// A leader, which has been removed from the cluster, steps down once the change is committed.
+	if !n.isMember(n.id) && n.configIndex() <= n.commitIndex {
+		n.stepDown(n.state.Term)
+	}
+}
+
+func (n *Node) notifyApply() {
+	select {
+	case n.applied <- struct{}{}:
+	default:
+	}
+}
+
+// runApply applies the committed entries to the database.
+func (n *Node) runApply() {
+	defer n.wg.Done()
+
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-n.applied:
+		}
+
+		n.applyCommitted()
+	}
+}
+
+func (n *Node) applyCommitted() {
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+
+	for {
+		n.lock.Lock()
+		if n.appliedIndex >= n.commitIndex || n.closed {
+			n.lock.Unlock()
+			return
+		}
+
+		entries := []entry{}
+		for i := n.appliedIndex + 1; i <= n.commitIndex && len(entries) < maxAppendEntries; i++ {
+			entries = append(entries, n.entry(i))
+		}
+		n.lock.Unlock()
+
+		for _, e := range entries {
+			result := proposalResult{
+				index: e.Index,
+				found: true,
+			}
+			if e.Type == entryCommand {
+				result.found, result.err = e.Command.apply(n.Database)
+			}
+
+			n.lock.Lock()
+			n.appliedIndex = e.Index
+			if p, ok := n.proposals[e.Index]; ok {
+				delete(n.proposals, e.Index)
+				if p.term != e.Term {
+					result = proposalResult{err: ErrNoLeader}
+				}
+				p.result <- result
+			}
+			n.lock.Unlock()
+		}
+
+		n.lock.Lock()
+		if err := n.storage.saveApplied(n.appliedIndex); err != nil {
+			log.Printf("Error saving applied index: %s", err)
+		}
+
+		for _, wait := range n.appliedWaiters {
+			close(wait)
+		}
+		n.appliedWaiters = nil
+
+		if len(n.log) > n.snapshotThreshold && n.appliedIndex > n.state.SnapshotIndex {
+			n.compact()
+		}
+		n.lock.Unlock()
+	}
+}
+
+// compact removes the applied entries from the log. The database contains their changes, so it is the
+// snapshot the log starts after. The caller needs to hold the lock.
+func (n *Node) compact() {
+	index := n.appliedIndex
+	state := n.state
+	state.SnapshotTerm = n.termAt(index)
+	state.Members = n.membersAt(index)
+	state.SnapshotIndex = index
+	if err := n.storage.saveState(state); err != nil {
+		log.Printf("Error saving snapshot: %s", err)
+		return
+	}
+
+	entries := append([]entry{}, n.log[index-n.state.SnapshotIndex:]...)
+	n.state = state
+	n.log = entries
+	if err := n.storage.rewrite(entries); err != nil {
+		log.Printf("Error rewriting log: %s", err)
+	}
+}
+
+// snapshotHeader starts a copy of the database sent to a follower. It is followed by the entries of the database.
+type snapshotHeader struct {
+	Term   uint64 `json:"term"`
+	Leader Member `json:"leader"`
+	// Index and LastTerm identify the last entry applied to the database.
+	Index    uint64   `json:"index"`
+	LastTerm uint64   `json:"lastTerm"`
+	Members  []Member `json:"members"`
+}
+
+// snapshotEntry is a single key of the database.
+type snapshotEntry struct {
+	Key      string      `json:"key"`
+	Value    []byte      `json:"value"`
+	Metadata db.Metadata `json:"metadata"`
+}
+
+type snapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// snapshotReader returns the entries of a copy of the database one at a time and io.EOF after the last one.
+type snapshotReader func() (snapshotEntry, error)
+
+// takeSnapshot returns the header of a copy of the database, which identifies the last entry applied to it.
+func (n *Node) takeSnapshot(term uint64) snapshotHeader {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return snapshotHeader{
+		Term: term,
+		Leader: Member{
+			ID:      n.id,
+			Address: n.address,
+		},
+		Index:    n.appliedIndex,
+		LastTerm: n.termAt(n.appliedIndex),
+		Members:  n.membersAt(n.appliedIndex),
+	}
+}
+
+// writeSnapshot encodes every key of the database, reading one value at a time. Entries are applied while the
+// copy is written, so it might contain the changes of entries after the index of its header. The follower
+// applies these entries again, which does not change the values any further.
+func (n *Node) writeSnapshot(encoder *json.Encoder) error {
+	keys, err := n.Database.List()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		reader, meta, found, err := db.GetReader(n.Database, key)
+		if err != nil {
+			return err
+		}
+
+		if !found {
+			continue
+		}
+
+		value, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+
+		if err := encoder.Encode(snapshotEntry{
+			Key:      key,
+			Value:    value,
+			Metadata: meta,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// sendSnapshot sends a copy of the database to a follower.
+func (n *Node) sendSnapshot(r *replicator, term uint64) {
+	header := n.takeSnapshot(term)
+	n.lock.Lock()
+	member := r.member
+	n.lock.Unlock()
+
+	log.Printf("Sending copy of database at index %d to %s.", header.Index, member.ID)
+	response := snapshotResponse{}
+	if err := n.sendSnapshotRequest(member, header, &response); err != nil {
+		log.Printf("Error sending copy of database to %s: %s", member.ID, err)
+		return
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	switch {
+	case response.Term > n.state.Term:
+		n.stepDown(response.Term)
+	case n.role != roleLeader || n.state.Term != term:
+	default:
+		r.needSnapshot = false
+		if header.Index > r.match {
+			r.match = header.Index
+		}
+		r.next = r.match + 1
+		n.advanceCommit()
+		r.notify()
+	}
+}
+
+// installSnapshot replaces the contents of the database with a copy sent by the leader. An interrupted
+// installation leaves the database incomplete, so the node waits for another copy.
+func (n *Node) installSnapshot(header snapshotHeader, read snapshotReader) (snapshotResponse, error) {
+	n.lock.Lock()
+	ok := n.contactLeader(header.Term, header.Leader)
+	response := snapshotResponse{Term: n.state.Term}
+	n.lock.Unlock()
+	if !ok {
+		return response, nil
+	}
+
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+
+	n.lock.Lock()
+	if n.state.Initialized && !n.state.Installing && header.Index <= n.appliedIndex {
+		n.lock.Unlock()
+		return response, nil
+	}
+	joining := !n.state.Initialized && !n.state.Installing
+	n.lock.Unlock()
+
+	if joining {
+		if err := n.checkEmpty(); err != nil {
+			log.Printf("Error installing copy of database: %s", err)
+			return response, err
+		}
+	}
+
+	n.lock.Lock()
+	n.state.Installing = true
+	err := n.persist()
+	n.lock.Unlock()
+	if err != nil {
+		return response, err
+	}
+
+	log.Printf("Installing copy of database at index %d.", header.Index)
+	if err := n.replaceContents(read); err != nil {
+		return response, err
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	remaining := []entry{}
+	if header.Index < n.lastIndex() && header.Index >= n.state.SnapshotIndex && n.termAt(header.Index) == header.LastTerm {
+		remaining = append(remaining, n.log[header.Index-n.state.SnapshotIndex:]...)
+	}
+
+	n.state.SnapshotIndex = header.Index
+	n.state.SnapshotTerm = header.LastTerm
+	n.state.Members = header.Members
+	n.state.Initialized = true
+	n.state.Installing = false
+	if err := n.persist(); err != nil {
+		return response, err
+	}
+
+	n.log = remaining
+	if err := n.storage.rewrite(remaining); err != nil {
+		return response, err
+	}
+
+	n.appliedIndex = header.Index
+	if n.commitIndex < header.Index || n.commitIndex > n.lastIndex() {
+		n.commitIndex = header.Index
+	}
+	if err := n.storage.saveApplied(n.appliedIndex); err != nil {
+		return response, err
+	}
+
+	n.setMembers(n.membersAt(n.lastIndex()))
+	n.notifyApply()
+	return response, nil
+}
+
+// replaceContents stores the entries of a snapshot including their metadata and removes all other keys. The
+// database of a node joining the cluster is empty, so only keys deleted by missed entries are removed.
+func (n *Node) replaceContents(read snapshotReader) error {
+	keys := make(map[string]bool)
+	for {
+		e, err := read()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+		keys[e.Key] = true
+
+		current, found, err := n.Database.Get(e.Key)
+		if err != nil {
+			return err
+		}
+
+		if found && current.Version == e.Metadata.Version && current.Checksum == e.Metadata.Checksum &&
+			current.Modified.Equal(e.Metadata.Modified) {
+			continue
+		}
+
+		if err := n.Database.Put(e.Key, string(e.Value), db.WithMetadata(e.Metadata)); err != nil {
+			return err
+		}
+	}
+
+	existing, err := n.Database.List()
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, key := range existing {
+		if keys[key] {
+			continue
+		}
+
+		if _, err := n.Database.Delete(key); err != nil {
+			return err
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		log.Printf("Removed %d keys, which are not contained in the copy.", removed)
+	}
+
+	return nil
+}
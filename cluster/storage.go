@@ -0,0 +1,361 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/xperimental/uswd/db"
+)
+
+// The state of a node is kept in three files: "state" contains the term, the vote and the snapshot the log
+// starts after, "log" contains the entries following the snapshot as JSON lines and "applied" contains
+// the index of the last entry applied to the database.
+const (
+	stateFileName   = "state"
+	logFileName     = "log"
+	appliedFileName = "applied"
+)
+
+// persistentState is the part of the state of a node, which needs to survive a restart.
+type persistentState struct {
+	Term uint64 `json:"term"`
+	Vote string `json:"vote,omitempty"`
+	// SnapshotIndex and SnapshotTerm identify the last entry, which is no longer kept in the log.
+	SnapshotIndex uint64 `json:"snapshotIndex"`
+	SnapshotTerm  uint64 `json:"snapshotTerm"`
+	// Members is the configuration of the cluster at the snapshot.
+	Members []Member `json:"members"`
+	// Initialized is set once the database contains the state of the cluster.
+	Initialized bool `json:"initialized"`
+	// Installing is set while a snapshot is being installed, so that an interrupted installation is repeated.
+	// The database is incomplete, so the node does not start elections.
+	Installing bool `json:"installing,omitempty"`
+}
+
+// storage writes the state of a node to its directory.
+type storage struct {
+	dir         string
+	durability  db.Durability
+	logFile     *os.File
+	appliedFile *os.File
+	// offsets contains the position of every entry in the log file and the end of the file as last element.
+	offsets []int64
+}
+
+// openStorage reads the state of a node from dir. An incomplete entry at the end of the log is discarded.
+// A directory without state starts with the given members.
+func openStorage(dir string, durability db.Durability, members []Member) (*storage, persistentState, []entry, uint64, error) {
+	state := persistentState{}
+	stat, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		return nil, state, nil, 0, fmt.Errorf("directory does not exist: %s", dir)
+	case err != nil:
+		return nil, state, nil, 0, fmt.Errorf("error checking directory: %s", err)
+	case !stat.IsDir():
+		return nil, state, nil, 0, fmt.Errorf("not a directory: %s", dir)
+	}
+
+	s := &storage{
+		dir:        dir,
+		durability: durability,
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, stateFileName))
+	switch {
+	case os.IsNotExist(err):
+		state.Members = members
+		if err := s.saveState(state); err != nil {
+			return nil, state, nil, 0, err
+		}
+	case err != nil:
+		return nil, state, nil, 0, fmt.Errorf("error reading state: %s", err)
+	default:
+		if err := json.Unmarshal(data, &state); err != nil {
+			return nil, state, nil, 0, fmt.Errorf("error decoding state: %s", err)
+		}
+	}
+
+	entries, err := s.openLog(state.SnapshotIndex)
+	if err != nil {
+		return nil, state, nil, 0, err
+	}
+
+	applied, err := s.openApplied()
+	if err != nil {
+		s.logFile.Close()
+		return nil, state, nil, 0, err
+	}
+
+	return s, state, entries, applied, nil
+}
+
+// openLog reads the entries following the snapshot from the log file and opens it for appending.
+func (s *storage) openLog(snapshotIndex uint64) ([]entry, error) {
+	file, err := os.OpenFile(filepath.Join(s.dir, logFileName), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("error opening log: %s", err)
+	}
+
+	entries := []entry{}
+	s.offsets = []int64{0}
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	stale := false
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Discarding incomplete entry at offset %d of %s.", offset, file.Name())
+			}
+			break
+		}
+
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("error reading log: %s", err)
+		}
+
+		e := entry{}
+		if err := json.Unmarshal(line, &e); err != nil {
+			log.Printf("Discarding invalid entry at offset %d of %s: %s", offset, file.Name(), err)
+			break
+		}
+
+		offset += int64(len(line))
+		if e.Index <= snapshotIndex {
+			// The log has not been rewritten after the snapshot has been saved.
+			stale = true
+			continue
+		}
+
+		if e.Index != snapshotIndex+uint64(len(entries))+1 {
+			file.Close()
+			return nil, fmt.Errorf("log entry %d does not follow %d", e.Index, snapshotIndex+uint64(len(entries)))
+		}
+
+		entries = append(entries, e)
+		s.offsets = append(s.offsets, offset)
+	}
+
+	s.logFile = file
+	if stale {
+		if err := s.rewrite(entries); err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		return entries, nil
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("error truncating log: %s", err)
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+func (s *storage) openApplied() (uint64, error) {
+	file, err := os.OpenFile(filepath.Join(s.dir, appliedFileName), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return 0, fmt.Errorf("error opening applied index: %s", err)
+	}
+
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return 0, fmt.Errorf("error reading applied index: %s", err)
+	}
+
+	s.appliedFile = file
+	if len(bytes.TrimSpace(data)) == 0 {
+		return 0, nil
+	}
+
+	applied, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		file.Close()
+		return 0, fmt.Errorf("error parsing applied index: %s", err)
+	}
+
+	return applied, nil
+}
+
+// saveState replaces the state file.
+func (s *storage) saveState(state persistentState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return s.replaceFile(stateFileName, data)
+}
+
+// replaceFile writes a file atomically by renaming a temporary file.
+func (s *storage) replaceFile(name string, data []byte) error {
+	path := filepath.Join(s.dir, name)
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+
+	if s.durability >= db.DurabilityFile {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	if s.durability >= db.DurabilityDirectory {
+		return syncDir(s.dir)
+	}
+
+	return nil
+}
+
+// append adds entries to the end of the log file.
+func (s *storage) append(entries ...entry) error {
+	buffer := &bytes.Buffer{}
+	offsets := make([]int64, 0, len(entries))
+	end := s.offsets[len(s.offsets)-1]
+	for _, e := range entries {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		buffer.Write(data)
+		buffer.WriteByte('\n')
+		offsets = append(offsets, end+int64(buffer.Len()))
+	}
+
+	if _, err := s.logFile.Write(buffer.Bytes()); err != nil {
+		s.truncate(len(s.offsets) - 1)
+		return fmt.Errorf("error writing log: %s", err)
+	}
+
+	s.offsets = append(s.offsets, offsets...)
+	if s.durability >= db.DurabilityFile {
+		return s.logFile.Sync()
+	}
+
+	return nil
+}
+
+// truncate removes the entries following the first count entries of the log file.
+func (s *storage) truncate(count int) error {
+	offset := s.offsets[count]
+	if err := s.logFile.Truncate(offset); err != nil {
+		return fmt.Errorf("error truncating log: %s", err)
+	}
+
+	if _, err := s.logFile.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	s.offsets = s.offsets[:count+1]
+	return nil
+}
+
+// rewrite replaces the log file with one containing only entries. It is used after taking a snapshot.
+func (s *storage) rewrite(entries []entry) error {
+	path := filepath.Join(s.dir, logFileName)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	old := s.logFile
+	s.logFile = file
+	s.offsets = []int64{0}
+	if len(entries) > 0 {
+		if err := s.append(entries...); err != nil {
+			file.Close()
+			s.logFile = old
+			return err
+		}
+	} else if s.durability >= db.DurabilityFile {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			s.logFile = old
+			return err
+		}
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		file.Close()
+		s.logFile = old
+		return err
+	}
+
+	old.Close()
+	if s.durability >= db.DurabilityDirectory {
+		return syncDir(s.dir)
+	}
+
+	return nil
+}
+
+// saveApplied records the index of the last entry applied to the database.
+func (s *storage) saveApplied(index uint64) error {
+	data := fmt.Sprintf("%020d\n", index)
+	if _, err := s.appliedFile.WriteAt([]byte(data), 0); err != nil {
+		return err
+	}
+
+	if s.durability >= db.DurabilityFile {
+		return s.appliedFile.Sync()
+	}
+
+	return nil
+}
+
+func (s *storage) close() error {
+	err := s.logFile.Close()
+	if appliedErr := s.appliedFile.Close(); err == nil {
+		err = appliedErr
+	}
+
+	return err
+}
+
+// syncDir synchronizes a directory, so that new and renamed files in it are persisted.
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
@@ -0,0 +1,190 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/xperimental/uswd/db"
+)
+
+func testEntries(from, to uint64) []entry {
+	entries := []entry{}
+	for i := from; i <= to; i++ {
+		entries = append(entries, entry{
+			Index: i,
+			Term:  1,
+			Type:  entryCommand,
+			Command: &command{
+				Op:    opPut,
+				Key:   "key",
+				Value: []byte("value"),
+			},
+		})
+	}
+
+	return entries
+}
+
+func TestStorage(t *testing.T) {
+	t.Parallel()
+
+	members := []Member{{ID: "node1", Address: "http://localhost:8080"}}
+	tests := []struct {
+		desc    string
+		prepare func(t *testing.T, s *storage)
+		state   persistentState
+		entries []entry
+		applied uint64
+	}{
+		{
+			desc:    "empty",
+			prepare: func(t *testing.T, s *storage) {},
+			state:   persistentState{Members: members},
+			entries: []entry{},
+		},
+		{
+			desc: "entries",
+			prepare: func(t *testing.T, s *storage) {
+				if err := s.append(testEntries(1, 3)...); err != nil {
+					t.Fatalf("got error %q, want none", err)
+				}
+
+				if err := s.saveApplied(2); err != nil {
+					t.Fatalf("got error %q, want none", err)
+				}
+			},
+			state:   persistentState{Members: members},
+			entries: testEntries(1, 3),
+			applied: 2,
+		},
+		{
+			desc: "truncated",
+			prepare: func(t *testing.T, s *storage) {
+				if err := s.append(testEntries(1, 3)...); err != nil {
+					t.Fatalf("got error %q, want none", err)
+				}
+
+				if err := s.truncate(1); err != nil {
+					t.Fatalf("got error %q, want none", err)
+				}
+
+				if err := s.append(testEntries(2, 2)...); err != nil {
+					t.Fatalf("got error %q, want none", err)
+				}
+			},
+			state:   persistentState{Members: members},
+			entries: testEntries(1, 2),
+		},
+		{
+			desc: "incomplete entry",
+			prepare: func(t *testing.T, s *storage) {
+				if err := s.append(testEntries(1, 2)...); err != nil {
+					t.Fatalf("got error %q, want none", err)
+				}
+
+				if _, err := s.logFile.Write([]byte(`{"index":3,"te`)); err != nil {
+					t.Fatalf("got error %q, want none", err)
+				}
+			},
+			state:   persistentState{Members: members},
+			entries: testEntries(1, 2),
+		},
+		{
+			desc: "log not rewritten after snapshot",
+			prepare: func(t *testing.T, s *storage) {
+				if err := s.append(testEntries(1, 4)...); err != nil {
+					t.Fatalf("got error %q, want none", err)
+				}
+
+				err := s.saveState(persistentState{
+					Term:          1,
+					SnapshotIndex: 2,
+					SnapshotTerm:  1,
+					Members:       members,
+				})
+				if err != nil {
+					t.Fatalf("got error %q, want none", err)
+				}
+			},
+			state: persistentState{
+				Term:          1,
+				SnapshotIndex: 2,
+				SnapshotTerm:  1,
+				Members:       members,
+			},
+			entries: testEntries(3, 4),
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			dir, err := ioutil.TempDir("", "uswd")
+			if err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+			defer os.RemoveAll(dir)
+
+			s, _, _, _, err := openStorage(dir, db.DurabilityNone, members)
+			if err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+
+			test.prepare(t, s)
+			s.close()
+
+			s, state, entries, applied, err := openStorage(dir, db.DurabilityNone, nil)
+			if err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+
+			if !reflect.DeepEqual(state, test.state) {
+				t.Errorf("got state %v, want %v", state, test.state)
+			}
+
+			if !reflect.DeepEqual(entries, test.entries) {
+				t.Errorf("got entries %v, want %v", entries, test.entries)
+			}
+
+			if applied != test.applied {
+				t.Errorf("got applied index %d, want %d", applied, test.applied)
+			}
+
+			// Entries appended after opening follow the recovered entries.
+			next := test.state.SnapshotIndex + uint64(len(test.entries)) + 1
+			if err := s.append(testEntries(next, next)...); err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+			s.close()
+
+			s, _, entries, _, err = openStorage(dir, db.DurabilityNone, nil)
+			if err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+			defer s.close()
+
+			if got := uint64(len(entries)); got != next-test.state.SnapshotIndex {
+				t.Errorf("got %d entries, want %d", got, next-test.state.SnapshotIndex)
+			}
+		})
+	}
+}
+
+func TestStorageMissingDirectory(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, _, _, _, err := openStorage(filepath.Join(dir, "missing"), db.DurabilityNone, nil); err == nil {
+		t.Error("got no error, want error")
+	}
+}
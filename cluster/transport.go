@@ -0,0 +1,312 @@
+package cluster
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Paths used by the nodes for contacting each other.
+const (
+	votePath     = "/_raft/vote"
+	appendPath   = "/_raft/append"
+	snapshotPath = "/_raft/snapshot"
+	proposePath  = "/_raft/propose"
+	raftPrefix   = "/_raft/"
+)
+
+// Paths used for managing the cluster.
+const (
+	statusPath  = "/_cluster"
+	membersPath = "/_cluster/members"
+)
+
+// secretHeader contains the secret shared by the members of a cluster. It is needed for all requests
+// between the nodes and for changing the members.
+const secretHeader = "X-Cluster-Secret"
+
+// proposeResponse is the result of a change forwarded to the leader.
+type proposeResponse struct {
+	Index uint64        `json:"index"`
+	Found bool          `json:"found"`
+	Error *commandError `json:"error,omitempty"`
+}
+
+// Handler serves the requests of the other nodes and the management of the cluster, passing all other
+// requests to next:
+//
+//	GET    /_cluster               returns the status of the node
+//	POST   /_cluster/members       adds a member given as JSON object with "id" and "address"
+//	DELETE /_cluster/members/<id>  removes a member
+//
+// Requests of other nodes and changes of the members need the secret of the cluster in the X-Cluster-Secret header.
+func (n *Node) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasPrefix(r.URL.Path, raftPrefix):
+			if n.authorize(w, r) {
+				n.handleRPC(w, r)
+			}
+		case r.URL.Path == statusPath:
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+				return
+			}
+
+			writeJSON(w, n.Status())
+		case r.URL.Path == membersPath || strings.HasPrefix(r.URL.Path, membersPath+"/"):
+			if n.authorize(w, r) {
+				n.handleMembers(w, r)
+			}
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// authorize checks the secret of the cluster sent with a request. It returns false after responding to a
+// request with a missing or wrong secret.
+func (n *Node) authorize(w http.ResponseWriter, r *http.Request) bool {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get(secretHeader)), []byte(n.secret)) != 1 {
+		http.Error(w, "Missing or invalid cluster secret.", http.StatusUnauthorized)
+		return false
+	}
+
+	return true
+}
+
+func (n *Node) handleRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	n.lock.Lock()
+	closed := n.closed
+	n.lock.Unlock()
+	if closed {
+		http.Error(w, "Node is shutting down.", http.StatusServiceUnavailable)
+		return
+	}
+
+	switch r.URL.Path {
+	case votePath:
+		request := voteRequest{}
+		if !readJSON(w, r, &request) {
+			return
+		}
+
+		writeJSON(w, n.handleVote(request))
+	case appendPath:
+		request := appendRequest{}
+		if !readJSON(w, r, &request) {
+			return
+		}
+
+		writeJSON(w, n.handleAppend(request))
+	case snapshotPath:
+		n.handleSnapshot(w, r)
+	case proposePath:
+		c := command{}
+		if !readJSON(w, r, &c) {
+			return
+		}
+
+		n.handlePropose(w, c)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handlePropose makes a change forwarded by another node. It is not forwarded again, so that nodes with
+// different opinions about the leader do not forward a change in circles.
+func (n *Node) handlePropose(w http.ResponseWriter, c command) {
+	result, leader, err := n.proposeLocal(c)
+	if err != nil {
+		result.err = err
+	}
+
+	response := proposeResponse{
+		Index: result.index,
+		Found: result.found,
+		Error: encodeError(result.err),
+	}
+	if leader.ID != "" {
+		response.Error = encodeError(errNotLeader)
+	}
+
+	writeJSON(w, response)
+}
+
+// handleSnapshot installs a copy of the database sent by the leader. The entries are stored while they are
+// read, a follower receiving an interrupted copy waits for the next one.
+func (n *Node) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	reader := bufio.NewReader(r.Body)
+	header := snapshotHeader{}
+	line, err := reader.ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &header)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading snapshot header: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	decoder := json.NewDecoder(reader)
+	response, err := n.installSnapshot(header, func() (snapshotEntry, error) {
+		e := snapshotEntry{}
+		err := decoder.Decode(&e)
+		return e, err
+	})
+	if err != nil {
+		log.Printf("Error installing snapshot: %s", err)
+		http.Error(w, fmt.Sprintf("Error installing snapshot: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, response)
+}
+
+func (n *Node) handleMembers(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch {
+	case r.URL.Path == membersPath && r.Method == http.MethodPost:
+		member := Member{}
+		if !readJSON(w, r, &member) {
+			return
+		}
+
+		err = n.AddMember(member)
+	case r.URL.Path != membersPath && r.Method == http.MethodDelete:
+		err = n.RemoveMember(strings.TrimPrefix(r.URL.Path, membersPath+"/"))
+	default:
+		http.Error(w, "Method not allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error changing members: %s", err), errorStatus(err))
+		return
+	}
+
+	writeJSON(w, n.Status())
+}
+
+func errorStatus(err error) int {
+	switch err {
+	case ErrNoLeader, ErrTimeout, errClosed:
+		return http.StatusServiceUnavailable
+	case ErrMembershipChange:
+		return http.StatusConflict
+	case ErrUnknownMember:
+		return http.StatusNotFound
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, value interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(value); err != nil {
+		http.Error(w, fmt.Sprintf("Error parsing request: %s", err), http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Error encoding response: %s", err)
+	}
+}
+
+// forward sends a change to the leader and returns the result.
+func (n *Node) forward(leader Member, c command) (proposalResult, error) {
+	response := proposeResponse{}
+	if err := n.call(leader, proposePath, c, &response, n.commitTimeout+n.electionTimeout); err != nil {
+		log.Printf("Error forwarding change to %s: %s", leader.ID, err)
+		return proposalResult{}, ErrNoLeader
+	}
+
+	return proposalResult{
+		index: response.Index,
+		found: response.Found,
+		err:   response.Error.decode(),
+	}, nil
+}
+
+// call sends a request to another node and decodes the response.
+func (n *Node) call(member Member, path string, request, response interface{}, timeout time.Duration) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	return n.post(member, path, bytes.NewReader(body), response, timeout)
+}
+
+// sendSnapshotRequest sends a copy of the database to a follower.
+func (n *Node) sendSnapshotRequest(member Member, header snapshotHeader, response *snapshotResponse) error {
+	reader, writer := io.Pipe()
+	go func() {
+		encoder := json.NewEncoder(writer)
+		err := encoder.Encode(header)
+		if err == nil {
+			err = n.writeSnapshot(encoder)
+		}
+
+		writer.CloseWithError(err)
+	}()
+	defer reader.Close()
+
+	// Installing a large snapshot takes longer than the usual requests.
+	return n.post(member, snapshotPath, reader, response, 10*n.commitTimeout)
+}
+
+func (n *Node) post(member Member, path string, body io.Reader, response interface{}, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	go func() {
+		select {
+		case <-n.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	target := strings.TrimSuffix(member.Address, "/") + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(secretHeader, n.secret)
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("unexpected status %q: %s", res.Status, strings.TrimSpace(string(message)))
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(response); err != nil {
+		return fmt.Errorf("error decoding response: %s", err)
+	}
+
+	return nil
+}
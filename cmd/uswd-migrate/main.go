@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+
+	"github.com/spf13/pflag"
+	"github.com/xperimental/uswd/db"
+)
+
+var (
+	baseDir = "./data/"
+	from    = db.LayoutFlat.String()
+	to      = ""
+)
+
+func main() {
+	pflag.StringVarP(&baseDir, "base", "b", baseDir, "Base directory of database.")
+	pflag.StringVar(&from, "from", from, "Current layout of the directory, when converting it using --to.")
+	pflag.StringVar(&to, "to", to, "Convert the directory to another layout: flat, nested or sharded.")
+	pflag.Parse()
+
+	if to != "" {
+		convert()
+		return
+	}
+
+	keys, err := db.MigrateFileDatabase(baseDir)
+	for _, k := range keys {
+		log.Printf("Migrated %q", k)
+	}
+
+	if err != nil {
+		log.Fatalf("Error migrating database: %s", err)
+	}
+
+	log.Printf("Migrated %d keys.", len(keys))
+}
+
+func convert() {
+	fromLayout, err := db.ParseLayout(from)
+	if err != nil {
+		log.Fatalf("Error parsing layout: %s", err)
+	}
+
+	toLayout, err := db.ParseLayout(to)
+	if err != nil {
+		log.Fatalf("Error parsing layout: %s", err)
+	}
+
+	keys, err := db.ConvertFileDatabase(baseDir, fromLayout, toLayout)
+	if err != nil {
+		log.Fatalf("Error converting database: %s", err)
+	}
+
+	log.Printf("Moved %d keys from %s to %s layout.", len(keys), fromLayout, toLayout)
+}
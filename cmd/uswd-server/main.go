@@ -1,31 +1,241 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/pflag"
+	"github.com/xperimental/uswd/cluster"
 	"github.com/xperimental/uswd/db"
+	"github.com/xperimental/uswd/replication"
 	"github.com/xperimental/uswd/web"
 )
 
+// shutdownTimeout is the time running requests have to finish when the server is stopped.
+const shutdownTimeout = 10 * time.Second
+
 var (
-	baseDir = "./data/"
-	addr    = ":8080"
+	backend    = "file"
+	baseDir    = "./data/"
+	addr       = ":8080"
+	durability = db.DurabilityDirectory.String()
+	layout     = db.LayoutFlat.String()
+	readOnly   = false
+	maxBody    int64
+	changesDir = ""
+	retention  = 24 * time.Hour
+	historyDir = ""
+	versions   = 10
+	window     time.Duration
+	leader     = ""
+	stateFile  = ""
+	clusterID  = ""
+	clusterURL = ""
+	clusterDir = ""
+	members    = ""
+	bootstrap  = false
+	secretFile = ""
+	origins    = []string{}
 )
 
 func main() {
+	pflag.StringVar(&backend, "backend", backend, "Storage backend: file, log or segment.")
 	pflag.StringVarP(&baseDir, "base", "b", baseDir, "Base directory of database.")
 	pflag.StringVarP(&addr, "addr", "a", addr, "Network address to listen on.")
+	pflag.StringVar(&durability, "durability", durability, "Synchronization of writes to disk: none, file or dir.")
+	pflag.StringVar(&layout, "layout", layout, "Arrangement of files in the base directory: flat, nested or sharded.")
+	pflag.BoolVar(&readOnly, "read-only", readOnly, "Open database read-only, allowing other read-only processes to share it.")
+	pflag.Int64Var(&maxBody, "max-body-size", maxBody, "Maximum size of stored values in bytes. Zero disables the limit.")
+	pflag.StringVar(&changesDir, "changes-dir", changesDir, "Directory of the change log. Without it, changes are only kept in memory.")
+	pflag.DurationVar(&retention, "changes-retention", retention, "Time for which changes are kept in the change log.")
+	pflag.StringVar(&historyDir, "history-dir", historyDir, "Directory keeping earlier values of the keys. Without it, no history is kept.")
+	pflag.IntVar(&versions, "history-versions", versions, "Number of revisions kept for every key. Needs to be positive.")
+	pflag.DurationVar(&window, "history-window", window, "Only keep revisions, which have been current during this time. Zero disables the limit.")
+	pflag.StringSliceVar(&origins, "allowed-origins", origins, "Origins of web pages, which can connect to /_ws besides the ones served by this host.")
+	pflag.StringVar(&leader, "leader", leader, "URL of the server to replicate. The server only serves reads when set.")
+	pflag.StringVar(&stateFile, "replication-state", stateFile, "File keeping the replicated revision, so that a follower continues after a restart.")
+	pflag.StringVar(&clusterID, "cluster-id", clusterID, "ID of this node in a cluster. The changes are replicated to all members when set.")
+	pflag.StringVar(&clusterURL, "cluster-address", clusterURL, "URL the other members of the cluster reach this node at.")
+	pflag.StringVar(&clusterDir, "cluster-dir", clusterDir, "Directory keeping the log and state of the cluster node.")
+	pflag.StringVar(&members, "cluster-members", members, "Members a new cluster starts with, as comma-separated list of id=url.")
+	pflag.BoolVar(&bootstrap, "cluster-bootstrap", bootstrap, "Start a new cluster with the contents of the database. Exactly one of the initial members is started with it.")
+	pflag.StringVar(&secretFile, "cluster-secret-file", secretFile, "File containing the secret shared by all members of the cluster.")
 	pflag.Parse()
 
-	db, err := db.NewFileDatabase(baseDir)
+	if leader != "" && readOnly {
+		log.Fatal("A follower can not open its database read-only.")
+	}
+
+	if versions <= 0 {
+		log.Fatal("The number of history versions needs to be positive.")
+	}
+
+	if clusterID != "" && (leader != "" || readOnly) {
+		log.Fatal("A cluster node can neither be a follower nor open its database read-only.")
+	}
+
+	level, err := db.ParseDurability(durability)
+	if err != nil {
+		log.Fatalf("Error parsing durability: %s", err)
+	}
+
+	database, err := openDatabase(level)
 	if err != nil {
 		log.Fatalf("Error initializing database: %s", err)
 	}
 
-	http.Handle("/", web.DatabaseHandler(db))
+	if historyDir != "" {
+		archive, err := db.NewFileDatabase(historyDir, db.WithDurability(level))
+		if err != nil {
+			log.Fatalf("Error opening history: %s", err)
+		}
+
+		database = db.NewHistory(database, archive, db.WithVersions(versions), db.WithWindow(window))
+	}
+
+	hubOpts := []db.HubOption{}
+	if changesDir != "" {
+		changeLog, err := db.OpenChangeLog(changesDir, db.WithRetention(retention), db.WithChangeLogDurability(level))
+		if err != nil {
+			log.Fatalf("Error opening change log: %s", err)
+		}
+
+		hubOpts = append(hubOpts, db.WithChangeLog(changeLog))
+	}
+
+	hub := db.NewHub(database, hubOpts...)
+	var served db.Database = hub
+	var node *cluster.Node
+	if clusterID != "" {
+		node, err = openNode(hub, level)
+		if err != nil {
+			log.Fatalf("Error starting cluster node: %s", err)
+		}
+
+		log.Printf("Starting node %s of cluster...", clusterID)
+		served = node
+	}
+	defer served.Close()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	handlerOpts := []web.HandlerOption{web.WithMaxBodySize(maxBody), web.WithShutdown(ctx), web.WithAllowedOrigins(origins...)}
+	replicated := make(chan struct{})
+	if leader != "" {
+		follower, err := replication.NewFollower(leader, hub, replication.WithStateFile(stateFile))
+		if err != nil {
+			log.Fatalf("Error creating follower: %s", err)
+		}
+
+		go func() {
+			defer close(replicated)
+			follower.Run(ctx)
+		}()
+
+		log.Printf("Replicating %s...", leader)
+		handlerOpts = append(handlerOpts, web.WithFollower(follower))
+	} else {
+		close(replicated)
+	}
+
+	handler := web.DatabaseHandler(served, handlerOpts...)
+	if node != nil {
+		handler = node.Handler(handler)
+	}
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		<-ctx.Done()
+		log.Println("Shutting down...")
+
+		timeout, cancelTimeout := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancelTimeout()
+
+		if err := server.Shutdown(timeout); err != nil {
+			log.Printf("Error shutting down server: %s", err)
+		}
+	}()
 
 	log.Printf("Listening on %s...", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	<-stopped
+	<-replicated
+}
+
+func openNode(database db.Database, level db.Durability) (*cluster.Node, error) {
+	if clusterURL == "" || clusterDir == "" || secretFile == "" {
+		return nil, errors.New("a cluster node needs an address, a directory and a secret")
+	}
+
+	secret, err := ioutil.ReadFile(secretFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cluster secret: %s", err)
+	}
+
+	initial, err := cluster.ParseMembers(members)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := []cluster.NodeOption{
+		cluster.WithMembers(initial),
+		cluster.WithNodeDurability(level),
+		cluster.WithSecret(strings.TrimSpace(string(secret))),
+	}
+	if bootstrap {
+		opts = append(opts, cluster.WithBootstrap())
+	}
+
+	return cluster.NewNode(clusterID, clusterURL, database, clusterDir, opts...)
+}
+
+func openDatabase(level db.Durability) (db.Database, error) {
+	switch backend {
+	case "file":
+		fileLayout, err := db.ParseLayout(layout)
+		if err != nil {
+			return nil, err
+		}
+
+		opts := []db.FileOption{db.WithDurability(level), db.WithLayout(fileLayout)}
+		if readOnly {
+			opts = append(opts, db.ReadOnly())
+		}
+
+		return db.NewFileDatabase(baseDir, opts...)
+	case "log":
+		if readOnly {
+			return nil, fmt.Errorf("backend %s can not be opened read-only", backend)
+		}
+
+		return db.NewLogDatabase(baseDir, db.WithLogDurability(level))
+	case "segment":
+		if readOnly {
+			return nil, fmt.Errorf("backend %s can not be opened read-only", backend)
+		}
+
+		return db.NewSegmentDatabase(baseDir, db.WithSegmentDurability(level))
+	default:
+		return nil, fmt.Errorf("unknown backend: %s", backend)
+	}
 }
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Op is a single change of a batch.
+type Op struct {
+	Key string
+	// Value is stored as new value of the key. It is not used when deleting.
+	Value string
+	// Delete removes the key instead of storing a value.
+	Delete bool
+	// ExpectedVersion guards the change like in CompareAndPut. AnyVersion disables the check.
+	ExpectedVersion int64
+	Options         []PutOption
+}
+
+// PutOp stores a value regardless of its current version.
+func PutOp(key, value string, opts ...PutOption) Op {
+	return CompareAndPutOp(key, value, AnyVersion, opts...)
+}
+
+// CompareAndPutOp only stores a value if the current version of the key matches expectedVersion.
+func CompareAndPutOp(key, value string, expectedVersion int64, opts ...PutOption) Op {
+	return Op{
+		Key:             key,
+		Value:           value,
+		ExpectedVersion: expectedVersion,
+		Options:         opts,
+	}
+}
+
+// DeleteOp removes a key regardless of its current version. Deleting a missing key is not an error.
+func DeleteOp(key string) Op {
+	return CompareAndDeleteOp(key, AnyVersion)
+}
+
+// CompareAndDeleteOp only removes a key if its current version matches expectedVersion.
+func CompareAndDeleteOp(key string, expectedVersion int64) Op {
+	return Op{
+		Key:             key,
+		Delete:          true,
+		ExpectedVersion: expectedVersion,
+	}
+}
+
+// BatchError is returned when a batch is rejected because of one of its operations.
+type BatchError struct {
+	// Index is the position of the operation in the batch.
+	Index int
+	Key   string
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("operation %d on %q: %s", e.Index, e.Key, e.Err)
+}
+
+// batchChange is the state of a key after a batch has been applied.
+type batchChange struct {
+	key string
+	// op is the index of the last operation changing the key.
+	op int
+	// meta describes the new value. Its version is zero if the key has been deleted.
+	meta Metadata
+}
+
+// planBatch checks the operations of a batch in order and returns the resulting change of every key
+// sorted by key. The function current returns the metadata of a key before the batch,
+// which is empty if the key does not exist.
+func planBatch(ops []Op, now time.Time, current func(key string) (Metadata, error)) ([]batchChange, error) {
+	for i, op := range ops {
+		if err := ValidateKey(op.Key); err != nil {
+			return nil, &BatchError{Index: i, Key: op.Key, Err: err}
+		}
+	}
+
+	changes := make(map[string]batchChange)
+	for i, op := range ops {
+		change, ok := changes[op.Key]
+		if !ok {
+			meta, err := current(op.Key)
+			if err != nil {
+				return nil, err
+			}
+
+			change = batchChange{
+				key:  op.Key,
+				meta: meta,
+			}
+		}
+
+		if op.ExpectedVersion >= 0 && change.meta.Version != op.ExpectedVersion {
+			return nil, &BatchError{Index: i, Key: op.Key, Err: ErrVersionMismatch}
+		}
+
+		change.op = i
+		if op.Delete {
+			change.meta = Metadata{}
+		} else {
+			options := ApplyPutOptions(op.Options...)
+			change.meta = options.metadata(change.meta, int64(len(op.Value)), checksum(op.Value), now)
+		}
+		changes[op.Key] = change
+	}
+
+	result := make([]batchChange, 0, len(changes))
+	for _, c := range changes {
+		result = append(result, c)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].key < result[j].key
+	})
+	return result, nil
+}
+
+// ResolveBatch checks the operations of a batch against the current state of database at now and returns
+// operations with the resulting metadata of every stored value, one for each changed key. Applying them to a
+// database in the same state using Batch makes the same change, regardless of its clock, and applying them
+// again does not change it any further.
+func ResolveBatch(database Database, ops []Op, now time.Time) ([]Op, error) {
+	changes, err := planBatch(ops, now, func(key string) (Metadata, error) {
+		meta, found, err := Stat(database, key)
+		if err != nil || !found || meta.Expired(now) {
+			return Metadata{}, err
+		}
+
+		return meta, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resolved := make([]Op, 0, len(changes))
+	for _, c := range changes {
+		if c.meta.Version == 0 {
+			resolved = append(resolved, DeleteOp(c.key))
+			continue
+		}
+
+		resolved = append(resolved, PutOp(c.key, ops[c.op].Value, WithMetadata(c.meta)))
+	}
+
+	return resolved, nil
+}
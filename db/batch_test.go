@@ -0,0 +1,150 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlanBatch(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	current := map[string]Metadata{
+		"existing": {Version: 2, Created: now.Add(-time.Hour)},
+	}
+
+	tests := []struct {
+		desc    string
+		ops     []Op
+		changes []batchChange
+		err     error
+	}{
+		{
+			desc: "put and delete",
+			ops: []Op{
+				PutOp("new", "value"),
+				DeleteOp("existing"),
+			},
+			changes: []batchChange{
+				{
+					key: "existing",
+					op:  1,
+				},
+				{
+					key: "new",
+					meta: Metadata{
+						Version:  1,
+						Size:     5,
+						Checksum: checksum("value"),
+						Created:  now,
+						Modified: now,
+					},
+				},
+			},
+		},
+		{
+			desc: "same key",
+			ops: []Op{
+				CompareAndPutOp("existing", "a", 2),
+				CompareAndPutOp("existing", "b", 3),
+			},
+			changes: []batchChange{
+				{
+					key: "existing",
+					op:  1,
+					meta: Metadata{
+						Version:  4,
+						Size:     1,
+						Checksum: checksum("b"),
+						Created:  now.Add(-time.Hour),
+						Modified: now,
+					},
+				},
+			},
+		},
+		{
+			desc: "version mismatch",
+			ops: []Op{
+				PutOp("new", "value"),
+				CompareAndPutOp("new", "value", 0),
+			},
+			err: &BatchError{Index: 1, Key: "new", Err: ErrVersionMismatch},
+		},
+		{
+			desc: "invalid key",
+			ops: []Op{
+				PutOp("new", "value"),
+				DeleteOp(""),
+			},
+			err: &BatchError{
+				Index: 1,
+				Err: &InvalidKeyError{
+					Key:    "",
+					Reason: "key can not be empty",
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			changes, err := planBatch(test.ops, now, func(key string) (Metadata, error) {
+				return current[key], nil
+			})
+
+			if !reflect.DeepEqual(err, test.err) {
+				t.Errorf("got error %q, want %q", err, test.err)
+			}
+
+			if !reflect.DeepEqual(changes, test.changes) {
+				t.Errorf("got changes %+v, want %+v", changes, test.changes)
+			}
+		})
+	}
+}
+
+func TestResolveBatch(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	database := NewMemoryDatabase()
+	if err := database.Put("existing", "value"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	ops, err := ResolveBatch(database, []Op{
+		CompareAndPutOp("existing", "a", 1, WithTTL(time.Hour)),
+		PutOp("existing", "b"),
+		PutOp("new", "value"),
+		DeleteOp("new"),
+	}, now)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if len(ops) != 2 || ops[0].Key != "existing" || ops[1].Key != "new" || !ops[1].Delete {
+		t.Fatalf("got operations %+v, want put of existing and delete of new", ops)
+	}
+
+	// Applying the resolved operations again does not change the value.
+	for i := 0; i < 2; i++ {
+		if err := database.Batch(ops); err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+	}
+
+	entry, found, err := database.Get("existing")
+	if err != nil || !found {
+		t.Fatalf("got %v and error %v, want value", found, err)
+	}
+
+	if entry.Value != "b" || entry.Version != 3 || !entry.Modified.Equal(now) || !entry.Expires.IsZero() {
+		t.Errorf("got %q, version %d, modified %s and expiry %s, want %q, 3, %s and none", entry.Value, entry.Version, entry.Modified, entry.Expires, "b", now)
+	}
+
+	if _, err := ResolveBatch(database, []Op{CompareAndPutOp("existing", "c", 1)}, now); !reflect.DeepEqual(err, &BatchError{Index: 0, Key: "existing", Err: ErrVersionMismatch}) {
+		t.Errorf("got error %v, want version mismatch", err)
+	}
+}
@@ -0,0 +1,626 @@
+package db
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The change log stores the events of a hub in segment files named after the revision of their first event.
+// Every event is stored in a record using the format of the write-ahead log with the JSON-encoded event as payload.
+// Records without a revision mark the keys of changes, which have been started or which failed.
+// A new segment is started once the current one grows too large or gets older than a quarter of the retention
+// window. Segments are removed once their last event is older than the retention window.
+const (
+	changeLogSuffix             = ".changes"
+	epochFileName               = "epoch"
+	defaultRetention            = 24 * time.Hour
+	defaultChangeLogSegmentSize = 16 << 20
+)
+
+// ChangeLog persists the events of a hub, so that revisions continue after a restart and consumers can read
+// the changes made during the retention window.
+type ChangeLog struct {
+	dir         string
+	retention   time.Duration
+	durability  Durability
+	segmentSize int64
+	now         func() time.Time
+	lockFile    *os.File
+	done        chan struct{}
+	epoch       string
+
+	lock     sync.Mutex
+	segments []changeSegment
+	active   *os.File
+	size     int64
+	started  time.Time
+	revision uint64
+	// pending contains the keys of changes, which have been started but not reported by an event yet.
+	pending map[string]bool
+	// failed is set when the end of the active segment could not be restored after a failed write.
+	failed error
+	closed bool
+}
+
+// markerRecord lists the keys of changes, which have been started or which failed.
+type markerRecord struct {
+	Time    time.Time `json:"time"`
+	Pending []string  `json:"pending,omitempty"`
+	Done    []string  `json:"done,omitempty"`
+}
+
+// changeRecord is a record of the change log, which is either an event or a marker.
+type changeRecord struct {
+	Event
+	Pending []string `json:"pending,omitempty"`
+	Done    []string `json:"done,omitempty"`
+}
+
+// changeSegment is a file of the change log. The last segment is the one events are appended to.
+type changeSegment struct {
+	first    uint64
+	modified time.Time
+}
+
+// ChangeLogOption changes the configuration of a change log.
+type ChangeLogOption func(l *ChangeLog)
+
+// WithRetention sets the time for which changes are kept at least. The default is 24 hours.
+func WithRetention(retention time.Duration) ChangeLogOption {
+	return func(l *ChangeLog) {
+		l.retention = retention
+	}
+}
+
+// WithChangeLogDurability sets how writes to the change log are synchronized to disk.
+// The default is DurabilityDirectory.
+func WithChangeLogDurability(durability Durability) ChangeLogOption {
+	return func(l *ChangeLog) {
+		l.durability = durability
+	}
+}
+
+// WithChangeLogSegmentSize sets the size in bytes after which a new segment is started.
+func WithChangeLogSegmentSize(size int64) ChangeLogOption {
+	return func(l *ChangeLog) {
+		l.segmentSize = size
+	}
+}
+
+// OpenChangeLog opens the change log stored in dir. An incomplete record at the end of the log is discarded.
+func OpenChangeLog(dir string, opts ...ChangeLogOption) (*ChangeLog, error) {
+	stat, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		return nil, fmt.Errorf("directory does not exist: %s", dir)
+	case err != nil:
+		return nil, fmt.Errorf("error checking directory: %s", err)
+	}
+
+	if !stat.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", dir)
+	}
+
+	l := &ChangeLog{
+		dir:         dir,
+		retention:   defaultRetention,
+		durability:  DurabilityDirectory,
+		segmentSize: defaultChangeLogSegmentSize,
+		now:         time.Now,
+		done:        make(chan struct{}),
+		pending:     make(map[string]bool),
+	}
+	for _, o := range opts {
+		o(l)
+	}
+
+	l.lockFile, err = lockFile(filepath.Join(dir, lockFileName), true)
+	switch {
+	case err == errLocked:
+		return nil, fmt.Errorf("directory is locked by another process: %s", dir)
+	case err != nil:
+		return nil, err
+	}
+
+	if err := l.open(); err != nil {
+		l.lockFile.Close()
+		return nil, err
+	}
+
+	go runSweeper(l.done, l.expire)
+	return l, nil
+}
+
+// open finds the segments and opens the last one for appending.
+func (l *ChangeLog) open() error {
+	if err := l.loadEpoch(); err != nil {
+		return fmt.Errorf("error reading epoch: %s", err)
+	}
+
+	infos, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return fmt.Errorf("error reading directory: %s", err)
+	}
+
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, changeLogSuffix) {
+			continue
+		}
+
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, changeLogSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		l.segments = append(l.segments, changeSegment{
+			first:    first,
+			modified: info.ModTime(),
+		})
+	}
+
+	sort.Slice(l.segments, func(i, j int) bool {
+		return l.segments[i].first < l.segments[j].first
+	})
+
+	if len(l.segments) == 0 {
+		return l.startSegment(1)
+	}
+
+	last := l.segments[len(l.segments)-1]
+	l.revision = last.first - 1
+	l.active, err = os.OpenFile(l.segmentPath(last.first), os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+
+	l.size, err = l.scan(l.active)
+	switch {
+	case err == errTornRecord:
+		log.Printf("Discarding incomplete record at offset %d of %s.", l.size, l.active.Name())
+		if err := l.active.Truncate(l.size); err != nil {
+			l.active.Close()
+			return fmt.Errorf("error truncating change log: %s", err)
+		}
+	case err != nil:
+		l.active.Close()
+		return fmt.Errorf("error reading change log: %s", err)
+	}
+
+	if _, err := l.active.Seek(l.size, io.SeekStart); err != nil {
+		l.active.Close()
+		return err
+	}
+
+	return nil
+}
+
+// loadEpoch reads the epoch of the log, which is created together with the log.
+func (l *ChangeLog) loadEpoch() error {
+	path := filepath.Join(l.dir, epochFileName)
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case err == nil:
+		l.epoch = strings.TrimSpace(string(data))
+		return nil
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	l.epoch = newEpoch()
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(l.epoch+"\n"), 0666); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	return syncDir(l.dir)
+}
+
+// scan reads the active segment to find the latest revision and the pending changes. It returns the offset after
+// the last complete record.
+func (l *ChangeLog) scan(file *os.File) (int64, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	for {
+		payload, err := readRecord(reader, stat.Size()-offset)
+		switch {
+		case err == io.EOF:
+			return offset, nil
+		case err != nil:
+			return offset, err
+		}
+
+		record := changeRecord{}
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return offset, fmt.Errorf("error decoding record at offset %d: %s", offset, err)
+		}
+
+		if offset == 0 {
+			l.started = record.Time
+		}
+
+		for _, key := range record.Pending {
+			l.pending[key] = true
+		}
+
+		for _, key := range record.Done {
+			delete(l.pending, key)
+		}
+
+		if record.Revision > 0 {
+			l.revision = record.Revision
+			delete(l.pending, record.Key)
+		}
+		offset += recordHeaderSize + int64(len(payload))
+	}
+}
+
+func (l *ChangeLog) segmentPath(first uint64) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%020d%s", first, changeLogSuffix))
+}
+
+// startSegment creates a new active segment starting with the given revision. The caller needs to hold the lock.
+func (l *ChangeLog) startSegment(first uint64) error {
+	file, err := os.OpenFile(l.segmentPath(first), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+
+	if l.durability >= DurabilityDirectory {
+		if err := syncDir(l.dir); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	l.segments = append(l.segments, changeSegment{
+		first:    first,
+		modified: l.now(),
+	})
+	l.active = file
+	l.size = 0
+	l.started = time.Time{}
+	return nil
+}
+
+// first returns the revision of the oldest event, which can be kept in the log.
+func (l *ChangeLog) first() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.segments[0].first
+}
+
+// Epoch returns the random ID of the log. It only changes when the log is created again.
+func (l *ChangeLog) Epoch() string {
+	return l.epoch
+}
+
+// Revision returns the revision of the latest event in the log.
+func (l *ChangeLog) Revision() uint64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.revision
+}
+
+// append adds events to the log. Their revisions need to follow the latest revision of the log. Either all
+// events are added or none.
+func (l *ChangeLog) append(events ...Event) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if err := l.writable(); err != nil {
+		return err
+	}
+
+	if len(events) == 0 {
+		return nil
+	}
+
+	records := []byte{}
+	revision := l.revision
+	for _, e := range events {
+		if e.Revision != revision+1 {
+			return fmt.Errorf("revision %d does not follow %d", e.Revision, revision)
+		}
+
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		records = append(records, frameRecord(payload)...)
+		revision = e.Revision
+	}
+
+	// Segments are named after their first event, so a segment containing only markers is not rotated.
+	hasEvents := l.revision >= l.segments[len(l.segments)-1].first
+	if hasEvents && (l.size >= l.segmentSize || l.now().Sub(l.started) >= l.retention/4) {
+		if err := l.rotate(events[0].Revision); err != nil {
+			return fmt.Errorf("error starting segment: %s", err)
+		}
+	}
+
+	if err := l.write(records, events[0].Time, true); err != nil {
+		return err
+	}
+
+	l.revision = revision
+	for _, e := range events {
+		delete(l.pending, e.Key)
+	}
+
+	return nil
+}
+
+// begin records that keys are about to be changed. The keys stay pending until an event for them is appended
+// or the change is marked as failed using abort.
+func (l *ChangeLog) begin(keys ...string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if err := l.writable(); err != nil {
+		return err
+	}
+
+	if err := l.writeMarker(markerRecord{Pending: keys}, true); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		l.pending[key] = true
+	}
+
+	return nil
+}
+
+// abort records that the changes of keys failed. The marker is not synchronized, as losing it only leads to
+// reporting the unchanged keys again.
+func (l *ChangeLog) abort(keys ...string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if err := l.writable(); err != nil {
+		return err
+	}
+
+	if err := l.writeMarker(markerRecord{Done: keys}, false); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		delete(l.pending, key)
+	}
+
+	return nil
+}
+
+// pendingKeys returns the sorted keys of changes, which have been started but not reported by an event.
+func (l *ChangeLog) pendingKeys() []string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	return l.sortedPending()
+}
+
+// sortedPending returns the sorted keys of pending changes. The caller needs to hold the lock.
+func (l *ChangeLog) sortedPending() []string {
+	keys := make([]string, 0, len(l.pending))
+	for key := range l.pending {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// writable returns an error if records can not be appended. The caller needs to hold the lock.
+func (l *ChangeLog) writable() error {
+	if l.closed {
+		return errors.New("change log is closed")
+	}
+
+	return l.failed
+}
+
+// writeMarker appends a marker to the active segment. The caller needs to hold the lock.
+func (l *ChangeLog) writeMarker(marker markerRecord, sync bool) error {
+	marker.Time = l.now()
+	payload, err := json.Marshal(marker)
+	if err != nil {
+		return err
+	}
+
+	return l.write(frameRecord(payload), marker.Time, sync)
+}
+
+// write appends records to the active segment. Records, which could not be written completely, are removed
+// again, so that they do not end up in front of the following records. If the segment can not be restored,
+// all further writes fail. The caller needs to hold the lock.
+func (l *ChangeLog) write(records []byte, started time.Time, sync bool) error {
+	_, err := l.active.Write(records)
+	if err == nil && sync && l.durability >= DurabilityFile {
+		err = l.active.Sync()
+	}
+
+	if err != nil {
+		truncErr := l.active.Truncate(l.size)
+		if truncErr == nil {
+			_, truncErr = l.active.Seek(l.size, io.SeekStart)
+		}
+
+		if truncErr != nil {
+			l.failed = fmt.Errorf("change log is in an unknown state after failed write: %s", truncErr)
+			log.Printf("Error restoring change log %s: %s", l.active.Name(), truncErr)
+		}
+
+		return err
+	}
+
+	if l.size == 0 {
+		l.started = started
+	}
+
+	l.size += int64(len(records))
+	l.segments[len(l.segments)-1].modified = l.now()
+	return nil
+}
+
+// rotate closes the active segment and starts a new one. The keys of pending changes are marked again in the
+// new segment, as only the active segment is read when the log is opened. The caller needs to hold the lock.
+func (l *ChangeLog) rotate(first uint64) error {
+	if err := l.active.Sync(); err != nil {
+		return err
+	}
+
+	if err := l.active.Close(); err != nil {
+		return err
+	}
+
+	if err := l.startSegment(first); err != nil {
+		return err
+	}
+
+	if len(l.pending) == 0 {
+		return nil
+	}
+
+	return l.writeMarker(markerRecord{Pending: l.sortedPending()}, true)
+}
+
+// read returns up to limit events following the revision since. A limit of zero returns all events.
+func (l *ChangeLog) read(since uint64, limit int) ([]Event, error) {
+	l.lock.Lock()
+	segments := append([]changeSegment{}, l.segments...)
+	revision := l.revision
+	l.lock.Unlock()
+
+	if since > revision || since+1 < segments[0].first {
+		return nil, ErrRevisionUnavailable
+	}
+
+	start := sort.Search(len(segments), func(i int) bool {
+		return segments[i].first > since+1
+	}) - 1
+
+	events := []Event{}
+	for _, segment := range segments[start:] {
+		if segment.first > revision {
+			break
+		}
+
+		var err error
+		events, err = l.readSegment(segment.first, since, revision, limit, events)
+		switch {
+		case os.IsNotExist(err):
+			// The segment has been removed after the retention window passed.
+			return nil, ErrRevisionUnavailable
+		case err != nil:
+			return nil, err
+		}
+
+		if limit > 0 && len(events) >= limit {
+			break
+		}
+	}
+
+	return events, nil
+}
+
+// readSegment appends the events of a segment between since and until to events.
+func (l *ChangeLog) readSegment(first, since, until uint64, limit int, events []Event) ([]Event, error) {
+	file, err := os.Open(l.segmentPath(first))
+	if err != nil {
+		return events, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return events, err
+	}
+
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	for limit <= 0 || len(events) < limit {
+		payload, err := readRecord(reader, stat.Size()-offset)
+		switch {
+		case err == io.EOF, err == errTornRecord:
+			// A record being appended concurrently is not complete yet.
+			return events, nil
+		case err != nil:
+			return events, err
+		}
+
+		offset += recordHeaderSize + int64(len(payload))
+
+		record := changeRecord{}
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return events, fmt.Errorf("error decoding record of %s: %s", file.Name(), err)
+		}
+
+		if record.Revision > until {
+			break
+		}
+
+		if record.Revision > since {
+			events = append(events, record.Event)
+		}
+	}
+
+	return events, nil
+}
+
+// expire removes the segments containing only events older than the retention window.
+func (l *ChangeLog) expire() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	threshold := l.now().Add(-l.retention)
+	for len(l.segments) > 1 && l.segments[0].modified.Before(threshold) {
+		if err := os.Remove(l.segmentPath(l.segments[0].first)); err != nil {
+			log.Printf("Error removing expired changes: %s", err)
+			return
+		}
+
+		l.segments = l.segments[1:]
+	}
+}
+
+// Close closes the change log.
+func (l *ChangeLog) Close() error {
+	close(l.done)
+
+	l.lock.Lock()
+	l.closed = true
+	err := l.active.Close()
+	l.lock.Unlock()
+
+	if lockErr := l.lockFile.Close(); err == nil {
+		err = lockErr
+	}
+
+	return err
+}
@@ -0,0 +1,308 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func openChangeLog(t *testing.T, dir string, opts ...ChangeLogOption) *ChangeLog {
+	t.Helper()
+
+	changeLog, err := OpenChangeLog(dir, opts...)
+	if err != nil {
+		t.Fatalf("error opening change log: %s", err)
+	}
+
+	return changeLog
+}
+
+// revisions returns the revisions of events.
+func revisions(events []Event) []uint64 {
+	result := []uint64{}
+	for _, e := range events {
+		result = append(result, e.Revision)
+	}
+
+	return result
+}
+
+func TestChangeLogRead(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	changeLog := openChangeLog(t, dir, WithChangeLogSegmentSize(200))
+	defer changeLog.Close()
+
+	for i := uint64(1); i <= 10; i++ {
+		err := changeLog.append(Event{
+			Revision: i,
+			Type:     EventPut,
+			Key:      "key",
+			Metadata: Metadata{Version: int64(i), Size: 5, ContentType: "text/plain"},
+		})
+		if err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+	}
+
+	if err := changeLog.append(Event{Revision: 12}); err == nil {
+		t.Error("got no error appending revision 12 after 10, want error")
+	}
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+changeLogSuffix))
+	if len(segments) < 3 {
+		t.Errorf("got %d segments, want at least 3", len(segments))
+	}
+
+	tests := []struct {
+		since     uint64
+		limit     int
+		revisions []uint64
+		err       error
+	}{
+		{since: 0, limit: 3, revisions: []uint64{1, 2, 3}},
+		{since: 4, limit: 0, revisions: []uint64{5, 6, 7, 8, 9, 10}},
+		{since: 7, limit: 2, revisions: []uint64{8, 9}},
+		{since: 10, limit: 0, revisions: []uint64{}},
+		{since: 11, limit: 0, err: ErrRevisionUnavailable},
+	}
+
+	for _, test := range tests {
+		events, err := changeLog.read(test.since, test.limit)
+		if err != test.err {
+			t.Errorf("got error %v since %d, want %v", err, test.since, test.err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if !reflect.DeepEqual(revisions(events), test.revisions) {
+			t.Errorf("got revisions %v since %d, want %v", revisions(events), test.since, test.revisions)
+		}
+	}
+
+	events, _ := changeLog.read(0, 1)
+	if events[0].Metadata.ContentType != "text/plain" {
+		t.Errorf("got content type %q, want %q", events[0].Metadata.ContentType, "text/plain")
+	}
+}
+
+func TestChangeLogReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	hub := NewHub(NewMemoryDatabase(), WithChangeLog(openChangeLog(t, dir)), WithHistorySize(2))
+	hub.Put("key1", "value")
+	hub.Put("key2", "value")
+	hub.Delete("key1")
+	hub.Close()
+
+	// Append an incomplete record.
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+changeLogSuffix))
+	file, err := os.OpenFile(segments[len(segments)-1], os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	file.Write([]byte{100, 0, 0, 0, 1})
+	file.Close()
+
+	hub = NewHub(NewMemoryDatabase(), WithChangeLog(openChangeLog(t, dir)), WithHistorySize(2))
+	defer hub.Close()
+
+	if hub.Revision() != 3 {
+		t.Errorf("got revision %d, want 3", hub.Revision())
+	}
+
+	if err := hub.Put("key3", "value"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	events, err := hub.Changes(0, 0)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if !reflect.DeepEqual(revisions(events), []uint64{1, 2, 3, 4}) {
+		t.Errorf("got revisions %v, want %v", revisions(events), []uint64{1, 2, 3, 4})
+	}
+
+	if events[2].Type != EventDelete || events[2].Key != "key1" || events[2].Time.IsZero() {
+		t.Errorf("got event %+v, want delete of %q", events[2], "key1")
+	}
+
+	// The latest events are kept in memory, so that watches can resume after a restart.
+	s, err := hub.Watch("", 2)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if received := revisions(receive(s)); !reflect.DeepEqual(received, []uint64{3, 4}) {
+		t.Errorf("got revisions %v, want %v", received, []uint64{3, 4})
+	}
+}
+
+func TestChangeLogExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	changeLog := openChangeLog(t, dir, WithRetention(time.Hour))
+	defer changeLog.Close()
+
+	changeLog.now = func() time.Time {
+		return now
+	}
+
+	for i := uint64(1); i <= 6; i++ {
+		if err := changeLog.append(Event{Revision: i, Type: EventDelete, Time: now}); err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+
+		// A new segment is started after a quarter of the retention window.
+		now = now.Add(20 * time.Minute)
+	}
+
+	changeLog.expire()
+
+	// The events older than an hour are removed.
+	if _, err := changeLog.read(2, 0); err != ErrRevisionUnavailable {
+		t.Errorf("got error %v, want %q", err, ErrRevisionUnavailable)
+	}
+
+	events, err := changeLog.read(3, 0)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if !reflect.DeepEqual(revisions(events), []uint64{4, 5, 6}) {
+		t.Errorf("got revisions %v, want %v", revisions(events), []uint64{4, 5, 6})
+	}
+}
+
+func TestChangeLogPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	changeLog := openChangeLog(t, dir, WithChangeLogSegmentSize(100))
+	for _, keys := range [][]string{{"a", "b"}, {"c"}, {"d"}} {
+		if err := changeLog.begin(keys...); err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+	}
+
+	if err := changeLog.abort("c"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	// Appending several events either adds all of them or none.
+	if err := changeLog.append(Event{Revision: 1, Type: EventDelete, Key: "a"}, Event{Revision: 3}); err == nil {
+		t.Error("got no error appending revision 3 after 1, want error")
+	}
+
+	for i := uint64(1); i <= 3; i++ {
+		// The segment size is exceeded, so the pending keys are marked again in the new segment.
+		if err := changeLog.append(Event{Revision: i, Type: EventDelete, Key: "a"}); err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+	}
+	changeLog.Close()
+
+	changeLog = openChangeLog(t, dir)
+	defer changeLog.Close()
+
+	if changeLog.Revision() != 3 {
+		t.Errorf("got revision %d, want 3", changeLog.Revision())
+	}
+
+	if keys := changeLog.pendingKeys(); !reflect.DeepEqual(keys, []string{"b", "d"}) {
+		t.Errorf("got pending keys %v, want %v", keys, []string{"b", "d"})
+	}
+}
+
+func TestHubInterruptedChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	database := NewMemoryDatabase()
+	database.Put("deleted", "value")
+
+	changeLog := openChangeLog(t, dir)
+	hub := NewHub(database, WithChangeLog(changeLog))
+	if err := hub.Put("key", "value"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	// The server stops after changing the database, but before reporting the change.
+	changeLog.begin("changed", "deleted")
+	database.Put("changed", "value")
+	database.Delete("deleted")
+	changeLog.Close()
+
+	hub = NewHub(database, WithChangeLog(openChangeLog(t, dir)))
+	defer hub.Close()
+
+	events, err := hub.Changes(0, 0)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	summary := []string{}
+	for _, e := range events {
+		summary = append(summary, fmt.Sprintf("%d %s %s", e.Revision, e.Type, e.Key))
+	}
+
+	expected := []string{"1 put key", "2 put changed", "3 delete deleted"}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("got events %v, want %v", summary, expected)
+	}
+}
+
+func TestHubChangeLogFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	changeLog := openChangeLog(t, dir)
+	hub := NewHub(NewMemoryDatabase(), WithChangeLog(changeLog))
+	defer hub.Close()
+
+	changeLog.lock.Lock()
+	changeLog.failed = errors.New("disk full")
+	changeLog.lock.Unlock()
+
+	if err := hub.Put("key", "value"); err == nil {
+		t.Error("got no error, want error")
+	}
+
+	if hub.Revision() != 0 {
+		t.Errorf("got revision %d, want 0", hub.Revision())
+	}
+
+	if _, found, _ := hub.Get("key"); found {
+		t.Error("got value written without change log, want none")
+	}
+}
@@ -0,0 +1,108 @@
+package db_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/xperimental/uswd/cluster"
+	"github.com/xperimental/uswd/db"
+	"github.com/xperimental/uswd/db/dbtest"
+)
+
+// directoryFactory returns a factory for databases stored in a temporary directory.
+func directoryFactory(open func(dir string) (db.Database, error)) dbtest.Factory {
+	return func(t *testing.T) (db.Database, func()) {
+		dir, err := ioutil.TempDir("", "uswd")
+		if err != nil {
+			t.Fatalf("error creating temporary directory: %s", err)
+		}
+
+		database, err := open(dir)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("error creating database: %s", err)
+		}
+
+		return database, func() {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		factory dbtest.Factory
+	}{
+		{
+			name: "memory",
+			factory: func(t *testing.T) (db.Database, func()) {
+				return db.NewMemoryDatabase(), func() {}
+			},
+		},
+		{
+			name: "hub",
+			factory: func(t *testing.T) (db.Database, func()) {
+				return db.NewHub(db.NewMemoryDatabase()), func() {}
+			},
+		},
+		{
+			name: "history",
+			factory: func(t *testing.T) (db.Database, func()) {
+				return db.NewHistory(db.NewMemoryDatabase(), db.NewMemoryDatabase()), func() {}
+			},
+		},
+		{
+			name: "cluster",
+			factory: directoryFactory(func(dir string) (db.Database, error) {
+				members := []cluster.Member{{ID: "node1", Address: "http://localhost"}}
+				return cluster.NewNode("node1", members[0].Address, db.NewMemoryDatabase(), dir,
+					cluster.WithMembers(members),
+					cluster.WithBootstrap(),
+					cluster.WithSecret("secret"),
+					cluster.WithNodeDurability(db.DurabilityNone),
+					cluster.WithElectionTimeout(10*time.Millisecond),
+				)
+			}),
+		},
+		{
+			name: "file",
+			factory: directoryFactory(func(dir string) (db.Database, error) {
+				return db.NewFileDatabase(dir, db.WithDurability(db.DurabilityNone))
+			}),
+		},
+		{
+			name: "file-nested",
+			factory: directoryFactory(func(dir string) (db.Database, error) {
+				return db.NewFileDatabase(dir, db.WithDurability(db.DurabilityNone), db.WithLayout(db.LayoutNested))
+			}),
+		},
+		{
+			name: "file-sharded",
+			factory: directoryFactory(func(dir string) (db.Database, error) {
+				return db.NewFileDatabase(dir, db.WithDurability(db.DurabilityNone), db.WithLayout(db.LayoutSharded))
+			}),
+		},
+		{
+			name: "log",
+			factory: directoryFactory(func(dir string) (db.Database, error) {
+				return db.NewLogDatabase(dir, db.WithLogDurability(db.DurabilityNone))
+			}),
+		},
+		{
+			name: "segment",
+			factory: directoryFactory(func(dir string) (db.Database, error) {
+				return db.NewSegmentDatabase(dir, db.WithSegmentDurability(db.DurabilityNone), db.WithSegmentSize(4096))
+			}),
+		},
+	} {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			dbtest.RunConformance(t, test.factory)
+		})
+	}
+}
@@ -1,9 +1,64 @@
 // Package db provides the database backend implementation.
 package db
 
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrReadOnly is returned when trying to modify a database which has been opened read-only.
+	ErrReadOnly = errors.New("database is read-only")
+	// ErrVersionMismatch is returned when a conditional write finds a different version than expected.
+	ErrVersionMismatch = errors.New("version does not match")
+)
+
+// AnyVersion can be used as expected version to write a value regardless of its current version.
+const AnyVersion int64 = -1
+
 // Database is a simple key-value store.
 type Database interface {
 	List() ([]string, error)
-	Get(key string) (content string, found bool, err error)
-	Put(key, value string) error
+	// ListRange returns a page of the keys selected by opts in sorted order.
+	ListRange(opts ListOptions) (ListResult, error)
+	Get(key string) (entry Entry, found bool, err error)
+	Put(key, value string, opts ...PutOption) error
+	// CompareAndPut only stores the value if the current version of the key matches expectedVersion.
+	// An expectedVersion of zero means that the key must not exist yet.
+	CompareAndPut(key, value string, expectedVersion int64, opts ...PutOption) error
+	Delete(key string) (found bool, err error)
+	// Batch applies the operations in order. Either all operations are applied or none of them.
+	Batch(ops []Op) error
+	Close() error
+}
+
+// Entry is a value stored in the database.
+type Entry struct {
+	Value string
+	Metadata
+}
+
+// Metadata contains information about a stored value.
+type Metadata struct {
+	// Version starts at one and is increased every time the value is replaced.
+	Version int64 `json:"version"`
+	// Expires is the time after which the value is removed. It is zero for values which do not expire.
+	Expires time.Time `json:"expires,omitzero"`
+	// Size is the length of the value in bytes.
+	Size int64 `json:"size"`
+	// Checksum is the hex-encoded SHA-256 hash of the value.
+	Checksum string `json:"checksum,omitempty"`
+	// ContentType is the media type of the value as provided when storing it.
+	ContentType string `json:"contentType,omitempty"`
+	// Created is the time the key has been created.
+	Created time.Time `json:"created,omitzero"`
+	// Modified is the time the value has last been changed.
+	Modified time.Time `json:"modified,omitzero"`
+	// Headers contains arbitrary user-defined metadata.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Expired returns true if the value has expired at the given time.
+func (m Metadata) Expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
 }
@@ -0,0 +1,547 @@
+// Package dbtest provides a test suite, which every implementation of db.Database needs to pass.
+package dbtest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/xperimental/uswd/db"
+)
+
+// Factory creates an empty database for a single test. The returned cleanup function is called
+// after the database has been closed.
+type Factory func(t *testing.T) (database db.Database, cleanup func())
+
+// RunConformance runs the conformance test suite against the databases created by factory.
+func RunConformance(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, database db.Database)
+	}{
+		{"Empty", testEmpty},
+		{"MissingKey", testMissingKey},
+		{"InvalidKey", testInvalidKey},
+		{"Overwrite", testOverwrite},
+		{"EmptyValue", testEmptyValue},
+		{"BinaryValue", testBinaryValue},
+		{"UnicodeKeys", testUnicodeKeys},
+		{"Ordering", testOrdering},
+		{"Delete", testDelete},
+		{"CompareAndPut", testCompareAndPut},
+		{"Metadata", testMetadata},
+		{"CopyMetadata", testCopyMetadata},
+		{"ListRange", testListRange},
+		{"Batch", testBatch},
+		{"Stream", testStream},
+		{"Concurrent", testConcurrent},
+		{"ConcurrentCompareAndPut", testConcurrentCompareAndPut},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			database, cleanup := factory(t)
+			defer cleanup()
+			defer database.Close()
+
+			test.test(t, database)
+		})
+	}
+}
+
+func put(t *testing.T, database db.Database, key, value string, opts ...db.PutOption) {
+	t.Helper()
+
+	if err := database.Put(key, value, opts...); err != nil {
+		t.Fatalf("got error %q storing %q, want none", err, key)
+	}
+}
+
+func get(t *testing.T, database db.Database, key string) (db.Entry, bool) {
+	t.Helper()
+
+	entry, found, err := database.Get(key)
+	if err != nil {
+		t.Fatalf("got error %q getting %q, want none", err, key)
+	}
+
+	return entry, found
+}
+
+func list(t *testing.T, database db.Database) []string {
+	t.Helper()
+
+	keys, err := database.List()
+	if err != nil {
+		t.Fatalf("got error %q listing keys, want none", err)
+	}
+
+	return keys
+}
+
+func testEmpty(t *testing.T, database db.Database) {
+	keys := list(t, database)
+	if keys == nil || len(keys) != 0 {
+		t.Errorf("got keys %#v, want empty list", keys)
+	}
+
+	result, err := database.ListRange(db.ListOptions{})
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if !reflect.DeepEqual(result, db.ListResult{Keys: []string{}}) {
+		t.Errorf("got result %#v, want empty result", result)
+	}
+}
+
+func testMissingKey(t *testing.T, database db.Database) {
+	put(t, database, "other", "value")
+
+	entry, found := get(t, database, "missing")
+	if found || entry.Value != "" {
+		t.Errorf("got value %q (found %v), want not found", entry.Value, found)
+	}
+
+	_, _, found, err := db.GetReader(database, "missing")
+	if err != nil || found {
+		t.Errorf("got error %v (found %v) from reader, want not found", err, found)
+	}
+
+	found, err = database.Delete("missing")
+	if err != nil || found {
+		t.Errorf("got error %v (found %v) deleting, want not found", err, found)
+	}
+}
+
+func testInvalidKey(t *testing.T, database db.Database) {
+	err := database.Put("", "value")
+	if _, ok := err.(*db.InvalidKeyError); !ok {
+		t.Errorf("got error %#v storing empty key, want InvalidKeyError", err)
+	}
+
+	_, _, err = database.Get("")
+	if _, ok := err.(*db.InvalidKeyError); !ok {
+		t.Errorf("got error %#v getting empty key, want InvalidKeyError", err)
+	}
+
+	_, err = database.Delete("")
+	if _, ok := err.(*db.InvalidKeyError); !ok {
+		t.Errorf("got error %#v deleting empty key, want InvalidKeyError", err)
+	}
+}
+
+func testOverwrite(t *testing.T, database db.Database) {
+	put(t, database, "key", "first")
+	put(t, database, "key", "second value")
+
+	entry, found := get(t, database, "key")
+	if !found || entry.Value != "second value" {
+		t.Errorf("got value %q (found %v), want %q", entry.Value, found, "second value")
+	}
+
+	if entry.Version != 2 {
+		t.Errorf("got version %d, want 2", entry.Version)
+	}
+
+	if entry.Size != int64(len("second value")) {
+		t.Errorf("got size %d, want %d", entry.Size, len("second value"))
+	}
+
+	if keys := list(t, database); !reflect.DeepEqual(keys, []string{"key"}) {
+		t.Errorf("got keys %q, want %q", keys, []string{"key"})
+	}
+}
+
+func testEmptyValue(t *testing.T, database db.Database) {
+	put(t, database, "empty", "")
+
+	entry, found := get(t, database, "empty")
+	if !found || entry.Value != "" {
+		t.Errorf("got value %q (found %v), want empty value", entry.Value, found)
+	}
+
+	if keys := list(t, database); !reflect.DeepEqual(keys, []string{"empty"}) {
+		t.Errorf("got keys %q, want %q", keys, []string{"empty"})
+	}
+}
+
+func testBinaryValue(t *testing.T, database db.Database) {
+	value := "\x00\xff\xfe binary \x80"
+	put(t, database, "binary", value)
+
+	entry, _ := get(t, database, "binary")
+	if entry.Value != value {
+		t.Errorf("got value %q, want %q", entry.Value, value)
+	}
+}
+
+func testUnicodeKeys(t *testing.T, database db.Database) {
+	keys := []string{"schlüssel", "日本語", "emoji 🎉", "with space", "../parent", "a/b", "100%", "~tilde"}
+	for _, k := range keys {
+		put(t, database, k, "value of "+k)
+	}
+
+	for _, k := range keys {
+		entry, found := get(t, database, k)
+		if !found || entry.Value != "value of "+k {
+			t.Errorf("got value %q (found %v) for %q, want %q", entry.Value, found, k, "value of "+k)
+		}
+	}
+
+	expected := append([]string{}, keys...)
+	sort.Strings(expected)
+	if listed := list(t, database); !reflect.DeepEqual(listed, expected) {
+		t.Errorf("got keys %q, want %q", listed, expected)
+	}
+}
+
+func testOrdering(t *testing.T, database db.Database) {
+	keys := []string{"m", "b", "z", "a", "B", "aa", "a/b", "0", "-"}
+	for _, k := range keys {
+		put(t, database, k, "value")
+	}
+
+	expected := append([]string{}, keys...)
+	sort.Strings(expected)
+	for i := 0; i < 3; i++ {
+		if listed := list(t, database); !reflect.DeepEqual(listed, expected) {
+			t.Errorf("got keys %q, want %q", listed, expected)
+		}
+	}
+}
+
+func testDelete(t *testing.T, database db.Database) {
+	put(t, database, "key1", "value")
+	put(t, database, "key2", "value")
+
+	found, err := database.Delete("key1")
+	if err != nil || !found {
+		t.Errorf("got error %v (found %v), want found", err, found)
+	}
+
+	if _, found := get(t, database, "key1"); found {
+		t.Errorf("got found %v after delete, want false", found)
+	}
+
+	found, err = database.Delete("key1")
+	if err != nil || found {
+		t.Errorf("got error %v (found %v) deleting again, want not found", err, found)
+	}
+
+	if keys := list(t, database); !reflect.DeepEqual(keys, []string{"key2"}) {
+		t.Errorf("got keys %q, want %q", keys, []string{"key2"})
+	}
+
+	put(t, database, "key1", "new")
+	entry, _ := get(t, database, "key1")
+	if entry.Version != 1 {
+		t.Errorf("got version %d after recreating, want 1", entry.Version)
+	}
+}
+
+func testCompareAndPut(t *testing.T, database db.Database) {
+	if err := database.CompareAndPut("key", "value", 1); err != db.ErrVersionMismatch {
+		t.Errorf("got error %v for missing key, want %q", err, db.ErrVersionMismatch)
+	}
+
+	if err := database.CompareAndPut("key", "first", 0); err != nil {
+		t.Errorf("got error %q creating key, want none", err)
+	}
+
+	if err := database.CompareAndPut("key", "second", 0); err != db.ErrVersionMismatch {
+		t.Errorf("got error %v creating existing key, want %q", err, db.ErrVersionMismatch)
+	}
+
+	if err := database.CompareAndPut("key", "second", 1); err != nil {
+		t.Errorf("got error %q, want none", err)
+	}
+
+	entry, _ := get(t, database, "key")
+	if entry.Value != "second" || entry.Version != 2 {
+		t.Errorf("got value %q at version %d, want %q at version 2", entry.Value, entry.Version, "second")
+	}
+}
+
+func testMetadata(t *testing.T, database db.Database) {
+	headers := map[string]string{
+		"X-Meta-Owner": "team",
+	}
+	put(t, database, "key", "{}", db.WithContentType("application/json"), db.WithHeaders(headers))
+
+	entry, _ := get(t, database, "key")
+	if entry.ContentType != "application/json" {
+		t.Errorf("got content type %q, want %q", entry.ContentType, "application/json")
+	}
+
+	if !reflect.DeepEqual(entry.Headers, headers) {
+		t.Errorf("got headers %q, want %q", entry.Headers, headers)
+	}
+
+	expectedChecksum := "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a"
+	if entry.Checksum != expectedChecksum {
+		t.Errorf("got checksum %q, want %q", entry.Checksum, expectedChecksum)
+	}
+
+	if entry.Created.IsZero() || entry.Modified.Before(entry.Created) {
+		t.Errorf("got created %s and modified %s, want valid times", entry.Created, entry.Modified)
+	}
+}
+
+func testCopyMetadata(t *testing.T, database db.Database) {
+	created := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	meta := db.Metadata{
+		Version:     7,
+		Expires:     time.Now().Add(time.Hour).Truncate(time.Second).UTC(),
+		ContentType: "text/plain",
+		Created:     created,
+		Modified:    created.Add(time.Minute),
+		Headers:     map[string]string{"X-Meta-Owner": "team"},
+	}
+	put(t, database, "key", "value", db.WithMetadata(meta))
+
+	entry, _ := get(t, database, "key")
+	meta.Size = 5
+	meta.Checksum = "cd42404d52ad55ccfa9aca4adc828aa5800ad9d385a0671fbcbf724118320619"
+	if entry.Version != meta.Version || !entry.Expires.Equal(meta.Expires) || !entry.Created.Equal(meta.Created) ||
+		!entry.Modified.Equal(meta.Modified) || entry.Size != meta.Size || entry.Checksum != meta.Checksum ||
+		entry.ContentType != meta.ContentType || !reflect.DeepEqual(entry.Headers, meta.Headers) {
+		t.Errorf("got metadata %+v, want %+v", entry.Metadata, meta)
+	}
+
+	if err := database.CompareAndPut("key", "new", 7); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	entry, _ = get(t, database, "key")
+	if entry.Version != 8 || !entry.Created.Equal(created) {
+		t.Errorf("got version %d created %s, want %d created %s", entry.Version, entry.Created, 8, created)
+	}
+}
+
+func testListRange(t *testing.T, database db.Database) {
+	for _, k := range []string{"a", "b/1", "b/2", "b/3", "b/c/1", "c"} {
+		put(t, database, k, "value")
+	}
+
+	for _, test := range []struct {
+		opts   db.ListOptions
+		result db.ListResult
+	}{
+		{
+			opts: db.ListOptions{Prefix: "b/"},
+			result: db.ListResult{
+				Keys: []string{"b/1", "b/2", "b/3", "b/c/1"},
+			},
+		},
+		{
+			opts: db.ListOptions{Start: "b/2", End: "c"},
+			result: db.ListResult{
+				Keys: []string{"b/2", "b/3", "b/c/1"},
+			},
+		},
+		{
+			opts: db.ListOptions{Prefix: "b/", Delimiter: "/"},
+			result: db.ListResult{
+				Keys:     []string{"b/1", "b/2", "b/3"},
+				Prefixes: []string{"b/c/"},
+			},
+		},
+		{
+			opts: db.ListOptions{Delimiter: "/"},
+			result: db.ListResult{
+				Keys:     []string{"a", "c"},
+				Prefixes: []string{"b/"},
+			},
+		},
+	} {
+		result, err := database.ListRange(test.opts)
+		if err != nil {
+			t.Fatalf("got error %q for %+v, want none", err, test.opts)
+		}
+
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("got result %+v for %+v, want %+v", result, test.opts, test.result)
+		}
+	}
+
+	listed := []string{}
+	opts := db.ListOptions{Limit: 2}
+	for i := 0; ; i++ {
+		result, err := database.ListRange(opts)
+		if err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+
+		listed = append(listed, result.Keys...)
+		if result.Next == "" || i > 10 {
+			break
+		}
+
+		opts.Token = result.Next
+	}
+
+	if !reflect.DeepEqual(listed, list(t, database)) {
+		t.Errorf("got keys %q using pages, want %q", listed, list(t, database))
+	}
+}
+
+func testBatch(t *testing.T, database db.Database) {
+	put(t, database, "key1", "value1")
+
+	err := database.Batch([]db.Op{
+		db.PutOp("key2", "value2"),
+		db.CompareAndDeleteOp("key1", 2),
+	})
+	if batchErr, ok := err.(*db.BatchError); !ok || batchErr.Err != db.ErrVersionMismatch {
+		t.Errorf("got error %#v, want BatchError with %q", err, db.ErrVersionMismatch)
+	}
+
+	if keys := list(t, database); !reflect.DeepEqual(keys, []string{"key1"}) {
+		t.Errorf("got keys %q after rejected batch, want %q", keys, []string{"key1"})
+	}
+
+	err = database.Batch([]db.Op{
+		db.PutOp("key2", "value2"),
+		db.CompareAndPutOp("key2", "value3", 1),
+		db.CompareAndDeleteOp("key1", 1),
+		db.DeleteOp("missing"),
+	})
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if keys := list(t, database); !reflect.DeepEqual(keys, []string{"key2"}) {
+		t.Errorf("got keys %q, want %q", keys, []string{"key2"})
+	}
+
+	entry, _ := get(t, database, "key2")
+	if entry.Value != "value3" || entry.Version != 2 {
+		t.Errorf("got value %q at version %d, want %q at version 2", entry.Value, entry.Version, "value3")
+	}
+}
+
+func testStream(t *testing.T, database db.Database) {
+	value := strings.Repeat("0123456789", 1000)
+	if err := db.PutReader(database, "key", strings.NewReader(value), 0); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	reader, meta, found, err := db.GetReader(database, "key")
+	if err != nil || !found {
+		t.Fatalf("got error %v (found %v), want found", err, found)
+	}
+	defer reader.Close()
+
+	if meta.Size != int64(len(value)) {
+		t.Errorf("got size %d, want %d", meta.Size, len(value))
+	}
+
+	if _, err := reader.Seek(-5, 2); err != nil {
+		t.Fatalf("got error %q seeking, want none", err)
+	}
+
+	tail, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("got error %q reading, want none", err)
+	}
+
+	if string(tail) != "56789" {
+		t.Errorf("got tail %q, want %q", tail, "56789")
+	}
+}
+
+func testConcurrent(t *testing.T, database db.Database) {
+	const workers = 8
+	const iterations = 20
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			shared := fmt.Sprintf("shared%d", w%2)
+			own := fmt.Sprintf("own%d", w)
+			for i := 0; i < iterations; i++ {
+				if err := database.Put(shared, fmt.Sprintf("value%d", i)); err != nil {
+					t.Errorf("got error %q, want none", err)
+				}
+
+				if err := database.Put(own, fmt.Sprintf("value%d", i)); err != nil {
+					t.Errorf("got error %q, want none", err)
+				}
+
+				if _, _, err := database.Get(shared); err != nil {
+					t.Errorf("got error %q, want none", err)
+				}
+
+				if _, err := database.List(); err != nil {
+					t.Errorf("got error %q, want none", err)
+				}
+
+				if _, err := database.Delete(shared); err != nil {
+					t.Errorf("got error %q, want none", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for w := 0; w < workers; w++ {
+		key := fmt.Sprintf("own%d", w)
+		entry, found := get(t, database, key)
+		expected := fmt.Sprintf("value%d", iterations-1)
+		if !found || entry.Value != expected || entry.Version != iterations {
+			t.Errorf("got %q at version %d (found %v) for %q, want %q at version %d", entry.Value, entry.Version, found, key, expected, iterations)
+		}
+	}
+}
+
+func testConcurrentCompareAndPut(t *testing.T, database db.Database) {
+	const workers = 4
+	const increments = 10
+
+	put(t, database, "counter", "0")
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < increments; {
+				entry, _, err := database.Get("counter")
+				if err != nil {
+					t.Errorf("got error %q, want none", err)
+					return
+				}
+
+				var count int
+				fmt.Sscan(entry.Value, &count)
+
+				err = database.CompareAndPut("counter", fmt.Sprint(count+1), entry.Version)
+				switch err {
+				case nil:
+					i++
+				case db.ErrVersionMismatch:
+				default:
+					t.Errorf("got error %q, want none", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	entry, _ := get(t, database, "counter")
+	if entry.Value != fmt.Sprint(workers*increments) {
+		t.Errorf("got counter %q, want %d", entry.Value, workers*increments)
+	}
+}
@@ -0,0 +1,41 @@
+package db
+
+import "fmt"
+
+// Durability controls how writes of the file backend are synchronized to disk.
+type Durability int
+
+const (
+	// DurabilityNone leaves synchronizing written data to the operating system.
+	DurabilityNone Durability = iota
+	// DurabilityFile synchronizes the contents of a file before it replaces the old value.
+	DurabilityFile
+	// DurabilityDirectory additionally synchronizes the directory after a value has been replaced,
+	// so that the new value survives a crash of the system.
+	DurabilityDirectory
+)
+
+var durabilityNames = map[Durability]string{
+	DurabilityNone:      "none",
+	DurabilityFile:      "file",
+	DurabilityDirectory: "dir",
+}
+
+func (d Durability) String() string {
+	if name, ok := durabilityNames[d]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Durability(%d)", int(d))
+}
+
+// ParseDurability returns the durability level matching a name.
+func ParseDurability(name string) (Durability, error) {
+	for d, n := range durabilityNames {
+		if n == name {
+			return d, nil
+		}
+	}
+
+	return DurabilityNone, fmt.Errorf("unknown durability: %s", name)
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseDurability(t *testing.T) {
+	tests := []struct {
+		name       string
+		durability Durability
+		err        error
+	}{
+		{
+			name:       "none",
+			durability: DurabilityNone,
+		},
+		{
+			name:       "file",
+			durability: DurabilityFile,
+		},
+		{
+			name:       "dir",
+			durability: DurabilityDirectory,
+		},
+		{
+			name:       "always",
+			durability: DurabilityNone,
+			err:        errors.New("unknown durability: always"),
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			durability, err := ParseDurability(test.name)
+
+			if !reflect.DeepEqual(err, test.err) {
+				t.Errorf("got error %q, want %q", err, test.err)
+			}
+
+			if durability != test.durability {
+				t.Errorf("got durability %s, want %s", durability, test.durability)
+			}
+		})
+	}
+}
@@ -1,18 +1,80 @@
 package db
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	tempFilePrefix = ".tmp-"
+	lockFileName   = ".lock"
+)
+
+var errLocked = errors.New("locked by another process")
+
 type fileDatabase struct {
-	baseDir string
+	lock       sync.RWMutex
+	baseDir    string
+	durability Durability
+	layout     Layout
+	readOnly   bool
+	lockFile   *os.File
+	now        func() time.Time
+	done       chan struct{}
+
+	// expiries contains the expiration time of all keys which expire.
+	expiries map[string]time.Time
+	// pending is set when applying a committed batch failed. The batch is completed before the next change.
+	pending bool
+}
+
+// FileOption changes the configuration of a database with a filesystem backend.
+type FileOption func(d *fileDatabase)
+
+// WithDurability sets how writes are synchronized to disk. The default is DurabilityDirectory.
+func WithDurability(durability Durability) FileOption {
+	return func(d *fileDatabase) {
+		d.durability = durability
+	}
+}
+
+// WithLayout sets how values are arranged in the directory. The default is LayoutFlat.
+// A directory needs to be opened with the layout it has been written with, ConvertFileDatabase
+// changes the layout of an existing directory.
+func WithLayout(layout Layout) FileOption {
+	return func(d *fileDatabase) {
+		d.layout = layout
+	}
+}
+
+// ReadOnly opens the database for reading only. Multiple processes can open a directory
+// read-only at the same time, as long as no process has opened it for writing.
+func ReadOnly() FileOption {
+	return func(d *fileDatabase) {
+		d.readOnly = true
+	}
 }
 
 // NewFileDatabase creates a database with a filesystem backend.
-func NewFileDatabase(baseDir string) (Database, error) {
+// The directory is locked, so that only one process at a time can open it for writing.
+// The lock is released when the database is closed.
+//
+// Expired values are removed in the background, unless the database is read-only.
+func NewFileDatabase(baseDir string, opts ...FileOption) (Database, error) {
 	stat, err := os.Stat(baseDir)
 	switch {
 	case os.IsNotExist(err):
@@ -25,29 +87,518 @@ func NewFileDatabase(baseDir string) (Database, error) {
 		return nil, fmt.Errorf("not a directory: %s", baseDir)
 	}
 
-	return &fileDatabase{
-		baseDir: baseDir,
-	}, nil
+	d := &fileDatabase{
+		baseDir:    baseDir,
+		durability: DurabilityDirectory,
+		now:        time.Now,
+		done:       make(chan struct{}),
+		expiries:   make(map[string]time.Time),
+	}
+	for _, o := range opts {
+		o(d)
+	}
+
+	d.lockFile, err = lockFile(filepath.Join(baseDir, lockFileName), !d.readOnly)
+	switch {
+	case err == errLocked:
+		return nil, fmt.Errorf("directory is locked by another process: %s", baseDir)
+	case err != nil:
+		return nil, err
+	}
+
+	if !d.readOnly {
+		if err := d.recoverBatch(); err != nil {
+			d.lockFile.Close()
+			return nil, fmt.Errorf("error recovering batch: %s", err)
+		}
+
+		if err := removeTempFiles(baseDir); err != nil {
+			d.lockFile.Close()
+			return nil, fmt.Errorf("error removing temporary files: %s", err)
+		}
+	}
+
+	d.expiries, err = d.readExpiries()
+	if err != nil {
+		d.lockFile.Close()
+		return nil, fmt.Errorf("error reading expiration times: %s", err)
+	}
+
+	if !d.readOnly {
+		go runSweeper(d.done, d.sweep)
+	}
+
+	return d, nil
 }
 
 func (d *fileDatabase) List() ([]string, error) {
-	infos, err := ioutil.ReadDir(d.baseDir)
+	return d.list("")
+}
+
+func (d *fileDatabase) ListRange(opts ListOptions) (ListResult, error) {
+	keys, err := d.list(opts.Prefix)
 	if err != nil {
-		return nil, err
+		return ListResult{}, err
+	}
+
+	return Paginate(keys, opts)
+}
+
+// list returns the sorted keys of all values, which are stored in the directory containing prefix.
+// The keys can include keys not starting with prefix.
+func (d *fileDatabase) list(prefix string) ([]string, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	dir := d.layout.dir(prefix)
+	segments := ""
+	if dir != "." {
+		segments = prefix[:strings.LastIndex(prefix, KeySeparator)+1]
 	}
 
+	now := d.now()
 	keys := []string{}
-	for _, i := range infos {
-		keys = append(keys, i.Name())
+	err := d.walk(filepath.Join(d.baseDir, dir), segments, hashedName(dir), func(path, key string) error {
+		if !d.expired(key, now) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+	switch {
+	case os.IsNotExist(err) && dir != ".":
+		return keys, nil
+	case err != nil:
+		return nil, err
 	}
 
+	sort.Strings(keys)
 	return keys, nil
 }
 
-func (d *fileDatabase) Get(key string) (string, bool, error) {
-	path := filepath.Join(d.baseDir, key)
+// walk calls fn for every value stored in dir and its subdirectories. The keys of the values in dir
+// start with prefix. If hashed is true, the prefix is unknown and the keys are read from the key files.
+func (d *fileDatabase) walk(dir, prefix string, hashed bool, fn func(path, key string) error) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, i := range infos {
+		name := i.Name()
+		path := filepath.Join(dir, name)
+		if i.IsDir() {
+			if d.layout == LayoutSharded && isShardName(name) {
+				if err := d.walk(path, prefix, hashed, fn); err != nil {
+					return err
+				}
+				continue
+			}
+
+			if d.layout != LayoutNested || !strings.HasSuffix(name, dirSuffix) {
+				continue
+			}
+
+			segment, segmentHashed, ok := decodeSegment(strings.TrimSuffix(name, dirSuffix))
+			if !ok {
+				continue
+			}
+
+			if err := d.walk(path, prefix+segment+KeySeparator, hashed || segmentHashed, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !i.Mode().IsRegular() {
+			continue
+		}
+
+		key, ok, err := d.fileKey(path, prefix, hashed)
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		if err := fn(path, key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fileKey returns the key stored in the file at path. It returns false if the file does not contain a value.
+func (d *fileDatabase) fileKey(path, prefix string, hashed bool) (string, bool, error) {
+	name := filepath.Base(path)
+	if d.layout != LayoutNested {
+		return nameKey(filepath.Dir(path), name)
+	}
+
+	segment, segmentHashed, ok := decodeSegment(name)
+	if !ok {
+		return "", false, nil
+	}
+
+	if !hashed && !segmentHashed {
+		key := prefix + segment
+		return key, key != "", nil
+	}
+
+	return readKeyFile(path)
+}
+
+func (d *fileDatabase) Get(key string) (Entry, bool, error) {
+	reader, meta, found, err := d.GetReader(key)
+	if err != nil || !found {
+		return Entry{}, found, err
+	}
+	defer reader.Close()
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return Entry{}, false, err
+	}
+
+	return Entry{
+		Value:    string(content),
+		Metadata: meta,
+	}, true, nil
+}
+
+// GetReader opens the file containing the value of key. Because values are replaced by renaming files,
+// the returned reader keeps reading the same value even if it is replaced in the meantime.
+func (d *fileDatabase) GetReader(key string) (ValueReader, Metadata, bool, error) {
+	path, err := d.path(key)
+	if err != nil {
+		return nil, Metadata{}, false, err
+	}
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
 
-	content, err := ioutil.ReadFile(path)
+	file, err := os.Open(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil, Metadata{}, false, nil
+	case err != nil:
+		return nil, Metadata{}, false, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, Metadata{}, false, err
+	}
+
+	meta, err := readMetadata(path, stat)
+	if err != nil {
+		file.Close()
+		return nil, Metadata{}, false, err
+	}
+
+	if meta.Expired(d.now()) {
+		file.Close()
+		return nil, Metadata{}, false, nil
+	}
+
+	meta.Size = stat.Size()
+	if meta.Modified.IsZero() {
+		meta.Modified = stat.ModTime()
+	}
+
+	if meta.Checksum == "" {
+		meta.Checksum, err = fileChecksum(file)
+		if err != nil {
+			file.Close()
+			return nil, Metadata{}, false, err
+		}
+	}
+
+	return file, meta, true, nil
+}
+
+func (d *fileDatabase) Put(key, value string, opts ...PutOption) error {
+	return d.PutReader(key, strings.NewReader(value), AnyVersion, opts...)
+}
+
+func (d *fileDatabase) CompareAndPut(key, value string, expectedVersion int64, opts ...PutOption) error {
+	return d.PutReader(key, strings.NewReader(value), expectedVersion, opts...)
+}
+
+// PutReader stores the content of r as value of key. The content is written to a temporary file first,
+// so the database only needs to be locked while the new value replaces the old one.
+func (d *fileDatabase) PutReader(key string, r io.Reader, expectedVersion int64, opts ...PutOption) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	path, err := d.path(key)
+	if err != nil {
+		return err
+	}
+
+	tmp, size, sum, err := d.writeTemp(d.baseDir, r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	options := ApplyPutOptions(opts...)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := d.completeBatch(); err != nil {
+		return err
+	}
+
+	now := d.now()
+	current, err := d.currentMetadata(path, now)
+	if err != nil {
+		return err
+	}
+
+	if expectedVersion >= 0 && current.Version != expectedVersion {
+		return ErrVersionMismatch
+	}
+
+	return d.commitValue(key, path, tmp, options.metadata(current, size, sum, now))
+}
+
+// commitValue replaces the value of key stored at path with the temporary file tmp.
+// If tmp is empty, only the metadata and the key file are written. The caller needs to hold the lock.
+func (d *fileDatabase) commitValue(key, path, tmp string, meta Metadata) error {
+	if err := d.makeDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	if hashedName(d.layout.name(key)) {
+		if err := d.writeFile(path+keyFileSuffix, []byte(key)); err != nil {
+			return err
+		}
+	}
+
+	// The value is committed first. The metadata records the size and modification time of the value file,
+	// so that metadata left over from the previous value by an interrupted write is detected as stale.
+	if tmp != "" {
+		if err := d.commitFile(tmp, path); err != nil {
+			return err
+		}
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	metaData, err := json.Marshal(metaFile{
+		Metadata:  meta,
+		ValueSize: stat.Size(),
+		ValueTime: stat.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := d.writeFile(path+metaFileSuffix, metaData); err != nil {
+		return err
+	}
+
+	if meta.Expires.IsZero() {
+		delete(d.expiries, key)
+	} else {
+		d.expiries[key] = meta.Expires
+	}
+
+	return nil
+}
+
+func (d *fileDatabase) Delete(key string) (bool, error) {
+	if d.readOnly {
+		return false, ErrReadOnly
+	}
+
+	path, err := d.path(key)
+	if err != nil {
+		return false, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := d.completeBatch(); err != nil {
+		return false, err
+	}
+
+	found, err := d.remove(path)
+	if err != nil {
+		return found, err
+	}
+
+	expired := d.expired(key, d.now())
+	delete(d.expiries, key)
+	return found && !expired, nil
+}
+
+// remove deletes all files belonging to the value stored at path.
+func (d *fileDatabase) remove(path string) (bool, error) {
+	err := os.Remove(path)
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	for _, suffix := range []string{metaFileSuffix, keyFileSuffix} {
+		if err := os.Remove(path + suffix); err != nil && !os.IsNotExist(err) {
+			return true, err
+		}
+	}
+
+	dir := d.removeEmptyDirs(filepath.Dir(path))
+	if d.durability >= DurabilityDirectory {
+		if err := syncDir(dir); err != nil {
+			return true, err
+		}
+	}
+
+	return true, nil
+}
+
+// removeEmptyDirs removes dir and its parents inside the base directory as long as they are empty.
+// It returns the first directory which has not been removed.
+func (d *fileDatabase) removeEmptyDirs(dir string) string {
+	base := filepath.Clean(d.baseDir)
+	for dir != base && strings.HasPrefix(dir, base) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+
+		dir = filepath.Dir(dir)
+	}
+
+	return dir
+}
+
+// makeDir creates the directory dir inside the base directory including missing parents.
+func (d *fileDatabase) makeDir(dir string) error {
+	_, err := os.Stat(dir)
+	switch {
+	case err == nil:
+		return nil
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	parent := filepath.Dir(dir)
+	if err := d.makeDir(parent); err != nil {
+		return err
+	}
+
+	if err := os.Mkdir(dir, 0777); err != nil && !os.IsExist(err) {
+		return err
+	}
+
+	if d.durability >= DurabilityDirectory {
+		return syncDir(parent)
+	}
+
+	return nil
+}
+
+// currentMetadata returns the metadata of the value stored at path.
+// The metadata is empty if there is no value.
+func (d *fileDatabase) currentMetadata(path string, now time.Time) (Metadata, error) {
+	stat, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err):
+		return Metadata{}, nil
+	case err != nil:
+		return Metadata{}, err
+	}
+
+	meta, err := readMetadata(path, stat)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	if meta.Expired(now) {
+		return Metadata{}, nil
+	}
+
+	return meta, nil
+}
+
+func (d *fileDatabase) Close() error {
+	close(d.done)
+	return d.lockFile.Close()
+}
+
+// expired checks if a key has expired according to the expiration times known to the database.
+// The caller needs to hold the lock.
+func (d *fileDatabase) expired(key string, now time.Time) bool {
+	expires, ok := d.expiries[key]
+	return ok && !now.Before(expires)
+}
+
+// sweep removes all expired values.
+func (d *fileDatabase) sweep() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := d.completeBatch(); err != nil {
+		log.Printf("Error completing batch: %s", err)
+		return
+	}
+
+	now := d.now()
+	for key := range d.expiries {
+		if !d.expired(key, now) {
+			continue
+		}
+
+		path, err := d.path(key)
+		if err == nil {
+			_, err = d.remove(path)
+		}
+
+		if err != nil {
+			log.Printf("Error removing expired key %q: %s", key, err)
+			continue
+		}
+
+		delete(d.expiries, key)
+	}
+}
+
+func (d *fileDatabase) path(key string) (string, error) {
+	if err := ValidateKey(key); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(d.baseDir, d.layout.name(key)), nil
+}
+
+// nameKey returns the key stored in the file with the given name.
+// It returns false if the file does not contain a value.
+func nameKey(dir, name string) (string, bool, error) {
+	if !isHashedName(name) {
+		key, ok := decodeName(name)
+		return key, ok, nil
+	}
+
+	return readKeyFile(filepath.Join(dir, name))
+}
+
+// readKeyFile reads the key of the value stored at path from its key file.
+// It returns false if there is no key file.
+func readKeyFile(path string) (string, bool, error) {
+	content, err := ioutil.ReadFile(path + keyFileSuffix)
 	switch {
 	case os.IsNotExist(err):
 		return "", false, nil
@@ -58,7 +609,184 @@ func (d *fileDatabase) Get(key string) (string, bool, error) {
 	return string(content), true, nil
 }
 
-func (d *fileDatabase) Put(key, value string) error {
-	path := filepath.Join(d.baseDir, key)
-	return ioutil.WriteFile(path, []byte(value), 0666)
+// writeFile atomically replaces the contents of the file at path.
+// The data is written to a temporary file in the base directory first, which then replaces the target.
+func (d *fileDatabase) writeFile(path string, data []byte) error {
+	tmp, _, _, err := d.writeTemp(d.baseDir, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+
+	if err := d.commitFile(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// writeTemp writes the content of r to a new temporary file in dir.
+// It returns the path of the file, the number of bytes written and the checksum of the content.
+func (d *fileDatabase) writeTemp(dir string, r io.Reader) (string, int64, string, error) {
+	file, err := createTemp(dir)
+	if err != nil {
+		return "", 0, "", err
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), r)
+	if err == nil && d.durability >= DurabilityFile {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return "", 0, "", err
+	}
+
+	return file.Name(), size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// commitFile replaces the file at path with the temporary file tmp.
+func (d *fileDatabase) commitFile(tmp, path string) error {
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	if d.durability >= DurabilityDirectory {
+		return syncDir(filepath.Dir(path))
+	}
+
+	return nil
+}
+
+// metaFile is the content of a metadata file. ValueSize and ValueTime identify the value file the metadata
+// has been written for.
+type metaFile struct {
+	Metadata
+	ValueSize int64     `json:"valueSize,omitempty"`
+	ValueTime time.Time `json:"valueTime,omitzero"`
+}
+
+// readMetadata reads the metadata belonging to the value stored at path, whose file is described by stat.
+// Values written by earlier versions without metadata are treated as the first version.
+//
+// Metadata which does not match the value file has been left over by a write interrupted after committing
+// the value. The value is then treated as the version following the stale metadata, without the size,
+// checksum, times and settings of the stale metadata, which are computed from the file where possible.
+func readMetadata(path string, stat os.FileInfo) (Metadata, error) {
+	content, err := ioutil.ReadFile(path + metaFileSuffix)
+	switch {
+	case os.IsNotExist(err):
+		return Metadata{Version: 1}, nil
+	case err != nil:
+		return Metadata{}, err
+	}
+
+	meta := metaFile{
+		Metadata: Metadata{
+			Version: 1,
+		},
+	}
+	if err := json.Unmarshal(content, &meta); err != nil {
+		return Metadata{}, fmt.Errorf("error reading metadata: %s", err)
+	}
+
+	if !meta.ValueTime.IsZero() && (meta.ValueSize != stat.Size() || !meta.ValueTime.Equal(stat.ModTime())) {
+		return Metadata{
+			Version: meta.Version + 1,
+			Created: meta.Created,
+		}, nil
+	}
+
+	return meta.Metadata, nil
+}
+
+// fileChecksum computes the checksum of a value written without one by an earlier version.
+// The file is read from the beginning and rewound afterwards.
+func fileChecksum(file *os.File) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// readExpiries reads the expiration times of all values stored in the database.
+func (d *fileDatabase) readExpiries() (map[string]time.Time, error) {
+	expiries := make(map[string]time.Time)
+	err := d.walk(d.baseDir, "", false, func(path, key string) error {
+		stat, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+
+		meta, err := readMetadata(path, stat)
+		if err != nil {
+			return err
+		}
+
+		if !meta.Expires.IsZero() {
+			expiries[key] = meta.Expires
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return expiries, nil
+}
+
+// removeTempFiles removes temporary files left behind by writes which have been interrupted.
+func removeTempFiles(dir string) error {
+	names, err := filepath.Glob(filepath.Join(dir, tempFilePrefix+"*"))
+	if err != nil {
+		return err
+	}
+
+	for _, n := range names {
+		if err := os.Remove(n); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createTemp(dir string) (*os.File, error) {
+	for {
+		random := make([]byte, 8)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+
+		name := filepath.Join(dir, tempFilePrefix+hex.EncodeToString(random))
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) {
+			continue
+		}
+
+		return file, err
+	}
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
 }
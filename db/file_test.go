@@ -2,10 +2,15 @@ package db
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewFileDatabase(t *testing.T) {
@@ -36,11 +41,15 @@ func TestNewFileDatabase(t *testing.T) {
 		t.Run(test.desc, func(t *testing.T) {
 			t.Parallel()
 
-			_, err := NewFileDatabase(test.path)
+			db, err := NewFileDatabase(test.path, ReadOnly())
 
 			if !reflect.DeepEqual(err, test.err) {
 				t.Errorf("got error %q, wanted %q", err, test.err)
 			}
+
+			if err == nil {
+				db.Close()
+			}
 		})
 	}
 }
@@ -48,10 +57,11 @@ func TestNewFileDatabase(t *testing.T) {
 func TestFileList(t *testing.T) {
 	expectedKeys := []string{"key1"}
 
-	db, err := NewFileDatabase("_testdata")
+	db, err := NewFileDatabase("_testdata", ReadOnly())
 	if err != nil {
 		t.Fatalf("error creating database: %s", err)
 	}
+	defer db.Close()
 
 	keys, err := db.List()
 	if err != nil {
@@ -92,12 +102,13 @@ func TestFileGet(t *testing.T) {
 		t.Run(test.desc, func(t *testing.T) {
 			t.Parallel()
 
-			db, err := NewFileDatabase("_testdata")
+			db, err := NewFileDatabase("_testdata", ReadOnly())
 			if err != nil {
 				t.Fatalf("error creating database: %s", err)
 			}
+			defer db.Close()
 
-			content, found, err := db.Get(test.key)
+			entry, found, err := db.Get(test.key)
 
 			if !reflect.DeepEqual(err, test.err) {
 				t.Errorf("got error %q, wanted %q", err, test.err)
@@ -107,8 +118,8 @@ func TestFileGet(t *testing.T) {
 				return
 			}
 
-			if content != test.content {
-				t.Errorf("got content %q, wanted %q", content, test.content)
+			if entry.Value != test.content {
+				t.Errorf("got content %q, wanted %q", entry.Value, test.content)
 			}
 
 			if found != test.found {
@@ -133,6 +144,23 @@ func TestFilePut(t *testing.T) {
 			found:   true,
 			err:     nil,
 		},
+		{
+			desc:    "path traversal",
+			key:     "../key1",
+			content: "value1",
+			found:   true,
+			err:     nil,
+		},
+		{
+			desc:    "empty key",
+			key:     "",
+			content: "value1",
+			found:   false,
+			err: &InvalidKeyError{
+				Key:    "",
+				Reason: "key can not be empty",
+			},
+		},
 	}
 
 	for _, test := range tests {
@@ -150,6 +178,7 @@ func TestFilePut(t *testing.T) {
 			if err != nil {
 				t.Fatalf("error creating database: %s", err)
 			}
+			defer db.Close()
 
 			err = db.Put(test.key, test.content)
 
@@ -159,3 +188,727 @@ func TestFilePut(t *testing.T) {
 		})
 	}
 }
+
+func TestFileDelete(t *testing.T) {
+	tests := []struct {
+		desc  string
+		store map[string]string
+		key   string
+		found bool
+		err   error
+	}{
+		{
+			desc:  "not found",
+			store: map[string]string{},
+			key:   "key1",
+			found: false,
+			err:   nil,
+		},
+		{
+			desc: "success",
+			store: map[string]string{
+				"key1": "value1",
+			},
+			key:   "key1",
+			found: true,
+			err:   nil,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			dir, err := ioutil.TempDir("", "uswd")
+			if err != nil {
+				t.Fatalf("error creating temporary directory: %s", err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := NewFileDatabase(dir)
+			if err != nil {
+				t.Fatalf("error creating database: %s", err)
+			}
+			defer db.Close()
+
+			for k, v := range test.store {
+				if err := db.Put(k, v); err != nil {
+					t.Fatalf("error storing %q: %s", k, err)
+				}
+			}
+
+			found, err := db.Delete(test.key)
+
+			if !reflect.DeepEqual(err, test.err) {
+				t.Errorf("got error %q, wanted %q", err, test.err)
+			}
+
+			if found != test.found {
+				t.Errorf("got found %v, want %v", found, test.found)
+			}
+
+			_, found, err = db.Get(test.key)
+			if err != nil {
+				t.Fatalf("got error %q, wanted none", err)
+			}
+
+			if found {
+				t.Errorf("got found %v after delete, want false", found)
+			}
+		})
+	}
+}
+
+func TestFileRoundTrip(t *testing.T) {
+	keys := []string{
+		"../../etc/passwd",
+		"a/b",
+		"a",
+		".",
+		"..",
+		"with\x00nul",
+		"schlüssel",
+		"100%",
+		"~tilde",
+		strings.Repeat("long", 100),
+		"team/service/config",
+		"team/",
+		"/leading",
+		"a//b",
+		"team/" + strings.Repeat("long", 100) + "/config",
+	}
+
+	for _, layout := range []Layout{LayoutFlat, LayoutNested, LayoutSharded} {
+		t.Run(layout.String(), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "uswd")
+			if err != nil {
+				t.Fatalf("error creating temporary directory: %s", err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := NewFileDatabase(dir, WithLayout(layout))
+			if err != nil {
+				t.Fatalf("error creating database: %s", err)
+			}
+			defer db.Close()
+
+			for _, k := range keys {
+				if err := db.Put(k, "value of "+k); err != nil {
+					t.Fatalf("error storing %q: %s", k, err)
+				}
+			}
+
+			if err := ioutil.WriteFile(filepath.Join(dir, ".stray"), []byte("stray"), 0666); err != nil {
+				t.Fatalf("error creating stray file: %s", err)
+			}
+
+			if err := os.Mkdir(filepath.Join(dir, "subdir"), 0777); err != nil {
+				t.Fatalf("error creating directory: %s", err)
+			}
+
+			listed, err := db.List()
+			if err != nil {
+				t.Fatalf("got error %q, wanted none", err)
+			}
+
+			expected := append([]string{}, keys...)
+			sort.Strings(expected)
+			if !reflect.DeepEqual(listed, expected) {
+				t.Errorf("got keys %q, wanted %q", listed, expected)
+			}
+
+			for _, k := range keys {
+				entry, found, err := db.Get(k)
+				if err != nil {
+					t.Fatalf("error getting %q: %s", k, err)
+				}
+
+				if !found || entry.Value != "value of "+k {
+					t.Errorf("got %q (found %v) for %q, wanted %q", entry.Value, found, k, "value of "+k)
+				}
+			}
+
+			if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "key1")); !os.IsNotExist(err) {
+				t.Errorf("file written outside of base directory")
+			}
+		})
+	}
+}
+
+func TestFileNestedLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewFileDatabase(dir, WithLayout(LayoutNested))
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"team/service/config", "team/service/secret", "team/readme", "other"} {
+		if err := db.Put(k, "value"); err != nil {
+			t.Fatalf("error storing %q: %s", k, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "team.d", "service.d", "config")); err != nil {
+		t.Errorf("got error %q for nested file, wanted none", err)
+	}
+
+	result, err := db.ListRange(ListOptions{
+		Prefix:    "team/",
+		Delimiter: "/",
+	})
+	if err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	expected := ListResult{
+		Keys:     []string{"team/readme"},
+		Prefixes: []string{"team/service/"},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("got result %+v, wanted %+v", result, expected)
+	}
+
+	for _, k := range []string{"team/service/config", "team/service/secret"} {
+		if _, err := db.Delete(k); err != nil {
+			t.Fatalf("error deleting %q: %s", k, err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "team.d", "service.d")); !os.IsNotExist(err) {
+		t.Errorf("got error %q for empty directory, wanted not existing", err)
+	}
+
+	result, err = db.ListRange(ListOptions{
+		Prefix: "team/service/",
+	})
+	if err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	if len(result.Keys) != 0 {
+		t.Errorf("got keys %q, wanted none", result.Keys)
+	}
+}
+
+func TestFilePutDurability(t *testing.T) {
+	for _, durability := range []Durability{DurabilityNone, DurabilityFile, DurabilityDirectory} {
+		durability := durability
+		t.Run(durability.String(), func(t *testing.T) {
+			t.Parallel()
+
+			dir, err := ioutil.TempDir("", "uswd")
+			if err != nil {
+				t.Fatalf("error creating temporary directory: %s", err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := NewFileDatabase(dir, WithDurability(durability))
+			if err != nil {
+				t.Fatalf("error creating database: %s", err)
+			}
+			defer db.Close()
+
+			for _, value := range []string{"first value", "second"} {
+				if err := db.Put("key1", value); err != nil {
+					t.Fatalf("got error %q, wanted none", err)
+				}
+
+				entry, _, err := db.Get("key1")
+				if err != nil {
+					t.Fatalf("got error %q, wanted none", err)
+				}
+
+				if entry.Value != value {
+					t.Errorf("got content %q, wanted %q", entry.Value, value)
+				}
+			}
+
+			infos, err := ioutil.ReadDir(dir)
+			if err != nil {
+				t.Fatalf("error reading directory: %s", err)
+			}
+
+			names := []string{}
+			for _, i := range infos {
+				names = append(names, i.Name())
+			}
+
+			expected := []string{lockFileName, "key1", "key1" + metaFileSuffix}
+			if !reflect.DeepEqual(names, expected) {
+				t.Errorf("got files %q in directory, wanted %q", names, expected)
+			}
+		})
+	}
+}
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+
+	expected := fmt.Errorf("directory is locked by another process: %s", dir)
+	for _, opts := range [][]FileOption{nil, {ReadOnly()}} {
+		_, err := NewFileDatabase(dir, opts...)
+		if !reflect.DeepEqual(err, expected) {
+			t.Errorf("got error %q, wanted %q", err, expected)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("error closing database: %s", err)
+	}
+
+	reader1, err := NewFileDatabase(dir, ReadOnly())
+	if err != nil {
+		t.Fatalf("error opening database read-only: %s", err)
+	}
+	defer reader1.Close()
+
+	reader2, err := NewFileDatabase(dir, ReadOnly())
+	if err != nil {
+		t.Fatalf("error opening database read-only: %s", err)
+	}
+	defer reader2.Close()
+
+	if err := reader1.Put("key1", "value1"); err != ErrReadOnly {
+		t.Errorf("got error %q, wanted %q", err, ErrReadOnly)
+	}
+
+	if _, err := reader1.Delete("key1"); err != ErrReadOnly {
+		t.Errorf("got error %q, wanted %q", err, ErrReadOnly)
+	}
+
+	_, err = NewFileDatabase(dir)
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("got error %q, wanted %q", err, expected)
+	}
+}
+
+func TestFileCompareAndPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+	defer db.Close()
+
+	if err := db.CompareAndPut("key1", "value1", 1); err != ErrVersionMismatch {
+		t.Errorf("got error %q, wanted %q", err, ErrVersionMismatch)
+	}
+
+	if err := db.CompareAndPut("key1", "value1", 0); err != nil {
+		t.Errorf("got error %q, wanted none", err)
+	}
+
+	if err := db.CompareAndPut("key1", "value2", 0); err != ErrVersionMismatch {
+		t.Errorf("got error %q, wanted %q", err, ErrVersionMismatch)
+	}
+
+	if err := db.CompareAndPut("key1", "value2", 1); err != nil {
+		t.Errorf("got error %q, wanted none", err)
+	}
+
+	if err := db.Put("key1", "value3"); err != nil {
+		t.Errorf("got error %q, wanted none", err)
+	}
+
+	entry, _, err := db.Get("key1")
+	if err != nil {
+		t.Errorf("got error %q, wanted none", err)
+	}
+
+	if entry.Value != "value3" || entry.Version != 3 {
+		t.Errorf("got value %q at version %d, wanted %q at version 3", entry.Value, entry.Version, "value3")
+	}
+
+	keys, err := db.List()
+	if err != nil {
+		t.Errorf("got error %q, wanted none", err)
+	}
+
+	if !reflect.DeepEqual(keys, []string{"key1"}) {
+		t.Errorf("got keys %q, wanted %q", keys, []string{"key1"})
+	}
+
+	if _, err := db.Delete("key1"); err != nil {
+		t.Errorf("got error %q, wanted none", err)
+	}
+
+	if err := db.CompareAndPut("key1", "value4", 0); err != nil {
+		t.Errorf("got error %q after delete, wanted none", err)
+	}
+}
+
+func TestFileExpiry(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		return now
+	}
+
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+	db.(*fileDatabase).now = clock
+
+	if err := db.Put("shortlived", "value", WithTTL(10*time.Second)); err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	if err := db.Put("permanent", "value"); err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("error closing database: %s", err)
+	}
+
+	db, err = NewFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+	defer db.Close()
+
+	fileDB := db.(*fileDatabase)
+	fileDB.now = clock
+
+	entry, found, err := db.Get("shortlived")
+	if err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	if !found || !entry.Expires.Equal(now.Add(10*time.Second)) {
+		t.Errorf("got found %v with expiry %s, wanted %s", found, entry.Expires, now.Add(10*time.Second))
+	}
+
+	now = now.Add(10 * time.Second)
+
+	if _, found, _ := db.Get("shortlived"); found {
+		t.Errorf("got found %v for expired key, wanted false", found)
+	}
+
+	keys, err := db.List()
+	if err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	if !reflect.DeepEqual(keys, []string{"permanent"}) {
+		t.Errorf("got keys %q, wanted %q", keys, []string{"permanent"})
+	}
+
+	fileDB.sweep()
+
+	if _, err := os.Stat(filepath.Join(dir, "shortlived")); !os.IsNotExist(err) {
+		t.Errorf("expired value still exists after sweep: %v", err)
+	}
+
+	if len(fileDB.expiries) != 0 {
+		t.Errorf("got %d expiration times after sweep, wanted none", len(fileDB.expiries))
+	}
+}
+
+func TestFileMetadata(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	created := now
+
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+	db.(*fileDatabase).now = func() time.Time {
+		return now
+	}
+
+	if err := db.Put("key1", "first"); err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	now = now.Add(time.Hour)
+	headers := map[string]string{
+		"X-Meta-Owner": "team",
+	}
+	if err := db.Put("key1", "{}", WithContentType("application/json"), WithHeaders(headers)); err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("error closing database: %s", err)
+	}
+
+	db, err = NewFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+	defer db.Close()
+
+	entry, _, err := db.Get("key1")
+	if err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	expected := Metadata{
+		Version:     2,
+		Size:        2,
+		Checksum:    "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+		ContentType: "application/json",
+		Created:     created,
+		Modified:    now,
+		Headers:     headers,
+	}
+	if !reflect.DeepEqual(entry.Metadata, expected) {
+		t.Errorf("got metadata %+v, wanted %+v", entry.Metadata, expected)
+	}
+
+	keys, err := db.List()
+	if err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	if !reflect.DeepEqual(keys, []string{"key1"}) {
+		t.Errorf("got keys %q, wanted %q", keys, []string{"key1"})
+	}
+}
+
+func TestFileBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewFileDatabase(dir, WithLayout(LayoutNested))
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+	defer db.Close()
+
+	if err := db.Put("team/key1", "value1"); err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	err = db.Batch([]Op{
+		PutOp("team/key2", "value2"),
+		CompareAndDeleteOp("team/key1", 2),
+	})
+	expectedErr := &BatchError{Index: 1, Key: "team/key1", Err: ErrVersionMismatch}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("got error %q, wanted %q", err, expectedErr)
+	}
+
+	err = db.Batch([]Op{
+		PutOp("team/key2", "value2", WithTTL(time.Hour)),
+		CompareAndDeleteOp("team/key1", 1),
+		PutOp("other", "value3"),
+	})
+	if err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	keys, err := db.List()
+	if err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	expectedKeys := []string{"other", "team/key2"}
+	if !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("got keys %q, wanted %q", keys, expectedKeys)
+	}
+
+	entry, _, err := db.Get("team/key2")
+	if err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	if entry.Value != "value2" || entry.Expires.IsZero() {
+		t.Errorf("got value %q expiring at %s, wanted %q with expiry", entry.Value, entry.Expires, "value2")
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, ".[bt]*"))
+	if err != nil {
+		t.Fatalf("error listing files: %s", err)
+	}
+
+	if len(files) != 0 {
+		t.Errorf("got files %q left behind, wanted none", files)
+	}
+}
+
+func TestFileBatchRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+
+	for _, k := range []string{"key1", "key2"} {
+		if err := db.Put(k, "old"); err != nil {
+			t.Fatalf("got error %q, wanted none", err)
+		}
+	}
+	db.Close()
+
+	// The journal of a batch, which has been interrupted before it has been applied.
+	if err := ioutil.WriteFile(filepath.Join(dir, ".tmp-batch"), []byte("new"), 0666); err != nil {
+		t.Fatalf("error writing value: %s", err)
+	}
+
+	journal := `[{"key":"key1","temp":".tmp-batch","metadata":{"version":2,"size":3}},{"key":"key2","metadata":{"version":0}}]`
+	if err := ioutil.WriteFile(filepath.Join(dir, journalFileName), []byte(journal), 0666); err != nil {
+		t.Fatalf("error writing journal: %s", err)
+	}
+
+	db, err = NewFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("error opening database: %s", err)
+	}
+	defer db.Close()
+
+	keys, err := db.List()
+	if err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	if !reflect.DeepEqual(keys, []string{"key1"}) {
+		t.Errorf("got keys %q, wanted %q", keys, []string{"key1"})
+	}
+
+	entry, _, err := db.Get("key1")
+	if err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	if entry.Value != "new" || entry.Version != 2 {
+		t.Errorf("got value %q at version %d, wanted %q at version 2", entry.Value, entry.Version, "new")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, journalFileName)); !os.IsNotExist(err) {
+		t.Errorf("got error %q for journal, wanted not existing", err)
+	}
+}
+
+func TestFileBatchApplyFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	database, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+	defer database.Close()
+
+	// A directory in place of the value of key2 makes applying the batch fail between key1 and key3.
+	blocker := filepath.Join(dir, LayoutFlat.name("key2"))
+	if err := os.MkdirAll(filepath.Join(blocker, "file"), 0777); err != nil {
+		t.Fatalf("error creating directory: %s", err)
+	}
+
+	if err := database.Batch([]Op{PutOp("key1", "batch"), PutOp("key2", "batch"), PutOp("key3", "batch")}); err == nil {
+		t.Fatal("got no error, wanted error")
+	}
+
+	if err := os.RemoveAll(blocker); err != nil {
+		t.Fatalf("error removing directory: %s", err)
+	}
+
+	// The next change completes the batch first, so that it is not lost and not applied after the change.
+	if err := database.Batch([]Op{PutOp("key2", "second")}); err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	for key, want := range map[string]string{"key1": "batch", "key2": "second", "key3": "batch"} {
+		entry, found, err := database.Get(key)
+		if err != nil || !found {
+			t.Fatalf("got %v and error %v for %s, wanted value", found, err, key)
+		}
+
+		if entry.Value != want {
+			t.Errorf("got value %q for %s, wanted %q", entry.Value, key, want)
+		}
+	}
+}
+
+func TestFileInterruptedPut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+
+	if err := db.Put("key1", "old", WithContentType("text/plain")); err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+	db.Close()
+
+	// A write interrupted after committing the value, but before writing its metadata.
+	if err := ioutil.WriteFile(filepath.Join(dir, "key1"), []byte("newer"), 0666); err != nil {
+		t.Fatalf("error writing value: %s", err)
+	}
+
+	db, err = NewFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("error opening database: %s", err)
+	}
+	defer db.Close()
+
+	entry, _, err := db.Get("key1")
+	if err != nil {
+		t.Fatalf("got error %q, wanted none", err)
+	}
+
+	if entry.Value != "newer" || entry.Version != 2 || entry.Size != 5 || entry.ContentType != "" {
+		t.Errorf("got value %q at version %d with size %d and content type %q, wanted %q at version 2", entry.Value, entry.Version, entry.Size, entry.ContentType, "newer")
+	}
+
+	checksum := "804f51f71254c4081e37e7c887073560f4a6fa6cdad202e9ac67e032c43ed1e1"
+	if entry.Checksum != checksum {
+		t.Errorf("got checksum %q, wanted %q", entry.Checksum, checksum)
+	}
+
+	if err := db.CompareAndPut("key1", "newest", 2); err != nil {
+		t.Errorf("got error %q, wanted none", err)
+	}
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+// The file backend derives file names from keys using a reversible encoding:
+// ASCII letters, digits, "-" and "_" are used verbatim, every other byte of the
+// key is written as "%XX". Encoded names never contain a ".", so names
+// containing one are free to be used for auxiliary and temporary files.
+//
+// Encoded names longer than maxNameLength are replaced by hashPrefix followed
+// by the hex-encoded SHA-256 hash of the key. The original key is then kept in
+// a file with keyFileSuffix next to the value.
+//
+// The metadata of a value is stored in a file with metaFileSuffix.
+const (
+	maxNameLength  = 200
+	hashPrefix     = "~"
+	keyFileSuffix  = ".key"
+	metaFileSuffix = ".meta"
+)
+
+const upperHex = "0123456789ABCDEF"
+
+// encodeKey returns the file name used for storing key.
+func encodeKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if verbatimNameChar(c) {
+			b.WriteByte(c)
+			continue
+		}
+
+		b.WriteByte('%')
+		b.WriteByte(upperHex[c>>4])
+		b.WriteByte(upperHex[c&0xF])
+	}
+
+	if b.Len() > maxNameLength {
+		hash := sha256.Sum256([]byte(key))
+		return hashPrefix + hex.EncodeToString(hash[:])
+	}
+
+	return b.String()
+}
+
+// decodeName returns the key stored in a file with the given name. It returns false
+// if the name is not a valid encoded key. Hashed names can not be decoded.
+func decodeName(name string) (string, bool) {
+	if name == "" || len(name) > maxNameLength {
+		return "", false
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case verbatimNameChar(c):
+			b.WriteByte(c)
+		case c == '%' && i+2 < len(name):
+			hi := strings.IndexByte(upperHex, name[i+1])
+			lo := strings.IndexByte(upperHex, name[i+2])
+			if hi < 0 || lo < 0 {
+				return "", false
+			}
+
+			decoded := byte(hi<<4 | lo)
+			if verbatimNameChar(decoded) {
+				return "", false
+			}
+
+			b.WriteByte(decoded)
+			i += 2
+		default:
+			return "", false
+		}
+	}
+
+	return b.String(), true
+}
+
+// auxiliaryBase returns the name of the value a file with the given name belongs to.
+// It returns false if the name is not the name of an auxiliary file.
+func auxiliaryBase(name string) (string, bool) {
+	if strings.HasSuffix(name, keyFileSuffix) {
+		base := strings.TrimSuffix(name, keyFileSuffix)
+		return base, isHashedName(base)
+	}
+
+	if strings.HasSuffix(name, metaFileSuffix) {
+		base := strings.TrimSuffix(name, metaFileSuffix)
+		if _, ok := decodeName(base); ok || isHashedName(base) {
+			return base, true
+		}
+	}
+
+	return "", false
+}
+
+func isHashedName(name string) bool {
+	if !strings.HasPrefix(name, hashPrefix) {
+		return false
+	}
+
+	hash, err := hex.DecodeString(name[len(hashPrefix):])
+	return err == nil && len(hash) == sha256.Size
+}
+
+func verbatimNameChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return true
+	case c >= 'A' && c <= 'Z':
+		return true
+	case c >= '0' && c <= '9':
+		return true
+	case c == '-', c == '_':
+		return true
+	}
+
+	return false
+}
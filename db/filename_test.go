@@ -0,0 +1,97 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEncodeKey(t *testing.T) {
+	tests := []struct {
+		desc   string
+		key    string
+		name   string
+		hashed bool
+	}{
+		{
+			desc: "verbatim",
+			key:  "Key_1-a",
+			name: "Key_1-a",
+		},
+		{
+			desc: "dots",
+			key:  "..",
+			name: "%2E%2E",
+		},
+		{
+			desc: "path",
+			key:  "a/b",
+			name: "a%2Fb",
+		},
+		{
+			desc: "percent",
+			key:  "100%",
+			name: "100%25",
+		},
+		{
+			desc: "unicode",
+			key:  "ü",
+			name: "%C3%BC",
+		},
+		{
+			desc:   "long",
+			key:    strings.Repeat("a", maxNameLength+1),
+			hashed: true,
+		},
+		{
+			desc:   "long after encoding",
+			key:    strings.Repeat(".", maxNameLength/3+1),
+			hashed: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			name := encodeKey(test.key)
+			if isHashedName(name) != test.hashed {
+				t.Errorf("got hashed %v for %q, want %v", isHashedName(name), name, test.hashed)
+			}
+
+			if test.hashed {
+				return
+			}
+
+			if name != test.name {
+				t.Errorf("got name %q, want %q", name, test.name)
+			}
+
+			key, ok := decodeName(name)
+			if !ok {
+				t.Fatalf("could not decode %q", name)
+			}
+
+			if key != test.key {
+				t.Errorf("got key %q, want %q", key, test.key)
+			}
+		})
+	}
+}
+
+func TestDecodeNameInvalid(t *testing.T) {
+	for _, name := range []string{
+		"",
+		".lock",
+		"key.key",
+		"%2",
+		"%zz",
+		"%2e",
+		"%41",
+		"~abc",
+	} {
+		if key, ok := decodeName(name); ok {
+			t.Errorf("decoded invalid name %q to %q", name, key)
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+const defaultHistoryVersions = 10
+
+// ErrNoHistory is returned when restoring a value of a database, which does not keep a history.
+var ErrNoHistory = errors.New("database does not keep a history")
+
+// Versioned is implemented by databases, which keep earlier values of their keys.
+type Versioned interface {
+	// Revisions returns the revisions kept for key, starting with the oldest one.
+	Revisions(key string) ([]HistoryEntry, error)
+	// GetRevision returns the value of key at a revision.
+	GetRevision(key string, revision uint64) (entry Entry, found bool, err error)
+	// GetAt returns the value key had at the given time.
+	GetAt(key string, at time.Time) (entry Entry, found bool, err error)
+}
+
+// Wrapper is implemented by databases, which add functionality to another database.
+type Wrapper interface {
+	Unwrap() Database
+}
+
+// HistoryEntry is a revision of a key.
+type HistoryEntry struct {
+	// Revision numbers the changes of a key. It is not reset when the key is deleted.
+	Revision uint64 `json:"revision"`
+	// Time is the time the revision has been created.
+	Time time.Time `json:"time"`
+	// Deleted is set for revisions, which deleted the key.
+	Deleted bool `json:"deleted,omitempty"`
+	// Value is encoded using base64 in JSON, so that binary values are preserved.
+	Value    []byte   `json:"value,omitempty"`
+	Metadata Metadata `json:"metadata,omitzero"`
+}
+
+// historyIndex is stored in the archive for every key with a history. Every revision is stored as its own
+// value, so that recording a revision does not depend on the number of revisions kept. The value of a revision
+// is stored separately from its description, so that it is streamed into the archive.
+type historyIndex struct {
+	Key string `json:"key"`
+	// First is the oldest revision kept.
+	First uint64 `json:"first"`
+	// Last is the latest revision assigned to the key.
+	Last uint64 `json:"last"`
+	// Deleted, Version and Modified describe the latest revision, so that it does not need to be read for
+	// comparing it with the current value.
+	Deleted  bool      `json:"deleted,omitempty"`
+	Version  int64     `json:"version,omitempty"`
+	Modified time.Time `json:"modified,omitzero"`
+}
+
+// History wraps a database and keeps the revisions of the keys changed through it in an archive, which is
+// another database. The archive contains an index for every key, which is stored under the hash of the key,
+// and a description and a value for every revision.
+//
+// Before a key is changed, its current state is recorded if it differs from its latest revision. This seeds
+// the history of keys written before the history has been enabled and records changes, whose revision has been
+// lost in a crash, with the next change of the key. Values removed after they expired are not recorded.
+type History struct {
+	Database
+	archive  Database
+	versions int
+	window   time.Duration
+	now      func() time.Time
+	keys     keyLocks
+}
+
+// HistoryOption changes the configuration of a history.
+type HistoryOption func(h *History)
+
+// WithVersions sets the number of revisions kept for every key. The default of 10 is used unless the number
+// is positive.
+func WithVersions(versions int) HistoryOption {
+	return func(h *History) {
+		h.versions = versions
+	}
+}
+
+// WithWindow limits the revisions to the ones, which have been current during the window. The latest revision
+// is always kept. Revisions are removed when the key is changed. Zero disables the limit, which is the default.
+func WithWindow(window time.Duration) HistoryOption {
+	return func(h *History) {
+		h.window = window
+	}
+}
+
+// NewHistory creates a history of the changes made to database, which is kept in archive.
+func NewHistory(database, archive Database, opts ...HistoryOption) *History {
+	h := &History{
+		Database: database,
+		archive:  archive,
+		versions: defaultHistoryVersions,
+		now:      time.Now,
+	}
+	for _, o := range opts {
+		o(h)
+	}
+
+	if h.versions <= 0 {
+		h.versions = defaultHistoryVersions
+	}
+
+	return h
+}
+
+// Unwrap returns the database, which is wrapped by the history.
+func (h *History) Unwrap() Database {
+	return h.Database
+}
+
+func (h *History) Revisions(key string) ([]HistoryEntry, error) {
+	index, err := h.loadIndex(key)
+	if err != nil || index.Last == 0 {
+		return []HistoryEntry{}, err
+	}
+
+	entries := []HistoryEntry{}
+	for revision := index.First; revision <= index.Last; revision++ {
+		e, found, err := h.loadRevision(key, revision)
+		if err == nil && found {
+			err = h.loadValue(key, &e)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			entries = append(entries, e)
+		}
+	}
+
+	return entries, nil
+}
+
+func (h *History) GetRevision(key string, revision uint64) (Entry, bool, error) {
+	index, err := h.loadIndex(key)
+	if err != nil || revision < index.First || revision > index.Last {
+		return Entry{}, false, err
+	}
+
+	e, found, err := h.loadRevision(key, revision)
+	if err != nil || !found {
+		return Entry{}, false, err
+	}
+
+	if err := h.loadValue(key, &e); err != nil {
+		return Entry{}, false, err
+	}
+
+	return e.entry()
+}
+
+func (h *History) GetAt(key string, at time.Time) (Entry, bool, error) {
+	index, err := h.loadIndex(key)
+	if err != nil || index.Last == 0 {
+		return Entry{}, false, err
+	}
+
+	for revision := index.Last; revision >= index.First; revision-- {
+		e, found, err := h.loadRevision(key, revision)
+		if err != nil {
+			return Entry{}, false, err
+		}
+
+		if !found || e.Time.After(at) {
+			continue
+		}
+
+		if e.Metadata.Expired(at) {
+			return Entry{}, false, nil
+		}
+
+		if err := h.loadValue(key, &e); err != nil {
+			return Entry{}, false, err
+		}
+
+		return e.entry()
+	}
+
+	return Entry{}, false, nil
+}
+
+// entry returns the value of the revision.
+func (e HistoryEntry) entry() (Entry, bool, error) {
+	if e.Deleted {
+		return Entry{}, false, nil
+	}
+
+	return Entry{
+		Value:    string(e.Value),
+		Metadata: e.Metadata,
+	}, true, nil
+}
+
+func (h *History) Put(key, value string, opts ...PutOption) error {
+	return h.change(func() error {
+		return h.Database.Put(key, value, opts...)
+	}, key)
+}
+
+func (h *History) CompareAndPut(key, value string, expectedVersion int64, opts ...PutOption) error {
+	return h.change(func() error {
+		return h.Database.CompareAndPut(key, value, expectedVersion, opts...)
+	}, key)
+}
+
+func (h *History) Delete(key string) (bool, error) {
+	found := false
+	err := h.change(func() error {
+		var err error
+		found, err = h.Database.Delete(key)
+		return err
+	}, key)
+
+	return found, err
+}
+
+func (h *History) Batch(ops []Op) error {
+	keys := make([]string, 0, len(ops))
+	for _, op := range ops {
+		keys = append(keys, op.Key)
+	}
+
+	return h.change(func() error {
+		return h.Database.Batch(ops)
+	}, uniqueKeys(keys)...)
+}
+
+// GetReader streams the value of key if the wrapped database supports it.
+func (h *History) GetReader(key string) (ValueReader, Metadata, bool, error) {
+	return GetReader(h.Database, key)
+}
+
+// PutReader streams the value of key if the wrapped database supports it. The value is also streamed into
+// the archive if both databases support it.
+func (h *History) PutReader(key string, r io.Reader, expectedVersion int64, opts ...PutOption) error {
+	return h.change(func() error {
+		return PutReader(h.Database, key, r, expectedVersion, opts...)
+	}, key)
+}
+
+// change applies a change to the keys and records their state before and after the change.
+func (h *History) change(apply func() error, keys ...string) error {
+	for _, key := range keys {
+		if err := ValidateKey(key); err != nil {
+			// Let the database report the invalid key.
+			return apply()
+		}
+	}
+
+	defer h.keys.acquire(keys...)()
+
+	indexes := make([]historyIndex, len(keys))
+	for i, key := range keys {
+		index, err := h.loadIndex(key)
+		if err != nil {
+			return err
+		}
+
+		if err := h.record(&index, key, true); err != nil {
+			return err
+		}
+
+		indexes[i] = index
+	}
+
+	if err := apply(); err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		if err := h.record(&indexes[i], key, false); err != nil {
+			log.Printf("Error saving history of %q: %s", key, err)
+		}
+	}
+
+	return nil
+}
+
+// record adds the current state of key to its history, if it differs from the latest revision. Revisions
+// recorded before a change get the modification time of the value.
+func (h *History) record(index *historyIndex, key string, before bool) error {
+	reader, meta, found, err := GetReader(h.Database, key)
+	if err != nil {
+		return err
+	}
+
+	if found {
+		defer reader.Close()
+	}
+
+	if index.Last == 0 && !found {
+		return nil
+	}
+
+	if index.Last > 0 {
+		switch {
+		case !found && index.Deleted:
+			return nil
+		case found && !index.Deleted && index.Version == meta.Version && index.Modified.Equal(meta.Modified):
+			return nil
+		}
+	}
+
+	e := HistoryEntry{
+		Revision: index.Last + 1,
+		Time:     h.now(),
+		Deleted:  !found,
+	}
+	if found {
+		e.Metadata = meta
+		if before && !meta.Modified.IsZero() {
+			e.Time = meta.Modified
+		}
+
+		if err := PutReader(h.archive, valueKey(key, e.Revision), reader, AnyVersion, WithContentType(meta.ContentType)); err != nil {
+			return err
+		}
+	}
+
+	// The revision is written before the index, so that the index never refers to a missing revision. A revision
+	// written without updating the index is overwritten by the next one.
+	if err := h.saveRevision(key, e); err != nil {
+		return err
+	}
+
+	if index.Last == 0 {
+		index.Key = key
+		index.First = e.Revision
+	}
+	index.Last = e.Revision
+	index.Deleted = e.Deleted
+	index.Version = e.Metadata.Version
+	index.Modified = e.Metadata.Modified
+
+	removed, err := h.trim(index, key)
+	if err != nil {
+		return err
+	}
+
+	if err := h.saveIndex(*index); err != nil {
+		return err
+	}
+
+	for _, revision := range removed {
+		for _, k := range []string{revisionKey(key, revision), valueKey(key, revision)} {
+			if _, err := h.archive.Delete(k); err != nil {
+				log.Printf("Error removing revision %d of %q: %s", revision, key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// trim advances the first revision of the index past the revisions exceeding the number of versions or the
+// window. It returns the removed revisions.
+func (h *History) trim(index *historyIndex, key string) ([]uint64, error) {
+	removed := []uint64{}
+	for index.Last-index.First+1 > uint64(h.versions) {
+		removed = append(removed, index.First)
+		index.First++
+	}
+
+	if h.window > 0 {
+		threshold := h.now().Add(-h.window)
+		for index.First < index.Last {
+			next, found, err := h.loadRevision(key, index.First+1)
+			if err != nil {
+				return nil, err
+			}
+
+			if found && !next.Time.Before(threshold) {
+				break
+			}
+
+			removed = append(removed, index.First)
+			index.First++
+		}
+	}
+
+	return removed, nil
+}
+
+// indexKey returns the key of the index of key in the archive. Keys are hashed, so that the keys of the
+// revisions do not exceed the maximum length.
+func indexKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// revisionKey returns the key of a revision of key in the archive.
+func revisionKey(key string, revision uint64) string {
+	return fmt.Sprintf("%s/%020d", indexKey(key), revision)
+}
+
+// valueKey returns the key of the value of a revision of key in the archive.
+func valueKey(key string, revision uint64) string {
+	return revisionKey(key, revision) + "/value"
+}
+
+// loadIndex reads the index of key from the archive.
+func (h *History) loadIndex(key string) (historyIndex, error) {
+	index := historyIndex{}
+	entry, found, err := h.archive.Get(indexKey(key))
+	if err != nil || !found {
+		return index, err
+	}
+
+	if err := json.Unmarshal([]byte(entry.Value), &index); err != nil {
+		return index, fmt.Errorf("error decoding history of %q: %s", key, err)
+	}
+
+	return index, nil
+}
+
+func (h *History) saveIndex(index historyIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	return h.archive.Put(indexKey(index.Key), string(data), WithContentType("application/json"))
+}
+
+// loadRevision reads the description of a revision of key from the archive, without its value.
+func (h *History) loadRevision(key string, revision uint64) (HistoryEntry, bool, error) {
+	e := HistoryEntry{}
+	entry, found, err := h.archive.Get(revisionKey(key, revision))
+	if err != nil || !found {
+		return e, false, err
+	}
+
+	if err := json.Unmarshal([]byte(entry.Value), &e); err != nil {
+		return e, false, fmt.Errorf("error decoding revision %d of %q: %s", revision, key, err)
+	}
+
+	return e, true, nil
+}
+
+// loadValue reads the value of a revision, which did not delete the key, from the archive. Revisions recorded
+// by earlier versions contain their value in the description and have no separate value.
+func (h *History) loadValue(key string, e *HistoryEntry) error {
+	if e.Deleted || e.Value != nil {
+		return nil
+	}
+
+	entry, found, err := h.archive.Get(valueKey(key, e.Revision))
+	if err != nil || !found {
+		return err
+	}
+
+	e.Value = []byte(entry.Value)
+	return nil
+}
+
+// saveRevision writes the description of a revision, whose value has been written before.
+func (h *History) saveRevision(key string, e HistoryEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return h.archive.Put(revisionKey(key, e.Revision), string(data), WithContentType("application/json"))
+}
+
+// Close closes the wrapped database and the archive.
+func (h *History) Close() error {
+	err := h.Database.Close()
+	if archiveErr := h.archive.Close(); err == nil {
+		err = archiveErr
+	}
+
+	return err
+}
+
+// FindVersioned returns the first database implementing Versioned, following the databases wrapped by database.
+func FindVersioned(database Database) (Versioned, bool) {
+	found, ok := find(database, func(d Database) bool {
+		_, ok := d.(Versioned)
+		return ok
+	})
+	if !ok {
+		return nil, false
+	}
+
+	return found.(Versioned), true
+}
+
+// find returns the first database matching, following the databases wrapped by database.
+func find(database Database, match func(d Database) bool) (Database, bool) {
+	for {
+		if match(database) {
+			return database, true
+		}
+
+		wrapper, ok := database.(Wrapper)
+		if !ok {
+			return nil, false
+		}
+
+		database = wrapper.Unwrap()
+	}
+}
+
+// Restore stores the value of key at a revision as its current value again. The value is written to database,
+// so that the change passes through all databases wrapping the history. The value does not expire.
+func Restore(database Database, key string, revision uint64) error {
+	versioned, ok := FindVersioned(database)
+	if !ok {
+		return ErrNoHistory
+	}
+
+	entry, found, err := versioned.GetRevision(key, revision)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return ErrRevisionUnavailable
+	}
+
+	opts := []PutOption{WithHeaders(entry.Headers)}
+	if entry.ContentType != "" {
+		opts = append(opts, WithContentType(entry.ContentType))
+	}
+
+	return database.Put(key, entry.Value, opts...)
+}
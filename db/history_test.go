@@ -0,0 +1,260 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testClock is a clock, which only changes when it is advanced.
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func TestHistory(t *testing.T) {
+	database := NewMemoryDatabase()
+	database.Put("old", "written before")
+
+	history := NewHistory(database, NewMemoryDatabase(), WithVersions(3))
+	defer history.Close()
+
+	history.Put("old", "first change")
+	history.Put("key", "one")
+	history.CompareAndPut("key", "two", 1)
+	history.CompareAndPut("key", "ignored", 1)
+	history.Delete("key")
+	history.Delete("key")
+	history.Batch([]Op{
+		PutOp("key", "three"),
+		DeleteOp("missing"),
+	})
+
+	type summary struct {
+		Revision uint64
+		Deleted  bool
+		Value    string
+	}
+
+	for _, test := range []struct {
+		key       string
+		revisions []summary
+	}{
+		{
+			key: "old",
+			revisions: []summary{
+				{1, false, "written before"},
+				{2, false, "first change"},
+			},
+		},
+		{
+			key: "key",
+			revisions: []summary{
+				{2, false, "two"},
+				{3, true, ""},
+				{4, false, "three"},
+			},
+		},
+		{
+			key:       "missing",
+			revisions: []summary{},
+		},
+	} {
+		entries, err := history.Revisions(test.key)
+		if err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+
+		revisions := []summary{}
+		for _, e := range entries {
+			revisions = append(revisions, summary{e.Revision, e.Deleted, string(e.Value)})
+		}
+
+		if !reflect.DeepEqual(revisions, test.revisions) {
+			t.Errorf("got revisions %+v of %q, want %+v", revisions, test.key, test.revisions)
+		}
+	}
+
+	entry, found, err := history.GetRevision("key", 2)
+	if err != nil || !found || entry.Value != "two" || entry.Version != 2 {
+		t.Errorf("got %q at version %d (found %v, error %v), want %q at version 2", entry.Value, entry.Version, found, err, "two")
+	}
+
+	for _, revision := range []uint64{1, 3, 5} {
+		if _, found, _ := history.GetRevision("key", revision); found {
+			t.Errorf("got revision %d, want not found", revision)
+		}
+	}
+}
+
+func TestHistoryGetAt(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := &testClock{now: start}
+	history := NewHistory(NewMemoryDatabase(), NewMemoryDatabase())
+	history.now = clock.Now
+	defer history.Close()
+
+	// The revisions are created at minutes one to three.
+	clock.Advance(time.Minute)
+	history.Put("key", "one")
+	clock.Advance(time.Minute)
+	history.Put("key", "two")
+	clock.Advance(time.Minute)
+	history.Delete("key")
+
+	for _, test := range []struct {
+		at    time.Duration
+		value string
+		found bool
+	}{
+		{at: 0, found: false},
+		{at: 90 * time.Second, value: "one", found: true},
+		{at: 2 * time.Minute, value: "two", found: true},
+		{at: 3 * time.Minute, found: false},
+	} {
+		entry, found, err := history.GetAt("key", start.Add(test.at))
+		if err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+
+		if found != test.found || entry.Value != test.value {
+			t.Errorf("got %q (found %v) at %s, want %q (found %v)", entry.Value, found, test.at, test.value, test.found)
+		}
+	}
+}
+
+func TestHistoryWindow(t *testing.T) {
+	clock := &testClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	history := NewHistory(NewMemoryDatabase(), NewMemoryDatabase(), WithWindow(90*time.Second))
+	history.now = clock.Now
+	defer history.Close()
+
+	for _, value := range []string{"one", "two", "three", "four"} {
+		clock.Advance(time.Minute)
+		history.Put("key", value)
+	}
+
+	entries, _ := history.Revisions("key")
+	values := []string{}
+	for _, e := range entries {
+		values = append(values, string(e.Value))
+	}
+
+	// Revision two has been replaced within the window.
+	expected := []string{"two", "three", "four"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("got values %q, want %q", values, expected)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	history := NewHistory(NewMemoryDatabase(), NewMemoryDatabase())
+	hub := NewHub(history)
+	defer hub.Close()
+
+	hub.Put("key", "one", WithContentType("text/plain"))
+	hub.Put("key", "two")
+
+	if err := Restore(hub, "key", 1); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	entry, _, _ := hub.Get("key")
+	if entry.Value != "one" || entry.ContentType != "text/plain" || entry.Version != 3 {
+		t.Errorf("got %q (%q) at version %d, want %q (%q) at version 3", entry.Value, entry.ContentType, entry.Version, "one", "text/plain")
+	}
+
+	if hub.Revision() != 3 {
+		t.Errorf("got hub revision %d, want 3", hub.Revision())
+	}
+
+	if err := Restore(hub, "key", 10); err != ErrRevisionUnavailable {
+		t.Errorf("got error %v, want %q", err, ErrRevisionUnavailable)
+	}
+
+	if err := Restore(NewMemoryDatabase(), "key", 1); err != ErrNoHistory {
+		t.Errorf("got error %v, want %q", err, ErrNoHistory)
+	}
+}
+
+func TestHistoryArchive(t *testing.T) {
+	database := NewMemoryDatabase()
+	archive := NewMemoryDatabase()
+	history := NewHistory(database, archive, WithVersions(2))
+	defer history.Close()
+
+	history.Put("key", "one")
+	history.Put("key", "two")
+
+	// A change, which has not been recorded, is recorded before the next change.
+	database.Put("key", "unrecorded")
+	history.Put("key", "three")
+
+	entries, err := history.Revisions("key")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	values := []string{}
+	for _, e := range entries {
+		values = append(values, string(e.Value))
+	}
+
+	expected := []string{"unrecorded", "three"}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("got values %q, want %q", values, expected)
+	}
+
+	// The archive contains the index and a description and a value for every revision kept.
+	keys, err := archive.List()
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if len(keys) != 5 {
+		t.Errorf("got %d keys in archive, want 5", len(keys))
+	}
+}
+
+func TestHistoryInlineValue(t *testing.T) {
+	archive := NewMemoryDatabase()
+	history := NewHistory(NewMemoryDatabase(), archive)
+	defer history.Close()
+
+	history.Put("key", "one")
+
+	// Earlier versions stored the value in the description of a revision.
+	if _, err := archive.Delete(valueKey("key", 1)); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	e, _, err := history.loadRevision("key", 1)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	e.Value = []byte("inline")
+	if err := history.saveRevision("key", e); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	entry, found, err := history.GetRevision("key", 1)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if !found {
+		t.Fatal("got no revision, want one")
+	}
+
+	if entry.Value != "inline" {
+		t.Errorf("got value %q, want %q", entry.Value, "inline")
+	}
+}
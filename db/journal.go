@@ -0,0 +1,173 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// journalFileName is the name of the redo journal of the file backend. A batch is committed as soon as its
+// journal has been written. Batches which have been interrupted afterwards are completed when the
+// directory is opened again.
+const journalFileName = ".batch"
+
+// journalEntry is the change of a single key recorded in the journal.
+type journalEntry struct {
+	Key string `json:"key"`
+	// Temp is the name of the temporary file containing the new value. It is empty if the key is deleted.
+	Temp     string   `json:"temp,omitempty"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// Batch writes the new values to temporary files and records the changes in the journal before applying them.
+func (d *fileDatabase) Batch(ops []Op) error {
+	if d.readOnly {
+		return ErrReadOnly
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if err := d.completeBatch(); err != nil {
+		return err
+	}
+
+	now := d.now()
+	changes, err := planBatch(ops, now, func(key string) (Metadata, error) {
+		path, err := d.path(key)
+		if err != nil {
+			return Metadata{}, err
+		}
+
+		return d.currentMetadata(path, now)
+	})
+	if err != nil {
+		return err
+	}
+
+	// The temporary files are kept once the journal is written, so that the batch can be completed later.
+	entries := []journalEntry{}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+
+		for _, e := range entries {
+			if e.Temp != "" {
+				os.Remove(filepath.Join(d.baseDir, e.Temp))
+			}
+		}
+	}()
+
+	for _, c := range changes {
+		entry := journalEntry{
+			Key:      c.key,
+			Metadata: c.meta,
+		}
+
+		if c.meta.Version > 0 {
+			tmp, _, _, err := d.writeTemp(d.baseDir, strings.NewReader(ops[c.op].Value))
+			if err != nil {
+				return err
+			}
+
+			entry.Temp = filepath.Base(tmp)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	journal, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	if err := d.writeFile(filepath.Join(d.baseDir, journalFileName), journal); err != nil {
+		return err
+	}
+	committed = true
+
+	if err := d.applyJournal(entries); err != nil {
+		d.pending = true
+		return err
+	}
+
+	return nil
+}
+
+// completeBatch completes a committed batch, which could not be applied completely, so that later changes
+// are made after it. The caller needs to hold the lock.
+func (d *fileDatabase) completeBatch() error {
+	if !d.pending {
+		return nil
+	}
+
+	if err := d.recoverBatch(); err != nil {
+		return fmt.Errorf("error completing earlier batch: %s", err)
+	}
+	d.pending = false
+
+	return nil
+}
+
+// recoverBatch completes a batch, which has been interrupted after writing the journal.
+func (d *fileDatabase) recoverBatch() error {
+	content, err := ioutil.ReadFile(filepath.Join(d.baseDir, journalFileName))
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	entries := []journalEntry{}
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return fmt.Errorf("error reading journal: %s", err)
+	}
+
+	return d.applyJournal(entries)
+}
+
+// applyJournal applies the changes recorded in the journal and removes it afterwards.
+// Applying the same journal again has no further effect. The caller needs to hold the lock.
+func (d *fileDatabase) applyJournal(entries []journalEntry) error {
+	for _, e := range entries {
+		path, err := d.path(e.Key)
+		if err != nil {
+			return err
+		}
+
+		if e.Temp == "" {
+			if _, err := d.remove(path); err != nil {
+				return err
+			}
+
+			delete(d.expiries, e.Key)
+			continue
+		}
+
+		// The temporary file has already been renamed, if a previous attempt got interrupted.
+		tmp := filepath.Join(d.baseDir, e.Temp)
+		if _, err := os.Stat(tmp); os.IsNotExist(err) {
+			tmp = ""
+		}
+
+		if err := d.commitValue(e.Key, path, tmp, e.Metadata); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(filepath.Join(d.baseDir, journalFileName)); err != nil {
+		return err
+	}
+
+	if d.durability >= DurabilityDirectory {
+		return syncDir(d.baseDir)
+	}
+
+	return nil
+}
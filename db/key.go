@@ -0,0 +1,42 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// MaxKeyLength is the maximum length of a key in bytes.
+const MaxKeyLength = 1024
+
+// InvalidKeyError is returned by a database when a key can not be used.
+type InvalidKeyError struct {
+	Key    string
+	Reason string
+}
+
+func (e *InvalidKeyError) Error() string {
+	return fmt.Sprintf("invalid key %q: %s", e.Key, e.Reason)
+}
+
+// ReservedKeyPrefix starts the paths of the endpoints of the server, so keys can not start with it.
+const ReservedKeyPrefix = "_"
+
+// ValidateKey checks if a key is acceptable for use in a database.
+// Any non-empty UTF-8 string up to MaxKeyLength bytes, which does not start with
+// ReservedKeyPrefix, is a valid key. Backends are responsible for mapping keys to
+// their storage safely.
+func ValidateKey(key string) error {
+	switch {
+	case key == "":
+		return &InvalidKeyError{Key: key, Reason: "key can not be empty"}
+	case len(key) > MaxKeyLength:
+		return &InvalidKeyError{Key: key, Reason: fmt.Sprintf("key is longer than %d bytes", MaxKeyLength)}
+	case !utf8.ValidString(key):
+		return &InvalidKeyError{Key: key, Reason: "key is not valid UTF-8"}
+	case strings.HasPrefix(key, ReservedKeyPrefix):
+		return &InvalidKeyError{Key: key, Reason: fmt.Sprintf("keys starting with %q are reserved", ReservedKeyPrefix)}
+	}
+
+	return nil
+}
@@ -0,0 +1,69 @@
+package db
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestValidateKey(t *testing.T) {
+	tests := []struct {
+		desc string
+		key  string
+		err  error
+	}{
+		{
+			desc: "simple",
+			key:  "key1",
+			err:  nil,
+		},
+		{
+			desc: "path",
+			key:  "../../etc/passwd",
+			err:  nil,
+		},
+		{
+			desc: "unicode",
+			key:  "schlüssel",
+			err:  nil,
+		},
+		{
+			desc: "empty",
+			key:  "",
+			err:  &InvalidKeyError{Key: "", Reason: "key can not be empty"},
+		},
+		{
+			desc: "too long",
+			key:  strings.Repeat("a", MaxKeyLength+1),
+			err:  &InvalidKeyError{Key: strings.Repeat("a", MaxKeyLength+1), Reason: "key is longer than 1024 bytes"},
+		},
+		{
+			desc: "invalid utf-8",
+			key:  "a\xffb",
+			err:  &InvalidKeyError{Key: "a\xffb", Reason: "key is not valid UTF-8"},
+		},
+		{
+			desc: "reserved",
+			key:  "_watch",
+			err:  &InvalidKeyError{Key: "_watch", Reason: `keys starting with "_" are reserved`},
+		},
+		{
+			desc: "reserved prefix in path",
+			key:  "team/_watch",
+			err:  nil,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			err := ValidateKey(test.key)
+
+			if !reflect.DeepEqual(err, test.err) {
+				t.Errorf("got error %q, want %q", err, test.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// KeySeparator separates the segments of hierarchical keys like "team/service/config".
+const KeySeparator = "/"
+
+// Layout controls how the file backend arranges values in its directory.
+type Layout int
+
+const (
+	// LayoutFlat stores all values directly in the base directory.
+	LayoutFlat Layout = iota
+	// LayoutNested stores hierarchical keys in nested directories, one for every segment of the key
+	// except the last one.
+	LayoutNested
+	// LayoutSharded spreads the values over subdirectories named after the hash of the key,
+	// so that no directory gets too large.
+	LayoutSharded
+)
+
+// The sharded layout uses shardLevels levels of directories named after the first bytes of the
+// hex-encoded SHA-256 hash of the key, shardNameLength characters per level.
+const (
+	shardLevels     = 2
+	shardNameLength = 2
+)
+
+// The nested layout names directories like the encoded segment followed by dirSuffix, so they can
+// not collide with values. Empty segments are stored as emptySegment, which is not a valid encoded name.
+const (
+	dirSuffix    = ".d"
+	emptySegment = "%"
+)
+
+var layoutNames = map[Layout]string{
+	LayoutFlat:    "flat",
+	LayoutNested:  "nested",
+	LayoutSharded: "sharded",
+}
+
+func (l Layout) String() string {
+	if name, ok := layoutNames[l]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("Layout(%d)", int(l))
+}
+
+// ParseLayout returns the layout matching a name.
+func ParseLayout(name string) (Layout, error) {
+	for l, n := range layoutNames {
+		if n == name {
+			return l, nil
+		}
+	}
+
+	return LayoutFlat, fmt.Errorf("unknown layout: %s", name)
+}
+
+// name returns the path of the file storing key relative to the base directory.
+func (l Layout) name(key string) string {
+	switch l {
+	case LayoutNested:
+		return nestedName(key)
+	case LayoutSharded:
+		return shardedName(key)
+	default:
+		return encodeKey(key)
+	}
+}
+
+func nestedName(key string) string {
+	segments := strings.Split(key, KeySeparator)
+	last := len(segments) - 1
+	for i, s := range segments {
+		segments[i] = encodeSegment(s)
+		if i < last {
+			segments[i] += dirSuffix
+		}
+	}
+
+	return filepath.Join(segments...)
+}
+
+func shardedName(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	hexHash := hex.EncodeToString(hash[:])
+
+	parts := make([]string, 0, shardLevels+1)
+	for i := 0; i < shardLevels; i++ {
+		parts = append(parts, hexHash[i*shardNameLength:(i+1)*shardNameLength])
+	}
+
+	return filepath.Join(append(parts, encodeKey(key))...)
+}
+
+// dir returns the directory relative to the base directory, which contains all keys starting with prefix.
+func (l Layout) dir(prefix string) string {
+	if l != LayoutNested {
+		return "."
+	}
+
+	i := strings.LastIndex(prefix, KeySeparator)
+	if i < 0 {
+		return "."
+	}
+
+	return filepath.Dir(l.name(prefix[:i+1]))
+}
+
+func encodeSegment(segment string) string {
+	if segment == "" {
+		return emptySegment
+	}
+
+	return encodeKey(segment)
+}
+
+// decodeSegment returns the part of a key stored in a file or directory with the given name.
+// The second return value is true, if the segment is hashed and the key needs to be read from a file.
+// It returns false if the name does not belong to a value.
+func decodeSegment(name string) (string, bool, bool) {
+	switch {
+	case name == emptySegment:
+		return "", false, true
+	case isHashedName(name):
+		return "", true, true
+	}
+
+	segment, ok := decodeName(name)
+	return segment, false, ok
+}
+
+// isShardName checks if a directory name is used by the sharded layout.
+func isShardName(name string) bool {
+	if len(name) != shardNameLength {
+		return false
+	}
+
+	for i := 0; i < len(name); i++ {
+		if strings.IndexByte("0123456789abcdef", name[i]) < 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hashedName checks if a file name relative to the base directory contains hashed segments.
+// In that case the key is kept in a separate file, because it can not be decoded from the name.
+// Encoded keys never contain the hash prefix, as it is not used verbatim.
+func hashedName(name string) bool {
+	return strings.Contains(name, hashPrefix)
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLayout(t *testing.T) {
+	tests := []struct {
+		name   string
+		layout Layout
+		err    error
+	}{
+		{
+			name:   "flat",
+			layout: LayoutFlat,
+		},
+		{
+			name:   "nested",
+			layout: LayoutNested,
+		},
+		{
+			name:   "sharded",
+			layout: LayoutSharded,
+		},
+		{
+			name:   "deep",
+			layout: LayoutFlat,
+			err:    errors.New("unknown layout: deep"),
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			layout, err := ParseLayout(test.name)
+
+			if !reflect.DeepEqual(err, test.err) {
+				t.Errorf("got error %q, want %q", err, test.err)
+			}
+
+			if layout != test.layout {
+				t.Errorf("got layout %s, want %s", layout, test.layout)
+			}
+		})
+	}
+}
+
+func TestLayoutName(t *testing.T) {
+	tests := []struct {
+		desc   string
+		layout Layout
+		key    string
+		name   string
+		hashed bool
+	}{
+		{
+			desc:   "flat",
+			layout: LayoutFlat,
+			key:    "team/config",
+			name:   "team%2Fconfig",
+		},
+		{
+			desc:   "nested",
+			layout: LayoutNested,
+			key:    "team/service/config",
+			name:   "team.d/service.d/config",
+		},
+		{
+			desc:   "empty segments",
+			layout: LayoutNested,
+			key:    "/a//",
+			name:   "%.d/a.d/%.d/%",
+		},
+		{
+			desc:   "dots",
+			layout: LayoutNested,
+			key:    "../..",
+			name:   "%2E%2E.d/%2E%2E",
+		},
+		{
+			desc:   "sharded",
+			layout: LayoutSharded,
+			key:    "team/config",
+			name:   "45/f7/team%2Fconfig",
+		},
+		{
+			desc:   "long segment",
+			layout: LayoutNested,
+			key:    strings.Repeat("a", maxNameLength+1) + "/config",
+			hashed: true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			name := test.layout.name(test.key)
+			if hashedName(name) != test.hashed {
+				t.Errorf("got hashed %v for %q, want %v", hashedName(name), name, test.hashed)
+			}
+
+			if !test.hashed && name != test.name {
+				t.Errorf("got name %q, want %q", name, test.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package db
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ErrInvalidToken is returned when a continuation token passed to ListRange can not be decoded.
+var ErrInvalidToken = errors.New("invalid continuation token")
+
+// ListOptions selects the keys returned by ListRange.
+type ListOptions struct {
+	// Prefix restricts the keys to the ones starting with the prefix.
+	Prefix string
+	// Start is the first key which is returned.
+	Start string
+	// End is the first key, which is not returned anymore.
+	End string
+	// Limit is the maximum number of keys returned. Zero means no limit.
+	Limit int
+	// Token continues a listing. It is taken from the Next field of a previous result.
+	Token string
+	// Delimiter groups keys like directories. Keys containing the delimiter after the prefix
+	// are returned once as a common prefix ending with the delimiter instead.
+	Delimiter string
+}
+
+// ListResult contains a page of keys.
+type ListResult struct {
+	Keys []string `json:"keys"`
+	// Prefixes contains the common prefixes of keys grouped using the delimiter.
+	Prefixes []string `json:"prefixes,omitempty"`
+	// Next contains a token for retrieving the next page. It is empty if there are no more keys.
+	Next string `json:"next,omitempty"`
+}
+
+// Paginate selects the keys matching opts from a sorted list of keys.
+func Paginate(keys []string, opts ListOptions) (ListResult, error) {
+	start := opts.Start
+	if opts.Prefix > start {
+		start = opts.Prefix
+	}
+
+	after := ""
+	if opts.Token != "" {
+		last, err := base64.RawURLEncoding.DecodeString(opts.Token)
+		if err != nil || len(last) == 0 {
+			return ListResult{}, ErrInvalidToken
+		}
+		after = string(last)
+	}
+
+	i := sort.SearchStrings(keys, start)
+	if after != "" && after >= start {
+		i = sort.Search(len(keys), func(i int) bool {
+			return keys[i] > after
+		})
+	}
+
+	result := ListResult{
+		Keys: []string{},
+	}
+	last := after
+	for ; i < len(keys); i++ {
+		key := keys[i]
+		if !opts.matches(key) {
+			break
+		}
+
+		prefix, grouped := opts.commonPrefix(key)
+		if grouped && prefix == last {
+			continue
+		}
+
+		if opts.Limit > 0 && len(result.Keys)+len(result.Prefixes) == opts.Limit {
+			result.Next = base64.RawURLEncoding.EncodeToString([]byte(last))
+			break
+		}
+
+		if grouped {
+			result.Prefixes = append(result.Prefixes, prefix)
+			last = prefix
+			continue
+		}
+
+		result.Keys = append(result.Keys, key)
+		last = key
+	}
+
+	return result, nil
+}
+
+// matches checks if key is within the end and prefix restrictions of the options.
+func (o ListOptions) matches(key string) bool {
+	if o.End != "" && key >= o.End {
+		return false
+	}
+
+	return strings.HasPrefix(key, o.Prefix)
+}
+
+// commonPrefix returns the prefix a key is grouped under when listing with a delimiter.
+// It returns false if the key is not grouped. The key needs to start with the prefix of the options.
+func (o ListOptions) commonPrefix(key string) (string, bool) {
+	if o.Delimiter == "" {
+		return "", false
+	}
+
+	i := strings.Index(key[len(o.Prefix):], o.Delimiter)
+	if i < 0 {
+		return "", false
+	}
+
+	return key[:len(o.Prefix)+i+len(o.Delimiter)], true
+}
@@ -0,0 +1,176 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPaginate(t *testing.T) {
+	keys := []string{"a", "b/1", "b/2", "b/3", "c", "d"}
+
+	tests := []struct {
+		desc   string
+		opts   ListOptions
+		result ListResult
+		err    error
+	}{
+		{
+			desc: "all",
+			opts: ListOptions{},
+			result: ListResult{
+				Keys: keys,
+			},
+		},
+		{
+			desc: "prefix",
+			opts: ListOptions{
+				Prefix: "b/",
+			},
+			result: ListResult{
+				Keys: []string{"b/1", "b/2", "b/3"},
+			},
+		},
+		{
+			desc: "range",
+			opts: ListOptions{
+				Start: "b/2",
+				End:   "d",
+			},
+			result: ListResult{
+				Keys: []string{"b/2", "b/3", "c"},
+			},
+		},
+		{
+			desc: "limit",
+			opts: ListOptions{
+				Limit: 2,
+			},
+			result: ListResult{
+				Keys: []string{"a", "b/1"},
+				Next: "Yi8x",
+			},
+		},
+		{
+			desc: "token",
+			opts: ListOptions{
+				Limit: 2,
+				Token: "Yi8x",
+			},
+			result: ListResult{
+				Keys: []string{"b/2", "b/3"},
+				Next: "Yi8z",
+			},
+		},
+		{
+			desc: "last page",
+			opts: ListOptions{
+				Limit: 2,
+				Token: "Yw",
+			},
+			result: ListResult{
+				Keys: []string{"d"},
+			},
+		},
+		{
+			desc: "prefix with token",
+			opts: ListOptions{
+				Prefix: "b/",
+				Limit:  2,
+				Token:  "Yi8y",
+			},
+			result: ListResult{
+				Keys: []string{"b/3"},
+			},
+		},
+		{
+			desc: "exact limit",
+			opts: ListOptions{
+				Prefix: "b/",
+				Limit:  3,
+			},
+			result: ListResult{
+				Keys: []string{"b/1", "b/2", "b/3"},
+			},
+		},
+		{
+			desc: "empty",
+			opts: ListOptions{
+				Prefix: "x",
+			},
+			result: ListResult{
+				Keys: []string{},
+			},
+		},
+		{
+			desc: "delimiter",
+			opts: ListOptions{
+				Delimiter: "/",
+			},
+			result: ListResult{
+				Keys:     []string{"a", "c", "d"},
+				Prefixes: []string{"b/"},
+			},
+		},
+		{
+			desc: "delimiter with prefix",
+			opts: ListOptions{
+				Prefix:    "b/",
+				Delimiter: "/",
+			},
+			result: ListResult{
+				Keys: []string{"b/1", "b/2", "b/3"},
+			},
+		},
+		{
+			desc: "delimiter with limit",
+			opts: ListOptions{
+				Delimiter: "/",
+				Limit:     2,
+			},
+			result: ListResult{
+				Keys:     []string{"a"},
+				Prefixes: []string{"b/"},
+				Next:     "Yi8",
+			},
+		},
+		{
+			desc: "delimiter after common prefix",
+			opts: ListOptions{
+				Delimiter: "/",
+				Limit:     2,
+				Token:     "Yi8",
+			},
+			result: ListResult{
+				Keys: []string{"c", "d"},
+			},
+		},
+		{
+			desc: "invalid token",
+			opts: ListOptions{
+				Token: "!",
+			},
+			err: ErrInvalidToken,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			result, err := Paginate(keys, test.opts)
+
+			if err != test.err {
+				t.Errorf("got error %q, want %q", err, test.err)
+			}
+
+			if err != nil {
+				return
+			}
+
+			if !reflect.DeepEqual(result, test.result) {
+				t.Errorf("got result %+v, want %+v", result, test.result)
+			}
+		})
+	}
+}
@@ -0,0 +1,23 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package db
+
+import (
+	"fmt"
+	"os"
+)
+
+// lockFile only opens the lock file on platforms without support for advisory file locks,
+// so concurrent use of a directory is not detected there.
+func lockFile(path string, exclusive bool) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil && !exclusive {
+		file, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file: %s", err)
+	}
+
+	return file, nil
+}
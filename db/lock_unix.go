@@ -0,0 +1,39 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package db
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// lockFile acquires an advisory lock on the file at path, creating it if necessary.
+// An exclusive lock fails if any other lock is held on the file, a shared lock only fails if
+// another process holds an exclusive lock.
+func lockFile(path string, exclusive bool) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil && !exclusive {
+		file, err = os.Open(path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error opening lock file: %s", err)
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errLocked
+		}
+
+		return nil, fmt.Errorf("error locking %s: %s", path, err)
+	}
+
+	return file, nil
+}
@@ -1,21 +1,52 @@
 package db
 
-import "sort"
+import (
+	"sort"
+	"sync"
+	"time"
+)
 
 type memoryDatabase struct {
-	store map[string]string
+	lock  sync.RWMutex
+	store map[string]Entry
+	now   func() time.Time
+	done  chan struct{}
+
+	// persist is called with the lock held before changes are applied.
+	// The changes are discarded if it returns an error.
+	persist func(changes []change) error
+}
+
+// change is the new state of a key. The entry of a deleted key has a zero version.
+type change struct {
+	key   string
+	entry Entry
 }
 
 // NewMemoryDatabase creates a simple in-memory key-value store.
+// It is safe for concurrent use by multiple goroutines.
 func NewMemoryDatabase() Database {
-	return &memoryDatabase{
-		store: make(map[string]string),
+	db := &memoryDatabase{
+		store: make(map[string]Entry),
+		now:   time.Now,
+		done:  make(chan struct{}),
 	}
+	go runSweeper(db.done, db.sweep)
+
+	return db
 }
 
 func (db *memoryDatabase) List() ([]string, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	now := db.timeNow()
 	keys := []string{}
-	for k := range db.store {
+	for k, e := range db.store {
+		if e.Expired(now) {
+			continue
+		}
+
 		keys = append(keys, k)
 	}
 
@@ -23,12 +54,185 @@ func (db *memoryDatabase) List() ([]string, error) {
 	return keys, nil
 }
 
-func (db *memoryDatabase) Get(key string) (string, bool, error) {
-	value, ok := db.store[key]
-	return value, ok, nil
+func (db *memoryDatabase) ListRange(opts ListOptions) (ListResult, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	now := db.timeNow()
+	keys := []string{}
+	for k, e := range db.store {
+		if k < opts.Start || !opts.matches(k) || e.Expired(now) {
+			continue
+		}
+
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return Paginate(keys, opts)
+}
+
+func (db *memoryDatabase) Get(key string) (Entry, bool, error) {
+	if err := ValidateKey(key); err != nil {
+		return Entry{}, false, err
+	}
+
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	entry, ok := db.store[key]
+	if !ok || entry.Expired(db.timeNow()) {
+		return Entry{}, false, nil
+	}
+
+	return entry, true, nil
+}
+
+func (db *memoryDatabase) Put(key, value string, opts ...PutOption) error {
+	return db.put(key, value, AnyVersion, ApplyPutOptions(opts...))
+}
+
+func (db *memoryDatabase) CompareAndPut(key, value string, expectedVersion int64, opts ...PutOption) error {
+	return db.put(key, value, expectedVersion, ApplyPutOptions(opts...))
+}
+
+// put stores a value. The version is only checked if expectedVersion is not negative.
+func (db *memoryDatabase) put(key, value string, expectedVersion int64, options PutOptions) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	now := db.timeNow()
+	current := db.store[key]
+	if current.Expired(now) {
+		current = Entry{}
+	}
+
+	if expectedVersion >= 0 && current.Version != expectedVersion {
+		return ErrVersionMismatch
+	}
+
+	entry := Entry{
+		Value:    value,
+		Metadata: options.metadata(current.Metadata, int64(len(value)), checksum(value), now),
+	}
+	if err := db.record(change{key: key, entry: entry}); err != nil {
+		return err
+	}
+
+	db.store[key] = entry
+	return nil
+}
+
+func (db *memoryDatabase) Delete(key string) (bool, error) {
+	if err := ValidateKey(key); err != nil {
+		return false, err
+	}
+
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	entry, ok := db.store[key]
+	if !ok {
+		return false, nil
+	}
+
+	if err := db.record(change{key: key}); err != nil {
+		return false, err
+	}
+
+	delete(db.store, key)
+	return !entry.Expired(db.timeNow()), nil
 }
 
-func (db *memoryDatabase) Put(key, value string) error {
-	db.store[key] = value
+func (db *memoryDatabase) Batch(ops []Op) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	now := db.timeNow()
+	changes, err := planBatch(ops, now, func(key string) (Metadata, error) {
+		entry := db.store[key]
+		if entry.Expired(now) {
+			return Metadata{}, nil
+		}
+
+		return entry.Metadata, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	applied := make([]change, 0, len(changes))
+	for _, c := range changes {
+		entry := Entry{}
+		if c.meta.Version > 0 {
+			entry = Entry{
+				Value:    ops[c.op].Value,
+				Metadata: c.meta,
+			}
+		}
+
+		applied = append(applied, change{key: c.key, entry: entry})
+	}
+
+	if err := db.record(applied...); err != nil {
+		return err
+	}
+
+	for _, c := range applied {
+		db.apply(c)
+	}
+
 	return nil
 }
+
+// record passes changes to the persist function of the database, if there is one.
+func (db *memoryDatabase) record(changes ...change) error {
+	if db.persist == nil {
+		return nil
+	}
+
+	return db.persist(changes)
+}
+
+// apply changes the stored entry of a key.
+func (db *memoryDatabase) apply(c change) {
+	if c.entry.Version == 0 {
+		delete(db.store, c.key)
+		return
+	}
+
+	db.store[c.key] = c.entry
+}
+
+func (db *memoryDatabase) Close() error {
+	if db.done != nil {
+		close(db.done)
+	}
+
+	return nil
+}
+
+// sweep removes all expired values.
+func (db *memoryDatabase) sweep() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	now := db.timeNow()
+	for k, e := range db.store {
+		if e.Expired(now) {
+			delete(db.store, k)
+		}
+	}
+}
+
+func (db *memoryDatabase) timeNow() time.Time {
+	if db.now == nil {
+		return time.Now()
+	}
+
+	return db.now()
+}
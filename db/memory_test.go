@@ -1,8 +1,11 @@
 package db
 
 import (
+	"fmt"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMemoryListEmpty(t *testing.T) {
@@ -20,9 +23,9 @@ func TestMemoryListEmpty(t *testing.T) {
 }
 
 func TestMemoryList(t *testing.T) {
-	store := map[string]string{
-		"key1": "value1",
-		"key2": "value2",
+	store := map[string]Entry{
+		"key1": {Value: "value1", Metadata: Metadata{Version: 1}},
+		"key2": {Value: "value2", Metadata: Metadata{Version: 1}},
 	}
 	expectedKeys := []string{"key1", "key2"}
 
@@ -43,7 +46,7 @@ func TestMemoryList(t *testing.T) {
 func TestMemoryGet(t *testing.T) {
 	tests := []struct {
 		desc  string
-		store map[string]string
+		store map[string]Entry
 		key   string
 		value string
 		found bool
@@ -51,8 +54,25 @@ func TestMemoryGet(t *testing.T) {
 	}{
 		{
 			desc: "success",
-			store: map[string]string{
-				"key1": "value1",
+			store: map[string]Entry{
+				"key1": {Value: "value1", Metadata: Metadata{Version: 1}},
+			},
+			key:   "key1",
+			value: "value1",
+			found: true,
+		},
+		{
+			desc:  "not found",
+			store: map[string]Entry{},
+			key:   "key1",
+		},
+		{
+			desc:  "invalid key",
+			store: map[string]Entry{},
+			key:   "",
+			err: &InvalidKeyError{
+				Key:    "",
+				Reason: "key can not be empty",
 			},
 		},
 	}
@@ -66,18 +86,18 @@ func TestMemoryGet(t *testing.T) {
 				store: test.store,
 			}
 
-			value, found, err := db.Get(test.key)
+			entry, found, err := db.Get(test.key)
 
-			if err != test.err {
-				t.Errorf("got error %q, want none", err)
+			if !reflect.DeepEqual(err, test.err) {
+				t.Errorf("got error %q, want %q", err, test.err)
 			}
 
 			if err != nil {
 				return
 			}
 
-			if value != test.value {
-				t.Errorf("got value %q, want %q", value, test.value)
+			if entry.Value != test.value {
+				t.Errorf("got value %q, want %q", entry.Value, test.value)
 			}
 
 			if found != test.found {
@@ -103,7 +123,7 @@ func TestMemoryPut(t *testing.T) {
 		t.Errorf("got error %q, want none", err)
 	}
 
-	content, found, err := db.Get("testkey")
+	entry, found, err := db.Get("testkey")
 	if err != nil {
 		t.Errorf("got error %q, want none", err)
 	}
@@ -112,7 +132,311 @@ func TestMemoryPut(t *testing.T) {
 		t.Errorf("got found %v, want true", found)
 	}
 
-	if content != "testvalue" {
-		t.Errorf("got content %q, want %q", content, "testvalue")
+	if entry.Value != "testvalue" {
+		t.Errorf("got content %q, want %q", entry.Value, "testvalue")
+	}
+}
+
+func TestMemoryDelete(t *testing.T) {
+	db := NewMemoryDatabase()
+
+	found, err := db.Delete("testkey")
+	if err != nil {
+		t.Errorf("got error %q, want none", err)
+	}
+
+	if found {
+		t.Errorf("got found %v, want false", found)
+	}
+
+	if err := db.Put("testkey", "testvalue"); err != nil {
+		t.Errorf("got error %q, want none", err)
+	}
+
+	found, err = db.Delete("testkey")
+	if err != nil {
+		t.Errorf("got error %q, want none", err)
+	}
+
+	if !found {
+		t.Errorf("got found %v, want true", found)
+	}
+
+	_, found, err = db.Get("testkey")
+	if err != nil {
+		t.Errorf("got error %q, want none", err)
+	}
+
+	if found {
+		t.Errorf("got found %v, want false", found)
+	}
+}
+
+func TestMemoryConcurrent(t *testing.T) {
+	const workers = 8
+	const iterations = 100
+
+	db := NewMemoryDatabase()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			key := fmt.Sprintf("key%d", w%2)
+			for i := 0; i < iterations; i++ {
+				if err := db.Put(key, fmt.Sprintf("value%d", i)); err != nil {
+					t.Errorf("got error %q, want none", err)
+				}
+
+				if _, _, err := db.Get(key); err != nil {
+					t.Errorf("got error %q, want none", err)
+				}
+
+				if _, err := db.List(); err != nil {
+					t.Errorf("got error %q, want none", err)
+				}
+
+				if _, err := db.Delete(key); err != nil {
+					t.Errorf("got error %q, want none", err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if err := db.Put("final", "value"); err != nil {
+		t.Errorf("got error %q, want none", err)
+	}
+
+	keys, err := db.List()
+	if err != nil {
+		t.Errorf("got error %q, want none", err)
+	}
+
+	for _, k := range keys {
+		if k != "key0" && k != "key1" && k != "final" {
+			t.Errorf("got unexpected key %q", k)
+		}
+	}
+}
+
+func TestMemoryCompareAndPut(t *testing.T) {
+	db := NewMemoryDatabase()
+
+	if err := db.CompareAndPut("testkey", "value1", 1); err != ErrVersionMismatch {
+		t.Errorf("got error %q, want %q", err, ErrVersionMismatch)
+	}
+
+	if err := db.CompareAndPut("testkey", "value1", 0); err != nil {
+		t.Errorf("got error %q, want none", err)
+	}
+
+	if err := db.CompareAndPut("testkey", "value2", 0); err != ErrVersionMismatch {
+		t.Errorf("got error %q, want %q", err, ErrVersionMismatch)
+	}
+
+	if err := db.CompareAndPut("testkey", "value2", 1); err != nil {
+		t.Errorf("got error %q, want none", err)
+	}
+
+	if err := db.Put("testkey", "value3"); err != nil {
+		t.Errorf("got error %q, want none", err)
+	}
+
+	entry, _, err := db.Get("testkey")
+	if err != nil {
+		t.Errorf("got error %q, want none", err)
+	}
+
+	if entry.Value != "value3" || entry.Version != 3 {
+		t.Errorf("got value %q at version %d, want %q at version 3", entry.Value, entry.Version, "value3")
+	}
+}
+
+func TestMemoryExpiry(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	db := &memoryDatabase{
+		store: map[string]Entry{},
+		now: func() time.Time {
+			return now
+		},
+	}
+
+	if err := db.Put("shortlived", "value", WithTTL(10*time.Second)); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if err := db.Put("permanent", "value"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	entry, found, err := db.Get("shortlived")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if !found || !entry.Expires.Equal(now.Add(10*time.Second)) {
+		t.Errorf("got found %v with expiry %s, want %s", found, entry.Expires, now.Add(10*time.Second))
+	}
+
+	now = now.Add(10 * time.Second)
+
+	if _, found, _ := db.Get("shortlived"); found {
+		t.Errorf("got found %v for expired key, want false", found)
+	}
+
+	keys, err := db.List()
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if !reflect.DeepEqual(keys, []string{"permanent"}) {
+		t.Errorf("got keys %q, want %q", keys, []string{"permanent"})
+	}
+
+	db.sweep()
+
+	if len(db.store) != 1 {
+		t.Errorf("got %d values after sweep, want 1", len(db.store))
+	}
+
+	if err := db.CompareAndPut("shortlived", "new value", 0); err != nil {
+		t.Errorf("got error %q, want none", err)
+	}
+}
+
+func TestMemoryListRange(t *testing.T) {
+	db := &memoryDatabase{
+		store: map[string]Entry{
+			"a":   {Value: "value", Metadata: Metadata{Version: 1}},
+			"b/1": {Value: "value", Metadata: Metadata{Version: 1}},
+			"b/2": {Value: "value", Metadata: Metadata{Version: 1, Expires: time.Unix(1, 0)}},
+			"b/3": {Value: "value", Metadata: Metadata{Version: 1}},
+			"c":   {Value: "value", Metadata: Metadata{Version: 1}},
+		},
+	}
+
+	result, err := db.ListRange(ListOptions{
+		Prefix: "b/",
+		Limit:  1,
+	})
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	expected := ListResult{
+		Keys: []string{"b/1"},
+		Next: "Yi8x",
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("got result %+v, want %+v", result, expected)
+	}
+
+	result, err = db.ListRange(ListOptions{
+		Prefix: "b/",
+		Limit:  1,
+		Token:  result.Next,
+	})
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	expected = ListResult{
+		Keys: []string{"b/3"},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("got result %+v, want %+v", result, expected)
+	}
+}
+
+func TestMemoryMetadata(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	created := now
+	db := &memoryDatabase{
+		store: map[string]Entry{},
+		now: func() time.Time {
+			return now
+		},
+	}
+
+	if err := db.Put("key1", "first"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	now = now.Add(time.Hour)
+	headers := map[string]string{
+		"X-Meta-Owner": "team",
+	}
+	if err := db.Put("key1", "{}", WithContentType("application/json"), WithHeaders(headers)); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	entry, _, err := db.Get("key1")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	expected := Metadata{
+		Version:     2,
+		Size:        2,
+		Checksum:    "44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a",
+		ContentType: "application/json",
+		Created:     created,
+		Modified:    now,
+		Headers:     headers,
+	}
+	if !reflect.DeepEqual(entry.Metadata, expected) {
+		t.Errorf("got metadata %+v, want %+v", entry.Metadata, expected)
+	}
+}
+
+func TestMemoryBatch(t *testing.T) {
+	db := NewMemoryDatabase()
+	defer db.Close()
+
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	err := db.Batch([]Op{
+		PutOp("key2", "value2"),
+		CompareAndDeleteOp("key1", 2),
+	})
+	expectedErr := &BatchError{Index: 1, Key: "key1", Err: ErrVersionMismatch}
+	if !reflect.DeepEqual(err, expectedErr) {
+		t.Errorf("got error %q, want %q", err, expectedErr)
+	}
+
+	if _, found, _ := db.Get("key2"); found {
+		t.Errorf("got found %v for key of rejected batch, want false", found)
+	}
+
+	err = db.Batch([]Op{
+		PutOp("key2", "value2"),
+		CompareAndPutOp("key2", "value3", 1),
+		CompareAndDeleteOp("key1", 1),
+	})
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	keys, err := db.List()
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if !reflect.DeepEqual(keys, []string{"key2"}) {
+		t.Errorf("got keys %q, want %q", keys, []string{"key2"})
+	}
+
+	entry, _, err := db.Get("key2")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if entry.Value != "value3" || entry.Version != 2 {
+		t.Errorf("got value %q at version %d, want %q at version 2", entry.Value, entry.Version, "value3")
 	}
 }
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MigrateFileDatabase converts a directory created by earlier versions of the file backend,
+// which used keys directly as file names, to the current file naming scheme.
+// It returns the keys of the files which have been renamed.
+func MigrateFileDatabase(baseDir string) ([]string, error) {
+	lock, err := lockFile(filepath.Join(baseDir, lockFileName), true)
+	switch {
+	case err == errLocked:
+		return nil, fmt.Errorf("directory is locked by another process: %s", baseDir)
+	case err != nil:
+		return nil, err
+	}
+	defer lock.Close()
+
+	infos, err := ioutil.ReadDir(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	migrated := []string{}
+	for _, i := range infos {
+		name := i.Name()
+		if !i.Mode().IsRegular() || strings.HasPrefix(name, ".") {
+			continue
+		}
+
+		if _, ok := decodeName(name); ok {
+			continue
+		}
+
+		if isHashedName(name) {
+			if _, err := os.Stat(filepath.Join(baseDir, name+keyFileSuffix)); err == nil {
+				continue
+			}
+		}
+
+		if base, ok := auxiliaryBase(name); ok {
+			if _, err := os.Stat(filepath.Join(baseDir, base)); err == nil {
+				continue
+			}
+		}
+
+		if err := migrateFile(baseDir, name); err != nil {
+			return migrated, err
+		}
+
+		migrated = append(migrated, name)
+	}
+
+	return migrated, nil
+}
+
+func migrateFile(baseDir, key string) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+
+	name := encodeKey(key)
+	target := filepath.Join(baseDir, name)
+	if _, err := os.Stat(target); err == nil {
+		return fmt.Errorf("can not migrate %q: target %q already exists", key, name)
+	}
+
+	if isHashedName(name) {
+		if err := ioutil.WriteFile(target+keyFileSuffix, []byte(key), 0666); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(filepath.Join(baseDir, key), target)
+}
+
+// ConvertFileDatabase moves the values of a directory written using the layout from to the locations used by
+// the layout to. It returns the keys of the values which have been moved. An interrupted conversion is
+// completed by running it again.
+func ConvertFileDatabase(baseDir string, from, to Layout) ([]string, error) {
+	database, err := NewFileDatabase(baseDir, WithLayout(from))
+	if err != nil {
+		return nil, err
+	}
+	defer database.Close()
+
+	return database.(*fileDatabase).convert(to)
+}
+
+func (d *fileDatabase) convert(to Layout) ([]string, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	paths := map[string]string{}
+	err := d.walk(d.baseDir, "", false, func(path, key string) error {
+		paths[key] = path
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(paths))
+	for k := range paths {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	converted := []string{}
+	for _, k := range keys {
+		name := to.name(k)
+		target := filepath.Join(d.baseDir, name)
+		if target == paths[k] {
+			continue
+		}
+
+		if err := d.move(paths[k], target, k, hashedName(name)); err != nil {
+			return converted, fmt.Errorf("error converting %q: %s", k, err)
+		}
+
+		converted = append(converted, k)
+	}
+
+	return converted, nil
+}
+
+// move moves the value stored at path to target. The value itself is moved last, so that an
+// interrupted move is continued when the value is found at its old location again.
+func (d *fileDatabase) move(path, target, key string, keyFile bool) error {
+	if err := d.makeDir(filepath.Dir(target)); err != nil {
+		return err
+	}
+
+	if keyFile {
+		if err := d.writeFile(target+keyFileSuffix, []byte(key)); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(path+metaFileSuffix, target+metaFileSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := d.commitFile(path, target); err != nil {
+		return err
+	}
+
+	if err := os.Remove(path + keyFileSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	d.removeEmptyDirs(filepath.Dir(path))
+	return nil
+}
@@ -0,0 +1,157 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMigrateFileDatabase(t *testing.T) {
+	legacy := map[string]string{
+		"key1":    "value1",
+		"my.key":  "value2",
+		"~tilde":  "value3",
+		"a-b_c":   "value4",
+		".hidden": "",
+		"long.key" + strings.Repeat("a", maxNameLength): "value5",
+	}
+
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range legacy {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0666); err != nil {
+			t.Fatalf("error creating file: %s", err)
+		}
+	}
+
+	migrated, err := MigrateFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if len(migrated) != 3 {
+		t.Errorf("got %d migrated keys, want 3: %q", len(migrated), migrated)
+	}
+
+	db, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+
+	for key, value := range legacy {
+		if strings.HasPrefix(key, ".") {
+			continue
+		}
+
+		entry, found, err := db.Get(key)
+		if err != nil {
+			t.Fatalf("error getting %q: %s", key, err)
+		}
+
+		if !found || entry.Value != value {
+			t.Errorf("got %q (found %v) for %q, want %q", entry.Value, found, key, value)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("error closing database: %s", err)
+	}
+
+	migrated, err = MigrateFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if !reflect.DeepEqual(migrated, []string{}) {
+		t.Errorf("got migrated keys %q on second run, want none", migrated)
+	}
+}
+
+func TestConvertFileDatabase(t *testing.T) {
+	keys := []string{
+		"key1",
+		"team/service/config",
+		strings.Repeat("long", 100),
+		"team/" + strings.Repeat("long", 100) + "/config",
+	}
+
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+
+	for _, k := range keys {
+		if err := db.Put(k, "value of "+k); err != nil {
+			t.Fatalf("error storing %q: %s", k, err)
+		}
+
+		if err := db.Put(k, "value of "+k); err != nil {
+			t.Fatalf("error storing %q: %s", k, err)
+		}
+	}
+	db.Close()
+
+	from := LayoutFlat
+	for _, to := range []Layout{LayoutSharded, LayoutNested, LayoutFlat} {
+		converted, err := ConvertFileDatabase(dir, from, to)
+		if err != nil {
+			t.Fatalf("got error %q converting from %s to %s, want none", err, from, to)
+		}
+
+		if len(converted) == 0 {
+			t.Errorf("got no converted keys from %s to %s", from, to)
+		}
+
+		db, err := NewFileDatabase(dir, WithLayout(to))
+		if err != nil {
+			t.Fatalf("error opening database: %s", err)
+		}
+
+		listed, err := db.List()
+		if err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+
+		if len(listed) != len(keys) {
+			t.Errorf("got keys %q with layout %s, want %q", listed, to, keys)
+		}
+
+		for _, k := range keys {
+			entry, found, err := db.Get(k)
+			if err != nil {
+				t.Fatalf("error getting %q: %s", k, err)
+			}
+
+			if !found || entry.Value != "value of "+k || entry.Version != 2 {
+				t.Errorf("got %q at version %d (found %v) for %q with layout %s, want %q at version 2", entry.Value, entry.Version, found, k, to, "value of "+k)
+			}
+		}
+		db.Close()
+
+		from = to
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("error reading directory: %s", err)
+	}
+
+	for _, i := range infos {
+		if i.IsDir() {
+			t.Errorf("got directory %q after converting back to flat layout", i.Name())
+		}
+	}
+}
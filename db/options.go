@@ -0,0 +1,103 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
+// PutOption changes how a value is stored.
+type PutOption func(o *PutOptions)
+
+// PutOptions contains the settings for storing a value.
+type PutOptions struct {
+	// TTL is the time after which the value expires. Values with a zero TTL do not expire.
+	TTL time.Duration
+	// ContentType is the media type of the value.
+	ContentType string
+	// Headers contains user-defined metadata stored with the value.
+	Headers map[string]string
+	// Metadata replaces the metadata derived from the current value. Only the size and checksum are computed.
+	Metadata *Metadata
+}
+
+// WithTTL stores a value, which expires after the given duration.
+func WithTTL(ttl time.Duration) PutOption {
+	return func(o *PutOptions) {
+		o.TTL = ttl
+	}
+}
+
+// WithContentType stores the media type of a value.
+func WithContentType(contentType string) PutOption {
+	return func(o *PutOptions) {
+		o.ContentType = contentType
+	}
+}
+
+// WithHeaders stores user-defined metadata with a value.
+func WithHeaders(headers map[string]string) PutOption {
+	return func(o *PutOptions) {
+		o.Headers = headers
+	}
+}
+
+// WithMetadata stores a value with a copy of the given metadata instead of increasing the version of the current
+// value. It is used for copying values between databases including their versions and times.
+func WithMetadata(meta Metadata) PutOption {
+	return func(o *PutOptions) {
+		o.Metadata = &meta
+	}
+}
+
+// ApplyPutOptions returns the settings resulting from a list of options.
+func ApplyPutOptions(opts ...PutOption) PutOptions {
+	result := PutOptions{}
+	for _, o := range opts {
+		o(&result)
+	}
+
+	return result
+}
+
+// metadata returns the metadata of a value with the given size and checksum written at now,
+// replacing the current metadata. The current metadata is empty if there is no value yet.
+func (o PutOptions) metadata(current Metadata, size int64, checksum string, now time.Time) Metadata {
+	if o.Metadata != nil {
+		meta := *o.Metadata
+		meta.Size = size
+		meta.Checksum = checksum
+		return meta
+	}
+
+	created := current.Created
+	if current.Version == 0 || created.IsZero() {
+		created = now
+	}
+
+	return Metadata{
+		Version:     current.Version + 1,
+		Expires:     o.expiry(now),
+		Size:        size,
+		Checksum:    checksum,
+		ContentType: o.ContentType,
+		Created:     created,
+		Modified:    now,
+		Headers:     o.Headers,
+	}
+}
+
+// expiry returns the expiration time of a value written at now.
+func (o PutOptions) expiry(now time.Time) time.Time {
+	if o.TTL <= 0 {
+		return time.Time{}
+	}
+
+	return now.Add(o.TTL)
+}
+
+// checksum returns the hex-encoded SHA-256 hash of a value.
+func checksum(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,1104 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The segment backend appends all records to segment files and keeps the location of the current value of
+// every key in memory (the key directory). Each record has the following layout:
+//
+//	| checksum (4) | value checksum (4) | flags (1) | key length (4) | metadata length (4) | value length (8) |
+//	| key | metadata | value |
+//
+// The checksum is the CRC-32C of the remaining header, the key and the metadata, the value checksum is the
+// CRC-32C of the value. Deleted keys are recorded with a metadata version of zero. All records of a batch
+// except the last one have flagPending set, so that an interrupted batch can be discarded when reading.
+//
+// Merging rewrites the current values of all segments into new segments and writes a hint file for each of
+// them. A hint file contains the key directory entries of its segment, so the segment does not need to be
+// read completely when opening the database:
+//
+//	| checksum (4) | key length (4) | metadata length (4) | offset (8) | record size (8) | key | metadata |
+const (
+	segmentSuffix     = ".data"
+	hintSuffix        = ".hint"
+	recordHeaderLen   = 25
+	hintHeaderLen     = 28
+	flagPending       = 1
+	defaultSegmentLen = 64 << 20
+	// minMergeSize is the amount of replaced data needed before segments are merged.
+	minMergeSize = 1 << 20
+)
+
+type segmentDatabase struct {
+	lock        sync.RWMutex
+	dir         string
+	durability  Durability
+	segmentSize int64
+	lockFile    *os.File
+	now         func() time.Time
+	done        chan struct{}
+	keydir      map[string]keydirEntry
+	segments    map[int]*os.File
+	activeID    int
+	activeSize  int64
+	staleSize   int64
+	totalSize   int64
+	closeOnce   sync.Once
+}
+
+// keydirEntry is the location of the current value of a key.
+type keydirEntry struct {
+	segment int
+	// offset is the position of the value in the segment.
+	offset int64
+	// recordSize is the size of the complete record.
+	recordSize int64
+	meta       Metadata
+}
+
+// SegmentOption changes the configuration of a database with a segment backend.
+type SegmentOption func(d *segmentDatabase)
+
+// WithSegmentDurability sets how writes are synchronized to disk. With DurabilityFile or higher,
+// every write is synchronized before it is acknowledged. The default is DurabilityDirectory.
+func WithSegmentDurability(durability Durability) SegmentOption {
+	return func(d *segmentDatabase) {
+		d.durability = durability
+	}
+}
+
+// WithSegmentSize sets the size in bytes after which a new segment is started.
+func WithSegmentSize(size int64) SegmentOption {
+	return func(d *segmentDatabase) {
+		d.segmentSize = size
+	}
+}
+
+// NewSegmentDatabase creates a database, which appends all values to segment files in dir and keeps an index
+// of the keys in memory. Segments containing values which have been replaced are merged in the background.
+func NewSegmentDatabase(dir string, opts ...SegmentOption) (Database, error) {
+	stat, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		return nil, fmt.Errorf("directory does not exist: %s", dir)
+	case err != nil:
+		return nil, fmt.Errorf("error checking directory: %s", err)
+	}
+
+	if !stat.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", dir)
+	}
+
+	d := &segmentDatabase{
+		dir:         dir,
+		durability:  DurabilityDirectory,
+		segmentSize: defaultSegmentLen,
+		now:         time.Now,
+		done:        make(chan struct{}),
+		keydir:      make(map[string]keydirEntry),
+		segments:    make(map[int]*os.File),
+	}
+	for _, o := range opts {
+		o(d)
+	}
+
+	d.lockFile, err = lockFile(filepath.Join(dir, lockFileName), true)
+	switch {
+	case err == errLocked:
+		return nil, fmt.Errorf("directory is locked by another process: %s", dir)
+	case err != nil:
+		return nil, err
+	}
+
+	if err := d.open(); err != nil {
+		d.closeSegments()
+		d.lockFile.Close()
+		return nil, err
+	}
+
+	go runSweeper(d.done, d.maintain)
+
+	return d, nil
+}
+
+// open reads all segments and opens the active segment.
+func (d *segmentDatabase) open() error {
+	if err := removeTempFiles(d.dir); err != nil {
+		return fmt.Errorf("error removing temporary files: %s", err)
+	}
+
+	ids, err := segmentIDs(d.dir)
+	if err != nil {
+		return err
+	}
+
+	for i, id := range ids {
+		last := i == len(ids)-1
+		if err := d.load(id, last); err != nil {
+			return fmt.Errorf("error reading segment %d: %s", id, err)
+		}
+	}
+
+	// Merged segments are never appended to, as their hint file would be incomplete otherwise.
+	if len(ids) > 0 {
+		last := ids[len(ids)-1]
+		_, err := os.Stat(d.segmentPath(last, hintSuffix))
+		if os.IsNotExist(err) && d.activeSize < d.segmentSize {
+			d.activeID = last
+			_, err = d.segments[last].Seek(d.activeSize, io.SeekStart)
+			return err
+		}
+	}
+
+	return d.startSegment(d.activeID + 1)
+}
+
+// load adds the records of a segment to the key directory. An incomplete record at the end of
+// the last segment is discarded, a damaged record followed by further records is reported as error.
+func (d *segmentDatabase) load(id int, last bool) error {
+	file, err := os.OpenFile(d.segmentPath(id, segmentSuffix), os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	d.segments[id] = file
+	d.activeID = id
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	d.totalSize += stat.Size()
+
+	if ok, err := d.loadHints(id); ok || err != nil {
+		d.activeSize = stat.Size()
+		return err
+	}
+
+	size, err := d.scan(id, file, stat.Size())
+	d.activeSize = size
+	switch {
+	case err == errTornRecord && last:
+		log.Printf("Discarding incomplete record at offset %d of %s.", size, file.Name())
+		d.totalSize -= stat.Size() - size
+		return file.Truncate(size)
+	case err == errCorruptRecord:
+		return fmt.Errorf("segment %s is corrupted at offset %d", file.Name(), size)
+	case err != nil:
+		return err
+	}
+
+	return nil
+}
+
+// scan reads all records of a segment. It returns the offset after the last complete record. A damaged record
+// is only reported as errTornRecord if it ends at the end of the segment, otherwise as errCorruptRecord.
+func (d *segmentDatabase) scan(id int, file *os.File, size int64) (int64, error) {
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, size))
+	pending := []keydirChange{}
+	offset := int64(0)
+	complete := int64(0)
+	for offset < size {
+		key, meta, flags, sizes, err := readRecordHeader(reader, size-offset)
+		if err != nil {
+			return complete, err
+		}
+
+		valueCRC := crc32.New(crcTable)
+		if _, err := io.CopyN(valueCRC, reader, sizes.length); err != nil {
+			return complete, errTornRecord
+		}
+
+		recordSize := recordHeaderLen + int64(len(key)) + sizes.metaLength + sizes.length
+		if valueCRC.Sum32() != sizes.checksum {
+			if offset+recordSize == size {
+				return complete, errTornRecord
+			}
+
+			return complete, errCorruptRecord
+		}
+
+		pending = append(pending, keydirChange{
+			key: key,
+			entry: keydirEntry{
+				segment:    id,
+				offset:     offset + recordSize - sizes.length,
+				recordSize: recordSize,
+				meta:       meta,
+			},
+		})
+		offset += recordSize
+
+		if flags&flagPending == 0 {
+			for _, c := range pending {
+				d.applyChange(c)
+			}
+			pending = pending[:0]
+			complete = offset
+		}
+	}
+
+	if len(pending) > 0 {
+		return complete, errTornRecord
+	}
+
+	return complete, nil
+}
+
+// recordSizes contains the sizes read from the header of a record.
+type recordSizes struct {
+	metaLength int64
+	length     int64
+	checksum   uint32
+}
+
+// readRecordHeader reads the header, key and metadata of a record. At most remaining bytes are
+// available for the record.
+func readRecordHeader(reader io.Reader, remaining int64) (string, Metadata, byte, recordSizes, error) {
+	header := make([]byte, recordHeaderLen)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return "", Metadata{}, 0, recordSizes{}, errTornRecord
+	}
+
+	flags := header[8]
+	keyLen := int64(binary.LittleEndian.Uint32(header[9:13]))
+	metaLen := int64(binary.LittleEndian.Uint32(header[13:17]))
+	valueLen := int64(binary.LittleEndian.Uint64(header[17:25]))
+	if keyLen+metaLen > remaining-recordHeaderLen || valueLen > remaining-recordHeaderLen-keyLen-metaLen {
+		return "", Metadata{}, 0, recordSizes{}, errTornRecord
+	}
+
+	data := make([]byte, keyLen+metaLen)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return "", Metadata{}, 0, recordSizes{}, errTornRecord
+	}
+
+	checksum := crc32.Update(crc32.Checksum(header[8:], crcTable), crcTable, data)
+	if checksum != binary.LittleEndian.Uint32(header[0:4]) {
+		if recordHeaderLen+keyLen+metaLen+valueLen == remaining {
+			return "", Metadata{}, 0, recordSizes{}, errTornRecord
+		}
+
+		return "", Metadata{}, 0, recordSizes{}, errCorruptRecord
+	}
+
+	meta := Metadata{}
+	if err := json.Unmarshal(data[keyLen:], &meta); err != nil {
+		return "", Metadata{}, 0, recordSizes{}, fmt.Errorf("error decoding metadata: %s", err)
+	}
+
+	return string(data[:keyLen]), meta, flags, recordSizes{
+		metaLength: metaLen,
+		length:     valueLen,
+		checksum:   binary.LittleEndian.Uint32(header[4:8]),
+	}, nil
+}
+
+// loadHints reads the key directory entries of a segment from its hint file.
+// It returns false if there is no valid hint file.
+func (d *segmentDatabase) loadHints(id int) (bool, error) {
+	content, err := ioutil.ReadFile(d.segmentPath(id, hintSuffix))
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+
+	changes := []keydirChange{}
+	for len(content) > 0 {
+		if len(content) < hintHeaderLen {
+			return false, nil
+		}
+
+		keyLen := int(binary.LittleEndian.Uint32(content[4:8]))
+		metaLen := int(binary.LittleEndian.Uint32(content[8:12]))
+		if keyLen+metaLen > len(content)-hintHeaderLen {
+			return false, nil
+		}
+
+		end := hintHeaderLen + keyLen + metaLen
+		if crc32.Checksum(content[4:end], crcTable) != binary.LittleEndian.Uint32(content[0:4]) {
+			return false, nil
+		}
+
+		meta := Metadata{}
+		if err := json.Unmarshal(content[hintHeaderLen+keyLen:end], &meta); err != nil {
+			return false, nil
+		}
+
+		changes = append(changes, keydirChange{
+			key: string(content[hintHeaderLen : hintHeaderLen+keyLen]),
+			entry: keydirEntry{
+				segment:    id,
+				offset:     int64(binary.LittleEndian.Uint64(content[12:20])),
+				recordSize: int64(binary.LittleEndian.Uint64(content[20:28])),
+				meta:       meta,
+			},
+		})
+		content = content[end:]
+	}
+
+	for _, c := range changes {
+		d.applyChange(c)
+	}
+
+	return true, nil
+}
+
+// keydirChange is a new entry of the key directory. The metadata of a deleted key has a zero version.
+type keydirChange struct {
+	key   string
+	entry keydirEntry
+}
+
+// applyChange updates the key directory and the amount of replaced data. The caller needs to hold the lock.
+func (d *segmentDatabase) applyChange(c keydirChange) {
+	if previous, ok := d.keydir[c.key]; ok {
+		d.staleSize += previous.recordSize
+	}
+
+	if c.entry.meta.Version == 0 {
+		delete(d.keydir, c.key)
+		d.staleSize += c.entry.recordSize
+		return
+	}
+
+	d.keydir[c.key] = c.entry
+}
+
+func (d *segmentDatabase) List() ([]string, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	now := d.now()
+	keys := []string{}
+	for k, e := range d.keydir {
+		if !e.meta.Expired(now) {
+			keys = append(keys, k)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (d *segmentDatabase) ListRange(opts ListOptions) (ListResult, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	now := d.now()
+	keys := []string{}
+	for k, e := range d.keydir {
+		if k < opts.Start || !opts.matches(k) || e.meta.Expired(now) {
+			continue
+		}
+
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return Paginate(keys, opts)
+}
+
+func (d *segmentDatabase) Get(key string) (Entry, bool, error) {
+	if err := ValidateKey(key); err != nil {
+		return Entry{}, false, err
+	}
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	entry, ok := d.current(key)
+	if !ok {
+		return Entry{}, false, nil
+	}
+
+	value := make([]byte, entry.meta.Size)
+	if _, err := d.segments[entry.segment].ReadAt(value, entry.offset); err != nil {
+		return Entry{}, false, err
+	}
+
+	return Entry{
+		Value:    string(value),
+		Metadata: entry.meta,
+	}, true, nil
+}
+
+// GetReader opens the segment containing the value of key. The reader keeps working when the segment is
+// removed by merging in the meantime.
+func (d *segmentDatabase) GetReader(key string) (ValueReader, Metadata, bool, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, Metadata{}, false, err
+	}
+
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	entry, ok := d.current(key)
+	if !ok {
+		return nil, Metadata{}, false, nil
+	}
+
+	file, err := os.Open(d.segmentPath(entry.segment, segmentSuffix))
+	if err != nil {
+		return nil, Metadata{}, false, err
+	}
+
+	return segmentReader{
+		SectionReader: io.NewSectionReader(file, entry.offset, entry.meta.Size),
+		file:          file,
+	}, entry.meta, true, nil
+}
+
+// segmentReader reads a value from its own handle of the segment file.
+type segmentReader struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (r segmentReader) Close() error {
+	return r.file.Close()
+}
+
+// current returns the key directory entry of a key, unless it has expired. The caller needs to hold the lock.
+func (d *segmentDatabase) current(key string) (keydirEntry, bool) {
+	entry, ok := d.keydir[key]
+	if !ok || entry.meta.Expired(d.now()) {
+		return keydirEntry{}, false
+	}
+
+	return entry, true
+}
+
+func (d *segmentDatabase) Put(key, value string, opts ...PutOption) error {
+	return d.CompareAndPut(key, value, AnyVersion, opts...)
+}
+
+func (d *segmentDatabase) CompareAndPut(key, value string, expectedVersion int64, opts ...PutOption) error {
+	err := d.Batch([]Op{CompareAndPutOp(key, value, expectedVersion, opts...)})
+	if batchErr, ok := err.(*BatchError); ok {
+		return batchErr.Err
+	}
+
+	return err
+}
+
+// PutReader writes the content of r to a temporary file first, so the database only needs to be locked
+// while the value is copied to the segment.
+func (d *segmentDatabase) PutReader(key string, r io.Reader, expectedVersion int64, opts ...PutOption) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+
+	file, err := createTemp(d.dir)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	hash := sha256.New()
+	valueCRC := crc32.New(crcTable)
+	size, err := io.Copy(io.MultiWriter(file, hash, valueCRC), r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := d.now()
+	current, _ := d.current(key)
+	if expectedVersion >= 0 && current.meta.Version != expectedVersion {
+		return ErrVersionMismatch
+	}
+
+	meta := ApplyPutOptions(opts...).metadata(current.meta, size, hex.EncodeToString(hash.Sum(nil)), now)
+	return d.write([]segmentWrite{{key: key, meta: meta, value: file, checksum: valueCRC.Sum32()}})
+}
+
+func (d *segmentDatabase) Delete(key string) (bool, error) {
+	if err := ValidateKey(key); err != nil {
+		return false, err
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if _, ok := d.keydir[key]; !ok {
+		return false, nil
+	}
+
+	_, found := d.current(key)
+	if err := d.write([]segmentWrite{{key: key, value: strings.NewReader("")}}); err != nil {
+		return false, err
+	}
+
+	return found, nil
+}
+
+func (d *segmentDatabase) Batch(ops []Op) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := d.now()
+	changes, err := planBatch(ops, now, func(key string) (Metadata, error) {
+		current, _ := d.current(key)
+		return current.meta, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	writes := make([]segmentWrite, 0, len(changes))
+	for _, c := range changes {
+		value := ""
+		if c.meta.Version > 0 {
+			value = ops[c.op].Value
+		}
+
+		writes = append(writes, segmentWrite{
+			key:      c.key,
+			meta:     c.meta,
+			value:    strings.NewReader(value),
+			checksum: crc32.Checksum([]byte(value), crcTable),
+		})
+	}
+
+	return d.write(writes)
+}
+
+// segmentWrite is a record, which is appended to the active segment.
+type segmentWrite struct {
+	key      string
+	meta     Metadata
+	value    io.Reader
+	checksum uint32
+}
+
+// write appends records to the active segment and updates the key directory after all of them have been written.
+// The caller needs to hold the lock.
+func (d *segmentDatabase) write(writes []segmentWrite) error {
+	if d.activeSize >= d.segmentSize {
+		if err := d.startSegment(d.activeID + 1); err != nil {
+			return err
+		}
+	}
+
+	file := d.segments[d.activeID]
+	start := d.activeSize
+	changes := make([]keydirChange, 0, len(writes))
+	for i, w := range writes {
+		var flags byte
+		if i < len(writes)-1 {
+			flags = flagPending
+		}
+
+		entry, err := d.appendRecord(file, w, flags)
+		if err != nil {
+			d.discardRecords(file, start)
+			return err
+		}
+
+		changes = append(changes, keydirChange{key: w.key, entry: entry})
+	}
+
+	if d.durability >= DurabilityFile {
+		if err := file.Sync(); err != nil {
+			d.discardRecords(file, start)
+			return err
+		}
+	}
+
+	for _, c := range changes {
+		d.applyChange(c)
+	}
+
+	return nil
+}
+
+// discardRecords removes the records of a failed write from the end of the active segment, so that they are
+// neither mistaken for the beginning of the next batch nor read after a restart. The caller needs to hold the lock.
+func (d *segmentDatabase) discardRecords(file *os.File, start int64) {
+	if err := file.Truncate(start); err != nil {
+		log.Printf("Error discarding records of failed write: %s", err)
+		return
+	}
+
+	file.Seek(start, io.SeekStart)
+	d.totalSize -= d.activeSize - start
+	d.activeSize = start
+}
+
+// appendRecord writes a single record at the end of the active segment.
+func (d *segmentDatabase) appendRecord(file *os.File, w segmentWrite, flags byte) (keydirEntry, error) {
+	metaData, err := json.Marshal(w.meta)
+	if err != nil {
+		return keydirEntry{}, err
+	}
+
+	header := encodeRecordHeader(w.key, metaData, w.meta.Size, w.checksum, flags)
+	if _, err := file.Write(header); err != nil {
+		return keydirEntry{}, err
+	}
+
+	size, err := io.Copy(file, w.value)
+	if err != nil {
+		return keydirEntry{}, err
+	}
+
+	if size != w.meta.Size {
+		return keydirEntry{}, fmt.Errorf("value of %q changed while writing", w.key)
+	}
+
+	entry := keydirEntry{
+		segment:    d.activeID,
+		offset:     d.activeSize + int64(len(header)),
+		recordSize: int64(len(header)) + size,
+		meta:       w.meta,
+	}
+	d.activeSize += entry.recordSize
+	d.totalSize += entry.recordSize
+	return entry, nil
+}
+
+// encodeRecordHeader returns the header of a record followed by the key and the metadata.
+func encodeRecordHeader(key string, metaData []byte, valueLen int64, valueChecksum uint32, flags byte) []byte {
+	header := make([]byte, recordHeaderLen, recordHeaderLen+len(key)+len(metaData))
+	binary.LittleEndian.PutUint32(header[4:8], valueChecksum)
+	header[8] = flags
+	binary.LittleEndian.PutUint32(header[9:13], uint32(len(key)))
+	binary.LittleEndian.PutUint32(header[13:17], uint32(len(metaData)))
+	binary.LittleEndian.PutUint64(header[17:25], uint64(valueLen))
+	header = append(header, key...)
+	header = append(header, metaData...)
+	binary.LittleEndian.PutUint32(header[0:4], crc32.Checksum(header[8:], crcTable))
+	return header
+}
+
+// startSegment seals the active segment and continues writing to a new segment.
+// The caller needs to hold the lock.
+func (d *segmentDatabase) startSegment(id int) error {
+	if active, ok := d.segments[d.activeID]; ok && d.durability >= DurabilityFile {
+		if err := active.Sync(); err != nil {
+			return err
+		}
+	}
+
+	file, err := os.OpenFile(d.segmentPath(id, segmentSuffix), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+
+	if d.durability >= DurabilityDirectory {
+		if err := syncDir(d.dir); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	d.segments[id] = file
+	d.activeID = id
+	d.activeSize = 0
+	return nil
+}
+
+// maintain removes expired values from the key directory and merges the segments if enough data has been replaced.
+func (d *segmentDatabase) maintain() {
+	d.lock.Lock()
+	now := d.now()
+	for k, e := range d.keydir {
+		if e.meta.Expired(now) {
+			delete(d.keydir, k)
+			d.staleSize += e.recordSize
+		}
+	}
+	needsMerge := d.staleSize > minMergeSize && d.staleSize > d.totalSize/2
+	d.lock.Unlock()
+
+	if needsMerge {
+		if err := d.merge(); err != nil {
+			log.Printf("Error merging segments: %s", err)
+		}
+	}
+}
+
+// merge writes the current values of all segments to new segments and removes the old ones. The active
+// segment is sealed first, so that writes continue in a new segment while the sealed segments, which never
+// change, are copied without holding the lock.
+func (d *segmentDatabase) merge() error {
+	merger, err := d.startMerge()
+	if merger == nil || err != nil {
+		return err
+	}
+
+	if err := merger.copy(); err != nil {
+		merger.abort()
+		return err
+	}
+
+	return d.finishMerge(merger)
+}
+
+// startMerge seals the active segment and returns a merger for the values of all sealed segments. The IDs of
+// the merged segments are reserved between the sealed segments and the new active segment, so that values
+// written during the merge replace the merged ones when the segments are read again.
+func (d *segmentDatabase) startMerge() (*segmentMerger, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.segments == nil {
+		return nil, nil
+	}
+
+	entries := make(map[string]keydirEntry, len(d.keydir))
+	liveSize := int64(0)
+	now := d.now()
+	for k, e := range d.keydir {
+		if !e.meta.Expired(now) {
+			entries[k] = e
+			liveSize += e.recordSize
+		}
+	}
+
+	sealed := make([]int, 0, len(d.segments))
+	for id := range d.segments {
+		sealed = append(sealed, id)
+	}
+	sort.Ints(sealed)
+
+	// Every merged segment except the last one is at least as large as the segment size.
+	firstID := d.activeID + 1
+	activeID := firstID + int(liveSize/d.segmentSize) + 1
+	if err := d.startSegment(activeID); err != nil {
+		return nil, err
+	}
+
+	return &segmentMerger{
+		database:   d,
+		nextID:     firstID,
+		lastID:     activeID - 1,
+		entries:    entries,
+		sealed:     sealed,
+		sealedSize: d.totalSize,
+		keydir:     make(map[string]keydirEntry, len(entries)),
+		files:      make(map[int]*os.File),
+		sources:    make(map[int]*os.File),
+	}, nil
+}
+
+// finishMerge replaces the sealed segments with the merged ones. Values which have been changed during the
+// merge keep their newer location.
+func (d *segmentDatabase) finishMerge(merger *segmentMerger) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.segments == nil {
+		merger.abort()
+		return nil
+	}
+
+	for k, merged := range merger.keydir {
+		previous := merger.entries[k]
+		if current, ok := d.keydir[k]; ok && current.segment == previous.segment && current.offset == previous.offset {
+			d.keydir[k] = merged
+		}
+	}
+
+	// The merged segments contain all values now, so the sealed segments can be removed. They are removed
+	// starting with the oldest, so that an interrupted removal can not bring back deleted values.
+	for _, id := range merger.sealed {
+		d.segments[id].Close()
+		delete(d.segments, id)
+		for _, suffix := range []string{hintSuffix, segmentSuffix} {
+			if err := os.Remove(d.segmentPath(id, suffix)); err != nil && !os.IsNotExist(err) {
+				log.Printf("Error removing merged segment: %s", err)
+			}
+		}
+	}
+
+	for id, file := range merger.files {
+		d.segments[id] = file
+	}
+
+	d.totalSize += merger.totalSize - merger.sealedSize
+	d.staleSize = d.totalSize
+	for _, e := range d.keydir {
+		d.staleSize -= e.recordSize
+	}
+
+	return nil
+}
+
+// segmentMerger writes values to new segments together with their hint files.
+type segmentMerger struct {
+	database   *segmentDatabase
+	nextID     int
+	lastID     int
+	entries    map[string]keydirEntry
+	sealed     []int
+	sealedSize int64
+	file       *os.File
+	hints      bytes.Buffer
+	size       int64
+	totalSize  int64
+	keydir     map[string]keydirEntry
+	files      map[int]*os.File
+	sources    map[int]*os.File
+	created    []string
+}
+
+// copy writes the values of the sealed segments to the merged segments.
+func (m *segmentMerger) copy() error {
+	keys := make([]string, 0, len(m.entries))
+	for k := range m.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if err := m.add(k, m.entries[k]); err != nil {
+			return err
+		}
+	}
+
+	if err := m.finish(); err != nil {
+		return err
+	}
+	m.closeSources()
+
+	return syncDir(m.database.dir)
+}
+
+// source returns a handle of a sealed segment. The merger uses its own handles, as the segments of the
+// database are only accessed with the lock held.
+func (m *segmentMerger) source(id int) (*os.File, error) {
+	if file, ok := m.sources[id]; ok {
+		return file, nil
+	}
+
+	file, err := os.Open(m.database.segmentPath(id, segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+	m.sources[id] = file
+	return file, nil
+}
+
+// add copies the value of a key to the current merged segment.
+func (m *segmentMerger) add(key string, entry keydirEntry) error {
+	if m.file == nil || m.size >= m.database.segmentSize {
+		if err := m.finish(); err != nil {
+			return err
+		}
+
+		if m.nextID > m.lastID {
+			return fmt.Errorf("merged segments exceed the reserved segment %d", m.lastID)
+		}
+
+		file, err := createTemp(m.database.dir)
+		if err != nil {
+			return err
+		}
+		m.file = file
+		m.created = append(m.created, file.Name())
+	}
+
+	source, err := m.source(entry.segment)
+	if err != nil {
+		return err
+	}
+
+	value := io.NewSectionReader(source, entry.offset, entry.meta.Size)
+	valueCRC := crc32.New(crcTable)
+	if _, err := io.Copy(valueCRC, value); err != nil {
+		return err
+	}
+
+	metaData, err := json.Marshal(entry.meta)
+	if err != nil {
+		return err
+	}
+
+	header := encodeRecordHeader(key, metaData, entry.meta.Size, valueCRC.Sum32(), 0)
+	if _, err := m.file.Write(header); err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(m.file, io.NewSectionReader(source, entry.offset, entry.meta.Size)); err != nil {
+		return err
+	}
+
+	merged := keydirEntry{
+		segment:    m.nextID,
+		offset:     m.size + int64(len(header)),
+		recordSize: int64(len(header)) + entry.meta.Size,
+		meta:       entry.meta,
+	}
+	m.keydir[key] = merged
+	m.size += merged.recordSize
+	m.totalSize += merged.recordSize
+
+	hint := make([]byte, hintHeaderLen, hintHeaderLen+len(key)+len(metaData))
+	binary.LittleEndian.PutUint32(hint[4:8], uint32(len(key)))
+	binary.LittleEndian.PutUint32(hint[8:12], uint32(len(metaData)))
+	binary.LittleEndian.PutUint64(hint[12:20], uint64(merged.offset))
+	binary.LittleEndian.PutUint64(hint[20:28], uint64(merged.recordSize))
+	hint = append(hint, key...)
+	hint = append(hint, metaData...)
+	binary.LittleEndian.PutUint32(hint[0:4], crc32.Checksum(hint[4:], crcTable))
+	m.hints.Write(hint)
+	return nil
+}
+
+// finish completes the current merged segment by moving it to its final name and writing its hint file.
+func (m *segmentMerger) finish() error {
+	if m.file == nil {
+		return nil
+	}
+
+	if err := m.file.Sync(); err != nil {
+		return err
+	}
+
+	path := m.database.segmentPath(m.nextID, segmentSuffix)
+	if err := os.Rename(m.file.Name(), path); err != nil {
+		return err
+	}
+	m.created = append(m.created, path)
+	m.files[m.nextID] = m.file
+
+	hints, err := createTemp(m.database.dir)
+	if err != nil {
+		return err
+	}
+	m.created = append(m.created, hints.Name())
+
+	_, err = m.hints.WriteTo(hints)
+	if err == nil {
+		err = hints.Sync()
+	}
+
+	if closeErr := hints.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	hintPath := m.database.segmentPath(m.nextID, hintSuffix)
+	if err := os.Rename(hints.Name(), hintPath); err != nil {
+		return err
+	}
+	m.created = append(m.created, hintPath)
+
+	m.file = nil
+	m.size = 0
+	m.nextID++
+	return nil
+}
+
+// closeSources closes the handles of the sealed segments.
+func (m *segmentMerger) closeSources() {
+	for id, f := range m.sources {
+		f.Close()
+		delete(m.sources, id)
+	}
+}
+
+// abort removes all files written by the merger.
+func (m *segmentMerger) abort() {
+	if m.file != nil {
+		m.file.Close()
+	}
+
+	for _, f := range m.files {
+		f.Close()
+	}
+	m.closeSources()
+
+	for _, path := range m.created {
+		os.Remove(path)
+	}
+}
+
+func (d *segmentDatabase) Close() error {
+	d.closeOnce.Do(func() {
+		close(d.done)
+	})
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	err := d.closeSegments()
+	if lockErr := d.lockFile.Close(); err == nil {
+		err = lockErr
+	}
+
+	return err
+}
+
+// closeSegments closes all segment files.
+func (d *segmentDatabase) closeSegments() error {
+	var err error
+	if active, ok := d.segments[d.activeID]; ok && d.durability >= DurabilityFile {
+		err = active.Sync()
+	}
+
+	for _, file := range d.segments {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	d.segments = nil
+
+	return err
+}
+
+func (d *segmentDatabase) segmentPath(id int, suffix string) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%09d%s", id, suffix))
+}
+
+// segmentIDs returns the sorted identifiers of all segments in dir.
+func segmentIDs(dir string) ([]int, error) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []int{}
+	for _, n := range names {
+		id, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(n), segmentSuffix))
+		if err != nil || id <= 0 {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	sort.Ints(ids)
+	return ids, nil
+}
@@ -0,0 +1,295 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openSegmentDatabase(t *testing.T, dir string, opts ...SegmentOption) *segmentDatabase {
+	t.Helper()
+
+	db, err := NewSegmentDatabase(dir, opts...)
+	if err != nil {
+		t.Fatalf("error opening database: %s", err)
+	}
+
+	return db.(*segmentDatabase)
+}
+
+func TestSegmentReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openSegmentDatabase(t, dir, WithSegmentSize(200))
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if err := db.Put("key1", "\xff\x00binary"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if err := PutReader(db, "key2", strings.NewReader("streamed"), 0); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if err := db.Put("key3", "value3"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if _, err := db.Delete("key3"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if err := db.Batch([]Op{PutOp("key4", ""), PutOp("key5", "value5")}); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if err := db.CompareAndPut("key1", "value", 1); err != ErrVersionMismatch {
+		t.Errorf("got error %q, want %q", err, ErrVersionMismatch)
+	}
+
+	if len(db.segments) < 2 {
+		t.Errorf("got %d segments, want more than one", len(db.segments))
+	}
+	db.Close()
+
+	db = openSegmentDatabase(t, dir, WithSegmentSize(200))
+	defer db.Close()
+
+	checkLogValues(t, db, map[string]string{
+		"key1": "\xff\x00binary",
+		"key2": "streamed",
+		"key4": "",
+		"key5": "value5",
+	})
+
+	entry, _, err := db.Get("key1")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if entry.Version != 2 || entry.Checksum != checksum("\xff\x00binary") {
+		t.Errorf("got version %d with checksum %q, want 2 with %q", entry.Version, entry.Checksum, checksum("\xff\x00binary"))
+	}
+}
+
+func TestSegmentTornBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openSegmentDatabase(t, dir)
+	if err := db.Put("key1", "old"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if err := db.Batch([]Op{PutOp("key1", "new"), PutOp("key2", "new")}); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	path := db.segmentPath(db.activeID, segmentSuffix)
+	db.Close()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading segment: %s", err)
+	}
+
+	if err := ioutil.WriteFile(path, content[:len(content)-1], 0666); err != nil {
+		t.Fatalf("error writing segment: %s", err)
+	}
+
+	db = openSegmentDatabase(t, dir)
+	checkLogValues(t, db, map[string]string{
+		"key1": "old",
+	})
+
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	db.Close()
+
+	db = openSegmentDatabase(t, dir)
+	defer db.Close()
+
+	checkLogValues(t, db, map[string]string{
+		"key1": "old",
+		"key2": "value2",
+	})
+}
+
+func TestSegmentCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openSegmentDatabase(t, dir)
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	entry := db.keydir["key1"]
+	path := db.segmentPath(db.activeID, segmentSuffix)
+	db.Close()
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading segment: %s", err)
+	}
+
+	// Damage the value of the first record, which is followed by the second one.
+	content[entry.offset] ^= 0xFF
+	if err := ioutil.WriteFile(path, content, 0666); err != nil {
+		t.Fatalf("error writing segment: %s", err)
+	}
+
+	if _, err := NewSegmentDatabase(dir); err == nil {
+		t.Fatal("got no error, want error")
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("error checking segment: %s", err)
+	}
+
+	if stat.Size() != int64(len(content)) {
+		t.Errorf("got segment size %d, want %d", stat.Size(), len(content))
+	}
+}
+
+func TestSegmentMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openSegmentDatabase(t, dir, WithSegmentSize(300))
+	for i := 0; i < 10; i++ {
+		for _, k := range []string{"key1", "key2", "key3"} {
+			if err := db.Put(k, k+" value"); err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+		}
+	}
+
+	if _, err := db.Delete("key3"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	reader, _, _, err := db.GetReader("key1")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	defer reader.Close()
+
+	if err := db.merge(); err != nil {
+		t.Fatalf("error merging: %s", err)
+	}
+
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("error reading value after merge: %s", err)
+	}
+
+	if string(content) != "key1 value" {
+		t.Errorf("got value %q, want %q", content, "key1 value")
+	}
+
+	for _, suffix := range []string{segmentSuffix, hintSuffix} {
+		names, err := filepath.Glob(filepath.Join(dir, "*"+suffix))
+		if err != nil {
+			t.Fatalf("error listing segments: %s", err)
+		}
+
+		expected := map[string]int{segmentSuffix: 2, hintSuffix: 1}[suffix]
+		if len(names) != expected {
+			t.Errorf("got %d %s files after merge, want %d", len(names), suffix, expected)
+		}
+	}
+
+	if db.staleSize != 0 {
+		t.Errorf("got stale size %d after merge, want 0", db.staleSize)
+	}
+
+	if err := db.Put("key2", "new value"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	db.Close()
+
+	db = openSegmentDatabase(t, dir, WithSegmentSize(300))
+	defer db.Close()
+
+	checkLogValues(t, db, map[string]string{
+		"key1": "key1 value",
+		"key2": "new value",
+	})
+}
+
+func TestSegmentMergeConcurrentWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openSegmentDatabase(t, dir, WithSegmentSize(300))
+	for i := 0; i < 10; i++ {
+		for _, k := range []string{"key1", "key2", "key3"} {
+			if err := db.Put(k, k+" value"); err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+		}
+	}
+
+	merger, err := db.startMerge()
+	if err != nil {
+		t.Fatalf("error starting merge: %s", err)
+	}
+
+	// The database stays writable while the sealed segments are copied.
+	if err := db.Put("key1", "new value"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if _, err := db.Delete("key2"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if err := merger.copy(); err != nil {
+		t.Fatalf("error copying segments: %s", err)
+	}
+
+	if err := db.finishMerge(merger); err != nil {
+		t.Fatalf("error finishing merge: %s", err)
+	}
+
+	want := map[string]string{
+		"key1": "new value",
+		"key3": "key3 value",
+	}
+	checkLogValues(t, db, want)
+
+	if want := int64(0); db.staleSize <= want {
+		t.Errorf("got stale size %d after merge, want more than %d", db.staleSize, want)
+	}
+	db.Close()
+
+	db = openSegmentDatabase(t, dir, WithSegmentSize(300))
+	defer db.Close()
+
+	checkLogValues(t, db, want)
+}
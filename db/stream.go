@@ -0,0 +1,77 @@
+package db
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// ValueReader provides random access to a stored value.
+type ValueReader interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+}
+
+// Streamer is implemented by databases, which can read and write values without holding them in memory.
+type Streamer interface {
+	// GetReader returns a reader for the value of key. The reader needs to be closed after use.
+	GetReader(key string) (reader ValueReader, meta Metadata, found bool, err error)
+	// PutReader stores the content read from r as value of key. Unless expectedVersion is AnyVersion,
+	// the value is only stored if the current version matches.
+	PutReader(key string, r io.Reader, expectedVersion int64, opts ...PutOption) error
+}
+
+// GetReader returns a reader for the value of key. It streams the value if the database implements Streamer,
+// otherwise the value is read into memory first.
+func GetReader(database Database, key string) (ValueReader, Metadata, bool, error) {
+	if streamer, ok := database.(Streamer); ok {
+		return streamer.GetReader(key)
+	}
+
+	entry, found, err := database.Get(key)
+	if err != nil || !found {
+		return nil, Metadata{}, found, err
+	}
+
+	return stringReader{strings.NewReader(entry.Value)}, entry.Metadata, true, nil
+}
+
+// Stat returns the metadata of the value of key. The value is not read if the database implements Streamer.
+func Stat(database Database, key string) (Metadata, bool, error) {
+	reader, meta, found, err := GetReader(database, key)
+	if err != nil || !found {
+		return Metadata{}, found, err
+	}
+	reader.Close()
+
+	return meta, true, nil
+}
+
+// stringReader is a ValueReader for a value held in memory.
+type stringReader struct {
+	*strings.Reader
+}
+
+func (stringReader) Close() error {
+	return nil
+}
+
+// PutReader stores the content read from r as value of key. It streams the value if the database implements
+// Streamer, otherwise the value is read into memory first.
+func PutReader(database Database, key string, r io.Reader, expectedVersion int64, opts ...PutOption) error {
+	if streamer, ok := database.(Streamer); ok {
+		return streamer.PutReader(key, r, expectedVersion, opts...)
+	}
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if expectedVersion == AnyVersion {
+		return database.Put(key, string(content), opts...)
+	}
+
+	return database.CompareAndPut(key, string(content), expectedVersion, opts...)
+}
@@ -0,0 +1,103 @@
+package db
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileDB, err := NewFileDatabase(dir)
+	if err != nil {
+		t.Fatalf("error creating database: %s", err)
+	}
+	defer fileDB.Close()
+
+	for _, test := range []struct {
+		desc string
+		db   Database
+	}{
+		{
+			desc: "memory",
+			db:   NewMemoryDatabase(),
+		},
+		{
+			desc: "file",
+			db:   fileDB,
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			value := strings.Repeat("streamed value ", 1000)
+			if err := PutReader(test.db, "key1", strings.NewReader(value), AnyVersion); err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+
+			if err := PutReader(test.db, "key1", strings.NewReader("other"), 0); err != ErrVersionMismatch {
+				t.Errorf("got error %q, want %q", err, ErrVersionMismatch)
+			}
+
+			reader, meta, found, err := GetReader(test.db, "key1")
+			if err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+			defer reader.Close()
+
+			if !found {
+				t.Fatalf("got found %v, want true", found)
+			}
+
+			if meta.Size != int64(len(value)) || meta.Version != 1 {
+				t.Errorf("got size %d at version %d, want %d at version 1", meta.Size, meta.Version, len(value))
+			}
+
+			content, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("error reading value: %s", err)
+			}
+
+			if string(content) != value {
+				t.Errorf("got value of length %d, want %d", len(content), len(value))
+			}
+
+			if _, err := reader.Seek(-6, io.SeekEnd); err != nil {
+				t.Fatalf("error seeking: %s", err)
+			}
+
+			tail, err := ioutil.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("error reading value: %s", err)
+			}
+
+			if string(tail) != "value " {
+				t.Errorf("got tail %q, want %q", tail, "value ")
+			}
+
+			meta, found, err = Stat(test.db, "key1")
+			if err != nil || !found {
+				t.Fatalf("got found %v and error %v, want value", found, err)
+			}
+
+			if meta.Size != int64(len(value)) || meta.Version != 1 {
+				t.Errorf("got size %d at version %d, want %d at version 1", meta.Size, meta.Version, len(value))
+			}
+
+			_, _, found, err = GetReader(test.db, "key2")
+			if err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+
+			if found {
+				t.Errorf("got found %v, want false", found)
+			}
+		})
+	}
+}
@@ -0,0 +1,21 @@
+package db
+
+import "time"
+
+// sweepInterval is the interval in which the backends remove expired values.
+const sweepInterval = time.Minute
+
+// runSweeper calls sweep regularly until done is closed.
+func runSweeper(done <-chan struct{}, sweep func()) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			sweep()
+		}
+	}
+}
@@ -0,0 +1,489 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The log backend keeps all values in memory and appends every change to a write-ahead log before applying it.
+// Every record of the log starts with a header containing the length of the payload and its CRC-32C checksum:
+//
+//	| length (4 bytes) | checksum (4 bytes) | payload (length bytes) |
+//
+// The payload is the JSON encoding of the changes made by a single write. Records contain the complete
+// new state of the changed keys, so replaying a record more than once has no further effect.
+//
+// Once the log grows beyond the compaction size, all values are written to a snapshot using the same format
+// and the log is started over with the records written while the snapshot was being created.
+const (
+	logFileName           = "wal.log"
+	snapshotFileName      = "snapshot"
+	recordHeaderSize      = 8
+	defaultCompactionSize = 64 << 20
+)
+
+var (
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	// errTornRecord is returned when the end of a log does not contain a complete record.
+	errTornRecord = errors.New("incomplete or corrupted record")
+	// errCorruptRecord is returned for a damaged record, which is followed by further data.
+	errCorruptRecord = errors.New("corrupted record")
+)
+
+type logDatabase struct {
+	*memoryDatabase
+	dir            string
+	durability     Durability
+	compactionSize int64
+	lockFile       *os.File
+	compact        chan struct{}
+
+	// The following fields are protected by the lock of the memory database.
+	log     *os.File
+	logSize int64
+	closed  bool
+	// failed is set when the end of the log could not be restored after a failed write.
+	failed error
+}
+
+// walChange is a change recorded in the log. A deleted key has a zero version.
+type walChange struct {
+	Key      string   `json:"key"`
+	Value    []byte   `json:"value,omitempty"`
+	Metadata Metadata `json:"metadata"`
+}
+
+// LogOption changes the configuration of a database with a write-ahead log.
+type LogOption func(d *logDatabase)
+
+// WithLogDurability sets how writes to the log are synchronized to disk. With DurabilityFile or higher,
+// every write is synchronized before it is acknowledged. The default is DurabilityDirectory.
+func WithLogDurability(durability Durability) LogOption {
+	return func(d *logDatabase) {
+		d.durability = durability
+	}
+}
+
+// WithCompactionSize sets the size in bytes after which the log is compacted into a snapshot.
+// A size of zero disables compaction.
+func WithCompactionSize(size int64) LogOption {
+	return func(d *logDatabase) {
+		d.compactionSize = size
+	}
+}
+
+// NewLogDatabase creates a database, which keeps all values in memory and uses a write-ahead log in dir
+// for persisting them. The snapshot and the log are read when opening the database. An incomplete record
+// at the end of the log, which is left behind by a crash during a write, is discarded. A damaged record
+// followed by further records can not be caused by a crash, so the database refuses to open.
+func NewLogDatabase(dir string, opts ...LogOption) (Database, error) {
+	stat, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		return nil, fmt.Errorf("directory does not exist: %s", dir)
+	case err != nil:
+		return nil, fmt.Errorf("error checking directory: %s", err)
+	}
+
+	if !stat.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", dir)
+	}
+
+	d := &logDatabase{
+		memoryDatabase: &memoryDatabase{
+			store: make(map[string]Entry),
+			now:   time.Now,
+			done:  make(chan struct{}),
+		},
+		dir:            dir,
+		durability:     DurabilityDirectory,
+		compactionSize: defaultCompactionSize,
+		compact:        make(chan struct{}, 1),
+	}
+	for _, o := range opts {
+		o(d)
+	}
+
+	d.lockFile, err = lockFile(filepath.Join(dir, lockFileName), true)
+	switch {
+	case err == errLocked:
+		return nil, fmt.Errorf("directory is locked by another process: %s", dir)
+	case err != nil:
+		return nil, err
+	}
+
+	if err := d.open(); err != nil {
+		d.lockFile.Close()
+		return nil, err
+	}
+
+	d.persist = d.append
+	go runSweeper(d.done, d.sweep)
+	go d.runCompactor()
+
+	return d, nil
+}
+
+// open reads the snapshot and the log and opens the log for appending.
+func (d *logDatabase) open() error {
+	if err := removeTempFiles(d.dir); err != nil {
+		return fmt.Errorf("error removing temporary files: %s", err)
+	}
+
+	snapshot, err := os.Open(filepath.Join(d.dir, snapshotFileName))
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		_, err := d.replay(snapshot)
+		snapshot.Close()
+		if err != nil {
+			return fmt.Errorf("error reading snapshot: %s", err)
+		}
+	}
+
+	d.log, err = os.OpenFile(filepath.Join(d.dir, logFileName), os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+
+	d.logSize, err = d.replay(d.log)
+	switch {
+	case err == errTornRecord:
+		log.Printf("Discarding incomplete record at offset %d of %s.", d.logSize, d.log.Name())
+		if err := d.log.Truncate(d.logSize); err != nil {
+			d.log.Close()
+			return fmt.Errorf("error truncating log: %s", err)
+		}
+	case err == errCorruptRecord:
+		d.log.Close()
+		return fmt.Errorf("log %s is corrupted at offset %d", d.log.Name(), d.logSize)
+	case err != nil:
+		d.log.Close()
+		return fmt.Errorf("error reading log: %s", err)
+	}
+
+	if _, err := d.log.Seek(d.logSize, io.SeekStart); err != nil {
+		d.log.Close()
+		return err
+	}
+
+	return nil
+}
+
+// replay applies the records read from file. It returns the offset after the last complete record.
+func (d *logDatabase) replay(file *os.File) (int64, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	reader := bufio.NewReader(file)
+	offset := int64(0)
+	for {
+		payload, err := readRecord(reader, stat.Size()-offset)
+		switch {
+		case err == io.EOF:
+			return offset, nil
+		case err != nil:
+			return offset, err
+		}
+
+		changes := []walChange{}
+		if err := json.Unmarshal(payload, &changes); err != nil {
+			return offset, fmt.Errorf("error decoding record at offset %d: %s", offset, err)
+		}
+
+		for _, c := range changes {
+			d.apply(change{
+				key: c.Key,
+				entry: Entry{
+					Value:    string(c.Value),
+					Metadata: c.Metadata,
+				},
+			})
+		}
+
+		offset += recordHeaderSize + int64(len(payload))
+	}
+}
+
+// readRecord returns the payload of the next record. Remaining is the number of bytes left in the file.
+// It returns io.EOF at the end of the file, errTornRecord for an incomplete or corrupted last record and
+// errCorruptRecord for a corrupted record followed by further data.
+func readRecord(reader io.Reader, remaining int64) ([]byte, error) {
+	header := make([]byte, recordHeaderSize)
+	_, err := io.ReadFull(reader, header)
+	switch {
+	case err == io.EOF:
+		return nil, io.EOF
+	case err == io.ErrUnexpectedEOF:
+		return nil, errTornRecord
+	case err != nil:
+		return nil, err
+	}
+
+	length := int64(binary.LittleEndian.Uint32(header[0:4]))
+	if length > remaining-recordHeaderSize {
+		return nil, errTornRecord
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:8]) {
+		if length == remaining-recordHeaderSize {
+			return nil, errTornRecord
+		}
+
+		return nil, errCorruptRecord
+	}
+
+	return payload, nil
+}
+
+// append writes changes to the log. The caller needs to hold the lock.
+func (d *logDatabase) append(changes []change) error {
+	if d.closed {
+		return errors.New("database is closed")
+	}
+
+	if d.failed != nil {
+		return d.failed
+	}
+
+	record, err := encodeRecord(changes)
+	if err != nil {
+		return err
+	}
+
+	if _, err := d.log.Write(record); err != nil {
+		return d.discardRecord(err)
+	}
+
+	if d.durability >= DurabilityFile {
+		if err := d.log.Sync(); err != nil {
+			return d.discardRecord(err)
+		}
+	}
+
+	d.logSize += int64(len(record))
+	if d.compactionSize > 0 && d.logSize > d.compactionSize {
+		select {
+		case d.compact <- struct{}{}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// discardRecord removes a record, which could not be written completely, from the end of the log, so that
+// it does not end up in front of the following records. If the log can not be restored, all further writes
+// fail. The caller needs to hold the lock.
+func (d *logDatabase) discardRecord(err error) error {
+	truncErr := d.log.Truncate(d.logSize)
+	if truncErr == nil {
+		_, truncErr = d.log.Seek(d.logSize, io.SeekStart)
+	}
+
+	if truncErr != nil {
+		d.failed = fmt.Errorf("log is in an unknown state after failed write: %s", truncErr)
+		log.Printf("Error restoring log %s: %s", d.log.Name(), truncErr)
+	}
+
+	return err
+}
+
+// runCompactor compacts the log when requested until the database is closed.
+func (d *logDatabase) runCompactor() {
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-d.compact:
+			if err := d.snapshot(); err != nil {
+				log.Printf("Error compacting log: %s", err)
+			}
+		}
+	}
+}
+
+// snapshot writes all values to a new snapshot and starts over with the records written in the meantime.
+// The lock is only held while copying the values and while replacing the log, so that writes continue while
+// the snapshot is being written.
+func (d *logDatabase) snapshot() error {
+	entries, offset, ok := d.snapshotState()
+	if !ok {
+		return nil
+	}
+
+	if err := d.writeSnapshot(entries); err != nil {
+		return err
+	}
+
+	return d.truncateLog(offset)
+}
+
+// snapshotState returns a copy of the current values and the size of the log containing their changes.
+func (d *logDatabase) snapshotState() (map[string]Entry, int64, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed {
+		return nil, 0, false
+	}
+
+	now := d.timeNow()
+	entries := make(map[string]Entry, len(d.store))
+	for key, entry := range d.store {
+		if !entry.Expired(now) {
+			entries[key] = entry
+		}
+	}
+
+	return entries, d.logSize, true
+}
+
+// writeSnapshot replaces the snapshot with one containing entries.
+func (d *logDatabase) writeSnapshot(entries map[string]Entry) error {
+	file, err := createTemp(d.dir)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	writer := bufio.NewWriter(file)
+	for key, entry := range entries {
+		record, err := encodeRecord([]change{{key: key, entry: entry}})
+		if err != nil {
+			file.Close()
+			return err
+		}
+
+		if _, err := writer.Write(record); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(file.Name(), filepath.Join(d.dir, snapshotFileName)); err != nil {
+		return err
+	}
+
+	return syncDir(d.dir)
+}
+
+// truncateLog replaces the log with the records following offset, which are not contained in the snapshot.
+//
+// The records preceding offset only contain changes which are part of the snapshot now. If the database is
+// opened before the log is replaced, replaying them again does not change the values, because the following
+// records are replayed as well.
+func (d *logDatabase) truncateLog(offset int64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.closed || d.failed != nil {
+		return nil
+	}
+
+	tail, err := createTemp(d.dir)
+	if err != nil {
+		return err
+	}
+
+	size, err := io.Copy(tail, io.NewSectionReader(d.log, offset, d.logSize-offset))
+	if err == nil {
+		err = tail.Sync()
+	}
+
+	path := filepath.Join(d.dir, logFileName)
+	if err == nil {
+		err = os.Rename(tail.Name(), path)
+	}
+
+	if err != nil {
+		tail.Close()
+		os.Remove(tail.Name())
+		return err
+	}
+
+	if err := syncDir(d.dir); err != nil {
+		tail.Close()
+		return err
+	}
+
+	d.log.Close()
+	d.log = tail
+	d.logSize = size
+	return nil
+}
+
+func (d *logDatabase) Close() error {
+	d.memoryDatabase.Close()
+
+	d.lock.Lock()
+	d.closed = true
+	err := d.log.Close()
+	d.lock.Unlock()
+
+	if lockErr := d.lockFile.Close(); err == nil {
+		err = lockErr
+	}
+
+	return err
+}
+
+// encodeRecord returns a log record containing changes.
+func encodeRecord(changes []change) ([]byte, error) {
+	records := make([]walChange, 0, len(changes))
+	for _, c := range changes {
+		records = append(records, walChange{
+			Key:      c.key,
+			Value:    []byte(c.entry.Value),
+			Metadata: c.entry.Metadata,
+		})
+	}
+
+	payload, err := json.Marshal(records)
+	if err != nil {
+		return nil, err
+	}
+
+	return frameRecord(payload), nil
+}
+
+// frameRecord prepends the header containing the length and checksum to payload.
+func frameRecord(payload []byte) []byte {
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[recordHeaderSize:], payload)
+	return record
+}
@@ -0,0 +1,346 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openLogDatabase(t *testing.T, dir string, opts ...LogOption) *logDatabase {
+	t.Helper()
+
+	db, err := NewLogDatabase(dir, opts...)
+	if err != nil {
+		t.Fatalf("error opening database: %s", err)
+	}
+
+	return db.(*logDatabase)
+}
+
+func checkLogValues(t *testing.T, db Database, expected map[string]string) {
+	t.Helper()
+
+	keys, err := db.List()
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	values := map[string]string{}
+	for _, k := range keys {
+		entry, _, err := db.Get(k)
+		if err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+
+		values[k] = entry.Value
+	}
+
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("got values %q, want %q", values, expected)
+	}
+}
+
+func TestLogReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openLogDatabase(t, dir)
+	if err := db.Put("key1", "value1", WithContentType("text/plain")); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if err := db.Put("key1", "\xff\x00binary"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if _, err := db.Delete("key2"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if err := db.Batch([]Op{PutOp("key3", "value3"), PutOp("key4", "")}); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if _, err := NewLogDatabase(dir); err == nil {
+		t.Errorf("got no error opening locked directory, want error")
+	}
+
+	before, _, _ := db.Get("key1")
+	db.Close()
+
+	db = openLogDatabase(t, dir)
+	defer db.Close()
+
+	checkLogValues(t, db, map[string]string{
+		"key1": "\xff\x00binary",
+		"key3": "value3",
+		"key4": "",
+	})
+
+	after, _, _ := db.Get("key1")
+	if after.Version != before.Version || after.Checksum != before.Checksum || !after.Created.Equal(before.Created) {
+		t.Errorf("got metadata %+v, want %+v", after.Metadata, before.Metadata)
+	}
+
+	if err := db.CompareAndPut("key1", "value", 2); err != nil {
+		t.Errorf("got error %q, want none", err)
+	}
+}
+
+func TestLogTornTail(t *testing.T) {
+	for _, test := range []struct {
+		desc    string
+		corrupt func(content []byte) []byte
+	}{
+		{
+			desc: "partial header",
+			corrupt: func(content []byte) []byte {
+				return append(content, 0x10, 0x00)
+			},
+		},
+		{
+			desc: "partial payload",
+			corrupt: func(content []byte) []byte {
+				return content[:len(content)-3]
+			},
+		},
+		{
+			desc: "checksum mismatch",
+			corrupt: func(content []byte) []byte {
+				content[len(content)-2] ^= 0xFF
+				return content
+			},
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			dir, err := ioutil.TempDir("", "uswd")
+			if err != nil {
+				t.Fatalf("error creating temporary directory: %s", err)
+			}
+			defer os.RemoveAll(dir)
+
+			db := openLogDatabase(t, dir, WithLogDurability(DurabilityNone))
+			if err := db.Put("key1", "value1"); err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+
+			if err := db.Put("key2", "value2"); err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+			db.Close()
+
+			path := filepath.Join(dir, logFileName)
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatalf("error reading log: %s", err)
+			}
+
+			if err := ioutil.WriteFile(path, test.corrupt(content), 0666); err != nil {
+				t.Fatalf("error writing log: %s", err)
+			}
+
+			db = openLogDatabase(t, dir, WithLogDurability(DurabilityNone))
+			expected := map[string]string{
+				"key1": "value1",
+				"key2": "value2",
+			}
+			if test.desc != "partial header" {
+				delete(expected, "key2")
+			}
+			checkLogValues(t, db, expected)
+
+			if err := db.Put("key3", "value3"); err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+			db.Close()
+
+			db = openLogDatabase(t, dir, WithLogDurability(DurabilityNone))
+			defer db.Close()
+
+			expected["key3"] = "value3"
+			checkLogValues(t, db, expected)
+		})
+	}
+}
+
+func TestLogSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openLogDatabase(t, dir, WithCompactionSize(0))
+	for _, k := range []string{"key1", "key2", "key3"} {
+		if err := db.Put(k, "old"); err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+	}
+
+	if _, err := db.Delete("key3"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if err := db.snapshot(); err != nil {
+		t.Fatalf("error creating snapshot: %s", err)
+	}
+
+	if db.logSize != 0 {
+		t.Errorf("got log size %d after snapshot, want 0", db.logSize)
+	}
+
+	if err := db.Put("key2", "new"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	db.Close()
+
+	db = openLogDatabase(t, dir, WithCompactionSize(0))
+	defer db.Close()
+
+	checkLogValues(t, db, map[string]string{
+		"key1": "old",
+		"key2": "new",
+	})
+
+	entry, _, err := db.Get("key2")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if entry.Version != 2 {
+		t.Errorf("got version %d, want 2", entry.Version)
+	}
+}
+
+func TestLogCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openLogDatabase(t, dir, WithLogDurability(DurabilityNone))
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if err := db.Put("key2", "value2"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	db.Close()
+
+	path := filepath.Join(dir, logFileName)
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("error reading log: %s", err)
+	}
+
+	// Damage the payload of the first record, which is followed by the second one.
+	content[recordHeaderSize+2] ^= 0xFF
+	if err := ioutil.WriteFile(path, content, 0666); err != nil {
+		t.Fatalf("error writing log: %s", err)
+	}
+
+	if _, err := NewLogDatabase(dir, WithLogDurability(DurabilityNone)); err == nil {
+		t.Fatal("got no error, want error")
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("error checking log: %s", err)
+	}
+
+	if stat.Size() != int64(len(content)) {
+		t.Errorf("got log size %d, want %d", stat.Size(), len(content))
+	}
+}
+
+func TestLogSnapshotConcurrentWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openLogDatabase(t, dir, WithCompactionSize(0))
+	if err := db.Put("key1", "old"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	entries, offset, ok := db.snapshotState()
+	if !ok {
+		t.Fatal("got no snapshot state, want state")
+	}
+
+	// Writes made while the snapshot is being written are kept in the log.
+	if err := db.Put("key2", "during"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if err := db.writeSnapshot(entries); err != nil {
+		t.Fatalf("error writing snapshot: %s", err)
+	}
+
+	if err := db.truncateLog(offset); err != nil {
+		t.Fatalf("error truncating log: %s", err)
+	}
+
+	if err := db.Put("key3", "after"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	db.Close()
+
+	db = openLogDatabase(t, dir, WithCompactionSize(0))
+	defer db.Close()
+
+	checkLogValues(t, db, map[string]string{
+		"key1": "old",
+		"key2": "during",
+		"key3": "after",
+	})
+}
+
+func TestLogFailedWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("error creating temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := openLogDatabase(t, dir, WithCompactionSize(0))
+	defer db.Close()
+
+	if err := db.Put("key1", "value1"); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	// The end of a log, which can neither be written nor truncated, is unknown.
+	db.log.Close()
+	if err := db.Put("key2", "value2"); err == nil {
+		t.Fatal("got no error, want error")
+	}
+
+	if db.failed == nil {
+		t.Error("got no failure, want failure")
+	}
+
+	if err := db.Put("key3", "value3"); err != db.failed {
+		t.Errorf("got error %v, want %v", err, db.failed)
+	}
+
+	checkLogValues(t, db, map[string]string{
+		"key1": "value1",
+	})
+}
@@ -0,0 +1,640 @@
+package db
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHistorySize        = 1000
+	defaultSubscriptionBuffer = 100
+)
+
+var (
+	// ErrRevisionUnavailable is returned when watching from a revision, which is no longer kept in the history
+	// or has not been reached yet.
+	ErrRevisionUnavailable = errors.New("revision is not available")
+	// ErrSubscriptionOverflow is reported by subscriptions, which have been closed because they did not receive
+	// their events fast enough.
+	ErrSubscriptionOverflow = errors.New("subscription could not keep up with changes")
+
+	errHubClosed = errors.New("hub is closed")
+)
+
+// EventType is the kind of change reported by an event.
+type EventType int
+
+const (
+	// EventPut is reported when a value has been stored.
+	EventPut EventType = iota + 1
+	// EventDelete is reported when a key has been deleted.
+	EventDelete
+)
+
+var eventTypeNames = map[EventType]string{
+	EventPut:    "put",
+	EventDelete: "delete",
+}
+
+func (t EventType) String() string {
+	if name, ok := eventTypeNames[t]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// MarshalText encodes the event type using its name.
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText decodes an event type from its name.
+func (t *EventType) UnmarshalText(text []byte) error {
+	for et, name := range eventTypeNames {
+		if name == string(text) {
+			*t = et
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown event type: %s", text)
+}
+
+// Event describes a change of a key.
+type Event struct {
+	// Revision numbers the events of a hub in the order they happened.
+	Revision uint64    `json:"revision"`
+	Type     EventType `json:"type"`
+	Key      string    `json:"key"`
+	// Time is the time the change has been made.
+	Time time.Time `json:"time,omitzero"`
+	// Metadata contains the new metadata of a stored value. It is empty for deleted keys. Events do not contain
+	// the value itself, its size and checksum identify it.
+	Metadata Metadata `json:"metadata,omitzero"`
+}
+
+// Watcher is implemented by databases, which report changes of their keys.
+type Watcher interface {
+	// Watch subscribes to changes of keys starting with prefix. If since is not zero, the events following
+	// that revision are delivered first.
+	Watch(prefix string, since uint64) (*Subscription, error)
+}
+
+// ChangeFeed is implemented by databases, which keep the changes made to them.
+type ChangeFeed interface {
+	Watcher
+	// Revision returns the revision of the latest event.
+	Revision() uint64
+	// Epoch identifies the sequence of revisions. It changes when the revisions start over, so that consumers
+	// know that they need to read all keys again.
+	Epoch() string
+	// Changes returns up to limit events following the revision since. A limit of zero returns all events.
+	Changes(since uint64, limit int) ([]Event, error)
+}
+
+// FindWatcher returns the first database implementing Watcher, following the databases wrapped by database.
+func FindWatcher(database Database) (Watcher, bool) {
+	found, ok := find(database, func(d Database) bool {
+		_, ok := d.(Watcher)
+		return ok
+	})
+	if !ok {
+		return nil, false
+	}
+
+	return found.(Watcher), true
+}
+
+// FindChangeFeed returns the first database implementing ChangeFeed, following the databases wrapped by database.
+func FindChangeFeed(database Database) (ChangeFeed, bool) {
+	found, ok := find(database, func(d Database) bool {
+		_, ok := d.(ChangeFeed)
+		return ok
+	})
+	if !ok {
+		return nil, false
+	}
+
+	return found.(ChangeFeed), true
+}
+
+// Hub wraps a database and notifies subscribers about the changes made through it. It keeps the latest
+// events in memory, so that subscribers can resume after a lost connection. Without a change log, revisions
+// start over when the hub is created. Values removed after they expired are not reported.
+//
+// A change is only acknowledged once its event has been appended to the change log. The keys are marked as
+// pending in the log before the database is changed, so that the state of keys, whose change has been
+// interrupted by a crash, is reported when the hub is created again.
+type Hub struct {
+	Database
+	historySize int
+	bufferSize  int
+	changeLog   *ChangeLog
+	epoch       string
+	keys        keyLocks
+
+	lock          sync.Mutex
+	revision      uint64
+	history       []Event
+	subscriptions map[*Subscription]struct{}
+	closed        bool
+}
+
+// HubOption changes the configuration of a hub.
+type HubOption func(h *Hub)
+
+// WithHistorySize sets the number of events kept for subscribers resuming from an earlier revision.
+// The default is 1000.
+func WithHistorySize(size int) HubOption {
+	return func(h *Hub) {
+		h.historySize = size
+	}
+}
+
+// WithSubscriptionBuffer sets the number of events buffered for every subscriber. Subscribers which fall
+// further behind are closed with ErrSubscriptionOverflow. The default is 100.
+func WithSubscriptionBuffer(size int) HubOption {
+	return func(h *Hub) {
+		h.bufferSize = size
+	}
+}
+
+// WithChangeLog persists the events in a change log. Revisions continue after the latest event of the log
+// and changes are available for the retention window of the log. The log is closed together with the hub.
+func WithChangeLog(changeLog *ChangeLog) HubOption {
+	return func(h *Hub) {
+		h.changeLog = changeLog
+	}
+}
+
+// NewHub creates a hub reporting the changes made to database.
+func NewHub(database Database, opts ...HubOption) *Hub {
+	h := &Hub{
+		Database:      database,
+		historySize:   defaultHistorySize,
+		bufferSize:    defaultSubscriptionBuffer,
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+	for _, o := range opts {
+		o(h)
+	}
+
+	h.epoch = newEpoch()
+	if h.changeLog != nil {
+		h.epoch = h.changeLog.Epoch()
+		h.loadHistory()
+		if err := h.recover(); err != nil {
+			log.Printf("Error reporting interrupted changes: %s", err)
+		}
+	}
+
+	return h
+}
+
+// loadHistory continues with the latest revision of the change log and keeps its latest events in memory.
+func (h *Hub) loadHistory() {
+	h.revision = h.changeLog.Revision()
+
+	since := uint64(0)
+	if h.revision > uint64(h.historySize) {
+		since = h.revision - uint64(h.historySize)
+	}
+
+	if first := h.changeLog.first(); since+1 < first {
+		since = first - 1
+	}
+
+	events, err := h.changeLog.read(since, h.historySize)
+	if err != nil {
+		log.Printf("Error reading change log: %s", err)
+		return
+	}
+
+	// The history needs to be contiguous up to the latest revision.
+	if len(events) > 0 && events[len(events)-1].Revision == h.revision {
+		h.history = events
+	}
+}
+
+// recover reports the state of the keys, whose changes have been started but not reported before the hub
+// was stopped. Keys which do not exist are reported as deleted.
+func (h *Hub) recover() error {
+	keys := h.changeLog.pendingKeys()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	existed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		existed[key] = true
+	}
+
+	log.Printf("Reporting %d keys changed before the hub was stopped.", len(keys))
+	return h.publishState(existed, keys...)
+}
+
+// Unwrap returns the database, which is wrapped by the hub.
+func (h *Hub) Unwrap() Database {
+	return h.Database
+}
+
+// Revision returns the revision of the latest event.
+func (h *Hub) Revision() uint64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	return h.revision
+}
+
+// Epoch returns the epoch of the change log. Without a change log, every hub has its own epoch, as its
+// revisions start over.
+func (h *Hub) Epoch() string {
+	return h.epoch
+}
+
+func (h *Hub) Watch(prefix string, since uint64) (*Subscription, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.closed {
+		return nil, errHubClosed
+	}
+
+	backlog := []Event{}
+	if since > 0 {
+		if since > h.revision || since < h.revision-uint64(len(h.history)) {
+			return nil, ErrRevisionUnavailable
+		}
+
+		for _, e := range h.history {
+			if e.Revision > since && strings.HasPrefix(e.Key, prefix) {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	s := &Subscription{
+		hub:    h,
+		prefix: prefix,
+		events: make(chan Event, h.bufferSize+len(backlog)),
+	}
+	for _, e := range backlog {
+		s.events <- e
+	}
+
+	h.subscriptions[s] = struct{}{}
+	return s, nil
+}
+
+// Changes returns up to limit events following the revision since. A limit of zero returns all events.
+// Events which are no longer kept in memory are read from the change log.
+func (h *Hub) Changes(since uint64, limit int) ([]Event, error) {
+	h.lock.Lock()
+	if since > h.revision {
+		h.lock.Unlock()
+		return nil, ErrRevisionUnavailable
+	}
+
+	if since >= h.revision-uint64(len(h.history)) {
+		defer h.lock.Unlock()
+
+		events := []Event{}
+		for _, e := range h.history {
+			if limit > 0 && len(events) >= limit {
+				break
+			}
+
+			if e.Revision > since {
+				events = append(events, e)
+			}
+		}
+
+		return events, nil
+	}
+
+	changeLog := h.changeLog
+	h.lock.Unlock()
+
+	if changeLog == nil {
+		return nil, ErrRevisionUnavailable
+	}
+
+	return changeLog.read(since, limit)
+}
+
+func (h *Hub) Put(key, value string, opts ...PutOption) error {
+	defer h.keys.acquire(key)()
+
+	return h.change(map[string]bool{}, []string{key}, func() (bool, error) {
+		return true, h.Database.Put(key, value, opts...)
+	})
+}
+
+func (h *Hub) CompareAndPut(key, value string, expectedVersion int64, opts ...PutOption) error {
+	defer h.keys.acquire(key)()
+
+	return h.change(map[string]bool{}, []string{key}, func() (bool, error) {
+		return true, h.Database.CompareAndPut(key, value, expectedVersion, opts...)
+	})
+}
+
+func (h *Hub) Delete(key string) (bool, error) {
+	defer h.keys.acquire(key)()
+
+	found := false
+	err := h.change(map[string]bool{key: true}, []string{key}, func() (bool, error) {
+		var err error
+		found, err = h.Database.Delete(key)
+		return found, err
+	})
+
+	return found, err
+}
+
+func (h *Hub) Batch(ops []Op) error {
+	keys := make([]string, 0, len(ops))
+	for _, op := range ops {
+		keys = append(keys, op.Key)
+	}
+	keys = uniqueKeys(keys)
+
+	defer h.keys.acquire(keys...)()
+
+	existed := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		_, found, err := Stat(h.Database, key)
+		switch err.(type) {
+		case nil:
+		case *InvalidKeyError:
+			// Let the database report the invalid operation.
+			return h.Database.Batch(ops)
+		default:
+			return err
+		}
+
+		existed[key] = found
+	}
+
+	return h.change(existed, keys, func() (bool, error) {
+		return true, h.Database.Batch(ops)
+	})
+}
+
+// GetReader streams the value of key if the wrapped database supports it.
+func (h *Hub) GetReader(key string) (ValueReader, Metadata, bool, error) {
+	return GetReader(h.Database, key)
+}
+
+// PutReader streams the value of key if the wrapped database supports it.
+func (h *Hub) PutReader(key string, r io.Reader, expectedVersion int64, opts ...PutOption) error {
+	defer h.keys.acquire(key)()
+
+	return h.change(map[string]bool{}, []string{key}, func() (bool, error) {
+		return true, PutReader(h.Database, key, r, expectedVersion, opts...)
+	})
+}
+
+// Close closes all subscriptions, the wrapped database and the change log.
+func (h *Hub) Close() error {
+	h.lock.Lock()
+	if h.closed {
+		h.lock.Unlock()
+		return nil
+	}
+
+	h.closed = true
+	for s := range h.subscriptions {
+		h.unsubscribe(s, nil)
+	}
+	h.lock.Unlock()
+
+	err := h.Database.Close()
+	if h.changeLog != nil {
+		if logErr := h.changeLog.Close(); err == nil {
+			err = logErr
+		}
+	}
+
+	return err
+}
+
+// change makes a change of keys using write and reports their new state. write returns false if nothing has
+// been changed. With a change log, the keys are marked as pending before they are changed. The caller needs to
+// hold the locks of the keys.
+func (h *Hub) change(existed map[string]bool, keys []string, write func() (bool, error)) error {
+	if h.changeLog != nil {
+		if err := h.changeLog.begin(keys...); err != nil {
+			return fmt.Errorf("error writing change log: %s", err)
+		}
+	}
+
+	changed, err := write()
+	if err != nil || !changed {
+		if h.changeLog != nil {
+			if abortErr := h.changeLog.abort(keys...); abortErr != nil {
+				log.Printf("Error writing change log: %s", abortErr)
+			}
+		}
+
+		return err
+	}
+
+	return h.publishState(existed, keys...)
+}
+
+// publishState reports the current metadata of keys after they have been changed. Keys which do not exist
+// are reported as deleted, if they existed before. The caller needs to hold the locks of the keys.
+func (h *Hub) publishState(existed map[string]bool, keys ...string) error {
+	events := make([]Event, 0, len(keys))
+	for _, key := range keys {
+		meta, found, err := Stat(h.Database, key)
+		switch {
+		case err != nil:
+			return fmt.Errorf("error reading changed key %q: %s", key, err)
+		case found:
+			events = append(events, Event{
+				Type:     EventPut,
+				Key:      key,
+				Metadata: meta,
+			})
+		case existed[key]:
+			events = append(events, Event{
+				Type: EventDelete,
+				Key:  key,
+			})
+		}
+	}
+
+	return h.publish(events...)
+}
+
+// publish assigns revisions to events, appends them to the change log and delivers them to the subscribers.
+// The revision of the hub only advances once the events have been appended.
+func (h *Hub) publish(events ...Event) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	now := time.Now()
+	for i := range events {
+		events[i].Revision = h.revision + uint64(i) + 1
+		events[i].Time = now
+	}
+
+	if h.changeLog != nil {
+		if err := h.changeLog.append(events...); err != nil {
+			return fmt.Errorf("error writing change log: %s", err)
+		}
+	}
+	h.revision += uint64(len(events))
+
+	for _, e := range events {
+		if h.historySize > 0 {
+			if len(h.history) >= h.historySize {
+				h.history = h.history[1:]
+			}
+			h.history = append(h.history, e)
+		}
+
+		for s := range h.subscriptions {
+			if !strings.HasPrefix(e.Key, s.prefix) {
+				continue
+			}
+
+			select {
+			case s.events <- e:
+			default:
+				h.unsubscribe(s, ErrSubscriptionOverflow)
+			}
+		}
+	}
+
+	return nil
+}
+
+// unsubscribe removes a subscription and closes its channel. The caller needs to hold the lock.
+func (h *Hub) unsubscribe(s *Subscription, err error) {
+	if _, ok := h.subscriptions[s]; !ok {
+		return
+	}
+
+	delete(h.subscriptions, s)
+	s.err = err
+	close(s.events)
+}
+
+// Subscription receives the events of a hub.
+type Subscription struct {
+	hub    *Hub
+	prefix string
+	events chan Event
+	err    error
+}
+
+// Events returns the channel delivering the events. It is closed when the subscription ends.
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Err returns the reason why the subscription has been ended by the hub. It is nil while the subscription
+// is active and after it has been closed regularly.
+func (s *Subscription) Err() error {
+	s.hub.lock.Lock()
+	defer s.hub.lock.Unlock()
+
+	return s.err
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.hub.lock.Lock()
+	defer s.hub.lock.Unlock()
+
+	s.hub.unsubscribe(s, nil)
+}
+
+// keyLocks serializes changes of the same key, while different keys can be changed concurrently.
+type keyLocks struct {
+	lock  sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	refs int
+}
+
+// acquire locks the sorted, distinct keys and returns a function releasing them again.
+func (l *keyLocks) acquire(keys ...string) func() {
+	l.lock.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*keyLock)
+	}
+
+	locks := make([]*keyLock, 0, len(keys))
+	for _, key := range keys {
+		kl, ok := l.locks[key]
+		if !ok {
+			kl = &keyLock{}
+			l.locks[key] = kl
+		}
+
+		kl.refs++
+		locks = append(locks, kl)
+	}
+	l.lock.Unlock()
+
+	for _, kl := range locks {
+		kl.Lock()
+	}
+
+	return func() {
+		l.lock.Lock()
+		defer l.lock.Unlock()
+
+		for i, kl := range locks {
+			kl.Unlock()
+
+			kl.refs--
+			if kl.refs == 0 {
+				delete(l.locks, keys[i])
+			}
+		}
+	}
+}
+
+// newEpoch returns a random epoch.
+func newEpoch() string {
+	epoch := make([]byte, 8)
+	if _, err := rand.Read(epoch); err != nil {
+		// The current time still distinguishes restarts.
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+
+	return hex.EncodeToString(epoch)
+}
+
+// uniqueKeys sorts keys and removes duplicates.
+func uniqueKeys(keys []string) []string {
+	sort.Strings(keys)
+
+	result := keys[:0]
+	for _, key := range keys {
+		if len(result) > 0 && key == result[len(result)-1] {
+			continue
+		}
+
+		result = append(result, key)
+	}
+
+	return result
+}
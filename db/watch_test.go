@@ -0,0 +1,208 @@
+package db
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// receive returns the events waiting in a subscription.
+func receive(s *Subscription) []Event {
+	events := []Event{}
+	for {
+		select {
+		case e, ok := <-s.Events():
+			if !ok {
+				return events
+			}
+
+			events = append(events, Event{
+				Revision: e.Revision,
+				Type:     e.Type,
+				Key:      e.Key,
+				Metadata: Metadata{
+					Version: e.Metadata.Version,
+				},
+			})
+		default:
+			return events
+		}
+	}
+}
+
+func TestHubWatch(t *testing.T) {
+	hub := NewHub(NewMemoryDatabase())
+	defer hub.Close()
+
+	all, err := hub.Watch("", 0)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	team, err := hub.Watch("team/", 0)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	hub.Put("team/a", "value")
+	hub.Put("other", "value")
+	hub.CompareAndPut("team/a", "value", 1)
+	hub.CompareAndPut("team/a", "value", 1)
+	hub.Delete("team/missing")
+	hub.Delete("other")
+	err = hub.Batch([]Op{
+		PutOp("team/b", "value"),
+		DeleteOp("team/a"),
+		DeleteOp("team/missing"),
+	})
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	expectedAll := []Event{
+		{Revision: 1, Type: EventPut, Key: "team/a", Metadata: Metadata{Version: 1}},
+		{Revision: 2, Type: EventPut, Key: "other", Metadata: Metadata{Version: 1}},
+		{Revision: 3, Type: EventPut, Key: "team/a", Metadata: Metadata{Version: 2}},
+		{Revision: 4, Type: EventDelete, Key: "other"},
+		{Revision: 5, Type: EventDelete, Key: "team/a"},
+		{Revision: 6, Type: EventPut, Key: "team/b", Metadata: Metadata{Version: 1}},
+	}
+	if events := receive(all); !reflect.DeepEqual(events, expectedAll) {
+		t.Errorf("got events %+v, want %+v", events, expectedAll)
+	}
+
+	expectedTeam := []Event{expectedAll[0], expectedAll[2], expectedAll[4], expectedAll[5]}
+	if events := receive(team); !reflect.DeepEqual(events, expectedTeam) {
+		t.Errorf("got events %+v, want %+v", events, expectedTeam)
+	}
+
+	if hub.Revision() != 6 {
+		t.Errorf("got revision %d, want 6", hub.Revision())
+	}
+
+	team.Close()
+	hub.Put("team/c", "value")
+	if events := receive(team); len(events) != 0 {
+		t.Errorf("got events %+v after closing, want none", events)
+	}
+
+	hub.Close()
+	if events := receive(all); len(events) != 1 {
+		t.Errorf("got %d events, want 1", len(events))
+	}
+
+	if _, ok := <-all.Events(); ok {
+		t.Error("got open channel after closing hub, want closed")
+	}
+
+	if all.Err() != nil {
+		t.Errorf("got error %q, want none", all.Err())
+	}
+}
+
+func TestHubResume(t *testing.T) {
+	hub := NewHub(NewMemoryDatabase(), WithHistorySize(3))
+	defer hub.Close()
+
+	for _, key := range []string{"a", "b", "a", "c", "a"} {
+		hub.Put(key, "value")
+	}
+
+	tests := []struct {
+		since     uint64
+		revisions []uint64
+		err       error
+	}{
+		{since: 0, revisions: []uint64{}},
+		{since: 1, err: ErrRevisionUnavailable},
+		{since: 2, revisions: []uint64{3, 5}},
+		{since: 4, revisions: []uint64{5}},
+		{since: 5, revisions: []uint64{}},
+		{since: 6, err: ErrRevisionUnavailable},
+	}
+
+	for _, test := range tests {
+		s, err := hub.Watch("a", test.since)
+		if err != test.err {
+			t.Errorf("got error %v since %d, want %v", err, test.since, test.err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		revisions := []uint64{}
+		for _, e := range receive(s) {
+			revisions = append(revisions, e.Revision)
+		}
+
+		if !reflect.DeepEqual(revisions, test.revisions) {
+			t.Errorf("got revisions %v since %d, want %v", revisions, test.since, test.revisions)
+		}
+	}
+}
+
+func TestHubOverflow(t *testing.T) {
+	hub := NewHub(NewMemoryDatabase(), WithSubscriptionBuffer(2))
+	defer hub.Close()
+
+	s, err := hub.Watch("", 0)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		hub.Put("key", "value")
+	}
+
+	if events := receive(s); len(events) != 2 {
+		t.Errorf("got %d events, want 2", len(events))
+	}
+
+	if s.Err() != ErrSubscriptionOverflow {
+		t.Errorf("got error %v, want %q", s.Err(), ErrSubscriptionOverflow)
+	}
+}
+
+// streamingDatabase is a memory database, which reports values read in full by Get.
+type streamingDatabase struct {
+	Database
+	gets int
+}
+
+func (d *streamingDatabase) Get(key string) (Entry, bool, error) {
+	d.gets++
+	return d.Database.Get(key)
+}
+
+func (d *streamingDatabase) GetReader(key string) (ValueReader, Metadata, bool, error) {
+	return GetReader(d.Database, key)
+}
+
+func (d *streamingDatabase) PutReader(key string, r io.Reader, expectedVersion int64, opts ...PutOption) error {
+	return PutReader(d.Database, key, r, expectedVersion, opts...)
+}
+
+func TestHubMetadataOnly(t *testing.T) {
+	database := &streamingDatabase{Database: NewMemoryDatabase()}
+	hub := NewHub(database)
+	defer hub.Close()
+
+	s, err := hub.Watch("", 0)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	hub.Put("a", "value")
+	hub.PutReader("b", strings.NewReader("value"), AnyVersion)
+	hub.Batch([]Op{PutOp("a", "new value"), DeleteOp("b")})
+
+	if events := receive(s); len(events) != 4 {
+		t.Errorf("got %d events, want 4", len(events))
+	}
+
+	if database.gets != 0 {
+		t.Errorf("got %d values read, want none", database.gets)
+	}
+}
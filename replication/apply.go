@@ -0,0 +1,51 @@
+package replication
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/xperimental/uswd/db"
+)
+
+// snapshotEntry is a single key of the snapshot sent by the leader.
+type snapshotEntry struct {
+	Key      string      `json:"key"`
+	Value    []byte      `json:"value"`
+	Metadata db.Metadata `json:"metadata"`
+}
+
+// apply changes database like the event changed the leader. Events do not contain values, so value is the
+// value of a stored key read from the leader.
+func apply(database db.Database, event db.Event, value []byte, now time.Time) error {
+	switch event.Type {
+	case db.EventPut:
+		return put(database, event.Key, value, event.Metadata, now)
+	case db.EventDelete:
+		_, err := database.Delete(event.Key)
+		return err
+	default:
+		return fmt.Errorf("unknown event type: %s", event.Type)
+	}
+}
+
+// put stores a value of the leader including its metadata, so that versions, times and expiry match the
+// leader. Values which already expired are deleted instead. A value, which is already stored, is not written
+// again, so that copying all keys again does not change unchanged keys.
+func put(database db.Database, key string, value []byte, meta db.Metadata, now time.Time) error {
+	if meta.Expired(now) {
+		_, err := database.Delete(key)
+		return err
+	}
+
+	current, found, err := db.Stat(database, key)
+	if err != nil {
+		return err
+	}
+
+	if found && current.Version == meta.Version && current.Checksum == meta.Checksum &&
+		current.Modified.Equal(meta.Modified) {
+		return nil
+	}
+
+	return database.Put(key, string(value), db.WithMetadata(meta))
+}
@@ -0,0 +1,560 @@
+// Package replication copies the contents of a server to another database.
+package replication
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xperimental/uswd/db"
+)
+
+const (
+	// revisionHeader contains the latest revision of the leader.
+	revisionHeader = "X-Revision"
+	// epochHeader identifies the sequence of revisions of the leader.
+	epochHeader = "X-Epoch"
+	// idleTimeout is the time after which a connection to the leader, which has not sent anything, is given up.
+	// The leader sends keep-alives while there are no changes.
+	idleTimeout = 90 * time.Second
+	// defaultRetryInterval is the time waited before connecting again after an error.
+	defaultRetryInterval = 5 * time.Second
+	// stateInterval is the minimum time between saving the applied revision to the state file.
+	stateInterval = time.Second
+)
+
+// errSnapshotNeeded is returned when the leader no longer has the changes following the applied revision or
+// when its revisions have started over.
+var errSnapshotNeeded = errors.New("changes are no longer available on the leader")
+
+// State is the phase of the replication.
+type State string
+
+const (
+	// StateConnecting is reported until the follower has connected to the leader.
+	StateConnecting State = "connecting"
+	// StateSnapshot is reported while the follower copies all keys of the leader.
+	StateSnapshot State = "snapshot"
+	// StateFollowing is reported while the follower applies the changes of the leader.
+	StateFollowing State = "following"
+	// StateDisconnected is reported after the connection to the leader has been lost.
+	StateDisconnected State = "disconnected"
+)
+
+// Status describes the progress of a follower.
+type Status struct {
+	Leader string `json:"leader"`
+	State  State  `json:"state"`
+	// Revision is the revision of the leader, which has been applied last.
+	Revision uint64 `json:"revision"`
+	// LeaderRevision is the latest revision of the leader known to the follower.
+	LeaderRevision uint64 `json:"leaderRevision"`
+	// Lag is the number of changes of the leader, which have not been applied yet.
+	Lag uint64 `json:"lag"`
+	// LastContact is the time data has last been received from the leader.
+	LastContact time.Time `json:"lastContact,omitzero"`
+	// Error is the error which ended the last connection to the leader.
+	Error string `json:"error,omitempty"`
+}
+
+// Follower replicates the changes of a leader server to a database.
+//
+// A follower without a known revision first copies all keys of the leader. Afterwards it applies the changes
+// following the copied revision. If the leader no longer keeps these changes, because the follower has been
+// disconnected for too long, or if the epoch of the leader changed, because its revisions started over, the
+// follower copies all keys again. Values are stored with the metadata of the leader, so their versions, times
+// and expiry are the same on the follower. Changes made to several keys in a batch
+// are applied one by one. The changes of the leader do not contain values, the follower reads every changed
+// value from the leader.
+type Follower struct {
+	leader        *url.URL
+	database      db.Database
+	client        *http.Client
+	stateFile     string
+	retryInterval time.Duration
+
+	lock   sync.Mutex
+	status Status
+	synced bool
+	saved  time.Time
+	// epoch is the epoch of the leader the applied revision belongs to.
+	epoch string
+}
+
+// FollowerOption changes the configuration of a follower.
+type FollowerOption func(f *Follower)
+
+// WithStateFile keeps the applied revision in a file, so that a restarted follower continues with the changes
+// it has not applied yet. Without a state file, the follower copies all keys when it is started.
+func WithStateFile(path string) FollowerOption {
+	return func(f *Follower) {
+		f.stateFile = path
+	}
+}
+
+// WithClient sets the HTTP client used for connecting to the leader.
+func WithClient(client *http.Client) FollowerOption {
+	return func(f *Follower) {
+		f.client = client
+	}
+}
+
+// WithRetryInterval sets the time waited before connecting to the leader again after an error.
+// The default is five seconds.
+func WithRetryInterval(interval time.Duration) FollowerOption {
+	return func(f *Follower) {
+		f.retryInterval = interval
+	}
+}
+
+// NewFollower creates a follower of the server at leader, which stores the replicated keys in database.
+// The leader needs to keep its changes. It should use a change log, so that revisions continue after a restart.
+func NewFollower(leader string, database db.Database, opts ...FollowerOption) (*Follower, error) {
+	leaderURL, err := url.Parse(leader)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing leader URL: %s", err)
+	}
+
+	if leaderURL.Scheme != "http" && leaderURL.Scheme != "https" {
+		return nil, fmt.Errorf("leader URL needs to use http or https: %s", leader)
+	}
+
+	f := &Follower{
+		leader:        leaderURL,
+		database:      database,
+		client:        http.DefaultClient,
+		retryInterval: defaultRetryInterval,
+		status: Status{
+			Leader: leader,
+			State:  StateConnecting,
+		},
+	}
+	for _, o := range opts {
+		o(f)
+	}
+
+	if f.stateFile != "" {
+		if err := f.loadState(); err != nil {
+			return nil, err
+		}
+	}
+
+	return f, nil
+}
+
+// Leader returns the URL of the leader.
+func (f *Follower) Leader() string {
+	return f.leader.String()
+}
+
+// Status returns the current progress of the follower.
+func (f *Follower) Status() Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	status := f.status
+	if status.LeaderRevision > status.Revision {
+		status.Lag = status.LeaderRevision - status.Revision
+	}
+
+	return status
+}
+
+// Run replicates the changes of the leader until ctx is done. Errors are logged and the follower connects
+// to the leader again after the retry interval.
+func (f *Follower) Run(ctx context.Context) {
+	defer f.saveState(true)
+
+	for {
+		err := f.replicate(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.Printf("Error replicating from %s: %s", f.leader, err)
+		f.update(func(s *Status) {
+			s.State = StateDisconnected
+			s.Error = err.Error()
+		})
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(f.retryInterval):
+		}
+	}
+}
+
+// replicate copies the keys of the leader if necessary and follows its changes until an error occurs.
+func (f *Follower) replicate(ctx context.Context) error {
+	for {
+		f.lock.Lock()
+		synced := f.synced
+		f.lock.Unlock()
+
+		if !synced {
+			if err := f.snapshot(ctx); err != nil {
+				return err
+			}
+		}
+
+		err := f.follow(ctx)
+		if err != errSnapshotNeeded {
+			return err
+		}
+
+		log.Printf("Changes of %s are not available, copying all keys.", f.leader)
+		f.lock.Lock()
+		f.synced = false
+		f.lock.Unlock()
+	}
+}
+
+// snapshot copies all keys of the leader and removes the keys, which the leader does not have.
+func (f *Follower) snapshot(ctx context.Context) error {
+	f.update(func(s *Status) {
+		s.State = StateSnapshot
+	})
+
+	body, revision, epoch, err := f.get(ctx, "/_snapshot", url.Values{})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	f.update(func(s *Status) {
+		s.LeaderRevision = revision
+	})
+
+	keys := make(map[string]bool)
+	decoder := json.NewDecoder(body)
+	for {
+		entry := snapshotEntry{}
+		err := decoder.Decode(&entry)
+		switch {
+		case err == io.EOF:
+			return f.finishSnapshot(keys, revision, epoch)
+		case err != nil:
+			return fmt.Errorf("error reading snapshot: %s", err)
+		}
+
+		keys[entry.Key] = true
+		if err := put(f.database, entry.Key, entry.Value, entry.Metadata, time.Now()); err != nil {
+			return fmt.Errorf("error storing %q: %s", entry.Key, err)
+		}
+	}
+}
+
+// finishSnapshot removes the keys missing from the snapshot and continues with the revision of the snapshot.
+func (f *Follower) finishSnapshot(keys map[string]bool, revision uint64, epoch string) error {
+	local, err := f.database.List()
+	if err != nil {
+		return fmt.Errorf("error listing keys: %s", err)
+	}
+
+	for _, key := range local {
+		if keys[key] {
+			continue
+		}
+
+		if _, err := f.database.Delete(key); err != nil {
+			return fmt.Errorf("error deleting %q: %s", key, err)
+		}
+	}
+
+	f.lock.Lock()
+	f.synced = true
+	f.status.Revision = revision
+	f.epoch = epoch
+	f.lock.Unlock()
+
+	f.saveState(true)
+	return nil
+}
+
+// follow applies the changes of the leader following the applied revision until an error occurs.
+func (f *Follower) follow(ctx context.Context) error {
+	since := f.Status().Revision
+	body, revision, epoch, err := f.get(ctx, "/_changes", url.Values{
+		"since":  []string{strconv.FormatUint(since, 10)},
+		"stream": []string{"true"},
+	})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// A follower, whose state does not contain an epoch yet, continues with the epoch of the leader.
+	f.lock.Lock()
+	known := f.epoch
+	if known == "" {
+		f.epoch = epoch
+	}
+	f.lock.Unlock()
+
+	if known != "" && known != epoch {
+		return errSnapshotNeeded
+	}
+
+	f.update(func(s *Status) {
+		s.State = StateFollowing
+		s.Error = ""
+		s.LeaderRevision = revision
+	})
+
+	decoder := json.NewDecoder(body)
+	for {
+		event := db.Event{}
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return errors.New("leader ended the stream of changes")
+			}
+
+			return fmt.Errorf("error reading changes: %s", err)
+		}
+
+		// Keep-alives do not have a type, they contain the latest revision of the leader.
+		if event.Type == 0 {
+			f.update(func(s *Status) {
+				if event.Revision > s.LeaderRevision {
+					s.LeaderRevision = event.Revision
+				}
+			})
+			continue
+		}
+
+		if event.Revision <= since {
+			continue
+		}
+
+		if err := f.applyEvent(ctx, event); err != nil {
+			return fmt.Errorf("error applying revision %d: %s", event.Revision, err)
+		}
+
+		since = event.Revision
+		f.update(func(s *Status) {
+			s.Revision = event.Revision
+			if event.Revision > s.LeaderRevision {
+				s.LeaderRevision = event.Revision
+			}
+		})
+		f.saveState(false)
+	}
+}
+
+// applyEvent applies a change of the leader. The value of a stored key is read from the leader. If the key
+// has been changed again in the meantime, the event is skipped, the following events bring the follower up
+// to date.
+func (f *Follower) applyEvent(ctx context.Context, event db.Event) error {
+	var value []byte
+	if event.Type == db.EventPut {
+		var current bool
+		var err error
+		value, current, err = f.value(ctx, event.Key, event.Metadata)
+		if err != nil || !current {
+			return err
+		}
+	}
+
+	return apply(f.database, event, value, time.Now())
+}
+
+// value reads the value of key from the leader. It returns false if the leader no longer has the value
+// described by meta, because the key has been changed again in the meantime.
+func (f *Follower) value(ctx context.Context, key string, meta db.Metadata) ([]byte, bool, error) {
+	target := *f.leader
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + key
+	target.RawQuery = ""
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		return nil, false, fmt.Errorf("unexpected status %q: %s", res.Status, strings.TrimSpace(string(message)))
+	}
+
+	value, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	hash := sha256.Sum256(value)
+	return value, hex.EncodeToString(hash[:]) == meta.Checksum, nil
+}
+
+// get requests a path of the leader and returns the body together with the revision and epoch of the leader.
+// The returned body is closed when the leader does not send anything for the idle timeout. A status of 410 is
+// returned as errSnapshotNeeded.
+func (f *Follower) get(ctx context.Context, path string, query url.Values) (io.ReadCloser, uint64, string, error) {
+	target := *f.leader
+	target.Path = strings.TrimSuffix(target.Path, "/") + path
+	target.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		cancel()
+		return nil, 0, "", err
+	}
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		cancel()
+		return nil, 0, "", err
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		res.Body.Close()
+		cancel()
+		return nil, 0, "", errSnapshotNeeded
+	default:
+		message, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		cancel()
+		return nil, 0, "", fmt.Errorf("unexpected status %q: %s", res.Status, strings.TrimSpace(string(message)))
+	}
+
+	revision, err := strconv.ParseUint(res.Header.Get(revisionHeader), 10, 64)
+	if err != nil {
+		res.Body.Close()
+		cancel()
+		return nil, 0, "", fmt.Errorf("invalid revision header: %q", res.Header.Get(revisionHeader))
+	}
+
+	f.contact()
+	return &idleReader{
+		body:   res.Body,
+		cancel: cancel,
+		timer:  time.AfterFunc(idleTimeout, cancel),
+		read:   f.contact,
+	}, revision, res.Header.Get(epochHeader), nil
+}
+
+// contact records that data has been received from the leader.
+func (f *Follower) contact() {
+	f.update(func(s *Status) {
+		s.LastContact = time.Now()
+	})
+}
+
+func (f *Follower) update(change func(s *Status)) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	change(&f.status)
+}
+
+// loadState reads the applied revision from the state file. A missing file is not an error.
+func (f *Follower) loadState() error {
+	data, err := ioutil.ReadFile(f.stateFile)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return fmt.Errorf("error reading state file: %s", err)
+	}
+
+	// The state contains the applied revision and the epoch it belongs to.
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return errors.New("error parsing state file: file is empty")
+	}
+
+	revision, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("error parsing state file: %s", err)
+	}
+
+	if len(fields) > 1 {
+		f.epoch = fields[1]
+	}
+
+	f.status.Revision = revision
+	f.synced = true
+	return nil
+}
+
+// saveState writes the applied revision to the state file. Unless forced, the file is written at most once
+// per state interval. Changes applied again after a restart lead to the same result, so the state only needs
+// to be written regularly.
+func (f *Follower) saveState(force bool) {
+	if f.stateFile == "" {
+		return
+	}
+
+	f.lock.Lock()
+	now := time.Now()
+	if !f.synced || (!force && now.Sub(f.saved) < stateInterval) {
+		f.lock.Unlock()
+		return
+	}
+
+	f.saved = now
+	state := strconv.FormatUint(f.status.Revision, 10)
+	if f.epoch != "" {
+		state += " " + f.epoch
+	}
+	f.lock.Unlock()
+
+	tmp := f.stateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(state+"\n"), 0666); err != nil {
+		log.Printf("Error writing state file: %s", err)
+		return
+	}
+
+	if err := os.Rename(tmp, f.stateFile); err != nil {
+		log.Printf("Error writing state file: %s", err)
+	}
+}
+
+// idleReader cancels a request when no data has been read for the idle timeout.
+type idleReader struct {
+	body   io.ReadCloser
+	cancel context.CancelFunc
+	timer  *time.Timer
+	read   func()
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 {
+		r.timer.Reset(idleTimeout)
+		r.read()
+	}
+
+	return n, err
+}
+
+func (r *idleReader) Close() error {
+	r.timer.Stop()
+	r.cancel()
+	return r.body.Close()
+}
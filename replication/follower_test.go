@@ -0,0 +1,256 @@
+package replication_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/xperimental/uswd/db"
+	"github.com/xperimental/uswd/replication"
+	"github.com/xperimental/uswd/web"
+)
+
+// storedValue is the part of an entry, which is replicated.
+type storedValue struct {
+	Value       string
+	ContentType string
+	Headers     map[string]string
+	Version     int64
+	Expires     time.Time
+	Modified    time.Time
+}
+
+func contents(t *testing.T, database db.Database) map[string]storedValue {
+	keys, err := database.List()
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	result := make(map[string]storedValue)
+	for _, key := range keys {
+		entry, found, err := database.Get(key)
+		if err != nil || !found {
+			t.Fatalf("got %v and error %v for %q, want value", found, err, key)
+		}
+
+		result[key] = storedValue{
+			Value:       entry.Value,
+			ContentType: entry.ContentType,
+			Headers:     entry.Headers,
+			Version:     entry.Version,
+			Expires:     entry.Expires.UTC(),
+			Modified:    entry.Modified.UTC(),
+		}
+	}
+
+	return result
+}
+
+// startFollower runs a follower until the returned function is called.
+func startFollower(t *testing.T, leader string, database db.Database, opts ...replication.FollowerOption) (*replication.Follower, func()) {
+	opts = append(opts, replication.WithRetryInterval(10*time.Millisecond))
+	follower, err := replication.NewFollower(leader, database, opts...)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		follower.Run(ctx)
+	}()
+
+	return follower, func() {
+		cancel()
+		<-done
+	}
+}
+
+// waitForRevision waits until the follower has applied the revision.
+func waitForRevision(t *testing.T, follower *replication.Follower, revision uint64) replication.Status {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := follower.Status()
+		if status.State == replication.StateFollowing && status.Revision == revision {
+			return status
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("got status %+v, want revision %d", status, revision)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	base := db.NewMemoryDatabase()
+	base.Put("existing", "value")
+	leader := db.NewHub(base)
+	defer leader.Close()
+
+	server := httptest.NewServer(web.DatabaseHandler(leader))
+	defer server.Close()
+
+	database := db.NewMemoryDatabase()
+	database.Put("stale", "value")
+	follower, stop := startFollower(t, server.URL, database)
+	defer stop()
+
+	status := waitForRevision(t, follower, 0)
+	if status.Lag != 0 || status.LastContact.IsZero() {
+		t.Errorf("got status %+v, want no lag and a contact", status)
+	}
+
+	// The copied values have the versions, times and expiry of the leader.
+	if got, want := contents(t, database), contents(t, leader); !reflect.DeepEqual(got, want) {
+		t.Errorf("got contents %+v, want %+v", got, want)
+	}
+
+	leader.Put("a", "one", db.WithContentType("text/plain"), db.WithHeaders(map[string]string{"owner": "team"}))
+	leader.Put("b", "two", db.WithTTL(time.Hour))
+	leader.Delete("existing")
+	leader.Batch([]db.Op{
+		db.PutOp("a", "three", db.WithContentType("text/plain")),
+		db.DeleteOp("b"),
+	})
+
+	waitForRevision(t, follower, leader.Revision())
+	if got, want := contents(t, database), contents(t, leader); !reflect.DeepEqual(got, want) {
+		t.Errorf("got contents %+v, want %+v", got, want)
+	}
+}
+
+func TestFollowerResume(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		historySize int
+		changes     int
+		snapshot    bool
+	}{
+		{
+			desc:        "changes available",
+			historySize: 10,
+			changes:     3,
+			snapshot:    false,
+		},
+		{
+			desc:        "too far behind",
+			historySize: 2,
+			changes:     5,
+			snapshot:    true,
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			dir, err := ioutil.TempDir("", "uswd")
+			if err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+			defer os.RemoveAll(dir)
+			stateFile := filepath.Join(dir, "state")
+
+			leader := db.NewHub(db.NewMemoryDatabase(), db.WithHistorySize(test.historySize))
+			defer leader.Close()
+
+			server := httptest.NewServer(web.DatabaseHandler(leader))
+			defer server.Close()
+
+			leader.Put("key", "value")
+
+			database := db.NewMemoryDatabase()
+			follower, stop := startFollower(t, server.URL, database, replication.WithStateFile(stateFile))
+			waitForRevision(t, follower, leader.Revision())
+			stop()
+
+			for i := 0; i < test.changes; i++ {
+				leader.Put("key", string(rune('a'+i)))
+			}
+
+			// A key only known to the follower is removed when all keys are copied again.
+			database.Put("local", "value")
+
+			follower, stop = startFollower(t, server.URL, database, replication.WithStateFile(stateFile))
+			defer stop()
+
+			waitForRevision(t, follower, leader.Revision())
+			if _, found, _ := database.Get("local"); found == test.snapshot {
+				t.Errorf("got local key %v, want %v", found, !test.snapshot)
+			}
+
+			entry, _, _ := database.Get("key")
+			if want := string(rune('a' + test.changes - 1)); entry.Value != want {
+				t.Errorf("got value %q, want %q", entry.Value, want)
+			}
+		})
+	}
+}
+
+func TestFollowerDisconnected(t *testing.T) {
+	server := httptest.NewServer(web.DatabaseHandler(db.NewMemoryDatabase()))
+	defer server.Close()
+
+	follower, stop := startFollower(t, server.URL, db.NewMemoryDatabase())
+	defer stop()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for follower.Status().State != replication.StateDisconnected {
+		if time.Now().After(deadline) {
+			t.Fatalf("got status %+v, want %q", follower.Status(), replication.StateDisconnected)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status := follower.Status(); status.Error == "" {
+		t.Errorf("got status %+v, want error", status)
+	}
+}
+
+func TestFollowerLeaderRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "uswd")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state")
+
+	base := db.NewMemoryDatabase()
+	handler := atomic.Value{}
+	handler.Store(web.DatabaseHandler(db.NewHub(base)))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler.Load().(http.Handler).ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	base.Put("key", "value")
+	database := db.NewMemoryDatabase()
+	follower, stop := startFollower(t, server.URL, database, replication.WithStateFile(stateFile))
+	waitForRevision(t, follower, 0)
+	stop()
+
+	// The leader is restarted without a change log, so its revisions start over with a new epoch.
+	leader := db.NewHub(base)
+	defer leader.Close()
+	handler.Store(web.DatabaseHandler(leader))
+	leader.Put("key", "new value")
+	database.Put("local", "value")
+
+	follower, stop = startFollower(t, server.URL, database, replication.WithStateFile(stateFile))
+	defer stop()
+
+	waitForRevision(t, follower, leader.Revision())
+	if got, want := contents(t, database), contents(t, leader); !reflect.DeepEqual(got, want) {
+		t.Errorf("got contents %+v, want %+v", got, want)
+	}
+}
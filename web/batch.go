@@ -0,0 +1,108 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/xperimental/uswd/db"
+)
+
+// batchPath is the path accepting batches of changes using POST.
+const batchPath = "/_batch"
+
+// batchRequest is the body of a batch request.
+type batchRequest struct {
+	Operations []batchOperation `json:"operations"`
+}
+
+// batchOperation is a single change of a batch. Without a version the change is applied regardless of
+// the current version of the key. A version of zero requires that the key does not exist yet.
+type batchOperation struct {
+	Op          string            `json:"op"`
+	Key         string            `json:"key"`
+	Value       string            `json:"value"`
+	Version     *int64            `json:"version"`
+	TTL         string            `json:"ttl"`
+	ContentType string            `json:"contentType"`
+	Headers     map[string]string `json:"headers"`
+}
+
+func handleBatch(database db.Database, config handlerConfig, w http.ResponseWriter, r *http.Request) {
+	body := r.Body
+	if config.maxBodySize > 0 {
+		body = http.MaxBytesReader(w, r.Body, config.maxBodySize)
+	}
+
+	request := batchRequest{}
+	if err := json.NewDecoder(body).Decode(&request); err != nil {
+		if _, ok := err.(*http.MaxBytesError); ok {
+			http.Error(w, fmt.Sprintf("Body larger than %d bytes.", config.maxBodySize), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		http.Error(w, fmt.Sprintf("Error parsing batch: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	ops := make([]db.Op, 0, len(request.Operations))
+	for i, o := range request.Operations {
+		op, err := o.op()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid operation %d: %s", i, err), http.StatusBadRequest)
+			return
+		}
+
+		ops = append(ops, op)
+	}
+
+	if err := database.Batch(ops); err != nil {
+		http.Error(w, fmt.Sprintf("Error applying batch: %s", err), errorStatus(err))
+		return
+	}
+
+	fmt.Fprintln(w, "saved.")
+}
+
+// op converts the operation to a database operation.
+func (o batchOperation) op() (db.Op, error) {
+	version := db.AnyVersion
+	if o.Version != nil {
+		version = *o.Version
+	}
+
+	switch o.Op {
+	case "put":
+	case "delete":
+		return db.CompareAndDeleteOp(o.Key, version), nil
+	default:
+		return db.Op{}, fmt.Errorf("unknown operation: %q", o.Op)
+	}
+
+	ttl, err := parseDuration(o.TTL)
+	if err != nil {
+		return db.Op{}, fmt.Errorf("error parsing TTL: %s", err)
+	}
+
+	opts := []db.PutOption{db.WithTTL(ttl)}
+	if o.ContentType != "" {
+		opts = append(opts, db.WithContentType(o.ContentType))
+	}
+
+	if len(o.Headers) > 0 {
+		headers := make(map[string]string, len(o.Headers))
+		for name, value := range o.Headers {
+			name = http.CanonicalHeaderKey(name)
+			if !strings.HasPrefix(name, metaHeaderPrefix) || len(name) == len(metaHeaderPrefix) {
+				return db.Op{}, fmt.Errorf("header does not start with %s: %s", metaHeaderPrefix, name)
+			}
+
+			headers[name] = value
+		}
+
+		opts = append(opts, db.WithHeaders(headers))
+	}
+
+	return db.CompareAndPutOp(o.Key, o.Value, version, opts...), nil
+}
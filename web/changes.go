@@ -0,0 +1,242 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/xperimental/uswd/db"
+)
+
+// changesPath is the path listing the changes of the database, if it keeps them.
+const changesPath = "/_changes"
+
+// revisionHeader contains the latest revision of the database in responses listing changes or keys.
+// Followers use it to report how far they are behind.
+const revisionHeader = "X-Revision"
+
+// epochHeader contains the epoch of the revisions. Followers read all keys again when it changes.
+const epochHeader = "X-Epoch"
+
+const (
+	// defaultChangesLimit is the number of changes returned by a request without a limit.
+	defaultChangesLimit = 1000
+	// maxChangesWait is the longest time a request waits for new changes.
+	maxChangesWait = 5 * time.Minute
+)
+
+// keepAlive is sent in a stream of changes while there are no changes. It contains the latest revision, so
+// that followers know how far they are behind.
+type keepAlive struct {
+	Revision uint64 `json:"revision"`
+}
+
+// changesResponse is a page of changes.
+type changesResponse struct {
+	Changes []db.Event `json:"changes"`
+	// Revision is the revision of the last change returned. It is used as "since" parameter for the next page.
+	Revision uint64 `json:"revision"`
+}
+
+// handleChanges returns the changes following the revision given by the "since" parameter. Using the "wait"
+// parameter, the request waits for new changes if there are none yet. With "stream" set, the changes are
+// sent as a stream of JSON objects separated by newlines, which continues with new changes as they happen.
+// Objects without a type are keep-alives containing the latest revision.
+func handleChanges(feed db.ChangeFeed, config handlerConfig, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	since := uint64(0)
+	if value := query.Get("since"); value != "" {
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid revision: %s", value), http.StatusBadRequest)
+			return
+		}
+
+		since = parsed
+	}
+
+	limit := defaultChangesLimit
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid limit: %s", value), http.StatusBadRequest)
+			return
+		}
+
+		limit = parsed
+	}
+
+	wait, err := parseDuration(query.Get("wait"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid wait time: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if wait > maxChangesWait {
+		wait = maxChangesWait
+	}
+
+	w.Header().Set(revisionHeader, strconv.FormatUint(feed.Revision(), 10))
+	w.Header().Set(epochHeader, feed.Epoch())
+	events, err := feed.Changes(since, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading changes: %s", err), errorStatus(err))
+		return
+	}
+
+	if stream, _ := strconv.ParseBool(query.Get("stream")); stream {
+		streamChanges(feed, config, since, events, w, r)
+		return
+	}
+
+	if len(events) == 0 && wait > 0 {
+		events, err = waitForChanges(feed, config, since, limit, wait, r)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error waiting for changes: %s", err), errorStatus(err))
+			return
+		}
+	}
+
+	response := changesResponse{
+		Changes:  events,
+		Revision: since,
+	}
+	if len(events) > 0 {
+		response.Revision = events[len(events)-1].Revision
+	}
+
+	writeJSON(w, r, response)
+}
+
+// waitForChanges returns the first changes following since, which happen before the wait time has passed.
+// The changes are read again after subscribing, so that changes made in between are not missed.
+func waitForChanges(feed db.ChangeFeed, config handlerConfig, since uint64, limit int, wait time.Duration, r *http.Request) ([]db.Event, error) {
+	subscription, err := feed.Watch("", since)
+	if err != nil {
+		return nil, err
+	}
+	defer subscription.Close()
+
+	events, err := feed.Changes(since, limit)
+	if err != nil || len(events) > 0 {
+		return events, err
+	}
+	events = []db.Event{}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-r.Context().Done():
+	case <-config.shutdown:
+	case <-timer.C:
+	case event, ok := <-subscription.Events():
+		if !ok {
+			break
+		}
+
+		events = append(events, event)
+		for len(events) < limit {
+			select {
+			case event, ok := <-subscription.Events():
+				if !ok {
+					return events, nil
+				}
+
+				events = append(events, event)
+			default:
+				return events, nil
+			}
+		}
+	}
+
+	return events, nil
+}
+
+// streamChanges sends the changes starting with the first page of events. Pages are read until the stream has
+// caught up, then it follows the new changes. The stream ends when an error occurs; the client can continue
+// after the last revision it received.
+func streamChanges(feed db.ChangeFeed, config handlerConfig, since uint64, events []db.Event, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported.", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	encoder := json.NewEncoder(w)
+	for {
+		for _, e := range events {
+			if err := encoder.Encode(e); err != nil {
+				return
+			}
+
+			since = e.Revision
+		}
+		flusher.Flush()
+
+		if len(events) == 0 && !followChanges(feed, config, &since, w, flusher, r) {
+			return
+		}
+
+		var err error
+		events, err = feed.Changes(since, defaultChangesLimit)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// followChanges sends new changes until the request ends. It returns true if the subscription could not keep up
+// or changes have been made before subscribing, so that the stream should catch up by reading pages again.
+func followChanges(feed db.ChangeFeed, config handlerConfig, since *uint64, w http.ResponseWriter, flusher http.Flusher, r *http.Request) bool {
+	subscription, err := feed.Watch("", *since)
+	if err != nil {
+		return false
+	}
+	defer subscription.Close()
+
+	if missed, err := feed.Changes(*since, 1); err != nil || len(missed) > 0 {
+		return err == nil
+	}
+
+	encoder := json.NewEncoder(w)
+
+	ticker := time.NewTicker(watchKeepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return false
+		case <-config.shutdown:
+			return false
+		case <-ticker.C:
+			if err := encoder.Encode(keepAlive{Revision: feed.Revision()}); err != nil {
+				return false
+			}
+		case event, ok := <-subscription.Events():
+			if !ok {
+				return subscription.Err() == db.ErrSubscriptionOverflow
+			}
+
+			if event.Revision <= *since {
+				continue
+			}
+
+			if err := encoder.Encode(event); err != nil {
+				return false
+			}
+
+			*since = event.Revision
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,118 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xperimental/uswd/db"
+)
+
+// historyPath is the prefix of the paths listing and restoring the revisions of a key.
+const historyPath = "/_history/"
+
+// isHistoryPath checks if the request is for the history of a key and the database keeps a history.
+func isHistoryPath(database db.Database, r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, historyPath) {
+		return false
+	}
+
+	_, ok := db.FindVersioned(database)
+	return ok
+}
+
+// isHistoryRequest checks if the request reads an earlier value of a key.
+func isHistoryRequest(r *http.Request) bool {
+	query := r.URL.Query()
+	return query.Get("revision") != "" || query.Get("at") != ""
+}
+
+// handleGetRevision returns the value of a key at the revision given by the "revision" parameter
+// or at the time given by the "at" parameter.
+func handleGetRevision(database db.Database, key string, w http.ResponseWriter, r *http.Request) {
+	versioned, ok := db.FindVersioned(database)
+	if !ok {
+		http.Error(w, fmt.Sprintf("Error getting content: %s", db.ErrNoHistory), errorStatus(db.ErrNoHistory))
+		return
+	}
+
+	var entry db.Entry
+	var found bool
+	query := r.URL.Query()
+	if value := query.Get("revision"); value != "" {
+		revision, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid revision: %s", value), http.StatusBadRequest)
+			return
+		}
+
+		entry, found, err = versioned.GetRevision(key, revision)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting content: %s", err), errorStatus(err))
+			return
+		}
+	} else {
+		value := query.Get("at")
+		at, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid time: %s", value), http.StatusBadRequest)
+			return
+		}
+
+		entry, found, err = versioned.GetAt(key, at)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error getting content: %s", err), errorStatus(err))
+			return
+		}
+	}
+
+	if !found {
+		http.Error(w, fmt.Sprintf("Key not found: %s", key), http.StatusNotFound)
+		return
+	}
+
+	writeMetadata(w, entry.Metadata)
+	http.ServeContent(w, r, "", entry.Modified, strings.NewReader(entry.Value))
+}
+
+// handleHistory lists the revisions of a key without their values.
+func handleHistory(database db.Database, w http.ResponseWriter, r *http.Request) {
+	versioned, _ := db.FindVersioned(database)
+	key := strings.TrimPrefix(r.URL.Path, historyPath)
+	entries, err := versioned.Revisions(key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading history: %s", err), errorStatus(err))
+		return
+	}
+
+	if len(entries) == 0 {
+		http.Error(w, fmt.Sprintf("Key not found: %s", key), http.StatusNotFound)
+		return
+	}
+
+	for i := range entries {
+		entries[i].Value = nil
+	}
+
+	writeJSON(w, r, entries)
+}
+
+// handleRestore stores the value of the revision given by the "revision" parameter as current value of the key.
+func handleRestore(database db.Database, w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, historyPath)
+	value := r.URL.Query().Get("revision")
+	revision, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid revision: %s", value), http.StatusBadRequest)
+		return
+	}
+
+	if err := db.Restore(database, key, revision); err != nil {
+		http.Error(w, fmt.Sprintf("Error restoring revision: %s", err), errorStatus(err))
+		return
+	}
+
+	fmt.Fprintln(w, "saved.")
+}
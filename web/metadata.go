@@ -0,0 +1,57 @@
+package web
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/xperimental/uswd/db"
+)
+
+// metaHeaderPrefix is the prefix of request headers, which are stored as user-defined metadata.
+const metaHeaderPrefix = "X-Meta-"
+
+// metadataOptions returns the options for storing the metadata sent with a request.
+func metadataOptions(r *http.Request) []db.PutOption {
+	opts := []db.PutOption{}
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		opts = append(opts, db.WithContentType(contentType))
+	}
+
+	headers := map[string]string{}
+	for name, values := range r.Header {
+		if strings.HasPrefix(name, metaHeaderPrefix) && len(name) > len(metaHeaderPrefix) {
+			headers[name] = strings.Join(values, ", ")
+		}
+	}
+
+	if len(headers) > 0 {
+		opts = append(opts, db.WithHeaders(headers))
+	}
+
+	return opts
+}
+
+// writeMetadata sets the response headers describing a stored value.
+func writeMetadata(w http.ResponseWriter, meta db.Metadata) {
+	header := w.Header()
+	for name, value := range meta.Headers {
+		header.Set(name, value)
+	}
+
+	header.Set("ETag", formatETag(meta))
+	if meta.ContentType != "" {
+		header.Set("Content-Type", meta.ContentType)
+	}
+
+	if !meta.Modified.IsZero() {
+		header.Set("Last-Modified", meta.Modified.UTC().Format(http.TimeFormat))
+	}
+
+	if !meta.Created.IsZero() {
+		header.Set("X-Created", meta.Created.UTC().Format(http.TimeFormat))
+	}
+
+	if !meta.Expires.IsZero() {
+		header.Set("X-Expires", meta.Expires.UTC().Format(http.TimeFormat))
+	}
+}
@@ -0,0 +1,51 @@
+package web
+
+import (
+	"context"
+
+	"github.com/xperimental/uswd/replication"
+)
+
+// handlerConfig contains the configuration of the database handler.
+type handlerConfig struct {
+	maxBodySize int64
+	shutdown    <-chan struct{}
+	follower    *replication.Follower
+	origins     []string
+}
+
+// HandlerOption changes the configuration of the database handler.
+type HandlerOption func(c *handlerConfig)
+
+// WithMaxBodySize limits the size of values, which can be stored using the handler.
+// A size of zero disables the limit.
+func WithMaxBodySize(size int64) HandlerOption {
+	return func(c *handlerConfig) {
+		c.maxBodySize = size
+	}
+}
+
+// WithShutdown ends long-running requests like watches and WebSocket connections when ctx is done.
+// They are not stopped by shutting down the HTTP server, because they never become idle.
+func WithShutdown(ctx context.Context) HandlerOption {
+	return func(c *handlerConfig) {
+		c.shutdown = ctx.Done()
+	}
+}
+
+// WithFollower serves the database of a follower. Changes are rejected, because they are only made by replicating
+// the leader, and the progress of the replication is reported at "/_replication".
+func WithFollower(follower *replication.Follower) HandlerOption {
+	return func(c *handlerConfig) {
+		c.follower = follower
+	}
+}
+
+// WithAllowedOrigins allows WebSocket connections from web pages of other origins, given like
+// "https://dashboard.example.com". Browsers send cookies with WebSocket connections regardless of the origin,
+// so by default only pages served from the host of the request can connect.
+func WithAllowedOrigins(origins ...string) HandlerOption {
+	return func(c *handlerConfig) {
+		c.origins = append(c.origins, origins...)
+	}
+}
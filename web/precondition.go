@@ -0,0 +1,80 @@
+package web
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/xperimental/uswd/db"
+)
+
+// formatETag returns the strong entity tag identifying the content of a value.
+// It falls back to the version for databases which do not provide checksums.
+func formatETag(meta db.Metadata) string {
+	if meta.Checksum == "" {
+		return fmt.Sprintf(`"v%d"`, meta.Version)
+	}
+
+	return fmt.Sprintf("%q", meta.Checksum)
+}
+
+// writePrecondition evaluates the If-Match and If-None-Match headers of a request modifying key.
+// It returns the version the write needs to be conditioned on, db.AnyVersion if the request has no preconditions,
+// and false if the preconditions do not hold.
+func writePrecondition(database db.Database, key string, r *http.Request) (int64, bool, error) {
+	ifMatch := r.Header.Get("If-Match")
+	ifNoneMatch := r.Header.Get("If-None-Match")
+	if ifMatch == "" && ifNoneMatch == "" {
+		return db.AnyVersion, true, nil
+	}
+
+	meta, found, err := db.Stat(database, key)
+	if err != nil {
+		return 0, false, err
+	}
+
+	etag := ""
+	if found {
+		etag = formatETag(meta)
+	}
+
+	if ifMatch != "" && !matchETag(ifMatch, etag, true) {
+		return 0, false, nil
+	}
+
+	if ifNoneMatch != "" && matchETag(ifNoneMatch, etag, false) {
+		return 0, false, nil
+	}
+
+	return meta.Version, true, nil
+}
+
+// matchETag checks if etag is contained in the list of entity tags of a conditional header.
+// Weak entity tags never match when strong comparison is requested.
+// An empty etag, meaning that there is no current value, does not match anything.
+func matchETag(header, etag string, strong bool) bool {
+	if etag == "" {
+		return false
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+
+		if strings.HasPrefix(tag, "W/") {
+			if strong {
+				continue
+			}
+
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+
+		if tag == etag {
+			return true
+		}
+	}
+
+	return false
+}
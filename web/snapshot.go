@@ -0,0 +1,68 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/xperimental/uswd/db"
+)
+
+// snapshotPath is the path returning all keys of the database together with the revision they have been read at.
+const snapshotPath = "/_snapshot"
+
+// replicationPath is the path reporting the progress of a follower.
+const replicationPath = "/_replication"
+
+// snapshotEntry is a single key of a snapshot.
+type snapshotEntry struct {
+	Key      string      `json:"key"`
+	Value    []byte      `json:"value"`
+	Metadata db.Metadata `json:"metadata"`
+}
+
+// handleSnapshot sends all keys as a stream of JSON objects separated by newlines. The revision read before
+// listing the keys is sent in the revision header. Keys changed while the snapshot is being sent might already
+// contain later changes, so a consumer applying the changes following the revision ends up with a consistent copy.
+//
+// The connection is aborted if an error occurs after the response has been started, so that an incomplete
+// snapshot can not be mistaken for a complete one.
+func handleSnapshot(database db.Database, feed db.ChangeFeed, w http.ResponseWriter, r *http.Request) {
+	revision := feed.Revision()
+	keys, err := database.List()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Database error: %s", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set(revisionHeader, strconv.FormatUint(revision, 10))
+	w.Header().Set(epochHeader, feed.Epoch())
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	encoder := json.NewEncoder(w)
+	for _, key := range keys {
+		entry, found, err := database.Get(key)
+		switch {
+		case err != nil:
+			log.Printf("Error reading %q for snapshot: %s", key, err)
+			panic(http.ErrAbortHandler)
+		case !found:
+			// The key has been deleted or expired since listing the keys.
+			continue
+		}
+
+		err = encoder.Encode(snapshotEntry{
+			Key:      key,
+			Value:    []byte(entry.Value),
+			Metadata: entry.Metadata,
+		})
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/xperimental/uswd/db"
+)
+
+// socketPath is the path accepting WebSocket connections.
+const socketPath = "/_ws"
+
+const (
+	// socketMaxMessageSize limits the size of messages received from clients.
+	socketMaxMessageSize = 16 << 20
+	// socketQueueSize is the number of messages waiting to be sent before the connection stops
+	// reading requests and delivering events.
+	socketQueueSize = 64
+	// socketPingInterval is the interval of pings keeping idle connections open. Connections which
+	// have not sent anything for two intervals are closed.
+	socketPingInterval = 30 * time.Second
+	// socketWriteTimeout is the time after which a connection not accepting any data is closed.
+	socketWriteTimeout = 10 * time.Second
+	// socketCloseTimeout is the time clients have to answer a close frame sent by the server.
+	socketCloseTimeout = 5 * time.Second
+)
+
+// socketRequest is a message sent by the client. Put and delete requests use the fields of batch operations.
+type socketRequest struct {
+	ID string `json:"id"`
+	batchOperation
+	Prefix       string `json:"prefix"`
+	Start        string `json:"start"`
+	End          string `json:"end"`
+	Limit        int    `json:"limit"`
+	Token        string `json:"token"`
+	Delimiter    string `json:"delimiter"`
+	Since        uint64 `json:"since"`
+	Subscription string `json:"subscription"`
+}
+
+// socketMessage is a message sent to the client. It is either the response to a request, an event
+// of a subscription or an error ending a subscription.
+type socketMessage struct {
+	Type         string         `json:"type"`
+	ID           string         `json:"id,omitempty"`
+	Status       int            `json:"status,omitempty"`
+	Error        string         `json:"error,omitempty"`
+	Value        *string        `json:"value,omitempty"`
+	Metadata     *db.Metadata   `json:"metadata,omitempty"`
+	List         *db.ListResult `json:"list,omitempty"`
+	Subscription string         `json:"subscription,omitempty"`
+	Event        *db.Event      `json:"event,omitempty"`
+}
+
+// socket serves a single WebSocket connection.
+type socket struct {
+	conn     *wsConn
+	database db.Database
+	config   handlerConfig
+	queue    chan []byte
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	lock          sync.Mutex
+	subscriptions map[string]*db.Subscription
+}
+
+func handleSocket(database db.Database, config handlerConfig, w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebSocket(w, r, config.origins)
+	if err != nil {
+		return
+	}
+
+	conn.maxMessageSize = socketMaxMessageSize
+	conn.readTimeout = 2 * socketPingInterval
+	conn.writeTimeout = socketWriteTimeout
+
+	s := &socket{
+		conn:          conn,
+		database:      database,
+		config:        config,
+		queue:         make(chan []byte, socketQueueSize),
+		done:          make(chan struct{}),
+		subscriptions: make(map[string]*db.Subscription),
+	}
+
+	s.wg.Add(2)
+	go s.writeLoop()
+	go s.waitShutdown()
+
+	s.readLoop()
+	s.stop()
+	s.wg.Wait()
+}
+
+// readLoop handles requests until the connection is closed. Requests are answered in order. While the queue
+// of outgoing messages is full, no further requests are read.
+func (s *socket) readLoop() {
+	for {
+		opcode, message, err := s.conn.readMessage()
+		if err != nil {
+			return
+		}
+
+		if opcode != opText {
+			s.conn.writeClose(closeUnsupportedData, "only text messages are supported")
+			return
+		}
+
+		request := socketRequest{}
+		if err := json.Unmarshal(message, &request); err != nil {
+			s.respond(socketRequest{}, http.StatusBadRequest, fmt.Errorf("error parsing request: %s", err))
+			continue
+		}
+
+		s.handle(request)
+	}
+}
+
+// writeLoop sends the queued messages and regular pings.
+func (s *socket) writeLoop() {
+	defer s.wg.Done()
+
+	ping := time.NewTicker(socketPingInterval)
+	defer ping.Stop()
+
+	for {
+		var err error
+		select {
+		case <-s.done:
+			return
+		case <-ping.C:
+			err = s.conn.writeFrame(opPing, nil)
+		case message := <-s.queue:
+			err = s.conn.writeMessage(message)
+		}
+
+		if err != nil {
+			s.stop()
+			return
+		}
+	}
+}
+
+// waitShutdown closes the connection when the server shuts down.
+func (s *socket) waitShutdown() {
+	defer s.wg.Done()
+
+	select {
+	case <-s.done:
+	case <-s.config.shutdown:
+		// The read loop ends once the client answers the close frame or the timeout expires.
+		s.conn.writeClose(closeGoingAway, "server shutting down")
+		s.conn.conn.SetReadDeadline(time.Now().Add(socketCloseTimeout))
+	}
+}
+
+// stop ends the subscriptions and closes the connection.
+func (s *socket) stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+		s.conn.Close()
+
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		for _, subscription := range s.subscriptions {
+			subscription.Close()
+		}
+	})
+}
+
+// send queues a message. It blocks while the queue is full.
+func (s *socket) send(message socketMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		data, _ = json.Marshal(socketMessage{
+			Type:   message.Type,
+			ID:     message.ID,
+			Status: http.StatusInternalServerError,
+			Error:  fmt.Sprintf("error encoding message: %s", err),
+		})
+	}
+
+	select {
+	case s.queue <- data:
+	case <-s.done:
+	}
+}
+
+// respond sends an empty response or an error response to a request.
+func (s *socket) respond(request socketRequest, status int, err error) {
+	message := socketMessage{
+		Type:   "response",
+		ID:     request.ID,
+		Status: status,
+	}
+	if err != nil {
+		message.Error = err.Error()
+	}
+
+	s.send(message)
+}
+
+func (s *socket) handle(request socketRequest) {
+	switch request.Op {
+	case "get":
+		s.handleGet(request)
+	case "put", "delete":
+		s.handleChange(request)
+	case "list":
+		s.handleList(request)
+	case "subscribe":
+		s.handleSubscribe(request)
+	case "unsubscribe":
+		s.handleUnsubscribe(request)
+	default:
+		s.respond(request, http.StatusBadRequest, fmt.Errorf("unknown operation: %q", request.Op))
+	}
+}
+
+func (s *socket) handleGet(request socketRequest) {
+	entry, found, err := s.database.Get(request.Key)
+	switch {
+	case err != nil:
+		s.respond(request, errorStatus(err), err)
+	case !found:
+		s.respond(request, http.StatusNotFound, fmt.Errorf("key not found: %s", request.Key))
+	default:
+		s.send(socketMessage{
+			Type:     "response",
+			ID:       request.ID,
+			Status:   http.StatusOK,
+			Value:    &entry.Value,
+			Metadata: &entry.Metadata,
+		})
+	}
+}
+
+func (s *socket) handleChange(request socketRequest) {
+	if s.config.follower != nil {
+		s.respond(request, http.StatusForbidden, fmt.Errorf("read-only follower of %s", s.config.follower.Leader()))
+		return
+	}
+
+	op, err := request.op()
+	if err != nil {
+		s.respond(request, http.StatusBadRequest, err)
+		return
+	}
+
+	if s.config.maxBodySize > 0 && int64(len(op.Value)) > s.config.maxBodySize {
+		s.respond(request, http.StatusRequestEntityTooLarge, fmt.Errorf("value larger than %d bytes", s.config.maxBodySize))
+		return
+	}
+
+	found := true
+	switch {
+	case op.Delete && op.ExpectedVersion == db.AnyVersion:
+		found, err = s.database.Delete(op.Key)
+	case op.Delete:
+		err = s.database.Batch([]db.Op{op})
+		if batchErr, ok := err.(*db.BatchError); ok {
+			err = batchErr.Err
+		}
+	case op.ExpectedVersion == db.AnyVersion:
+		err = s.database.Put(op.Key, op.Value, op.Options...)
+	default:
+		err = s.database.CompareAndPut(op.Key, op.Value, op.ExpectedVersion, op.Options...)
+	}
+
+	switch {
+	case err != nil:
+		s.respond(request, errorStatus(err), err)
+	case !found:
+		s.respond(request, http.StatusNotFound, fmt.Errorf("key not found: %s", request.Key))
+	default:
+		s.respond(request, http.StatusOK, nil)
+	}
+}
+
+func (s *socket) handleList(request socketRequest) {
+	result, err := s.database.ListRange(db.ListOptions{
+		Prefix:    request.Prefix,
+		Start:     request.Start,
+		End:       request.End,
+		Limit:     request.Limit,
+		Token:     request.Token,
+		Delimiter: request.Delimiter,
+	})
+	if err != nil {
+		s.respond(request, errorStatus(err), err)
+		return
+	}
+
+	s.send(socketMessage{
+		Type:   "response",
+		ID:     request.ID,
+		Status: http.StatusOK,
+		List:   &result,
+	})
+}
+
+// handleSubscribe starts delivering the events of keys starting with the prefix. The subscription
+// is identified by the ID of the request.
+func (s *socket) handleSubscribe(request socketRequest) {
+	watcher, ok := db.FindWatcher(s.database)
+	if !ok {
+		s.respond(request, http.StatusNotImplemented, fmt.Errorf("database does not support watching"))
+		return
+	}
+
+	if request.ID == "" {
+		s.respond(request, http.StatusBadRequest, fmt.Errorf("subscription needs an ID"))
+		return
+	}
+
+	s.lock.Lock()
+	_, exists := s.subscriptions[request.ID]
+	s.lock.Unlock()
+	if exists {
+		s.respond(request, http.StatusConflict, fmt.Errorf("subscription already exists: %s", request.ID))
+		return
+	}
+
+	subscription, err := watcher.Watch(request.Prefix, request.Since)
+	if err != nil {
+		s.respond(request, errorStatus(err), err)
+		return
+	}
+
+	s.lock.Lock()
+	s.subscriptions[request.ID] = subscription
+	s.lock.Unlock()
+
+	// The response is queued before any event of the subscription.
+	s.respond(request, http.StatusOK, nil)
+
+	s.wg.Add(1)
+	go s.forward(request.ID, subscription)
+}
+
+func (s *socket) handleUnsubscribe(request socketRequest) {
+	s.lock.Lock()
+	subscription, ok := s.subscriptions[request.Subscription]
+	delete(s.subscriptions, request.Subscription)
+	s.lock.Unlock()
+
+	if !ok {
+		s.respond(request, http.StatusNotFound, fmt.Errorf("subscription not found: %s", request.Subscription))
+		return
+	}
+
+	subscription.Close()
+	s.respond(request, http.StatusOK, nil)
+}
+
+// forward queues the events of a subscription. A client which does not read its messages fast enough
+// causes the subscription to overflow. It is ended with an error message then and the client can
+// subscribe again after the last revision it received.
+func (s *socket) forward(id string, subscription *db.Subscription) {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case event, ok := <-subscription.Events():
+			if !ok {
+				s.lock.Lock()
+				if s.subscriptions[id] == subscription {
+					delete(s.subscriptions, id)
+				}
+				s.lock.Unlock()
+
+				if err := subscription.Err(); err != nil {
+					s.send(socketMessage{
+						Type:         "error",
+						Subscription: id,
+						Error:        err.Error(),
+					})
+				}
+				return
+			}
+
+			s.send(socketMessage{
+				Type:         "event",
+				Subscription: id,
+				Event:        &event,
+			})
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/xperimental/uswd/db"
+)
+
+// watchPath is the path streaming changes as server-sent events, if the database supports watching.
+const watchPath = "/_watch"
+
+// watchKeepAlive is the interval of comments sent to keep idle connections open.
+const watchKeepAlive = 30 * time.Second
+
+// handleWatch streams the changes of keys starting with the "prefix" parameter. Clients can resume after
+// the revision given by the "since" parameter or the Last-Event-ID header sent when reconnecting.
+func handleWatch(watcher db.Watcher, config handlerConfig, w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported.", http.StatusInternalServerError)
+		return
+	}
+
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+
+	revision := uint64(0)
+	if since != "" {
+		value, err := strconv.ParseUint(since, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid revision: %s", since), http.StatusBadRequest)
+			return
+		}
+
+		revision = value
+	}
+
+	subscription, err := watcher.Watch(r.URL.Query().Get("prefix"), revision)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error watching changes: %s", err), errorStatus(err))
+		return
+	}
+	defer subscription.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-config.shutdown:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event, ok := <-subscription.Events():
+			if !ok {
+				// The client reconnects and resumes after the last event it received.
+				if err := subscription.Err(); err != nil {
+					fmt.Fprintf(w, "event: error\ndata: %s\n\n", err)
+					flusher.Flush()
+				}
+				return
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Revision, event.Type, data)
+		}
+
+		flusher.Flush()
+	}
+}
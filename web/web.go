@@ -2,56 +2,187 @@
 package web
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/xperimental/uswd/db"
 )
 
 // DatabaseHandler creates a HTTP handler for interacting with a database.
-func DatabaseHandler(database db.Database) http.Handler {
+func DatabaseHandler(database db.Database, opts ...HandlerOption) http.Handler {
+	config := handlerConfig{}
+	for _, o := range opts {
+		o(&config)
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if config.follower != nil && isChange(r) {
+			http.Error(w, fmt.Sprintf("Read-only follower of %s.", config.follower.Leader()), http.StatusForbidden)
+			return
+		}
+
 		switch r.Method {
-		case http.MethodGet:
-			handleGet(database, w, r)
+		case http.MethodGet, http.MethodHead:
+			if r.URL.Path == socketPath && isWebSocketRequest(r) {
+				handleSocket(database, config, w, r)
+				return
+			}
+
+			if config.follower != nil && r.URL.Path == replicationPath {
+				writeJSON(w, r, config.follower.Status())
+				return
+			}
+
+			handleGet(database, config, w, r)
 		case http.MethodPut:
-			handlePut(database, w, r)
+			handlePut(database, config, w, r)
+		case http.MethodDelete:
+			handleDelete(database, w, r)
+		case http.MethodPost:
+			switch {
+			case r.URL.Path == batchPath:
+				handleBatch(database, config, w, r)
+			case isHistoryPath(database, r):
+				handleRestore(database, w, r)
+			default:
+				http.Error(w, fmt.Sprintf("Unknown method: %s", r.Method), http.StatusMethodNotAllowed)
+			}
 		default:
 			http.Error(w, fmt.Sprintf("Unknown method: %s", r.Method), http.StatusMethodNotAllowed)
 		}
 	})
 }
 
-func handleGet(database db.Database, w http.ResponseWriter, r *http.Request) {
+// isChange checks if the request changes the database.
+func isChange(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPut, http.MethodDelete, http.MethodPost:
+		return true
+	default:
+		return false
+	}
+}
+
+func handleGet(database db.Database, config handlerConfig, w http.ResponseWriter, r *http.Request) {
+	if watcher, ok := db.FindWatcher(database); ok && r.URL.Path == watchPath {
+		handleWatch(watcher, config, w, r)
+		return
+	}
+
+	if feed, ok := db.FindChangeFeed(database); ok && r.URL.Path == changesPath {
+		handleChanges(feed, config, w, r)
+		return
+	}
+
+	if feed, ok := db.FindChangeFeed(database); ok && r.URL.Path == snapshotPath {
+		handleSnapshot(database, feed, w, r)
+		return
+	}
+
+	if isHistoryPath(database, r) {
+		handleHistory(database, w, r)
+		return
+	}
+
 	key := getKey(r)
 	if key == "" {
 		handleGetList(database, w, r)
 		return
 	}
 
+	if isHistoryRequest(r) {
+		handleGetRevision(database, key, w, r)
+		return
+	}
+
+	if _, ok := r.URL.Query()["delimiter"]; ok {
+		handleGetRange(database, key, w, r)
+		return
+	}
+
 	handleGetSingle(database, key, w, r)
 }
 
 func handleGetList(database db.Database, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	for _, p := range listParameters {
+		if _, ok := query[p]; ok {
+			handleGetRange(database, "", w, r)
+			return
+		}
+	}
+
 	keys, err := database.List()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Database error: %s", err), http.StatusInternalServerError)
 		return
 	}
 
-	if err := json.NewEncoder(w).Encode(keys); err != nil {
+	writeJSON(w, r, keys)
+}
+
+// listParameters contains the query parameters which switch the list to returning pages of keys.
+var listParameters = []string{"prefix", "start", "end", "limit", "token", "delimiter"}
+
+// handleGetRange returns a page of keys. The prefix taken from the path is combined with the "prefix" parameter,
+// so that "/team/?delimiter=/" lists the contents of "team/" like a directory.
+func handleGetRange(database db.Database, prefix string, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	opts := db.ListOptions{
+		Prefix:    prefix + query.Get("prefix"),
+		Start:     query.Get("start"),
+		End:       query.Get("end"),
+		Token:     query.Get("token"),
+		Delimiter: query.Get("delimiter"),
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 0 {
+			http.Error(w, fmt.Sprintf("Invalid limit: %s", limit), http.StatusBadRequest)
+			return
+		}
+
+		opts.Limit = value
+	}
+
+	result, err := database.ListRange(opts)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Database error: %s", err), errorStatus(err))
+		return
+	}
+
+	writeJSON(w, r, result)
+}
+
+// writeJSON encodes value as the response. Only the headers are written for HEAD requests.
+func writeJSON(w http.ResponseWriter, r *http.Request, value interface{}) {
+	body := &bytes.Buffer{}
+	if err := json.NewEncoder(body).Encode(value); err != nil {
 		http.Error(w, fmt.Sprintf("Error encoding JSON: %s", err), http.StatusInternalServerError)
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	body.WriteTo(w)
 }
 
 func handleGetSingle(database db.Database, key string, w http.ResponseWriter, r *http.Request) {
-	content, found, err := database.Get(key)
+	reader, meta, found, err := db.GetReader(database, key)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error getting content: %s", err), http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf("Error getting content: %s", err), errorStatus(err))
 		return
 	}
 
@@ -59,31 +190,180 @@ func handleGetSingle(database db.Database, key string, w http.ResponseWriter, r
 		http.Error(w, fmt.Sprintf("Key not found: %s", key), http.StatusNotFound)
 		return
 	}
+	defer reader.Close()
 
-	fmt.Fprint(w, content)
+	// ServeContent handles conditional requests using the entity tag and modification time,
+	// and serves single or multiple byte ranges by seeking in the value.
+	writeMetadata(w, meta)
+	http.ServeContent(w, r, "", meta.Modified, reader)
 }
 
-func handlePut(database db.Database, w http.ResponseWriter, r *http.Request) {
+func handlePut(database db.Database, config handlerConfig, w http.ResponseWriter, r *http.Request) {
 	key := getKey(r)
 	if key == "" {
 		http.Error(w, "Key can not be empty!", http.StatusBadRequest)
 		return
 	}
 
-	content, err := ioutil.ReadAll(r.Body)
+	ttl, err := parseTTL(r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error parsing TTL: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if config.maxBodySize > 0 && r.ContentLength > config.maxBodySize {
+		http.Error(w, fmt.Sprintf("Body larger than %d bytes.", config.maxBodySize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	expected, ok, err := writePrecondition(database, key, r)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error reading body: %s", err), http.StatusBadRequest)
+		http.Error(w, fmt.Sprintf("Error getting content: %s", err), errorStatus(err))
 		return
 	}
 
-	if err := database.Put(key, string(content)); err != nil {
-		http.Error(w, fmt.Sprintf("Error writing content: %s", err), http.StatusInternalServerError)
+	if !ok {
+		http.Error(w, "Precondition failed.", http.StatusPreconditionFailed)
+		return
+	}
+
+	body := &bodyReader{
+		reader: r.Body,
+	}
+	if config.maxBodySize > 0 {
+		body.reader = http.MaxBytesReader(w, r.Body, config.maxBodySize)
+	}
+
+	opts := append(metadataOptions(r), db.WithTTL(ttl))
+	err = db.PutReader(database, key, body, expected, opts...)
+	switch {
+	case body.err != nil:
+		if _, ok := body.err.(*http.MaxBytesError); ok {
+			http.Error(w, fmt.Sprintf("Body larger than %d bytes.", config.maxBodySize), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		http.Error(w, fmt.Sprintf("Error reading body: %s", body.err), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Error writing content: %s", err), errorStatus(err))
 		return
 	}
 
 	fmt.Fprintln(w, "saved.")
 }
 
+// bodyReader remembers errors encountered while reading a request body,
+// so that they can be told apart from errors of the database.
+type bodyReader struct {
+	reader io.Reader
+	err    error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+
+	return n, err
+}
+
+func handleDelete(database db.Database, w http.ResponseWriter, r *http.Request) {
+	key := getKey(r)
+	if key == "" {
+		http.Error(w, "Key can not be empty!", http.StatusBadRequest)
+		return
+	}
+
+	found, err := database.Delete(key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error deleting content: %s", err), errorStatus(err))
+		return
+	}
+
+	if !found {
+		http.Error(w, fmt.Sprintf("Key not found: %s", key), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// unavailable is implemented by errors of databases, which are temporarily unable to make a change, like a
+// cluster without a leader.
+type unavailable interface {
+	Unavailable() bool
+}
+
+// errorStatus returns the HTTP status code matching an error returned by the database.
+func errorStatus(err error) int {
+	switch err {
+	case db.ErrReadOnly:
+		return http.StatusForbidden
+	case db.ErrVersionMismatch:
+		return http.StatusPreconditionFailed
+	case db.ErrInvalidToken:
+		return http.StatusBadRequest
+	case db.ErrRevisionUnavailable:
+		return http.StatusGone
+	case db.ErrNoHistory:
+		return http.StatusNotImplemented
+	}
+
+	switch err := err.(type) {
+	case unavailable:
+		if err.Unavailable() {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusInternalServerError
+	case *db.BatchError:
+		return errorStatus(err.Err)
+	case *db.InvalidKeyError:
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// parseTTL returns the time-to-live requested for a value either using the "ttl" query parameter
+// or the X-TTL header. The TTL is either a number of seconds or a duration like "1h30m".
+func parseTTL(r *http.Request) (time.Duration, error) {
+	value := r.URL.Query().Get("ttl")
+	if value == "" {
+		value = r.Header.Get("X-TTL")
+	}
+
+	return parseDuration(value)
+}
+
+// parseDuration parses either a number of seconds or a duration like "1h30m". An empty value is a zero duration.
+func parseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(value)
+	if err != nil {
+		seconds, convErr := strconv.ParseUint(value, 10, 63)
+		if convErr != nil {
+			return 0, err
+		}
+
+		if seconds > math.MaxInt64/uint64(time.Second) {
+			return 0, fmt.Errorf("TTL too large: %s", value)
+		}
+
+		ttl = time.Duration(seconds) * time.Second
+	}
+
+	if ttl < 0 {
+		return 0, fmt.Errorf("negative TTL: %s", value)
+	}
+
+	return ttl, nil
+}
+
 func getKey(r *http.Request) string {
 	return strings.TrimPrefix(r.URL.Path, "/")
 }
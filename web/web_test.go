@@ -1,18 +1,52 @@
 package web
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/xperimental/uswd/db"
+	"github.com/xperimental/uswd/replication"
 )
 
 type testDatabase struct {
-	db  map[string]string
-	err error
+	db       map[string]string
+	versions map[string]int64
+	options  map[string]db.PutOptions
+	err      error
+}
+
+// version returns the version of a key. Keys without an explicit version are at version one.
+func (d *testDatabase) version(key string) int64 {
+	if _, ok := d.db[key]; !ok {
+		return 0
+	}
+
+	if v, ok := d.versions[key]; ok {
+		return v
+	}
+
+	return 1
 }
 
 func (d *testDatabase) List() ([]string, error) {
@@ -28,31 +62,112 @@ func (d *testDatabase) List() ([]string, error) {
 	return keys, nil
 }
 
-func (d *testDatabase) Get(key string) (string, bool, error) {
+func (d *testDatabase) ListRange(opts db.ListOptions) (db.ListResult, error) {
+	keys, err := d.List()
+	if err != nil {
+		return db.ListResult{}, err
+	}
+
+	sort.Strings(keys)
+	return db.Paginate(keys, opts)
+}
+
+func (d *testDatabase) Get(key string) (db.Entry, bool, error) {
 	if d.err != nil {
-		return "", false, d.err
+		return db.Entry{}, false, d.err
 	}
 
 	value, ok := d.db[key]
 	if !ok {
-		return "", false, nil
+		return db.Entry{}, false, nil
 	}
 
-	return value, true, nil
+	return db.Entry{
+		Value: value,
+		Metadata: db.Metadata{
+			Version:     d.version(key),
+			Size:        int64(len(value)),
+			Checksum:    checksum(value),
+			ContentType: d.options[key].ContentType,
+			Headers:     d.options[key].Headers,
+		},
+	}, true, nil
+}
+
+func checksum(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+func (d *testDatabase) Put(key, value string, opts ...db.PutOption) error {
+	return d.CompareAndPut(key, value, d.version(key), opts...)
 }
 
-func (d *testDatabase) Put(key, value string) error {
+func (d *testDatabase) CompareAndPut(key, value string, expectedVersion int64, opts ...db.PutOption) error {
 	if d.err != nil {
 		return d.err
 	}
 
+	version := d.version(key)
+	if version != expectedVersion {
+		return db.ErrVersionMismatch
+	}
+
+	if d.versions == nil {
+		d.versions = make(map[string]int64)
+		d.options = make(map[string]db.PutOptions)
+	}
+
 	d.db[key] = value
+	d.versions[key] = version + 1
+	d.options[key] = db.ApplyPutOptions(opts...)
+	return nil
+}
+
+func (d *testDatabase) Delete(key string) (bool, error) {
+	if d.err != nil {
+		return false, d.err
+	}
+
+	_, ok := d.db[key]
+	if !ok {
+		return false, nil
+	}
+
+	delete(d.db, key)
+	return true, nil
+}
+
+func (d *testDatabase) Batch(ops []db.Op) error {
+	if d.err != nil {
+		return d.err
+	}
+
+	for i, op := range ops {
+		if op.ExpectedVersion >= 0 && d.version(op.Key) != op.ExpectedVersion {
+			return &db.BatchError{Index: i, Key: op.Key, Err: db.ErrVersionMismatch}
+		}
+	}
+
+	for _, op := range ops {
+		if op.Delete {
+			d.Delete(op.Key)
+			continue
+		}
+
+		d.Put(op.Key, op.Value, op.Options...)
+	}
+
+	return nil
+}
+
+func (d *testDatabase) Close() error {
 	return nil
 }
 
 func TestRouterUnknownMethod(t *testing.T) {
 	w := httptest.NewRecorder()
-	r := httptest.NewRequest(http.MethodDelete, "/", nil)
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
 
 	handler := DatabaseHandler(&testDatabase{})
 	handler.ServeHTTP(w, r)
@@ -155,6 +270,15 @@ func TestHandleGetSingle(t *testing.T) {
 			code: http.StatusInternalServerError,
 			body: "Error getting content: test error\n",
 		},
+		{
+			desc: "invalid key",
+			db: &testDatabase{
+				err: &db.InvalidKeyError{Key: "..", Reason: "test reason"},
+			},
+			path: "/..",
+			code: http.StatusBadRequest,
+			body: "Error getting content: invalid key \"..\": test reason\n",
+		},
 	} {
 		test := test
 		t.Run(test.desc, func(t *testing.T) {
@@ -216,6 +340,34 @@ func TestHandlePut(t *testing.T) {
 			code:  http.StatusInternalServerError,
 			body:  "Error writing content: test error\n",
 		},
+		{
+			desc: "invalid key",
+			db: &testDatabase{
+				err: &db.InvalidKeyError{Key: "..", Reason: "test reason"},
+			},
+			path:  "/..",
+			value: "",
+			code:  http.StatusBadRequest,
+			body:  "Error writing content: invalid key \"..\": test reason\n",
+		},
+		{
+			desc:  "reserved key",
+			db:    db.NewMemoryDatabase(),
+			path:  "/_watch",
+			value: "value",
+			code:  http.StatusBadRequest,
+			body:  "Error writing content: invalid key \"_watch\": keys starting with \"_\" are reserved\n",
+		},
+		{
+			desc: "read-only",
+			db: &testDatabase{
+				err: db.ErrReadOnly,
+			},
+			path:  "/key",
+			value: "",
+			code:  http.StatusForbidden,
+			body:  "Error writing content: database is read-only\n",
+		},
 	} {
 		test := test
 		t.Run(test.desc, func(t *testing.T) {
@@ -239,3 +391,1846 @@ func TestHandlePut(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleDelete(t *testing.T) {
+	for _, test := range []struct {
+		desc string
+		db   db.Database
+		path string
+		code int
+		body string
+	}{
+		{
+			desc: "success",
+			db: &testDatabase{
+				db: map[string]string{
+					"key": "value",
+				},
+			},
+			path: "/key",
+			code: http.StatusNoContent,
+			body: "",
+		},
+		{
+			desc: "not found",
+			db: &testDatabase{
+				db: map[string]string{},
+			},
+			path: "/key",
+			code: http.StatusNotFound,
+			body: "Key not found: key\n",
+		},
+		{
+			desc: "no key",
+			db: &testDatabase{
+				db: map[string]string{},
+			},
+			path: "/",
+			code: http.StatusBadRequest,
+			body: "Key can not be empty!\n",
+		},
+		{
+			desc: "error",
+			db: &testDatabase{
+				err: errors.New("test error"),
+			},
+			path: "/key",
+			code: http.StatusInternalServerError,
+			body: "Error deleting content: test error\n",
+		},
+		{
+			desc: "invalid key",
+			db: &testDatabase{
+				err: &db.InvalidKeyError{Key: "..", Reason: "test reason"},
+			},
+			path: "/..",
+			code: http.StatusBadRequest,
+			body: "Error deleting content: invalid key \"..\": test reason\n",
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodDelete, test.path, nil)
+
+			handler := DatabaseHandler(test.db)
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.code {
+				t.Errorf("got status %d, want %d", w.Code, test.code)
+			}
+
+			if w.Body.String() != test.body {
+				t.Errorf("got body %q, want %q", w.Body.String(), test.body)
+			}
+		})
+	}
+}
+
+func TestHandleGetETag(t *testing.T) {
+	database := &testDatabase{
+		db: map[string]string{
+			"key": "value",
+		},
+		versions: map[string]int64{
+			"key": 3,
+		},
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/key", nil)
+
+	handler := DatabaseHandler(database)
+	handler.ServeHTTP(w, r)
+
+	expected := `"` + checksum("value") + `"`
+	if etag := w.Header().Get("ETag"); etag != expected {
+		t.Errorf("got ETag %q, want %q", etag, expected)
+	}
+}
+
+func TestHandlePutConditional(t *testing.T) {
+	for _, test := range []struct {
+		desc    string
+		db      map[string]string
+		headers map[string]string
+		code    int
+		value   string
+	}{
+		{
+			desc: "if-match success",
+			db: map[string]string{
+				"key": "old",
+			},
+			headers: map[string]string{
+				"If-Match": `"` + checksum("old") + `"`,
+			},
+			code:  http.StatusOK,
+			value: "new",
+		},
+		{
+			desc: "if-match list",
+			db: map[string]string{
+				"key": "old",
+			},
+			headers: map[string]string{
+				"If-Match": `"other", "` + checksum("old") + `"`,
+			},
+			code:  http.StatusOK,
+			value: "new",
+		},
+		{
+			desc: "if-match conflict",
+			db: map[string]string{
+				"key": "old",
+			},
+			headers: map[string]string{
+				"If-Match": `"` + checksum("other") + `"`,
+			},
+			code:  http.StatusPreconditionFailed,
+			value: "old",
+		},
+		{
+			desc: "if-match weak",
+			db: map[string]string{
+				"key": "old",
+			},
+			headers: map[string]string{
+				"If-Match": `W/"` + checksum("old") + `"`,
+			},
+			code:  http.StatusPreconditionFailed,
+			value: "old",
+		},
+		{
+			desc: "if-match any",
+			db: map[string]string{
+				"key": "old",
+			},
+			headers: map[string]string{
+				"If-Match": "*",
+			},
+			code:  http.StatusOK,
+			value: "new",
+		},
+		{
+			desc: "if-match any missing",
+			db:   map[string]string{},
+			headers: map[string]string{
+				"If-Match": "*",
+			},
+			code:  http.StatusPreconditionFailed,
+			value: "",
+		},
+		{
+			desc: "if-none-match create",
+			db:   map[string]string{},
+			headers: map[string]string{
+				"If-None-Match": "*",
+			},
+			code:  http.StatusOK,
+			value: "new",
+		},
+		{
+			desc: "if-none-match exists",
+			db: map[string]string{
+				"key": "old",
+			},
+			headers: map[string]string{
+				"If-None-Match": "*",
+			},
+			code:  http.StatusPreconditionFailed,
+			value: "old",
+		},
+		{
+			desc: "if-none-match other version",
+			db: map[string]string{
+				"key": "old",
+			},
+			headers: map[string]string{
+				"If-None-Match": `"` + checksum("other") + `"`,
+			},
+			code:  http.StatusOK,
+			value: "new",
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			database := &testDatabase{
+				db: test.db,
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/key", bytes.NewBufferString("new"))
+			for k, v := range test.headers {
+				r.Header.Set(k, v)
+			}
+
+			handler := DatabaseHandler(database)
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.code {
+				t.Errorf("got status %d, want %d", w.Code, test.code)
+			}
+
+			if value := database.db["key"]; value != test.value {
+				t.Errorf("got value %q, want %q", value, test.value)
+			}
+		})
+	}
+}
+
+func TestHandlePutTTL(t *testing.T) {
+	for _, test := range []struct {
+		desc    string
+		query   string
+		headers map[string]string
+		code    int
+		ttl     time.Duration
+	}{
+		{
+			desc: "none",
+			code: http.StatusOK,
+			ttl:  0,
+		},
+		{
+			desc:  "query seconds",
+			query: "?ttl=30",
+			code:  http.StatusOK,
+			ttl:   30 * time.Second,
+		},
+		{
+			desc:  "query duration",
+			query: "?ttl=1h30m",
+			code:  http.StatusOK,
+			ttl:   90 * time.Minute,
+		},
+		{
+			desc: "header",
+			headers: map[string]string{
+				"X-TTL": "5m",
+			},
+			code: http.StatusOK,
+			ttl:  5 * time.Minute,
+		},
+		{
+			desc:  "invalid",
+			query: "?ttl=soon",
+			code:  http.StatusBadRequest,
+		},
+		{
+			desc:  "negative",
+			query: "?ttl=-5s",
+			code:  http.StatusBadRequest,
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			database := &testDatabase{
+				db: map[string]string{},
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/key"+test.query, bytes.NewBufferString("value"))
+			for k, v := range test.headers {
+				r.Header.Set(k, v)
+			}
+
+			handler := DatabaseHandler(database)
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.code {
+				t.Errorf("got status %d, want %d", w.Code, test.code)
+			}
+
+			if ttl := database.options["key"].TTL; ttl != test.ttl {
+				t.Errorf("got TTL %s, want %s", ttl, test.ttl)
+			}
+		})
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	maxSeconds := int64(math.MaxInt64 / int64(time.Second))
+	for _, test := range []struct {
+		desc     string
+		value    string
+		duration time.Duration
+		err      bool
+	}{
+		{
+			desc:     "empty",
+			value:    "",
+			duration: 0,
+		},
+		{
+			desc:     "seconds",
+			value:    "30",
+			duration: 30 * time.Second,
+		},
+		{
+			desc:     "duration",
+			value:    "1h30m",
+			duration: 90 * time.Minute,
+		},
+		{
+			desc:     "largest seconds",
+			value:    strconv.FormatInt(maxSeconds, 10),
+			duration: time.Duration(maxSeconds) * time.Second,
+		},
+		{
+			desc:  "overflowing seconds",
+			value: strconv.FormatInt(maxSeconds+1, 10),
+			err:   true,
+		},
+		{
+			desc:  "wrapping seconds",
+			value: "18446744074",
+			err:   true,
+		},
+		{
+			desc:  "largest uint63",
+			value: strconv.FormatInt(math.MaxInt64, 10),
+			err:   true,
+		},
+		{
+			desc:  "negative",
+			value: "-1m",
+			err:   true,
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			duration, err := parseDuration(test.value)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, want error %v", err, test.err)
+			}
+
+			if duration != test.duration {
+				t.Errorf("got duration %s, want %s", duration, test.duration)
+			}
+		})
+	}
+}
+
+func TestHandleGetRange(t *testing.T) {
+	database := &testDatabase{
+		db: map[string]string{
+			"a":   "value",
+			"b/1": "value",
+			"b/2": "value",
+			"b/3": "value",
+			"c":   "value",
+		},
+	}
+
+	for _, test := range []struct {
+		desc   string
+		target string
+		code   int
+		body   string
+	}{
+		{
+			desc:   "prefix",
+			target: "/?prefix=b/",
+			code:   http.StatusOK,
+			body:   "{\"keys\":[\"b/1\",\"b/2\",\"b/3\"]}\n",
+		},
+		{
+			desc:   "range",
+			target: "/?start=b/3&end=d",
+			code:   http.StatusOK,
+			body:   "{\"keys\":[\"b/3\",\"c\"]}\n",
+		},
+		{
+			desc:   "limit",
+			target: "/?limit=2",
+			code:   http.StatusOK,
+			body:   "{\"keys\":[\"a\",\"b/1\"],\"next\":\"Yi8x\"}\n",
+		},
+		{
+			desc:   "token",
+			target: "/?limit=2&token=Yi8x",
+			code:   http.StatusOK,
+			body:   "{\"keys\":[\"b/2\",\"b/3\"],\"next\":\"Yi8z\"}\n",
+		},
+		{
+			desc:   "empty",
+			target: "/?prefix=x",
+			code:   http.StatusOK,
+			body:   "{\"keys\":[]}\n",
+		},
+		{
+			desc:   "delimiter",
+			target: "/?delimiter=/",
+			code:   http.StatusOK,
+			body:   "{\"keys\":[\"a\",\"c\"],\"prefixes\":[\"b/\"]}\n",
+		},
+		{
+			desc:   "directory",
+			target: "/b/?delimiter=/",
+			code:   http.StatusOK,
+			body:   "{\"keys\":[\"b/1\",\"b/2\",\"b/3\"]}\n",
+		},
+		{
+			desc:   "directory with prefix",
+			target: "/b/?delimiter=/&prefix=2",
+			code:   http.StatusOK,
+			body:   "{\"keys\":[\"b/2\"]}\n",
+		},
+		{
+			desc:   "invalid limit",
+			target: "/?limit=many",
+			code:   http.StatusBadRequest,
+			body:   "Invalid limit: many\n",
+		},
+		{
+			desc:   "invalid token",
+			target: "/?token=!",
+			code:   http.StatusBadRequest,
+			body:   "Database error: invalid continuation token\n",
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, test.target, nil)
+
+			handler := DatabaseHandler(database)
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.code {
+				t.Errorf("got status %d, want %d", w.Code, test.code)
+			}
+
+			if w.Body.String() != test.body {
+				t.Errorf("got body %q, want %q", w.Body.String(), test.body)
+			}
+		})
+	}
+}
+
+func TestHandlePutMaxBodySize(t *testing.T) {
+	for _, test := range []struct {
+		desc          string
+		value         string
+		contentLength bool
+		code          int
+		body          string
+	}{
+		{
+			desc:  "small",
+			value: "value",
+			code:  http.StatusOK,
+			body:  "saved.\n",
+		},
+		{
+			desc:  "too large",
+			value: "larger value",
+			code:  http.StatusRequestEntityTooLarge,
+			body:  "Body larger than 10 bytes.\n",
+		},
+		{
+			desc:          "too large content length",
+			value:         "larger value",
+			contentLength: true,
+			code:          http.StatusRequestEntityTooLarge,
+			body:          "Body larger than 10 bytes.\n",
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			database := &testDatabase{
+				db: map[string]string{},
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/key", bytes.NewBufferString(test.value))
+			if !test.contentLength {
+				r.ContentLength = -1
+			}
+
+			handler := DatabaseHandler(database, WithMaxBodySize(10))
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.code {
+				t.Errorf("got status %d, want %d", w.Code, test.code)
+			}
+
+			if w.Body.String() != test.body {
+				t.Errorf("got body %q, want %q", w.Body.String(), test.body)
+			}
+		})
+	}
+}
+
+func TestHandleMetadata(t *testing.T) {
+	database := &testDatabase{
+		db: map[string]string{},
+	}
+	handler := DatabaseHandler(database)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/key", bytes.NewBufferString("{}"))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Meta-Owner", "team")
+	r.Header.Set("X-Other", "ignored")
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(method, "/key", nil)
+		handler.ServeHTTP(w, r)
+
+		expected := http.Header{
+			"Accept-Ranges":  {"bytes"},
+			"Content-Type":   {"application/json"},
+			"Content-Length": {"2"},
+			"Etag":           {`"` + checksum("{}") + `"`},
+			"X-Meta-Owner":   {"team"},
+		}
+		if !reflect.DeepEqual(w.Header(), expected) {
+			t.Errorf("got headers %v for %s, want %v", w.Header(), method, expected)
+		}
+
+		body := "{}"
+		if method == http.MethodHead {
+			body = ""
+		}
+
+		if w.Body.String() != body {
+			t.Errorf("got body %q for %s, want %q", w.Body.String(), method, body)
+		}
+	}
+}
+
+func TestHandleGetConditional(t *testing.T) {
+	modified := time.Date(2018, 1, 1, 12, 0, 0, 0, time.UTC)
+	database := &modifiedDatabase{
+		testDatabase: testDatabase{
+			db: map[string]string{
+				"key": "value",
+			},
+		},
+		modified: modified,
+	}
+
+	for _, test := range []struct {
+		desc    string
+		method  string
+		headers map[string]string
+		code    int
+		body    string
+	}{
+		{
+			desc:   "unconditional",
+			method: http.MethodGet,
+			code:   http.StatusOK,
+			body:   "value",
+		},
+		{
+			desc:   "etag match",
+			method: http.MethodGet,
+			headers: map[string]string{
+				"If-None-Match": `"` + checksum("value") + `"`,
+			},
+			code: http.StatusNotModified,
+			body: "",
+		},
+		{
+			desc:   "weak etag match",
+			method: http.MethodHead,
+			headers: map[string]string{
+				"If-None-Match": `W/"` + checksum("value") + `"`,
+			},
+			code: http.StatusNotModified,
+			body: "",
+		},
+		{
+			desc:   "etag changed",
+			method: http.MethodGet,
+			headers: map[string]string{
+				"If-None-Match":     `"` + checksum("other") + `"`,
+				"If-Modified-Since": modified.Format(http.TimeFormat),
+			},
+			code: http.StatusOK,
+			body: "value",
+		},
+		{
+			desc:   "not modified since",
+			method: http.MethodGet,
+			headers: map[string]string{
+				"If-Modified-Since": modified.Format(http.TimeFormat),
+			},
+			code: http.StatusNotModified,
+			body: "",
+		},
+		{
+			desc:   "modified since",
+			method: http.MethodGet,
+			headers: map[string]string{
+				"If-Modified-Since": modified.Add(-time.Second).Format(http.TimeFormat),
+			},
+			code: http.StatusOK,
+			body: "value",
+		},
+		{
+			desc:   "head",
+			method: http.MethodHead,
+			code:   http.StatusOK,
+			body:   "",
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(test.method, "/key", nil)
+			for k, v := range test.headers {
+				r.Header.Set(k, v)
+			}
+
+			handler := DatabaseHandler(database)
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.code {
+				t.Errorf("got status %d, want %d", w.Code, test.code)
+			}
+
+			if w.Body.String() != test.body {
+				t.Errorf("got body %q, want %q", w.Body.String(), test.body)
+			}
+
+			if w.Code != http.StatusOK {
+				return
+			}
+
+			if lastModified := w.Header().Get("Last-Modified"); lastModified != modified.Format(http.TimeFormat) {
+				t.Errorf("got Last-Modified %q, want %q", lastModified, modified.Format(http.TimeFormat))
+			}
+		})
+	}
+}
+
+// modifiedDatabase returns the same modification time for all values.
+type modifiedDatabase struct {
+	testDatabase
+	modified time.Time
+}
+
+func (d *modifiedDatabase) Get(key string) (db.Entry, bool, error) {
+	entry, found, err := d.testDatabase.Get(key)
+	entry.Modified = d.modified
+	return entry, found, err
+}
+
+func TestHandleHeadList(t *testing.T) {
+	database := &testDatabase{
+		db: map[string]string{
+			"key": "value",
+		},
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodHead, "/", nil)
+
+	handler := DatabaseHandler(database)
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusOK)
+	}
+
+	expected := http.Header{
+		"Content-Type":   {"application/json"},
+		"Content-Length": {"8"},
+	}
+	if !reflect.DeepEqual(w.Header(), expected) {
+		t.Errorf("got headers %v, want %v", w.Header(), expected)
+	}
+
+	if w.Body.Len() != 0 {
+		t.Errorf("got body %q, want none", w.Body.String())
+	}
+}
+
+func TestHandleGetByteRange(t *testing.T) {
+	database := &testDatabase{
+		db: map[string]string{
+			"key": "0123456789",
+		},
+	}
+
+	for _, test := range []struct {
+		desc         string
+		headers      map[string]string
+		code         int
+		contentRange string
+		body         string
+	}{
+		{
+			desc: "single range",
+			headers: map[string]string{
+				"Range": "bytes=2-5",
+			},
+			code:         http.StatusPartialContent,
+			contentRange: "bytes 2-5/10",
+			body:         "2345",
+		},
+		{
+			desc: "suffix",
+			headers: map[string]string{
+				"Range": "bytes=-3",
+			},
+			code:         http.StatusPartialContent,
+			contentRange: "bytes 7-9/10",
+			body:         "789",
+		},
+		{
+			desc: "unsatisfiable",
+			headers: map[string]string{
+				"Range": "bytes=20-30",
+			},
+			code:         http.StatusRequestedRangeNotSatisfiable,
+			contentRange: "bytes */10",
+			body:         "invalid range: failed to overlap\n",
+		},
+		{
+			desc: "if-range match",
+			headers: map[string]string{
+				"Range":    "bytes=0-0",
+				"If-Range": `"` + checksum("0123456789") + `"`,
+			},
+			code:         http.StatusPartialContent,
+			contentRange: "bytes 0-0/10",
+			body:         "0",
+		},
+		{
+			desc: "if-range changed",
+			headers: map[string]string{
+				"Range":    "bytes=0-0",
+				"If-Range": `"` + checksum("other") + `"`,
+			},
+			code: http.StatusOK,
+			body: "0123456789",
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/key", nil)
+			for k, v := range test.headers {
+				r.Header.Set(k, v)
+			}
+
+			handler := DatabaseHandler(database)
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.code {
+				t.Errorf("got status %d, want %d", w.Code, test.code)
+			}
+
+			if contentRange := w.Header().Get("Content-Range"); contentRange != test.contentRange {
+				t.Errorf("got Content-Range %q, want %q", contentRange, test.contentRange)
+			}
+
+			if w.Body.String() != test.body {
+				t.Errorf("got body %q, want %q", w.Body.String(), test.body)
+			}
+		})
+	}
+}
+
+func TestHandleGetMultiRange(t *testing.T) {
+	database := &testDatabase{
+		db: map[string]string{
+			"key": "0123456789",
+		},
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/key", nil)
+	r.Header.Set("Range", "bytes=0-1,8-9")
+
+	handler := DatabaseHandler(database)
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("got status %d, want %d", w.Code, http.StatusPartialContent)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("error parsing content type: %s", err)
+	}
+
+	if mediaType != "multipart/byteranges" {
+		t.Fatalf("got media type %q, want %q", mediaType, "multipart/byteranges")
+	}
+
+	parts := []string{}
+	reader := multipart.NewReader(w.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatalf("error reading part: %s", err)
+		}
+
+		content, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatalf("error reading part: %s", err)
+		}
+
+		parts = append(parts, part.Header.Get("Content-Range")+" "+string(content))
+	}
+
+	expected := []string{"bytes 0-1/10 01", "bytes 8-9/10 89"}
+	if !reflect.DeepEqual(parts, expected) {
+		t.Errorf("got parts %q, want %q", parts, expected)
+	}
+}
+
+func TestHandleBatch(t *testing.T) {
+	for _, test := range []struct {
+		desc     string
+		path     string
+		body     string
+		code     int
+		response string
+		db       map[string]string
+	}{
+		{
+			desc:     "success",
+			path:     "/_batch",
+			body:     `{"operations":[{"op":"put","key":"new","value":"value","headers":{"x-meta-owner":"team"}},{"op":"delete","key":"old","version":1}]}`,
+			code:     http.StatusOK,
+			response: "saved.\n",
+			db: map[string]string{
+				"new": "value",
+			},
+		},
+		{
+			desc:     "version mismatch",
+			path:     "/_batch",
+			body:     `{"operations":[{"op":"put","key":"new","value":"value"},{"op":"delete","key":"old","version":2}]}`,
+			code:     http.StatusPreconditionFailed,
+			response: "Error applying batch: operation 1 on \"old\": version does not match\n",
+			db: map[string]string{
+				"old": "value",
+			},
+		},
+		{
+			desc:     "unknown operation",
+			path:     "/_batch",
+			body:     `{"operations":[{"op":"move","key":"old"}]}`,
+			code:     http.StatusBadRequest,
+			response: "Invalid operation 0: unknown operation: \"move\"\n",
+			db: map[string]string{
+				"old": "value",
+			},
+		},
+		{
+			desc:     "invalid header",
+			path:     "/_batch",
+			body:     `{"operations":[{"op":"put","key":"new","headers":{"Owner":"team"}}]}`,
+			code:     http.StatusBadRequest,
+			response: "Invalid operation 0: header does not start with X-Meta-: Owner\n",
+			db: map[string]string{
+				"old": "value",
+			},
+		},
+		{
+			desc:     "invalid json",
+			path:     "/_batch",
+			body:     `[`,
+			code:     http.StatusBadRequest,
+			response: "Error parsing batch: unexpected EOF\n",
+			db: map[string]string{
+				"old": "value",
+			},
+		},
+		{
+			desc:     "other path",
+			path:     "/old",
+			body:     `{}`,
+			code:     http.StatusMethodNotAllowed,
+			response: "Unknown method: POST\n",
+			db: map[string]string{
+				"old": "value",
+			},
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			database := &testDatabase{
+				db: map[string]string{
+					"old": "value",
+				},
+			}
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, test.path, bytes.NewBufferString(test.body))
+
+			handler := DatabaseHandler(database)
+			handler.ServeHTTP(w, r)
+
+			if w.Code != test.code {
+				t.Errorf("got status %d, want %d", w.Code, test.code)
+			}
+
+			if w.Body.String() != test.response {
+				t.Errorf("got body %q, want %q", w.Body.String(), test.response)
+			}
+
+			if !reflect.DeepEqual(database.db, test.db) {
+				t.Errorf("got database %q, want %q", database.db, test.db)
+			}
+		})
+	}
+}
+
+// readEvent reads the next server-sent event, skipping comments.
+func readEvent(t *testing.T, reader *bufio.Reader) map[string]string {
+	t.Helper()
+
+	event := map[string]string{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("got error %q reading event, want none", err)
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && len(event) > 0:
+			return event
+		case line == "", strings.HasPrefix(line, ":"):
+		default:
+			parts := strings.SplitN(line, ": ", 2)
+			event[parts[0]] = parts[1]
+		}
+	}
+}
+
+func TestHandleWatch(t *testing.T) {
+	hub := db.NewHub(db.NewMemoryDatabase())
+	defer hub.Close()
+
+	server := httptest.NewServer(DatabaseHandler(hub))
+	defer server.Close()
+
+	hub.Put("team/a", "first")
+	hub.Put("other", "value")
+
+	res, err := http.Get(server.URL + "/_watch?prefix=team/&since=0")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusOK)
+	}
+
+	if contentType := res.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Errorf("got content type %q, want %q", contentType, "text/event-stream")
+	}
+
+	hub.Put("other", "value")
+	hub.Put("team/a", "second")
+	hub.Delete("team/a")
+
+	reader := bufio.NewReader(res.Body)
+	event := readEvent(t, reader)
+	if event["id"] != "4" || event["event"] != "put" {
+		t.Errorf("got event %q, want put with id 4", event)
+	}
+
+	data := db.Event{}
+	if err := json.Unmarshal([]byte(event["data"]), &data); err != nil {
+		t.Fatalf("got error %q decoding %q, want none", err, event["data"])
+	}
+
+	if data.Key != "team/a" || data.Metadata.Version != 2 {
+		t.Errorf("got key %q at version %d, want %q at version 2", data.Key, data.Metadata.Version, "team/a")
+	}
+
+	event = readEvent(t, reader)
+	if event["id"] != "5" || event["event"] != "delete" {
+		t.Errorf("got event %q, want delete with id 5", event)
+	}
+
+	// Reconnecting clients resume after the last event they received.
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/_watch?since=5", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	resumed, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	defer resumed.Body.Close()
+
+	ids := []string{}
+	reader = bufio.NewReader(resumed.Body)
+	for i := 0; i < 4; i++ {
+		ids = append(ids, readEvent(t, reader)["id"])
+	}
+
+	if !reflect.DeepEqual(ids, []string{"2", "3", "4", "5"}) {
+		t.Errorf("got ids %q, want %q", ids, []string{"2", "3", "4", "5"})
+	}
+}
+
+func TestHandleWatchErrors(t *testing.T) {
+	hub := db.NewHub(db.NewMemoryDatabase())
+	defer hub.Close()
+
+	hub.Put("key", "value")
+
+	for _, test := range []struct {
+		desc     string
+		since    string
+		code     int
+		response string
+	}{
+		{
+			desc:     "invalid revision",
+			since:    "first",
+			code:     http.StatusBadRequest,
+			response: "Invalid revision: first\n",
+		},
+		{
+			desc:     "future revision",
+			since:    "2",
+			code:     http.StatusGone,
+			response: "Error watching changes: revision is not available\n",
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/_watch?since="+test.since, nil)
+			res := httptest.NewRecorder()
+			DatabaseHandler(hub).ServeHTTP(res, req)
+
+			if res.Code != test.code {
+				t.Errorf("got status %d, want %d", res.Code, test.code)
+			}
+
+			if res.Body.String() != test.response {
+				t.Errorf("got response %q, want %q", res.Body.String(), test.response)
+			}
+		})
+	}
+}
+
+// dialSocket opens a WebSocket connection to the server.
+func dialSocket(t *testing.T, server *httptest.Server) *wsConn {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatalf("got error %q connecting, want none", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+socketPath, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("got error %q sending handshake, want none", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatalf("got error %q reading handshake, want none", err)
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got status %d, want %d", res.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	if accept := res.Header.Get("Sec-WebSocket-Accept"); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("got accept key %q, want %q", accept, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+	}
+
+	return &wsConn{
+		conn:   conn,
+		reader: reader,
+		client: true,
+	}
+}
+
+// exchange sends a request and returns the next message received.
+func exchange(t *testing.T, conn *wsConn, request string) socketMessage {
+	t.Helper()
+
+	if err := conn.writeMessage([]byte(request)); err != nil {
+		t.Fatalf("got error %q sending, want none", err)
+	}
+
+	return readSocketMessage(t, conn)
+}
+
+func readSocketMessage(t *testing.T, conn *wsConn) socketMessage {
+	t.Helper()
+
+	_, data, err := conn.readMessage()
+	if err != nil {
+		t.Fatalf("got error %q receiving, want none", err)
+	}
+
+	message := socketMessage{}
+	if err := json.Unmarshal(data, &message); err != nil {
+		t.Fatalf("got error %q decoding %q, want none", err, data)
+	}
+
+	return message
+}
+
+func TestSocketHandshake(t *testing.T) {
+	for _, test := range []struct {
+		desc    string
+		headers map[string]string
+		code    int
+	}{
+		{
+			desc: "unsupported version",
+			headers: map[string]string{
+				"Sec-WebSocket-Version": "8",
+				"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+			},
+			code: http.StatusUpgradeRequired,
+		},
+		{
+			desc: "invalid key",
+			headers: map[string]string{
+				"Sec-WebSocket-Version": "13",
+				"Sec-WebSocket-Key":     "c2hvcnQ=",
+			},
+			code: http.StatusBadRequest,
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, socketPath, nil)
+			req.Header.Set("Connection", "keep-alive, Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+
+			res := httptest.NewRecorder()
+			DatabaseHandler(&testDatabase{}).ServeHTTP(res, req)
+
+			if res.Code != test.code {
+				t.Errorf("got status %d, want %d", res.Code, test.code)
+			}
+		})
+	}
+}
+
+func TestSocketOrigin(t *testing.T) {
+	t.Parallel()
+
+	hub := db.NewHub(db.NewMemoryDatabase())
+	defer hub.Close()
+
+	server := httptest.NewServer(DatabaseHandler(hub, WithAllowedOrigins("https://dashboard.example.com")))
+	defer server.Close()
+
+	for _, test := range []struct {
+		desc   string
+		origin string
+		code   int
+	}{
+		{
+			desc: "no origin",
+			code: http.StatusSwitchingProtocols,
+		},
+		{
+			desc:   "same host",
+			origin: "http://" + strings.TrimPrefix(server.URL, "http://"),
+			code:   http.StatusSwitchingProtocols,
+		},
+		{
+			desc:   "allowed origin",
+			origin: "https://dashboard.example.com",
+			code:   http.StatusSwitchingProtocols,
+		},
+		{
+			desc:   "foreign origin",
+			origin: "https://attacker.example.com",
+			code:   http.StatusForbidden,
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+			if err != nil {
+				t.Fatalf("got error %q connecting, want none", err)
+			}
+			defer conn.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, server.URL+socketPath, nil)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			if err := req.Write(conn); err != nil {
+				t.Fatalf("got error %q sending handshake, want none", err)
+			}
+
+			res, err := http.ReadResponse(bufio.NewReader(conn), req)
+			if err != nil {
+				t.Fatalf("got error %q reading handshake, want none", err)
+			}
+
+			if res.StatusCode != test.code {
+				t.Errorf("got status %d, want %d", res.StatusCode, test.code)
+			}
+		})
+	}
+}
+
+func TestSocket(t *testing.T) {
+	hub := db.NewHub(db.NewMemoryDatabase())
+	defer hub.Close()
+
+	server := httptest.NewServer(DatabaseHandler(hub, WithMaxBodySize(10)))
+	defer server.Close()
+
+	conn := dialSocket(t, server)
+	defer conn.Close()
+
+	for _, test := range []struct {
+		request  string
+		response socketMessage
+	}{
+		{
+			request:  `{"id":"1","op":"put","key":"team/a","value":"first"}`,
+			response: socketMessage{Type: "response", ID: "1", Status: http.StatusOK},
+		},
+		{
+			request:  `{"id":"2","op":"put","key":"team/a","value":"second","version":2}`,
+			response: socketMessage{Type: "response", ID: "2", Status: http.StatusPreconditionFailed, Error: "version does not match"},
+		},
+		{
+			request:  `{"id":"3","op":"put","key":"team/a","value":"far too long"}`,
+			response: socketMessage{Type: "response", ID: "3", Status: http.StatusRequestEntityTooLarge, Error: "value larger than 10 bytes"},
+		},
+		{
+			request:  `{"id":"4","op":"get","key":"missing"}`,
+			response: socketMessage{Type: "response", ID: "4", Status: http.StatusNotFound, Error: "key not found: missing"},
+		},
+		{
+			request:  `{"id":"5","op":"delete","key":"missing"}`,
+			response: socketMessage{Type: "response", ID: "5", Status: http.StatusNotFound, Error: "key not found: missing"},
+		},
+		{
+			request:  `{"id":"6","op":"move"}`,
+			response: socketMessage{Type: "response", ID: "6", Status: http.StatusBadRequest, Error: `unknown operation: "move"`},
+		},
+		{
+			request:  `{"id":`,
+			response: socketMessage{Type: "response", Status: http.StatusBadRequest, Error: "error parsing request: unexpected end of JSON input"},
+		},
+		{
+			request:  `{"id":"7","op":"unsubscribe","subscription":"missing"}`,
+			response: socketMessage{Type: "response", ID: "7", Status: http.StatusNotFound, Error: "subscription not found: missing"},
+		},
+	} {
+		response := exchange(t, conn, test.request)
+		if !reflect.DeepEqual(response, test.response) {
+			t.Errorf("got response %+v to %s, want %+v", response, test.request, test.response)
+		}
+	}
+
+	response := exchange(t, conn, `{"id":"get","op":"get","key":"team/a"}`)
+	if response.Status != http.StatusOK || response.Value == nil || *response.Value != "first" || response.Metadata.Version != 1 {
+		t.Errorf("got response %+v, want value %q at version 1", response, "first")
+	}
+
+	response = exchange(t, conn, `{"id":"list","op":"list","prefix":"team/"}`)
+	if response.Status != http.StatusOK || response.List == nil || !reflect.DeepEqual(response.List.Keys, []string{"team/a"}) {
+		t.Errorf("got response %+v, want key %q", response, "team/a")
+	}
+
+	response = exchange(t, conn, `{"id":"sub","op":"subscribe","prefix":"team/","since":0}`)
+	if response.Status != http.StatusOK {
+		t.Fatalf("got response %+v, want success", response)
+	}
+
+	response = exchange(t, conn, `{"id":"sub","op":"subscribe"}`)
+	if response.Status != http.StatusConflict {
+		t.Errorf("got response %+v, want conflict", response)
+	}
+
+	response = exchange(t, conn, `{"id":"del","op":"delete","key":"team/a","version":1}`)
+	if response.Status != http.StatusOK {
+		t.Errorf("got response %+v, want success", response)
+	}
+
+	event := readSocketMessage(t, conn)
+	if event.Type != "event" || event.Subscription != "sub" || event.Event == nil || event.Event.Type != db.EventDelete || event.Event.Key != "team/a" {
+		t.Errorf("got message %+v, want delete event of %q", event, "team/a")
+	}
+
+	response = exchange(t, conn, `{"id":"unsub","op":"unsubscribe","subscription":"sub"}`)
+	if response.Status != http.StatusOK {
+		t.Errorf("got response %+v, want success", response)
+	}
+
+	hub.Put("team/b", "value")
+	response = exchange(t, conn, `{"id":"last","op":"get","key":"team/b"}`)
+	if response.ID != "last" {
+		t.Errorf("got message %+v after unsubscribing, want response", response)
+	}
+}
+
+func TestSocketFrames(t *testing.T) {
+	server := httptest.NewServer(DatabaseHandler(db.NewMemoryDatabase()))
+	defer server.Close()
+
+	conn := dialSocket(t, server)
+	defer conn.Close()
+
+	// A fragmented message interleaved with a ping.
+	frames := [][]byte{
+		{0x01, 0x80 | 10},
+		[]byte(`{"id":"1",`),
+		{0x89, 0x80 | 2},
+		[]byte("hi"),
+		{0x80, 0x80 | 21},
+		[]byte(`"op":"get","key":"a"}`),
+	}
+	for i := 0; i < len(frames); i += 2 {
+		// A zero mask leaves the payload unchanged.
+		frame := append(append(frames[i], 0, 0, 0, 0), frames[i+1]...)
+		if _, err := conn.conn.Write(frame); err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+	}
+
+	fin, opcode, payload, err := conn.readFrame()
+	if err != nil || !fin || opcode != opPong || string(payload) != "hi" {
+		t.Errorf("got frame %v %d %q (error %v), want pong %q", fin, opcode, payload, err, "hi")
+	}
+
+	response := readSocketMessage(t, conn)
+	if response.ID != "1" || response.Status != http.StatusNotFound {
+		t.Errorf("got response %+v, want not found", response)
+	}
+
+	// Clients need to mask their frames.
+	if _, err := conn.conn.Write([]byte{0x81, 2, 'h', 'i'}); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	_, _, err = conn.readMessage()
+	if closeErr, ok := err.(*closeError); !ok || closeErr.code != closeProtocolError {
+		t.Errorf("got error %v, want close with status %d", err, closeProtocolError)
+	}
+}
+
+func TestSocketShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	server := httptest.NewServer(DatabaseHandler(db.NewMemoryDatabase(), WithShutdown(ctx)))
+	defer server.Close()
+
+	conn := dialSocket(t, server)
+	defer conn.Close()
+
+	cancel()
+
+	_, _, err := conn.readMessage()
+	if closeErr, ok := err.(*closeError); !ok || closeErr.code != closeGoingAway {
+		t.Errorf("got error %v, want close with status %d", err, closeGoingAway)
+	}
+}
+
+func TestHandleChanges(t *testing.T) {
+	hub := db.NewHub(db.NewMemoryDatabase())
+	defer hub.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		hub.Put(key, "value")
+	}
+
+	for _, test := range []struct {
+		desc      string
+		query     string
+		code      int
+		revisions []uint64
+		revision  uint64
+		response  string
+	}{
+		{
+			desc:      "all",
+			query:     "",
+			code:      http.StatusOK,
+			revisions: []uint64{1, 2, 3},
+			revision:  3,
+		},
+		{
+			desc:      "page",
+			query:     "?since=1&limit=1",
+			code:      http.StatusOK,
+			revisions: []uint64{2},
+			revision:  2,
+		},
+		{
+			desc:      "no changes",
+			query:     "?since=3&wait=10ms",
+			code:      http.StatusOK,
+			revisions: []uint64{},
+			revision:  3,
+		},
+		{
+			desc:     "future revision",
+			query:    "?since=4",
+			code:     http.StatusGone,
+			response: "Error reading changes: revision is not available\n",
+		},
+		{
+			desc:     "invalid limit",
+			query:    "?limit=-1",
+			code:     http.StatusBadRequest,
+			response: "Invalid limit: -1\n",
+		},
+	} {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, changesPath+test.query, nil)
+			res := httptest.NewRecorder()
+			DatabaseHandler(hub).ServeHTTP(res, req)
+
+			if res.Code != test.code {
+				t.Errorf("got status %d, want %d", res.Code, test.code)
+			}
+
+			if test.code != http.StatusOK {
+				if res.Body.String() != test.response {
+					t.Errorf("got response %q, want %q", res.Body.String(), test.response)
+				}
+				return
+			}
+
+			response := changesResponse{}
+			if err := json.Unmarshal(res.Body.Bytes(), &response); err != nil {
+				t.Fatalf("got error %q decoding %q, want none", err, res.Body.String())
+			}
+
+			revisions := []uint64{}
+			for _, e := range response.Changes {
+				revisions = append(revisions, e.Revision)
+			}
+
+			if !reflect.DeepEqual(revisions, test.revisions) {
+				t.Errorf("got revisions %v, want %v", revisions, test.revisions)
+			}
+
+			if response.Revision != test.revision {
+				t.Errorf("got revision %d, want %d", response.Revision, test.revision)
+			}
+		})
+	}
+}
+
+func TestHandleChangesWait(t *testing.T) {
+	hub := db.NewHub(db.NewMemoryDatabase())
+	defer hub.Close()
+
+	server := httptest.NewServer(DatabaseHandler(hub))
+	defer server.Close()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		hub.Put("key", "value")
+	}()
+
+	res, err := http.Get(server.URL + changesPath + "?since=0&wait=10s")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	defer res.Body.Close()
+
+	response := changesResponse{}
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if len(response.Changes) != 1 || response.Changes[0].Key != "key" || response.Changes[0].Metadata.Size != 5 {
+		t.Errorf("got changes %+v, want put of %q", response.Changes, "key")
+	}
+}
+
+// racingFeed makes a change right after the first time the changes are read.
+type racingFeed struct {
+	*db.Hub
+	once sync.Once
+}
+
+func (f *racingFeed) Changes(since uint64, limit int) ([]db.Event, error) {
+	events, err := f.Hub.Changes(since, limit)
+	f.once.Do(func() {
+		f.Hub.Put("key", "value")
+	})
+
+	return events, err
+}
+
+func TestHandleChangesWaitRace(t *testing.T) {
+	for _, query := range []string{"?since=0&wait=1s", "?since=0&stream=true"} {
+		hub := db.NewHub(db.NewMemoryDatabase())
+		defer hub.Close()
+
+		server := httptest.NewServer(DatabaseHandler(&racingFeed{Hub: hub}))
+		defer server.Close()
+
+		res, err := http.Get(server.URL + changesPath + query)
+		if err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+		defer res.Body.Close()
+
+		// The change made before the request subscribed to new changes is returned.
+		event := db.Event{}
+		decoder := json.NewDecoder(res.Body)
+		if res.Header.Get("Content-Type") == "application/x-ndjson" {
+			err = decoder.Decode(&event)
+		} else {
+			response := changesResponse{}
+			err = decoder.Decode(&response)
+			if len(response.Changes) > 0 {
+				event = response.Changes[0]
+			}
+		}
+		if err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+
+		if event.Revision != 1 || event.Key != "key" {
+			t.Errorf("got event %+v for %s, want put of %q", event, query, "key")
+		}
+	}
+}
+
+func TestHandleChangesStream(t *testing.T) {
+	hub := db.NewHub(db.NewMemoryDatabase())
+	defer hub.Close()
+
+	server := httptest.NewServer(DatabaseHandler(hub))
+	defer server.Close()
+
+	hub.Put("a", "value")
+	hub.Put("b", "value")
+
+	res, err := http.Get(server.URL + changesPath + "?since=1&stream=true")
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+	defer res.Body.Close()
+
+	if contentType := res.Header.Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("got content type %q, want %q", contentType, "application/x-ndjson")
+	}
+
+	hub.Delete("a")
+
+	decoder := json.NewDecoder(res.Body)
+	keys := []string{}
+	for i := 0; i < 2; i++ {
+		event := db.Event{}
+		if err := decoder.Decode(&event); err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+
+		keys = append(keys, fmt.Sprintf("%d %s %s", event.Revision, event.Type, event.Key))
+	}
+
+	expected := []string{"2 put b", "3 delete a"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("got events %q, want %q", keys, expected)
+	}
+}
+
+func TestHandleHistory(t *testing.T) {
+	history := db.NewHistory(db.NewMemoryDatabase(), db.NewMemoryDatabase())
+	hub := db.NewHub(history)
+	defer hub.Close()
+
+	hub.Put("key", "one", db.WithContentType("text/plain"))
+	between := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	hub.Put("key", "two")
+	hub.Delete("key")
+
+	handler := DatabaseHandler(hub)
+	for _, test := range []struct {
+		desc     string
+		method   string
+		path     string
+		code     int
+		response string
+	}{
+		{
+			desc:     "revision",
+			method:   http.MethodGet,
+			path:     "/key?revision=1",
+			code:     http.StatusOK,
+			response: "one",
+		},
+		{
+			desc:     "deleted revision",
+			method:   http.MethodGet,
+			path:     "/key?revision=3",
+			code:     http.StatusNotFound,
+			response: "Key not found: key\n",
+		},
+		{
+			desc:     "at time",
+			method:   http.MethodGet,
+			path:     "/key?at=" + between.UTC().Format(time.RFC3339Nano),
+			code:     http.StatusOK,
+			response: "one",
+		},
+		{
+			desc:     "invalid time",
+			method:   http.MethodGet,
+			path:     "/key?at=yesterday",
+			code:     http.StatusBadRequest,
+			response: "Invalid time: yesterday\n",
+		},
+		{
+			desc:     "restore missing revision",
+			method:   http.MethodPost,
+			path:     "/_history/key?revision=7",
+			code:     http.StatusGone,
+			response: "Error restoring revision: revision is not available\n",
+		},
+		{
+			desc:     "restore",
+			method:   http.MethodPost,
+			path:     "/_history/key?revision=2",
+			code:     http.StatusOK,
+			response: "saved.\n",
+		},
+		{
+			desc:     "current value",
+			method:   http.MethodGet,
+			path:     "/key",
+			code:     http.StatusOK,
+			response: "two",
+		},
+		{
+			desc:     "missing history",
+			method:   http.MethodGet,
+			path:     "/_history/other",
+			code:     http.StatusNotFound,
+			response: "Key not found: other\n",
+		},
+	} {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		if res.Code != test.code {
+			t.Errorf("%s: got status %d, want %d", test.desc, res.Code, test.code)
+		}
+
+		if res.Body.String() != test.response {
+			t.Errorf("%s: got response %q, want %q", test.desc, res.Body.String(), test.response)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/_history/key", nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	entries := []db.HistoryEntry{}
+	if err := json.Unmarshal(res.Body.Bytes(), &entries); err != nil {
+		t.Fatalf("got error %q decoding %q, want none", err, res.Body.String())
+	}
+
+	summary := []string{}
+	for _, e := range entries {
+		summary = append(summary, fmt.Sprintf("%d %v %q", e.Revision, e.Deleted, e.Value))
+	}
+
+	expected := []string{`1 false ""`, `2 false ""`, `3 true ""`, `4 false ""`}
+	if !reflect.DeepEqual(summary, expected) {
+		t.Errorf("got revisions %q, want %q", summary, expected)
+	}
+}
+
+func TestHandleHistoryUnsupported(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/key?revision=1", nil)
+	res := httptest.NewRecorder()
+	DatabaseHandler(&testDatabase{db: map[string]string{"key": "value"}}).ServeHTTP(res, req)
+
+	if res.Code != http.StatusNotImplemented {
+		t.Errorf("got status %d, want %d", res.Code, http.StatusNotImplemented)
+	}
+}
+
+func TestHandleSnapshot(t *testing.T) {
+	hub := db.NewHub(db.NewMemoryDatabase())
+	defer hub.Close()
+
+	hub.Put("a", "one", db.WithContentType("text/plain"))
+	hub.Put("b", "two")
+	hub.Delete("b")
+
+	req := httptest.NewRequest(http.MethodGet, snapshotPath, nil)
+	res := httptest.NewRecorder()
+	DatabaseHandler(hub).ServeHTTP(res, req)
+
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", res.Code, http.StatusOK)
+	}
+
+	if revision := res.Header().Get(revisionHeader); revision != "3" {
+		t.Errorf("got revision %q, want %q", revision, "3")
+	}
+
+	entries := []snapshotEntry{}
+	decoder := json.NewDecoder(res.Body)
+	for decoder.More() {
+		entry := snapshotEntry{}
+		if err := decoder.Decode(&entry); err != nil {
+			t.Fatalf("got error %q, want none", err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 1 || entries[0].Key != "a" || string(entries[0].Value) != "one" || entries[0].Metadata.ContentType != "text/plain" {
+		t.Errorf("got entries %+v, want %q", entries, "a")
+	}
+}
+
+func TestHandleFollower(t *testing.T) {
+	follower, err := replication.NewFollower("http://leader.example", db.NewMemoryDatabase())
+	if err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	database := &testDatabase{db: map[string]string{"key": "value"}}
+	handler := DatabaseHandler(database, WithFollower(follower))
+
+	for _, test := range []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/key", http.StatusOK},
+		{http.MethodPut, "/key", http.StatusForbidden},
+		{http.MethodDelete, "/key", http.StatusForbidden},
+		{http.MethodPost, batchPath, http.StatusForbidden},
+	} {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader("changed"))
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		if res.Code != test.status {
+			t.Errorf("got status %d for %s %s, want %d", res.Code, test.method, test.path, test.status)
+		}
+	}
+
+	if value := database.db["key"]; value != "value" {
+		t.Errorf("got value %q, want %q", value, "value")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, replicationPath, nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+
+	status := replication.Status{}
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		t.Fatalf("got error %q, want none", err)
+	}
+
+	if status.Leader != "http://leader.example" || status.State != replication.StateConnecting {
+		t.Errorf("got status %+v, want connecting to %q", status, "http://leader.example")
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	conn := dialSocket(t, server)
+	defer conn.Close()
+
+	if message := exchange(t, conn, `{"id":"1","op":"put","key":"key","value":"changed"}`); message.Status != http.StatusForbidden {
+		t.Errorf("got status %d, want %d", message.Status, http.StatusForbidden)
+	}
+}
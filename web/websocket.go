@@ -0,0 +1,404 @@
+package web
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// websocketGUID is appended to the key of the opening handshake as defined by RFC 6455.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes of WebSocket frames.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// Status codes sent when closing a WebSocket connection.
+const (
+	closeNormal          = 1000
+	closeGoingAway       = 1001
+	closeProtocolError   = 1002
+	closeUnsupportedData = 1003
+	closeNoStatus        = 1005
+	closeInvalidPayload  = 1007
+	closeMessageTooBig   = 1009
+)
+
+// maxControlPayload is the maximum length of the payload of control frames.
+const maxControlPayload = 125
+
+var errCloseSent = errors.New("close frame has already been sent")
+
+// closeError ends a WebSocket connection, either because the peer closed it or because of a protocol violation.
+type closeError struct {
+	code   int
+	reason string
+}
+
+func (e *closeError) Error() string {
+	return fmt.Sprintf("websocket closed with status %d: %s", e.code, e.reason)
+}
+
+// wsConn is a WebSocket connection. Messages are read by a single goroutine, while frames can be written concurrently.
+type wsConn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	maxMessageSize int64
+	readTimeout    time.Duration
+	writeTimeout   time.Duration
+	// client is set for the client side of the connection, which masks the frames it sends.
+	client bool
+
+	writeLock sync.Mutex
+	closeSent bool
+}
+
+// isWebSocketRequest checks if the request asks for upgrading the connection to the WebSocket protocol.
+func isWebSocketRequest(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") && headerContains(r.Header, "Upgrade", "websocket")
+}
+
+// headerContains checks if a header contains a token in its comma-separated list of values.
+func headerContains(header http.Header, name, token string) bool {
+	for _, value := range header[name] {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// upgradeWebSocket performs the opening handshake and takes over the connection of the request.
+// Requests of web pages are only accepted from the host of the request or one of the allowed origins.
+// An error response has already been sent, if it returns an error.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, origins []string) (*wsConn, error) {
+	if r.Method != http.MethodGet || !isWebSocketRequest(r) {
+		http.Error(w, "Not a WebSocket handshake.", http.StatusBadRequest)
+		return nil, errors.New("not a websocket handshake")
+	}
+
+	if origin := r.Header.Get("Origin"); origin != "" && !originAllowed(origin, r.Host, origins) {
+		http.Error(w, "Origin not allowed.", http.StatusForbidden)
+		return nil, fmt.Errorf("origin not allowed: %s", origin)
+	}
+
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version.", http.StatusUpgradeRequired)
+		return nil, errors.New("unsupported websocket version")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, "Invalid WebSocket key.", http.StatusBadRequest)
+		return nil, errors.New("invalid websocket key")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported.", http.StatusInternalServerError)
+		return nil, errors.New("connection can not be hijacked")
+	}
+
+	conn, buffer, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error taking over connection: %s", err), http.StatusInternalServerError)
+		return nil, err
+	}
+
+	// Remove the deadlines the server might have set for reading the request.
+	conn.SetDeadline(time.Time{})
+
+	fmt.Fprintf(buffer, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", acceptKey(key))
+	if err := buffer.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{
+		conn:   conn,
+		reader: buffer.Reader,
+	}, nil
+}
+
+// originAllowed checks if the origin of a web page matches the host of the request or one of the allowed origins.
+func originAllowed(origin, host string, origins []string) bool {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	if u.Host != "" && strings.EqualFold(u.Host, host) {
+		return true
+	}
+
+	for _, allowed := range origins {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// acceptKey returns the value of the Sec-WebSocket-Accept header answering the key sent by the client.
+func acceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// readMessage returns the next text or binary message. Control frames are handled while reading.
+// A *closeError is returned when the connection has been closed, the close frame has been sent in that case.
+func (c *wsConn) readMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	for {
+		if c.readTimeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+		}
+
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch op {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			return 0, nil, c.receiveClose(payload)
+		case opContinuation:
+			if opcode == 0 {
+				return 0, nil, c.fail(closeProtocolError, "unexpected continuation frame")
+			}
+		case opText, opBinary:
+			if opcode != 0 {
+				return 0, nil, c.fail(closeProtocolError, "expected continuation frame")
+			}
+
+			opcode = op
+		default:
+			return 0, nil, c.fail(closeProtocolError, fmt.Sprintf("unknown opcode %d", op))
+		}
+
+		if c.maxMessageSize > 0 && int64(len(message)+len(payload)) > c.maxMessageSize {
+			return 0, nil, c.fail(closeMessageTooBig, fmt.Sprintf("message larger than %d bytes", c.maxMessageSize))
+		}
+
+		message = append(message, payload...)
+		if !fin {
+			continue
+		}
+
+		if opcode == opText && !utf8.Valid(message) {
+			return 0, nil, c.fail(closeInvalidPayload, "invalid UTF-8 in text message")
+		}
+
+		return opcode, message, nil
+	}
+}
+
+// readFrame reads a single frame and removes the masking of its payload.
+func (c *wsConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	if header[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(closeProtocolError, "reserved bits set")
+	}
+
+	// Clients need to mask all frames they send, while servers must not mask any.
+	masked := header[1]&0x80 != 0
+	if masked == c.client {
+		return false, 0, nil, c.fail(closeProtocolError, "invalid masking")
+	}
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		extended := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+
+		length = uint64(binary.BigEndian.Uint16(extended))
+	case 127:
+		extended := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, extended); err != nil {
+			return false, 0, nil, err
+		}
+
+		length = binary.BigEndian.Uint64(extended)
+	}
+
+	if opcode >= opClose && (!fin || length > maxControlPayload) {
+		return false, 0, nil, c.fail(closeProtocolError, "invalid control frame")
+	}
+
+	if c.maxMessageSize > 0 && length > uint64(c.maxMessageSize) {
+		return false, 0, nil, c.fail(closeMessageTooBig, fmt.Sprintf("message larger than %d bytes", c.maxMessageSize))
+	}
+
+	mask := make([]byte, 4)
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask); err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+
+	if masked {
+		maskBytes(mask, payload)
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// receiveClose answers a close frame sent by the peer.
+func (c *wsConn) receiveClose(payload []byte) error {
+	switch {
+	case len(payload) == 0:
+		c.writeFrame(opClose, nil)
+		return &closeError{code: closeNoStatus}
+	case len(payload) == 1:
+		return c.fail(closeProtocolError, "invalid close frame")
+	}
+
+	code := int(binary.BigEndian.Uint16(payload))
+	reason := payload[2:]
+	if !utf8.Valid(reason) {
+		return c.fail(closeInvalidPayload, "invalid UTF-8 in close reason")
+	}
+
+	c.writeClose(code, "")
+	return &closeError{
+		code:   code,
+		reason: string(reason),
+	}
+}
+
+// fail closes the connection because of an error and returns the error.
+func (c *wsConn) fail(code int, reason string) error {
+	c.writeClose(code, reason)
+	return &closeError{
+		code:   code,
+		reason: reason,
+	}
+}
+
+// writeClose starts the closing handshake. No messages can be written afterwards.
+func (c *wsConn) writeClose(code int, reason string) error {
+	if len(reason) > maxControlPayload-2 {
+		reason = reason[:maxControlPayload-2]
+	}
+
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], reason)
+	return c.writeFrame(opClose, payload)
+}
+
+// writeMessage sends a text message.
+func (c *wsConn) writeMessage(message []byte) error {
+	return c.writeFrame(opText, message)
+}
+
+// writeFrame sends a single frame. It can be called concurrently.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if c.closeSent {
+		return errCloseSent
+	}
+
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+
+	switch length := len(payload); {
+	case length < 126:
+		frame = append(frame, maskBit|byte(length))
+	case length <= 0xffff:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(length))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(length))
+	}
+
+	if c.client {
+		mask := make([]byte, 4)
+		if _, err := rand.Read(mask); err != nil {
+			return err
+		}
+
+		frame = append(frame, mask...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		maskBytes(mask, frame[start:])
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	if c.writeTimeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+	}
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close closes the underlying connection without a closing handshake.
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+// maskBytes applies the masking key to data. Masking again removes it.
+func maskBytes(mask, data []byte) {
+	for i := range data {
+		data[i] ^= mask[i%4]
+	}
+}